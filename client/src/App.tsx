@@ -10,6 +10,8 @@ import Keys from './pages/Keys'
 import Account from './pages/Account'
 import Chat from './pages/Chat'
 import ModelsFallback from './pages/ModelsFallback'
+import Audit from './pages/Audit'
+import SetPassword from './pages/SetPassword'
 
 function useMe() {
   const [me, setMe] = React.useState<any>(null)
@@ -25,7 +27,9 @@ function Layout() {
   const nav = useNavigate()
   const loc = useLocation()
   // Determine requirement before returns
-  const mustChange = me?.role === 'admin' && me?.must_change_password
+  // Password change and two-factor enrollment both confine the user to the Account page
+  const mustChange = (me?.role === 'admin' && me?.must_change_password) || me?.must_enroll_totp
+  const can = (perm: string) => (me?.permissions || []).some((p: string) => p === '*' || p === perm)
   // Ensure hook is always called (no conditional returns before this)
   React.useEffect(() => {
     if (mustChange && loc.pathname !== '/account') {
@@ -33,6 +37,8 @@ function Layout() {
     }
   }, [mustChange, loc.pathname, nav])
   if (loading) return <div className="p-6">Loading...</div>
+  // Invite and reset links work whether or not someone is signed in here
+  if (loc.pathname === '/set-password') return <SetPassword onDone={() => { Auth.me().then(setMe).catch(() => setMe(null)); nav('/') }} />
   if (!me) return <Login onLoggedIn={(u) => { setMe(u); nav('/') }} />
   return (
     <div className="min-h-screen grid grid-cols-1 md:grid-cols-[260px_1fr]">
@@ -64,7 +70,7 @@ function Layout() {
               <svg className="h-4 w-4 opacity-80" viewBox="0 0 24 24" fill="currentColor"><path d="M3 7l9-4 9 4v6l-9 4-9-4V7zm9 2l6-2.67L12 3 6 6.33 12 9z"/></svg>
               Models
             </NavLink>
-            {me.role === 'admin' && (
+            {can('routes.manage') && (
               <NavLink to="/models/fallback" className={({ isActive }) => `ml-6 group flex items-center gap-2 px-3 py-1.5 rounded-md text-xs transition ${isActive ? 'bg-indigo-50 text-brand ring-1 ring-inset ring-indigo-100 dark:bg-slate-800/60 dark:text-indigo-300 dark:ring-slate-700' : 'hover:bg-slate-100 text-slate-500 dark:text-slate-400 dark:hover:bg-slate-800'}`}>
                 Fallback
               </NavLink>
@@ -73,16 +79,24 @@ function Layout() {
               <svg className="h-4 w-4 opacity-80" viewBox="0 0 24 24" fill="currentColor"><path d="M12.65 10A5 5 0 1020 5a5 5 0 00-7.35 5zM2 20l7-7 2 2-7 7H2v-2z"/></svg>
               API Keys
             </NavLink>
-            {me.role === 'admin' && <>
+            {can('providers.manage') && (
               <NavLink to="/providers" className={({ isActive }) => `group flex items-center gap-2 px-3 py-2 rounded-lg text-sm transition ${isActive ? 'bg-indigo-50 text-brand ring-1 ring-inset ring-indigo-100 dark:bg-slate-800/60 dark:text-indigo-300 dark:ring-slate-700' : 'hover:bg-slate-100 text-slate-700 dark:text-slate-300 dark:hover:bg-slate-800'}`}>
                 <svg className="h-4 w-4 opacity-80" viewBox="0 0 24 24" fill="currentColor"><path d="M6 19a4 4 0 010-8 5 5 0 019.58-1.36A4.5 4.5 0 1118.5 19H6z"/></svg>
                 Providers
               </NavLink>
+            )}
+            {can('users.manage') && (
               <NavLink to="/users" className={({ isActive }) => `group flex items-center gap-2 px-3 py-2 rounded-lg text-sm transition ${isActive ? 'bg-indigo-50 text-brand ring-1 ring-inset ring-indigo-100 dark:bg-slate-800/60 dark:text-indigo-300 dark:ring-slate-700' : 'hover:bg-slate-100 text-slate-700 dark:text-slate-300 dark:hover:bg-slate-800'}`}>
                 <svg className="h-4 w-4 opacity-80" viewBox="0 0 24 24" fill="currentColor"><path d="M16 11c1.66 0 2.99-1.34 2.99-3S17.66 5 16 5s-3 1.34-3 3 1.34 3 3 3zM8 11c1.66 0 2.99-1.34 2.99-3S9.66 5 8 5 5 6.34 5 8s1.34 3 3 3zm0 2c-2.33 0-7 1.17-7 3.5V19h14v-2.5C15 14.17 10.33 13 8 13zm8 0c-.29 0-.62.02-.97.05 1.16.84 1.97 1.97 1.97 3.45V19h6v-2.5c0-2.33-4.67-3.5-7-3.5z"/></svg>
                 Users
               </NavLink>
-            </>}
+            )}
+            {can('audit.view') && (
+              <NavLink to="/audit" className={({ isActive }) => `group flex items-center gap-2 px-3 py-2 rounded-lg text-sm transition ${isActive ? 'bg-indigo-50 text-brand ring-1 ring-inset ring-indigo-100 dark:bg-slate-800/60 dark:text-indigo-300 dark:ring-slate-700' : 'hover:bg-slate-100 text-slate-700 dark:text-slate-300 dark:hover:bg-slate-800'}`}>
+                <svg className="h-4 w-4 opacity-80" viewBox="0 0 24 24" fill="currentColor"><path d="M14 2H6a2 2 0 00-2 2v16a2 2 0 002 2h12a2 2 0 002-2V8l-6-6zm-1 7V3.5L18.5 9H13zM8 13h8v2H8v-2zm0 4h8v2H8v-2z"/></svg>
+                Audit Log
+              </NavLink>
+            )}
           </>}
           <button onClick={async (e) => { e.preventDefault(); await Auth.logout(); window.location.href='/' }}
             className="mt-3 text-left px-3 py-2 rounded-lg text-sm hover:bg-red-50 text-red-600 dark:hover:bg-red-900/30">
@@ -92,17 +106,18 @@ function Layout() {
       </aside>
       <main className="p-5 md:p-8">
         <Routes>
-          <Route path="/account" element={<Account onUpdated={() => { setMe({ ...me, must_change_password: false }) }} me={me} />} />
+          <Route path="/account" element={<Account onUpdated={() => { Auth.me().then(setMe).catch(() => {}) }} me={me} />} />
           {!mustChange && <>
             <Route path="/" element={<Dashboard />} />
             <Route path="/chat" element={<Chat />} />
             <Route path="/keys" element={<Keys />} />
             <Route path="/providers" element={<Providers />} />
             <Route path="/models" element={<Models />} />
-            {me.role === 'admin' && <Route path="/models/fallback" element={<ModelsFallback />} />}
+            {can('routes.manage') && <Route path="/models/fallback" element={<ModelsFallback />} />}
             <Route path="/users" element={<Users />} />
+            {can('audit.view') && <Route path="/audit" element={<Audit />} />}
           </>}
-          {mustChange && <Route path="*" element={<Account onUpdated={() => { setMe({ ...me, must_change_password: false }) }} me={me} />} />}
+          {mustChange && <Route path="*" element={<Account onUpdated={() => { Auth.me().then(setMe).catch(() => {}) }} me={me} />} />}
         </Routes>
       </main>
     </div>
@@ -16,12 +16,24 @@ export async function api(path: string, init?: RequestInit) {
 export const Auth = {
   login: (email: string, password: string) => api('/auth/login', { method: 'POST', body: JSON.stringify({ email, password }) }),
   me: () => api('/auth/me'),
+  methods: () => api('/auth/methods'),
   logout: () => api('/auth/logout', { method: 'POST' }),
+  totp: (challenge: string, code: string) => api('/auth/totp', { method: 'POST', body: JSON.stringify({ challenge, code }) }),
+  requestReset: (email: string) => api('/auth/password-reset', { method: 'POST', body: JSON.stringify({ email }) }),
+  checkToken: (token: string) => api(`/auth/password-token?token=${encodeURIComponent(token)}`),
+  useToken: (token: string, password: string) => api('/auth/password-token', { method: 'POST', body: JSON.stringify({ token, password }) }),
 }
 
 export const Account = {
   get: () => api('/account'),
   update: (data: { email?: string, current_password?: string, new_password?: string }) => api('/account', { method: 'PUT', body: JSON.stringify(data) }),
+  totpSetup: () => api('/account/totp/setup', { method: 'POST' }),
+  totpEnable: (code: string) => api('/account/totp/enable', { method: 'POST', body: JSON.stringify({ code }) }),
+  totpDisable: (code: string) => api('/account/totp/disable', { method: 'POST', body: JSON.stringify({ code }) }),
+  recoveryCodes: (code: string) => api('/account/totp/recovery-codes', { method: 'POST', body: JSON.stringify({ code }) }),
+  sessions: () => api('/account/sessions'),
+  revokeSession: (id: string) => api(`/account/sessions/${id}`, { method: 'DELETE' }),
+  revokeOtherSessions: () => api('/account/sessions', { method: 'DELETE' }),
 }
 
 // OpenAI-compatible v1 endpoints (require user API key)
@@ -1,5 +1,5 @@
 import React from 'react'
-import { Account as AccountAPI } from '../api'
+import { Account as AccountAPI, Auth } from '../api'
 
 export default function Account({ me, onUpdated }: { me: any, onUpdated: () => void }) {
   const [data, setData] = React.useState<any>({})
@@ -12,8 +12,36 @@ export default function Account({ me, onUpdated }: { me: any, onUpdated: () => v
   const [savingEmail, setSavingEmail] = React.useState(false)
   const [savingPw, setSavingPw] = React.useState(false)
   const [showPw, setShowPw] = React.useState(false)
+  const [totpSetup, setTotpSetup] = React.useState<any>(null)
+  const [totpCode, setTotpCode] = React.useState('')
+  const [recoveryCodes, setRecoveryCodes] = React.useState<string[] | null>(null)
+  const [sessions, setSessions] = React.useState<any[]>([])
+  const [minLength, setMinLength] = React.useState(8)
 
-  React.useEffect(() => { AccountAPI.get().then(setData).catch(() => {}) }, [])
+  async function reload() { setData(await AccountAPI.get()); setSessions(await AccountAPI.sessions()) }
+  React.useEffect(() => { reload().catch(() => {}) }, [])
+  React.useEffect(() => { Auth.methods().then(m => setMinLength(m.password_min_length || 8)).catch(() => {}) }, [])
+
+  // Two-factor actions all take the current code and share one input
+  async function totp(action: 'setup' | 'enable' | 'disable' | 'codes') {
+    setMsg(null); setErr(null)
+    try {
+      if (action === 'setup') { setTotpSetup(await AccountAPI.totpSetup()); setRecoveryCodes(null) }
+      if (action === 'enable') { setRecoveryCodes((await AccountAPI.totpEnable(totpCode)).recovery_codes); setTotpSetup(null); setMsg('Two-factor enabled.'); onUpdated() }
+      if (action === 'disable') { await AccountAPI.totpDisable(totpCode); setRecoveryCodes(null); setMsg('Two-factor disabled.') }
+      if (action === 'codes') { setRecoveryCodes((await AccountAPI.recoveryCodes(totpCode)).recovery_codes) }
+      setTotpCode('')
+      await reload()
+    } catch (e:any) { setErr(e.message) }
+  }
+
+  async function revoke(id?: string) {
+    setMsg(null); setErr(null)
+    try {
+      if (id) await AccountAPI.revokeSession(id); else await AccountAPI.revokeOtherSessions()
+      setSessions(await AccountAPI.sessions())
+    } catch (e:any) { setErr(e.message) }
+  }
 
   async function saveEmail() {
     setMsg(null); setErr(null)
@@ -30,7 +58,8 @@ export default function Account({ me, onUpdated }: { me: any, onUpdated: () => v
     setSavingPw(true)
     try {
       await AccountAPI.update({ current_password: currentPassword, new_password: newPassword })
-      setMsg('Password updated.')
+      setMsg('Password updated. Other sessions were signed out.')
+      setSessions(await AccountAPI.sessions())
       onUpdated()
       setCurrentPassword(''); setNewPassword(''); setConfirmPassword('')
     } catch (e:any) { setErr(e.message) }
@@ -55,6 +84,11 @@ export default function Account({ me, onUpdated }: { me: any, onUpdated: () => v
             Please change your password before using LLM Router.
           </div>
         )}
+        {data.must_enroll_totp && (
+          <div className="mt-3 rounded-md border border-amber-200 bg-amber-50 text-amber-800 dark:border-amber-700/40 dark:bg-amber-950/30 dark:text-amber-300 px-3 py-2">
+            Please set up two-factor authentication before using LLM Router.
+          </div>
+        )}
       </div>
 
       <div className="grid md:grid-cols-2 gap-4">
@@ -114,7 +148,7 @@ export default function Account({ me, onUpdated }: { me: any, onUpdated: () => v
               <button type="button" className="underline decoration-dotted underline-offset-2" onClick={() => setShowPw(v => !v)}>
                 {showPw ? 'Hide passwords' : 'Show passwords'}
               </button>
-              <span>At least 8 characters recommended</span>
+              <span>At least {minLength} characters; common or breached passwords are refused</span>
             </div>
             {newPassword && confirmPassword && newPassword !== confirmPassword && (
               <div className="rounded-md border border-amber-300/70 bg-amber-50 text-amber-700 dark:border-amber-700/40 dark:bg-amber-900/30 dark:text-amber-300 px-3 py-2 text-sm">
@@ -125,7 +159,7 @@ export default function Account({ me, onUpdated }: { me: any, onUpdated: () => v
               <button
                 className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm disabled:opacity-60"
                 onClick={savePassword}
-                disabled={!currentPassword || newPassword.length < 6 || newPassword !== confirmPassword || savingPw}
+                disabled={!currentPassword || newPassword.length < minLength || newPassword !== confirmPassword || savingPw}
                 aria-busy={savingPw}
               >
                 {savingPw ? 'Saving…' : 'Save Password'}
@@ -135,6 +169,71 @@ export default function Account({ me, onUpdated }: { me: any, onUpdated: () => v
         </div>
       </div>
 
+      <div className="rounded-xl border border-slate-200 dark:border-slate-800 bg-white/70 dark:bg-slate-900/60 p-4 shadow mt-4">
+        <h3 className="font-medium mb-2">Two-Factor Authentication</h3>
+        <div className="space-y-2 text-sm">
+          {data.totp_enabled
+            ? <div className="text-slate-600 dark:text-slate-400">Enabled. {data.recovery_codes_left} recovery codes left.</div>
+            : <div className="text-slate-600 dark:text-slate-400">Not enabled. Use an authenticator app to get a code at each login.</div>}
+          {!data.totp_enabled && !totpSetup && (
+            <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm" onClick={() => totp('setup')}>Set up</button>
+          )}
+          {totpSetup && (
+            <div className="space-y-1">
+              <div className="text-xs text-slate-500">Add this key to your authenticator app, or open the link on your phone, then enter the code it shows.</div>
+              <code className="block rounded bg-slate-100 dark:bg-slate-800 px-2 py-1 break-all">{totpSetup.secret}</code>
+              <a className="text-xs underline break-all" href={totpSetup.otpauth_url}>{totpSetup.otpauth_url}</a>
+            </div>
+          )}
+          {(totpSetup || data.totp_enabled) && (
+            <div className="flex flex-wrap items-center gap-2">
+              <input
+                className="rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                placeholder="Code" autoComplete="one-time-code" value={totpCode} onChange={e => setTotpCode(e.target.value)}
+              />
+              {totpSetup && <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm disabled:opacity-60" disabled={!totpCode} onClick={() => totp('enable')}>Enable</button>}
+              {data.totp_enabled && <>
+                <button className="rounded-md border border-slate-300 dark:border-slate-700 px-4 py-2 text-sm disabled:opacity-60" disabled={!totpCode} onClick={() => totp('codes')}>New recovery codes</button>
+                <button className="rounded-md bg-red-600 hover:bg-red-700 text-white px-4 py-2 text-sm disabled:opacity-60" disabled={!totpCode} onClick={() => totp('disable')}>Disable</button>
+              </>}
+            </div>
+          )}
+          {recoveryCodes && (
+            <div>
+              <div className="text-xs text-slate-500 mb-1">Recovery codes. Each works once; store them somewhere safe. They won't be shown again.</div>
+              <pre className="rounded bg-slate-100 dark:bg-slate-800 px-3 py-2 text-sm">{recoveryCodes.join('\n')}</pre>
+            </div>
+          )}
+        </div>
+      </div>
+
+      <div className="rounded-xl border border-slate-200 dark:border-slate-800 bg-white/70 dark:bg-slate-900/60 p-4 shadow mt-4">
+        <div className="flex items-center justify-between mb-2">
+          <h3 className="font-medium">Active Sessions</h3>
+          {sessions.length > 1 && <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs" onClick={() => revoke()}>Sign out other sessions</button>}
+        </div>
+        <table className="w-full text-sm">
+          <thead className="text-left text-xs text-slate-500">
+            <tr><th className="py-1">Device</th><th>IP</th><th>Signed in</th><th>Last active</th><th></th></tr>
+          </thead>
+          <tbody>
+            {sessions.map(s => (
+              <tr key={s.id} className="border-t border-slate-200 dark:border-slate-800">
+                <td className="py-1.5 pr-2 max-w-xs truncate" title={s.user_agent}>{s.user_agent || 'Unknown'}</td>
+                <td className="pr-2">{s.ip}</td>
+                <td className="pr-2">{new Date(s.created_at).toLocaleString()}</td>
+                <td className="pr-2">{new Date(s.last_seen_at).toLocaleString()}</td>
+                <td className="text-right">
+                  {s.current
+                    ? <span className="text-xs text-slate-500">This browser</span>
+                    : <button className="rounded-md border border-slate-300 dark:border-slate-700 px-2 py-1 text-xs" onClick={() => revoke(s.id)}>Revoke</button>}
+                </td>
+              </tr>
+            ))}
+          </tbody>
+        </table>
+      </div>
+
       {msg && <div className="mt-3 rounded-md border border-emerald-300/70 bg-emerald-50 text-emerald-700 dark:border-emerald-700/40 dark:bg-emerald-900/30 dark:text-emerald-300 px-3 py-2 text-sm">{msg}</div>}
       {err && <div className="mt-3 rounded-md border border-red-300/70 bg-red-50 text-red-700 dark:border-red-700/40 dark:bg-red-900/30 dark:text-red-300 px-3 py-2 text-sm">{err}</div>}
     </div>
@@ -0,0 +1,70 @@
+import React from 'react'
+import { api } from '../api'
+
+const input = 'rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-2 py-1.5 text-sm'
+
+export default function Audit() {
+  const [events, setEvents] = React.useState<any[]>([])
+  const [filters, setFilters] = React.useState<any>({ action: '', actor: '', target_type: '', target_id: '', from: '', to: '' })
+  const [more, setMore] = React.useState(false)
+  const [err, setErr] = React.useState<string | null>(null)
+
+  function query(extra: Record<string, string> = {}) {
+    const p = new URLSearchParams()
+    Object.entries({ ...filters, ...extra }).forEach(([k, v]) => { if (v) p.set(k, String(v)) })
+    return p.toString()
+  }
+
+  async function load(beforeId?: number) {
+    setErr(null)
+    try {
+      const page = await api(`/admin/audit?${query({ limit: '100', ...(beforeId ? { before_id: String(beforeId) } : {}) })}`)
+      setEvents(beforeId ? [...events, ...page] : page)
+      setMore(page.length === 100)
+    } catch (e:any) { setErr(e.message) }
+  }
+  React.useEffect(() => { load() }, [])
+
+  return (
+    <div>
+      <h2 className="text-xl font-semibold mb-3">Audit Log</h2>
+      <div className="flex flex-wrap items-end gap-2 mb-3">
+        <input className={input} placeholder="Action, e.g. user. or provider.update" value={filters.action} onChange={e => setFilters({ ...filters, action: e.target.value })} />
+        <input className={input} placeholder="Actor" value={filters.actor} onChange={e => setFilters({ ...filters, actor: e.target.value })} />
+        <select className={input} value={filters.target_type} onChange={e => setFilters({ ...filters, target_type: e.target.value })}>
+          <option value="">Any target</option>
+          {['provider', 'route', 'user', 'api_key', 'ip'].map(t => <option key={t} value={t}>{t}</option>)}
+        </select>
+        <input className={`${input} w-24`} placeholder="Target ID" value={filters.target_id} onChange={e => setFilters({ ...filters, target_id: e.target.value })} />
+        <input className={input} type="date" value={filters.from} onChange={e => setFilters({ ...filters, from: e.target.value })} />
+        <input className={input} type="date" value={filters.to} onChange={e => setFilters({ ...filters, to: e.target.value })} />
+        <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-1.5 text-sm" onClick={() => load()}>Filter</button>
+        <a className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-sm" href={`/api/admin/audit?${query({ format: 'csv' })}`}>Export CSV</a>
+        <a className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-sm" href={`/api/admin/audit?${query({ format: 'json' })}`}>Export JSON</a>
+      </div>
+      {err && <div className="mb-3 rounded-md border border-red-300/70 bg-red-50 text-red-700 dark:border-red-700/40 dark:bg-red-900/30 dark:text-red-300 px-3 py-2 text-sm">{err}</div>}
+      <div className="rounded-lg border border-slate-200 dark:border-slate-800 overflow-hidden">
+        <table className="w-full text-sm">
+          <thead className="bg-slate-50 dark:bg-slate-800/50"><tr><th className="text-left p-2">Time</th><th className="text-left p-2">Actor</th><th className="text-left p-2">Action</th><th className="text-left p-2">Target</th><th className="text-left p-2">Changes</th><th className="text-left p-2">IP</th></tr></thead>
+          <tbody>
+            {events.map(ev => (
+              <tr key={ev.id} className="border-t border-slate-200 dark:border-slate-800 align-top">
+                <td className="p-2 whitespace-nowrap">{new Date(ev.created_at).toLocaleString()}</td>
+                <td className="p-2">{ev.actor}</td>
+                <td className="p-2">{ev.action}</td>
+                <td className="p-2">{ev.target_type} {ev.target_id}</td>
+                <td className="p-2 text-xs">
+                  {Object.entries(ev.changes || {}).map(([k, ch]: any) => (
+                    <div key={k}><span className="text-slate-500">{k}:</span> {JSON.stringify(ch.before)} → {JSON.stringify(ch.after)}</div>
+                  ))}
+                </td>
+                <td className="p-2" title={`request ${ev.request_id}`}>{ev.ip}</td>
+              </tr>
+            ))}
+          </tbody>
+        </table>
+      </div>
+      {more && <button className="mt-3 rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-sm" onClick={() => load(events[events.length - 1].id)}>Load more</button>}
+    </div>
+  )
+}
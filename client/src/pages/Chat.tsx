@@ -41,8 +41,8 @@ export default function Chat() {
   React.useEffect(() => {
     api('/models').then((data:any[]) => {
       // server returns array of { provider_id, provider_name, name }
-      // Build qualified ids: provider/name
-      const qualified = data.map((m:any) => `${String(m.provider_name || '').toLowerCase()}/${m.name}`)
+      // Build qualified ids: provider/name (aliases carry their own id)
+      const qualified = data.map((m:any) => m.id || `${String(m.provider_name || '').toLowerCase()}/${m.name}`)
       // Do not de-duplicate by raw name; keep provider distinction
 
       // Custom sort based on the raw model id portion
@@ -68,7 +68,7 @@ export default function Dashboard() {
             <svg className="h-4 w-4" viewBox="0 0 24 24" fill="currentColor"><path d="M3 13h6V3H3v10zm0 8h6v-6H3v6zm8 0h10V11H11v10zm0-18v6h10V3H11z"/></svg>
             Usage
           </div>
-          <div className="grid grid-cols-2 md:grid-cols-4 gap-3 text-sm">
+          <div className="grid grid-cols-2 md:grid-cols-5 gap-3 text-sm">
             <div>
               <div className="text-slate-500">Requests</div>
               <div className="text-xl font-semibold">{stats ? stats.requests : '-'}</div>
@@ -85,6 +85,10 @@ export default function Dashboard() {
               <div className="text-slate-500">Completion tokens</div>
               <div className="text-xl font-semibold">{stats ? stats.tokens_out : '-'}</div>
             </div>
+            <div>
+              <div className="text-slate-500">Spend (USD)</div>
+              <div className="text-xl font-semibold">{stats && typeof stats.cost === 'number' ? stats.cost.toFixed(4) : '-'}</div>
+            </div>
           </div>
         </div>
         <div className="rounded-xl border border-slate-200 dark:border-slate-800 bg-white/80 dark:bg-slate-900/60 p-4 shadow-card">
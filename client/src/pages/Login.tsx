@@ -4,16 +4,38 @@ import { Auth } from '../api'
 export default function Login({ onLoggedIn }: { onLoggedIn: (me: any) => void }) {
   const [email, setEmail] = React.useState('admin')
   const [password, setPassword] = React.useState('admin')
-  const [error, setError] = React.useState<string | null>(null)
+  const [error, setError] = React.useState<string | null>(() => new URLSearchParams(window.location.search).get('sso_error'))
+  const [methods, setMethods] = React.useState<any>({ password_login: true, oidc: { enabled: false } })
+  const [showPassword, setShowPassword] = React.useState(false)
+  const [challenge, setChallenge] = React.useState<string | null>(null)
+  const [code, setCode] = React.useState('')
+  const [forgot, setForgot] = React.useState(false)
+  const [notice, setNotice] = React.useState<string | null>(null)
+  React.useEffect(() => { Auth.methods().then(setMethods).catch(() => {}) }, [])
+  const passwordForm = methods.password_login || showPassword
 
   async function submit(e: React.FormEvent) {
     e.preventDefault()
     setError(null)
+    if (forgot) {
+      try {
+        await Auth.requestReset(email)
+        setNotice('If that account exists, a reset link is on its way.')
+        setForgot(false)
+      } catch (e: any) { setError(e.message || 'Request failed') }
+      return
+    }
     try {
-      await Auth.login(email, password)
+      if (challenge) {
+        await Auth.totp(challenge, code)
+      } else {
+        const res = await Auth.login(email, password)
+        if (res?.totp_required) { setChallenge(res.challenge); return }
+      }
       const me = await Auth.me()
       onLoggedIn(me)
     } catch (e: any) {
+      if (challenge && /sign in again/.test(e.message || '')) { setChallenge(null); setCode('') }
       setError(e.message || 'Login failed')
     }
   }
@@ -22,14 +44,28 @@ export default function Login({ onLoggedIn }: { onLoggedIn: (me: any) => void })
     <div className="min-h-screen grid place-items-center p-6">
       <form onSubmit={submit} className="w-full max-w-sm rounded-xl border border-slate-200 dark:border-slate-800 bg-white/70 dark:bg-slate-900/70 backdrop-blur p-6 shadow">
         <h3 className="text-lg font-semibold mb-4">Login</h3>
-        <div className="grid gap-3">
+        {methods.oidc?.enabled && (
+          <a href="/api/auth/oidc/login" className="mb-4 flex items-center justify-center rounded-md border border-slate-300 dark:border-slate-700 hover:bg-slate-100 dark:hover:bg-slate-800 px-4 py-2 text-sm">{methods.oidc.label}</a>
+        )}
+        {challenge && <div className="grid gap-3">
+          <label className="text-sm text-slate-600 dark:text-slate-400">Authentication code or recovery code</label>
+          <input autoFocus autoComplete="one-time-code" className="border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 rounded-md px-3 py-2 outline-none focus:ring-2 focus:ring-blue-500" value={code} onChange={e => setCode(e.target.value)} />
+        </div>}
+        {forgot && <div className="grid gap-3">
+          <label className="text-sm text-slate-600 dark:text-slate-400">Email</label>
+          <input autoFocus className="border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 rounded-md px-3 py-2 outline-none focus:ring-2 focus:ring-blue-500" value={email} onChange={e => setEmail(e.target.value)} />
+        </div>}
+        {passwordForm && !challenge && !forgot && <div className="grid gap-3">
           <label className="text-sm text-slate-600 dark:text-slate-400">Username</label>
           <input className="border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 rounded-md px-3 py-2 outline-none focus:ring-2 focus:ring-blue-500" value={email} onChange={e => setEmail(e.target.value)} />
           <label className="text-sm text-slate-600 dark:text-slate-400">Password</label>
           <input className="border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 rounded-md px-3 py-2 outline-none focus:ring-2 focus:ring-blue-500" type="password" value={password} onChange={e => setPassword(e.target.value)} />
-        </div>
+        </div>}
         {error && <div className="mt-3 text-sm border border-red-300/60 dark:border-red-700 rounded-md px-3 py-2 bg-red-50 dark:bg-red-900/20 text-red-700 dark:text-red-300">{error}</div>}
-        <button type="submit" className="mt-4 inline-flex items-center justify-center rounded-md bg-brand hover:bg-brand-dark text-white px-4 py-2">Login</button>
+        {notice && <div className="mt-3 text-sm border border-slate-300 dark:border-slate-700 rounded-md px-3 py-2">{notice}</div>}
+        {(passwordForm || challenge) && <button type="submit" className="mt-4 inline-flex items-center justify-center rounded-md bg-brand hover:bg-brand-dark text-white px-4 py-2">{forgot ? 'Send reset link' : 'Login'}</button>}
+        {passwordForm && !challenge && methods.password_reset && <button type="button" className="ml-3 text-xs text-slate-500 underline" onClick={() => { setForgot(!forgot); setError(null); setNotice(null) }}>{forgot ? 'Back to login' : 'Forgot password?'}</button>}
+        {!passwordForm && <button type="button" className="text-xs text-slate-500 underline" onClick={() => setShowPassword(true)}>Break-glass login</button>}
       </form>
     </div>
   )
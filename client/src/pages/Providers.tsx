@@ -1,7 +1,9 @@
 import React from 'react'
 import { api } from '../api'
 
-type Provider = { id: number, name: string, type: string, base_url: string, enabled: boolean, runtime_models?: string[] }
+type Provider = { id: number, name: string, type: string, base_url: string, enabled: boolean, runtime_models?: string[], model_include?: string[], model_exclude?: string[] }
+
+function splitPatterns(s: string) { return s.split(',').map(x => x.trim()).filter(Boolean) }
 
 export default function Providers() {
   const [providers, setProviders] = React.useState<Provider[]>([])
@@ -19,6 +21,8 @@ export default function Providers() {
     if (!edit) return
     const payload: any = { name: edit.name, type: edit.type, base_url: edit.base_url, enabled: !!edit.enabled }
     if (edit.api_key) payload.api_key = edit.api_key
+    payload.model_include = splitPatterns(edit.include || '')
+    payload.model_exclude = splitPatterns(edit.exclude || '')
     await api(`/providers/${edit.id}`, { method: 'PUT', body: JSON.stringify(payload) })
     // Force refresh models after editing
     await api(`/providers/${edit.id}/refresh_models`, { method: 'POST' }).catch(() => {})
@@ -35,7 +39,7 @@ export default function Providers() {
             <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Name" value={form.name} onChange={e => setForm({ ...form, name: e.target.value })} />
             <select className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none" value={form.type} onChange={e => setForm({ ...form, type: e.target.value })}><option value="openai">OpenAI-compatible</option></select>
             <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Base URL" value={form.base_url} onChange={e => setForm({ ...form, base_url: e.target.value })} />
-            <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="API Key" value={form.api_key} onChange={e => setForm({ ...form, api_key: e.target.value })} />
+            <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="API Key, env:NAME or file:/path" value={form.api_key} onChange={e => setForm({ ...form, api_key: e.target.value })} />
             <label className="flex items-center gap-2 text-sm text-slate-500"><input type="checkbox" checked={form.enabled} onChange={e => setForm({ ...form, enabled: e.target.checked })} /> Enabled</label>
             <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm" onClick={create}>Save</button>
           </div>
@@ -53,7 +57,7 @@ export default function Providers() {
                     <td className="p-2">{p.type}</td>
                     <td className="p-2">{String(p.enabled)}</td>
                     <td className="p-2">
-                      <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs mr-2" onClick={() => setEdit({ ...p })}>Edit</button>
+                      <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs mr-2" onClick={() => setEdit({ ...p, include: (p.model_include || []).join(', '), exclude: (p.model_exclude || []).join(', ') })}>Edit</button>
                       <button className="rounded-md bg-red-600 hover:bg-red-700 text-white px-3 py-1.5 text-xs" onClick={() => del(p.id)}>Delete</button>
                     </td>
                   </tr>
@@ -74,7 +78,11 @@ export default function Providers() {
                 <label className="text-xs text-slate-500">Base URL</label>
                 <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" value={edit.base_url} onChange={e => setEdit({ ...edit, base_url: e.target.value })} />
                 <label className="text-xs text-slate-500">API Key (leave blank to keep)</label>
-                <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" value={edit.api_key || ''} onChange={e => setEdit({ ...edit, api_key: e.target.value })} />
+                <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Leave blank to keep; or env:NAME, file:/path" value={edit.api_key || ''} onChange={e => setEdit({ ...edit, api_key: e.target.value })} />
+                <label className="text-xs text-slate-500">Include models (comma-separated globs, or re:regex; empty = all)</label>
+                <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="gpt-4o*, text-embedding-*" value={edit.include} onChange={e => setEdit({ ...edit, include: e.target.value })} />
+                <label className="text-xs text-slate-500">Exclude models</label>
+                <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="tts-*, ft:*" value={edit.exclude} onChange={e => setEdit({ ...edit, exclude: e.target.value })} />
                 <label className="flex items-center gap-2 text-sm text-slate-500"><input type="checkbox" checked={!!edit.enabled} onChange={e => setEdit({ ...edit, enabled: e.target.checked })} /> Enabled</label>
                 <div className="flex gap-2">
                   <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm" onClick={saveEdit}>Save</button>
@@ -0,0 +1,49 @@
+import React from 'react'
+import { Auth } from '../api'
+
+// Landing page for invite and password-reset links
+export default function SetPassword({ onDone }: { onDone: () => void }) {
+  const token = React.useMemo(() => new URLSearchParams(window.location.search).get('token') || '', [])
+  const [info, setInfo] = React.useState<any>(null)
+  const [minLength, setMinLength] = React.useState(8)
+  const [password, setPassword] = React.useState('')
+  const [confirm, setConfirm] = React.useState('')
+  const [error, setError] = React.useState<string | null>(null)
+  const [done, setDone] = React.useState(false)
+  React.useEffect(() => {
+    Auth.checkToken(token).then(setInfo).catch((e: any) => setError(e.message))
+    Auth.methods().then((m: any) => setMinLength(m.password_min_length || 8)).catch(() => {})
+  }, [token])
+
+  async function submit(e: React.FormEvent) {
+    e.preventDefault()
+    setError(null)
+    if (password !== confirm) { setError('Passwords do not match'); return }
+    try {
+      await Auth.useToken(token, password)
+      setDone(true)
+    } catch (e: any) { setError(e.message || 'Could not set password') }
+  }
+
+  const input = 'border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 rounded-md px-3 py-2 outline-none focus:ring-2 focus:ring-blue-500'
+  return (
+    <div className="min-h-screen grid place-items-center p-6">
+      <form onSubmit={submit} className="w-full max-w-sm rounded-xl border border-slate-200 dark:border-slate-800 bg-white/70 dark:bg-slate-900/70 backdrop-blur p-6 shadow">
+        <h3 className="text-lg font-semibold mb-4">{info?.purpose === 'invite' ? 'Welcome' : 'Reset password'}</h3>
+        {done ? <div className="grid gap-3 text-sm">
+          <div>Your password has been set.</div>
+          <button type="button" className="inline-flex items-center justify-center rounded-md bg-brand hover:bg-brand-dark text-white px-4 py-2" onClick={onDone}>Go to login</button>
+        </div> : info && <div className="grid gap-3">
+          <div className="text-sm text-slate-600 dark:text-slate-400">Choose a password for <b>{info.email}</b> (at least {minLength} characters).</div>
+          <label className="text-sm text-slate-600 dark:text-slate-400">New password</label>
+          <input autoFocus autoComplete="new-password" className={input} type="password" value={password} onChange={e => setPassword(e.target.value)} />
+          <label className="text-sm text-slate-600 dark:text-slate-400">Confirm password</label>
+          <input autoComplete="new-password" className={input} type="password" value={confirm} onChange={e => setConfirm(e.target.value)} />
+          <button type="submit" className="mt-1 inline-flex items-center justify-center rounded-md bg-brand hover:bg-brand-dark text-white px-4 py-2">Set password</button>
+        </div>}
+        {error && <div className="mt-3 text-sm border border-red-300/60 dark:border-red-700 rounded-md px-3 py-2 bg-red-50 dark:bg-red-900/20 text-red-700 dark:text-red-300">{error}</div>}
+        {!info && !done && error && <button type="button" className="mt-3 text-xs text-slate-500 underline" onClick={onDone}>Back to login</button>}
+      </form>
+    </div>
+  )
+}
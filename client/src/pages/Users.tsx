@@ -5,16 +5,40 @@ export default function Users() {
   const [users, setUsers] = React.useState<any[]>([])
   const [form, setForm] = React.useState<any>({ email: '', password: '', role: 'user' })
   const [edit, setEdit] = React.useState<any | null>(null)
-  async function load() { setUsers(await api('/users')) }
+  const [teams, setTeams] = React.useState<any[]>([])
+  const [teamName, setTeamName] = React.useState('')
+  const [roles, setRoles] = React.useState<any[]>([])
+  // Last invite or reset link, shown when mail delivery is "display" or to report a send
+  const [link, setLink] = React.useState<any | null>(null)
+  async function load() { setUsers(await api('/users')); setTeams(await api('/teams')); setRoles(await api('/roles')) }
+  async function createTeam() { await api('/teams', { method: 'POST', body: JSON.stringify({ name: teamName }) }); setTeamName(''); await load() }
+  async function delTeam(id: number) { await api(`/teams/${id}`, { method: 'DELETE' }); await load() }
+  const teamLabel = (id: number) => teams.find(t => t.id === id)?.name || ''
   React.useEffect(() => { load() }, [])
-  async function create() { await api('/users', { method: 'POST', body: JSON.stringify(form) }); setForm({ email: '', password: '', role: 'user' }); await load() }
+  async function create() {
+    const res = await api('/users', { method: 'POST', body: JSON.stringify(form) })
+    setLink(res?.invite ? { ...res.invite, email: form.email, kind: 'Invite' } : null)
+    setForm({ email: '', password: '', role: 'user' })
+    await load()
+  }
+  async function sendLink(u: any, kind: 'Invite' | 'Reset') {
+    const res = await api(`/users/${u.id}/${kind === 'Invite' ? 'invite' : 'password-reset'}`, { method: 'POST' })
+    setLink({ ...res, email: u.email, kind })
+    await load()
+  }
+  async function resetTOTP(id: number) { await api(`/users/${id}/totp`, { method: 'DELETE' }); setEdit(null); await load() }
+  async function unlock(id: number) { await api(`/users/${id}/unlock`, { method: 'POST' }); await load() }
+  async function signOut(id: number) { await api(`/users/${id}/sessions`, { method: 'DELETE' }); setEdit(null) }
   async function del(id: number) { await api(`/users/${id}`, { method: 'DELETE' }); await load() }
   async function saveEdit() {
     if (!edit) return
     const payload: any = {}
     if (edit.role) payload.role = edit.role
     if (typeof edit.disabled === 'boolean') payload.disabled = edit.disabled
+    if (typeof edit.totp_required === 'boolean') payload.totp_required = edit.totp_required
     if (edit.newPassword) payload.password = edit.newPassword
+    payload.team_id = Number(edit.team_id) || 0
+    if (payload.team_id) payload.team_role = edit.team_role || 'member'
     await api(`/users/${edit.id}`, { method: 'PUT', body: JSON.stringify(payload) })
     setEdit(null)
     await load()
@@ -27,27 +51,45 @@ export default function Users() {
           <h3 className="font-medium mb-2">Add User</h3>
           <div className="space-y-3">
             <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Username" value={form.email} onChange={e => setForm({ ...form, email: e.target.value })} />
-            <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Password" value={form.password} onChange={e => setForm({ ...form, password: e.target.value })} />
+            <input className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Password (blank to send an invite)" value={form.password} onChange={e => setForm({ ...form, password: e.target.value })} />
             <select className="w-full rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm" value={form.role} onChange={e => setForm({ ...form, role: e.target.value })}>
-              <option value="user">user</option>
-              <option value="admin">admin</option>
+              {roles.map(r => <option key={r.id} value={r.name}>{r.name}</option>)}
             </select>
-            <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm" onClick={create} disabled={!form.email || !form.password}>Create</button>
+            <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm" onClick={create} disabled={!form.email}>{form.password ? 'Create' : 'Invite'}</button>
+            {link && <div className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-2 text-xs break-all">
+              {link.link ? <>{link.kind} link for {link.email} (expires {new Date(link.expires_at).toLocaleString()}): <a className="underline" href={link.link}>{link.link}</a></> : <>{link.kind} link sent to {link.email}.</>}
+            </div>}
+          </div>
+          <h3 className="font-medium mt-5 mb-2">Teams</h3>
+          <div className="flex gap-2 mb-3">
+            <input className="flex-1 rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-3 py-2 text-sm focus:outline-none focus:ring-2 focus:ring-blue-500" placeholder="Team name" value={teamName} onChange={e => setTeamName(e.target.value)} />
+            <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 text-sm" onClick={createTeam} disabled={!teamName}>Add Team</button>
           </div>
+          <ul className="text-sm space-y-1">
+            {teams.map(t => (
+              <li key={t.id} className="flex items-center justify-between">
+                <span>{t.name} <span className="text-slate-500">({users.filter(u => u.team_id === t.id).length} members)</span></span>
+                <button className="rounded-md bg-red-600 hover:bg-red-700 text-white px-3 py-1 text-xs" onClick={() => delTeam(t.id)}>Delete</button>
+              </li>
+            ))}
+          </ul>
         </div>
         <div>
           <h3 className="font-medium mb-2">Existing</h3>
           <div className="rounded-lg border border-slate-200 dark:border-slate-800 overflow-hidden">
             <table className="w-full text-sm">
-              <thead className="bg-slate-50 dark:bg-slate-800/50"><tr><th className="text-left p-2">ID</th><th className="text-left p-2">Username</th><th className="text-left p-2">Role</th><th className="text-left p-2">Disabled</th><th className="text-left p-2">Actions</th></tr></thead>
+              <thead className="bg-slate-50 dark:bg-slate-800/50"><tr><th className="text-left p-2">ID</th><th className="text-left p-2">Username</th><th className="text-left p-2">Role</th><th className="text-left p-2">Team</th><th className="text-left p-2">Disabled</th><th className="text-left p-2">Actions</th></tr></thead>
               <tbody>
                 {users.map(u => (
                   <tr key={u.id} className="border-t border-slate-200 dark:border-slate-800">
                     <td className="p-2">{u.id}</td>
                     <td className="p-2">{u.email}</td>
-                    <td className="p-2">{u.role}</td>
-                    <td className="p-2">{String(u.disabled)}</td>
+                    <td className="p-2">{u.role}{u.service_account ? ' (service)' : ''}{u.ldap_dn ? ' (ldap)' : ''}{u.oidc_subject ? ' (sso)' : ''}</td>
+                    <td className="p-2">{u.team_id ? `${teamLabel(u.team_id)}${u.team_role === 'admin' ? ' (admin)' : ''}` : ''}</td>
+                    <td className="p-2">{String(u.disabled)}{u.locked_until && new Date(u.locked_until) > new Date() ? ' (locked)' : ''}{u.invited_at ? ' (invited)' : ''}</td>
                     <td className="p-2">
+                      {u.locked_until && new Date(u.locked_until) > new Date() && <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs mr-2" onClick={() => unlock(u.id)}>Unlock</button>}
+                      {u.invited_at && <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs mr-2" onClick={() => sendLink(u, 'Invite')}>Resend invite</button>}
                       <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs mr-2" onClick={() => setEdit({ ...u, newPassword: '' })}>Edit</button>
                       {u.email !== 'admin' && <button className="rounded-md bg-red-600 hover:bg-red-700 text-white px-3 py-1.5 text-xs" onClick={() => del(u.id)}>Delete</button>}
                     </td>
@@ -62,11 +104,26 @@ export default function Users() {
               <div className="flex flex-wrap gap-3 items-center text-sm">
                 <label className="text-slate-500">Role</label>
                 <select className="rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-2 py-1.5" value={edit.role} onChange={e => setEdit({ ...edit, role: e.target.value })}>
-                  <option value="user">user</option>
-                  <option value="admin">admin</option>
+                  {roles.map(r => <option key={r.id} value={r.name}>{r.name}</option>)}
+                </select>
+                <label className="text-slate-500">Team</label>
+                <select className="rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-2 py-1.5" value={edit.team_id || 0} onChange={e => setEdit({ ...edit, team_id: Number(e.target.value) })}>
+                  <option value={0}>none</option>
+                  {teams.map(t => <option key={t.id} value={t.id}>{t.name}</option>)}
                 </select>
+                {!!edit.team_id && (
+                  <select className="rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-2 py-1.5" value={edit.team_role || 'member'} onChange={e => setEdit({ ...edit, team_role: e.target.value })}>
+                    <option value="member">member</option>
+                    <option value="admin">team admin</option>
+                  </select>
+                )}
                 <label className="text-slate-500">Disabled</label>
                 <input type="checkbox" checked={!!edit.disabled} onChange={e => setEdit({ ...edit, disabled: e.target.checked })} />
+                <label className="text-slate-500">Require 2FA</label>
+                <input type="checkbox" checked={!!edit.totp_required} onChange={e => setEdit({ ...edit, totp_required: e.target.checked })} />
+                {edit.totp_enabled && <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs" onClick={() => resetTOTP(edit.id)}>Reset 2FA</button>}
+                {!edit.service_account && <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs" onClick={() => signOut(edit.id)}>Sign out everywhere</button>}
+                {!edit.service_account && !edit.ldap_dn && !edit.oidc_subject && !edit.invited_at && <button className="rounded-md border border-slate-300 dark:border-slate-700 px-3 py-1.5 text-xs" onClick={() => sendLink(edit, 'Reset')}>Send reset link</button>}
                 <label className="text-slate-500">New Password</label>
                 <input className="rounded-md border border-slate-300 dark:border-slate-700 bg-white dark:bg-slate-900 px-2 py-1.5" type="password" value={edit.newPassword} onChange={e => setEdit({ ...edit, newPassword: e.target.value })} placeholder="Leave blank to keep" />
                 <button className="rounded-md bg-blue-600 hover:bg-blue-700 text-white px-4 py-2" onClick={saveEdit}>Save</button>
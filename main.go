@@ -2,6 +2,7 @@ package main
 
 import (
     "log"
+    "net"
     "net/http"
     "os"
     "path/filepath"
@@ -20,6 +21,16 @@ func main() {
         log.Fatalf("failed to load config: %v", err)
     }
 
+    // "rotate-secrets" re-encrypts stored provider keys with the current master key and exits
+    if len(os.Args) > 1 && os.Args[1] == "rotate-secrets" {
+        n, err := server.RotateSecrets(cfg)
+        if err != nil {
+            log.Fatalf("rotate-secrets: %v", err)
+        }
+        log.Printf("rotate-secrets: re-encrypted %d secrets", n)
+        return
+    }
+
     // Default to production-like behavior: require built client unless dev
     staticDir := cfg.Server.StaticDir
     if _, err := os.Stat(staticDir); os.IsNotExist(err) {
@@ -31,6 +42,32 @@ func main() {
     e := echo.New()
     e.HideBanner = true
     e.HidePort = true
+
+    // Client IPs come from the connection unless it is a trusted proxy, so a
+    // spoofed X-Forwarded-For can't dodge login lockouts or rate limits
+    e.IPExtractor = echo.ExtractIPDirect()
+    proxies := cfg.Server.TrustedProxies
+    if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+        proxies = strings.Split(v, ",")
+    }
+    if len(proxies) > 0 {
+        trust := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+        for _, p := range proxies {
+            p = strings.TrimSpace(p)
+            if p == "" {
+                continue
+            }
+            if !strings.Contains(p, "/") {
+                if strings.Contains(p, ":") { p += "/128" } else { p += "/32" }
+            }
+            _, ipNet, err := net.ParseCIDR(p)
+            if err != nil {
+                log.Fatalf("server.trusted_proxies: invalid address %q", p)
+            }
+            trust = append(trust, echo.TrustIPRange(ipNet))
+        }
+        e.IPExtractor = echo.ExtractIPFromXFFHeader(trust...)
+    }
     e.Pre(middleware.RemoveTrailingSlash())
     e.Use(middleware.Recover())
     e.Use(middleware.RequestID())
@@ -26,6 +26,9 @@ func handleAccountGet(c echo.Context) error {
         "role": u.Role,
         "disabled": u.Disabled,
         "must_change_password": u.MustChangePassword,
+        "totp_enabled": u.TOTPEnabled,
+        "must_enroll_totp": mustEnrollTOTP(getApp(c), u),
+        "recovery_codes_left": len(u.RecoveryCodes),
     })
 }
 
@@ -36,6 +39,7 @@ func handleAccountUpdate(c echo.Context) error {
     if err := c.Bind(&req); err != nil {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
     }
+    before := *u
     changed := false
     if req.Email != nil {
         email := strings.TrimSpace(*req.Email)
@@ -49,8 +53,8 @@ func handleAccountUpdate(c echo.Context) error {
         if req.CurrentPassword == nil || !u.CheckPassword(*req.CurrentPassword) {
             return c.JSON(http.StatusBadRequest, echo.Map{"error": "current_password_incorrect"})
         }
-        if len(*req.NewPassword) < 6 {
-            return c.JSON(http.StatusBadRequest, echo.Map{"error": "new_password_too_short"})
+        if err := app.passwords.check(*req.NewPassword); err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": app.passwords.errorCode(err), "message": err.Error()})
         }
         if err := u.SetPassword(*req.NewPassword); err != nil {
             return c.JSON(http.StatusInternalServerError, echo.Map{"error": "hash_error"})
@@ -64,6 +68,13 @@ func handleAccountUpdate(c echo.Context) error {
     if err := app.DB.Save(u).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db_error"})
     }
+    var secrets []string
+    if req.NewPassword != nil {
+        // Other browsers signed in with the old password are signed out
+        revokeSessions(app, u.ID, currentSessionID(c))
+        secrets = append(secrets, "password")
+    }
+    audit(c, "account.update", "user", u.ID, before, u, secrets...)
     return handleAccountGet(c)
 }
 
@@ -0,0 +1,244 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Aliases may point at other aliases. validateAlias refuses loops; the cap
+// also bounds lookups per request.
+const maxAliasHops = 5
+
+type aliasReq struct {
+    Name       string     `json:"name"`
+    Target     string     `json:"target"`
+    NextTarget string     `json:"next_target"`
+    SwitchAt   *time.Time `json:"switch_at"`
+    Deprecated bool       `json:"deprecated"`
+    Enabled    bool       `json:"enabled"`
+}
+
+func registerAliasRoutes(g *echo.Group) {
+    ag := g.Group("/aliases")
+    ag.GET("", requirePermission(permRoutes, blockAdminIfMustChange(listAliases)))
+    ag.POST("", requirePermission(permRoutes, blockAdminIfMustChange(createAlias)))
+    ag.GET("/:id", requirePermission(permRoutes, blockAdminIfMustChange(getAlias)))
+    ag.PUT("/:id", requirePermission(permRoutes, blockAdminIfMustChange(updateAlias)))
+    ag.DELETE("/:id", requirePermission(permRoutes, blockAdminIfMustChange(deleteAlias)))
+}
+
+func listAliases(c echo.Context) error {
+    app := getApp(c)
+    var aliases []ModelAlias
+    if err := app.DB.Order("id ASC").Find(&aliases).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    now := time.Now()
+    for i := range aliases {
+        aliases[i].EffectiveTarget = aliases[i].TargetAt(now)
+    }
+    return c.JSON(http.StatusOK, aliases)
+}
+
+func createAlias(c echo.Context) error {
+    app := getApp(c)
+    var req aliasReq
+    if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.Target) == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    a := ModelAlias{
+        Name:       strings.ToLower(strings.TrimSpace(req.Name)),
+        Target:     strings.TrimSpace(req.Target),
+        NextTarget: strings.TrimSpace(req.NextTarget),
+        SwitchAt:   req.SwitchAt,
+        Deprecated: req.Deprecated,
+        Enabled:    req.Enabled,
+    }
+    if err := validateAlias(app, &a); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if aliasNameTaken(app, &a) {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    if err := app.DB.Create(&a).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    a.EffectiveTarget = a.TargetAt(time.Now())
+    return c.JSON(http.StatusCreated, a)
+}
+
+func getAlias(c echo.Context) error {
+    app := getApp(c)
+    var a ModelAlias
+    if err := app.DB.First(&a, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    a.EffectiveTarget = a.TargetAt(time.Now())
+    return c.JSON(http.StatusOK, a)
+}
+
+func updateAlias(c echo.Context) error {
+    app := getApp(c)
+    var a ModelAlias
+    if err := app.DB.First(&a, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req aliasReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if strings.TrimSpace(req.Name) != "" { a.Name = strings.TrimSpace(req.Name) }
+    // Lookups are case-insensitive; this also folds names saved before that
+    a.Name = strings.ToLower(a.Name)
+    if strings.TrimSpace(req.Target) != "" { a.Target = strings.TrimSpace(req.Target) }
+    // next_target/switch_at are replaced as a pair so a schedule can be cleared
+    a.NextTarget = strings.TrimSpace(req.NextTarget)
+    a.SwitchAt = req.SwitchAt
+    a.Deprecated = req.Deprecated
+    a.Enabled = req.Enabled
+    if err := validateAlias(app, &a); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if aliasNameTaken(app, &a) {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    if err := app.DB.Save(&a).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    a.EffectiveTarget = a.TargetAt(time.Now())
+    return c.JSON(http.StatusOK, a)
+}
+
+func deleteAlias(c echo.Context) error {
+    app := getApp(c)
+    if err := app.DB.Unscoped().Delete(&ModelAlias{}, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.NoContent(http.StatusNoContent)
+}
+
+func validateAlias(app *App, a *ModelAlias) error {
+    if strings.EqualFold(a.Name, a.Target) || strings.EqualFold(a.Name, a.NextTarget) {
+        return fmt.Errorf("alias cannot target itself")
+    }
+    if strings.HasPrefix(strings.ToLower(a.Name), "router/") {
+        return fmt.Errorf("router/ names are reserved")
+    }
+    if a.Deprecated && !strings.Contains(a.Name, "/") {
+        return fmt.Errorf("deprecated entries must name a provider/model id")
+    }
+    if !modelTargetExists(app, a.Target) {
+        return fmt.Errorf("unknown target: %s", a.Target)
+    }
+    if aliasLoops(app, a) {
+        return fmt.Errorf("alias target loops back to %s", a.Name)
+    }
+    // The scheduled target may not exist upstream yet; only require a schedule
+    if a.NextTarget != "" && a.SwitchAt == nil {
+        return fmt.Errorf("switch_at required with next_target")
+    }
+    return nil
+}
+
+// aliasNameTaken reports whether another alias has a's name in any case.
+// Names are stored lower-case, but older rows may not be.
+func aliasNameTaken(app *App, a *ModelAlias) bool {
+    var count int64
+    app.DB.Model(&ModelAlias{}).Where("LOWER(name) = ? AND id <> ?", a.Name, a.ID).Count(&count)
+    return count > 0
+}
+
+// aliasLoops reports whether following a's current or scheduled target through
+// other enabled aliases leads back to a.
+func aliasLoops(app *App, a *ModelAlias) bool {
+    seen := map[string]bool{}
+    next := []string{a.Target, a.NextTarget}
+    for len(next) > 0 {
+        id := strings.ToLower(next[0])
+        next = next[1:]
+        if id == "" || seen[id] { continue }
+        if id == a.Name { return true }
+        seen[id] = true
+        var b ModelAlias
+        if app.DB.Where("enabled = ? AND LOWER(name) = ? AND id <> ?", true, id, a.ID).First(&b).Error != nil { continue }
+        next = append(next, b.Target, b.NextTarget)
+    }
+    return false
+}
+
+// modelTargetExists reports whether id resolves to a router route, an alias or
+// a pulled provider model.
+func modelTargetExists(app *App, id string) bool {
+    if strings.HasPrefix(strings.ToLower(id), "router/") {
+        name := strings.TrimPrefix(strings.ToLower(id), "router/")
+        var count int64
+        app.DB.Model(&FallbackRoute{}).Where("enabled = ? AND name = ?", true, name).Count(&count)
+        return count > 0
+    }
+    if _, _, ok := resolveQualifiedModel(app, id); ok {
+        return true
+    }
+    var count int64
+    app.DB.Model(&ModelAlias{}).Where("enabled = ? AND deprecated = ? AND LOWER(name) = ?", true, false, strings.ToLower(id)).Count(&count)
+    return count > 0
+}
+
+// resolveAlias follows enabled aliases starting at model and returns the
+// effective model id. For deprecated ids it also returns an RFC 7234 Warning
+// header value; a deprecated id that still exists upstream is not redirected.
+func resolveAlias(app *App, model string) (string, string) {
+    current := model
+    warning := ""
+    now := time.Now()
+    for i := 0; i < maxAliasHops; i++ {
+        var a ModelAlias
+        if err := app.DB.Where("enabled = ? AND LOWER(name) = ?", true, strings.ToLower(current)).First(&a).Error; err != nil {
+            return current, warning
+        }
+        target := a.TargetAt(now)
+        if a.Deprecated {
+            if _, _, ok := resolveQualifiedModel(app, current); ok {
+                if warning == "" {
+                    warning = fmt.Sprintf(`299 - "model %s is deprecated; use %s"`, current, target)
+                }
+                return current, warning
+            }
+            if warning == "" {
+                warning = fmt.Sprintf(`299 - "model %s is deprecated; redirected to %s"`, current, target)
+            }
+        }
+        current = target
+    }
+    return current, warning
+}
+
+// applyModelAlias rewrites an alias or deprecated model id to its effective
+// target and sets a Warning header when the client should migrate.
+func applyModelAlias(c echo.Context, app *App, clientModel string) string {
+    _, sp := app.tracer.start(c.Request().Context(), "model.alias", spanInternal)
+    defer sp.finish()
+    target, warning := resolveAlias(app, clientModel)
+    sp.set("llmrouter.model.requested", clientModel)
+    sp.set("llmrouter.model", target)
+    if warning != "" {
+        c.Response().Header().Add("Warning", warning)
+    }
+    return target
+}
+
+// listAliasIDs returns enabled, non-deprecated alias names for model listings.
+func listAliasIDs(app *App) []string {
+    var aliases []ModelAlias
+    if err := app.DB.Where("enabled = ? AND deprecated = ?", true, false).Order("name ASC").Find(&aliases).Error; err != nil {
+        return nil
+    }
+    out := make([]string, 0, len(aliases))
+    for _, a := range aliases {
+        out = append(out, a.Name)
+    }
+    return out
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+)
+
+func TestAliasWrites(t *testing.T) {
+    app := newTestApp(t)
+    admin := newTestUser(t, app, "admin@example.org", "admin")
+    app.DB.Create(&FallbackRoute{Name: "fast", Enabled: true})
+    // Saved before names were folded to lower case
+    app.DB.Create(&ModelAlias{Name: "Legacy", Target: "router/fast", Enabled: true})
+
+    // Steps run in order against the same database; an empty id creates an alias
+    tests := []struct {
+        name   string
+        id     string // alias to update, by name
+        body   string
+        want   int
+        stored string
+    }{
+        {name: "create folds case", body: `{"name":"GPT-Default","target":"router/fast","enabled":true}`, want: http.StatusCreated, stored: "gpt-default"},
+        {name: "create same name, other case", body: `{"name":"gpt-DEFAULT","target":"router/fast","enabled":true}`, want: http.StatusConflict},
+        {name: "create over older mixed-case name", body: `{"name":"legacy","target":"router/fast","enabled":true}`, want: http.StatusConflict},
+        {name: "create chained alias", body: `{"name":"chat","target":"GPT-default","enabled":true}`, want: http.StatusCreated, stored: "chat"},
+        {name: "target itself", body: `{"name":"self","target":"SELF","enabled":true}`, want: http.StatusBadRequest},
+        {name: "loop through another alias", id: "gpt-default", body: `{"target":"chat","enabled":true}`, want: http.StatusBadRequest},
+        {name: "loop through scheduled target", id: "gpt-default", body: `{"target":"router/fast","next_target":"Chat","switch_at":"2030-01-01T00:00:00Z","enabled":true}`, want: http.StatusBadRequest},
+        {name: "update keeps name, folds case", id: "legacy", body: `{"target":"chat","enabled":true}`, want: http.StatusOK, stored: "legacy"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            h, method, params := createAlias, http.MethodPost, []string{}
+            if tt.id != "" {
+                var a ModelAlias
+                if err := app.DB.Where("LOWER(name) = ?", tt.id).First(&a).Error; err != nil {
+                    t.Fatal(err)
+                }
+                h, method, params = updateAlias, http.MethodPut, []string{"id", strconv.Itoa(int(a.ID))}
+            }
+            rec := callAs(app, admin, h, method, tt.body, params...)
+            if rec.Code != tt.want {
+                t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+            }
+            var out ModelAlias
+            json.Unmarshal(rec.Body.Bytes(), &out)
+            if tt.stored != "" && out.Name != tt.stored {
+                t.Errorf("name = %q, want %q", out.Name, tt.stored)
+            }
+        })
+    }
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+// Shown instead of the value of any secret field in an audit diff.
+const auditRedacted = "[redacted]"
+
+// Bookkeeping fields left out of diffs.
+var auditSkipFields = map[string]bool{"created_at": true, "updated_at": true, "deleted_at": true}
+
+func registerAuditRoutes(g *echo.Group) {
+    g.GET("/admin/audit", requirePermission(permAudit, blockAdminIfMustChange(adminListAudit)))
+}
+
+// audit appends an event for a change made by the caller. before and after
+// are the target's state (nil on create and delete); secrets names fields that
+// changed but are hidden from JSON, such as passwords, so the event still shows them.
+func audit(c echo.Context, action, targetType string, targetID any, before, after any, secrets ...string) {
+    ev := AuditEvent{
+        Actor:      actorName(c),
+        Action:     action,
+        TargetType: targetType,
+        TargetID:   fmt.Sprint(targetID),
+        Changes:    auditDiff(before, after),
+        IP:         c.RealIP(),
+        RequestID:  c.Response().Header().Get(echo.HeaderXRequestID),
+    }
+    if u, ok := c.Get("user").(*User); ok && u != nil {
+        ev.ActorID = u.ID
+    }
+    for _, s := range secrets {
+        if ev.Changes == nil { ev.Changes = map[string]AuditChange{} }
+        ch := AuditChange{Before: auditRedacted, After: auditRedacted}
+        if before == nil { ch.Before = nil }
+        ev.Changes[s] = ch
+    }
+    writeAudit(getApp(c), &ev)
+}
+
+// auditSystem records an event with no request behind it, e.g. a lockout.
+func auditSystem(app *App, action, targetType string, targetID any, ip string) {
+    writeAudit(app, &AuditEvent{Actor: "system", Action: action, TargetType: targetType, TargetID: fmt.Sprint(targetID), IP: ip})
+}
+
+func writeAudit(app *App, ev *AuditEvent) {
+    if err := app.DB.Create(ev).Error; err != nil {
+        log.Printf("audit: %s %s %s by %s not recorded: %v", ev.Action, ev.TargetType, ev.TargetID, ev.Actor, err)
+    }
+}
+
+// auditDiff compares the JSON form of two values field by field.
+func auditDiff(before, after any) map[string]AuditChange {
+    b, a := auditFields(before), auditFields(after)
+    out := map[string]AuditChange{}
+    // A missing side counts as null, so creates and deletes skip empty fields
+    for k, av := range a {
+        if !reflect.DeepEqual(b[k], av) {
+            out[k] = auditChange(k, b[k], av)
+        }
+    }
+    for k, bv := range b {
+        if _, ok := a[k]; !ok && bv != nil {
+            out[k] = auditChange(k, bv, nil)
+        }
+    }
+    if len(out) == 0 {
+        return nil
+    }
+    return out
+}
+
+func auditFields(v any) map[string]any {
+    m := map[string]any{}
+    if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+        return m
+    }
+    raw, err := json.Marshal(v)
+    if err != nil {
+        return m
+    }
+    json.Unmarshal(raw, &m)
+    for k := range auditSkipFields {
+        delete(m, k)
+    }
+    return m
+}
+
+func auditChange(field string, before, after any) AuditChange {
+    if secretField(field) {
+        return AuditChange{Before: redactValue(before), After: redactValue(after)}
+    }
+    return AuditChange{Before: before, After: after}
+}
+
+// secretField reports whether a JSON field may hold a credential.
+func secretField(name string) bool {
+    n := strings.ToLower(name)
+    for _, s := range []string{"password", "secret", "hash", "token"} {
+        if n == s || strings.HasSuffix(n, "_"+s) {
+            return true
+        }
+    }
+    return n == "key" || n == "api_key" || n == "value"
+}
+
+// redactValue keeps whether a secret was set, not what it was. Flags such
+// as must_change_password are not secret.
+func redactValue(v any) any {
+    if _, ok := v.(bool); ok || v == nil || v == "" {
+        return v
+    }
+    return auditRedacted
+}
+
+// adminListAudit pages through the audit log, newest first, or exports every
+// matching event with format=csv|json.
+func adminListAudit(c echo.Context) error {
+    app := getApp(c)
+    q := app.DB.Model(&AuditEvent{})
+    for param, col := range map[string]string{"actor_id": "actor_id", "target_type": "target_type", "target_id": "target_id", "request_id": "request_id"} {
+        if v := c.QueryParam(param); v != "" {
+            q = q.Where(col+" = ?", v)
+        }
+    }
+    if v := c.QueryParam("action"); v != "" {
+        // "provider." matches every provider action
+        if strings.HasSuffix(v, ".") {
+            q = q.Where("action LIKE ?", v+"%")
+        } else {
+            q = q.Where("action = ?", v)
+        }
+    }
+    if v := c.QueryParam("actor"); v != "" {
+        q = q.Where("actor LIKE ?", "%"+v+"%")
+    }
+    for param, op := range map[string]string{"from": ">=", "to": "<"} {
+        if v := c.QueryParam(param); v != "" {
+            t, err := parseTimeParam(v)
+            if err != nil {
+                return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid " + param})
+            }
+            q = q.Where("created_at "+op+" ?", t)
+        }
+    }
+    switch c.QueryParam("format") {
+    case "csv":
+        return exportAuditCSV(c, q)
+    case "json":
+        var events []AuditEvent
+        if err := q.Order("id ASC").Find(&events).Error; err != nil {
+            return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+        }
+        if events == nil { events = []AuditEvent{} }
+        c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.json"`)
+        return c.JSON(http.StatusOK, events)
+    case "":
+    default:
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid format"})
+    }
+    if v := c.QueryParam("before_id"); v != "" {
+        q = q.Where("id < ?", v)
+    }
+    limit := defaultLogLimit
+    if v := c.QueryParam("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n <= 0 {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid limit"})
+        }
+        limit = min(n, maxLogLimit)
+    }
+    var events []AuditEvent
+    if err := q.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    if events == nil { events = []AuditEvent{} }
+    return c.JSON(http.StatusOK, events)
+}
+
+// exportAuditCSV streams events oldest first; changes are a JSON column.
+func exportAuditCSV(c echo.Context, q *gorm.DB) error {
+    res := c.Response()
+    res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+    res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.csv"`)
+    res.WriteHeader(http.StatusOK)
+    w := csv.NewWriter(res)
+    w.Write([]string{"id", "time", "actor_id", "actor", "action", "target_type", "target_id", "changes", "ip", "request_id"})
+    var batch []AuditEvent
+    err := q.FindInBatches(&batch, 500, func(*gorm.DB, int) error {
+        for _, ev := range batch {
+            changes := ""
+            if ev.Changes != nil {
+                b, _ := json.Marshal(ev.Changes)
+                changes = string(b)
+            }
+            w.Write([]string{strconv.FormatUint(uint64(ev.ID), 10), ev.CreatedAt.UTC().Format(time.RFC3339), strconv.FormatUint(uint64(ev.ActorID), 10),
+                ev.Actor, ev.Action, ev.TargetType, ev.TargetID, changes, ev.IP, ev.RequestID})
+        }
+        w.Flush()
+        return w.Error()
+    }).Error
+    if err != nil {
+        // Headers are gone; all that's left is to cut the file short
+        log.Printf("audit: export: %v", err)
+    }
+    return nil
+}
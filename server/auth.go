@@ -1,6 +1,7 @@
 package server
 
 import (
+    "errors"
     "net/http"
     "strings"
     "time"
@@ -27,18 +28,56 @@ func handleLogin(c echo.Context) error {
     }
 
     email := strings.TrimSpace(strings.ToLower(req.Email))
-    var u User
-    if err := app.DB.Where("email = ?", email).First(&u).Error; err != nil {
-        return c.JSON(http.StatusUnauthorized, echo.Map{"error": "invalid credentials"})
+    if !passwordLoginAllowed(app, email) {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": "password login disabled, use single sign-on"})
+    }
+    // Directory logins by user name have no row to lock; the per-IP limit and
+    // the directory's own lockout policy cover those
+    var acct *User
+    var known User
+    if app.DB.Where("email = ?", email).First(&known).Error == nil { acct = &known }
+    if wait, msg := loginLockout(c, app, acct); wait > 0 {
+        return tooManyLogins(c, wait, msg)
     }
-    if u.Disabled || !u.CheckPassword(req.Password) {
+    u, err := passwordLogin(app, email, req.Password)
+    if errors.Is(err, errInvalidCredentials) {
+        recordLoginFailure(c, app, acct)
         return c.JSON(http.StatusUnauthorized, echo.Map{"error": "invalid credentials"})
     }
-
-    token, err := signJWT(app, u.ID, u.Role, 24*time.Hour)
+    if errors.Is(err, errDirectoryUnavailable) {
+        return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": "directory unavailable"})
+    }
     if err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "auth error"})
     }
+    if wait, msg := loginLockout(c, app, u); wait > 0 {
+        return tooManyLogins(c, wait, msg)
+    }
+    if u.TOTPEnabled {
+        return totpChallenge(c, app, u)
+    }
+
+    clearLoginFailures(app, u)
+    if err := setSessionCookie(c, app, u); err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "auth error"})
+    }
+    return c.JSON(http.StatusOK, echo.Map{"ok": true})
+}
+
+// setSessionCookie signs u in with a new session; shared by password and single sign-on logins.
+func setSessionCookie(c echo.Context, app *App, u *User) error {
+    s, err := createSession(c, app, u)
+    if err != nil {
+        return err
+    }
+    return writeSessionCookie(c, app, u, s)
+}
+
+func writeSessionCookie(c echo.Context, app *App, u *User, s *Session) error {
+    token, err := signJWT(app, u.ID, u.Role, s.ID, time.Until(s.ExpiresAt))
+    if err != nil {
+        return err
+    }
     cookie := &http.Cookie{
         Name:     "session",
         Value:    token,
@@ -46,13 +85,19 @@ func handleLogin(c echo.Context) error {
         HttpOnly: true,
         Secure:   false,
         SameSite: http.SameSiteLaxMode,
-        Expires:  time.Now().Add(24 * time.Hour),
+        Expires:  s.ExpiresAt,
     }
     c.SetCookie(cookie)
-    return c.JSON(http.StatusOK, echo.Map{"ok": true})
+    return nil
 }
 
 func handleLogout(c echo.Context) error {
+    app := getApp(c)
+    if cookie, err := c.Cookie("session"); err == nil && cookie.Value != "" {
+        if claims, err := parseJWT(app, cookie.Value); err == nil && claims.ID != "" {
+            app.DB.Where("id = ? AND user_id = ?", claims.ID, claims.UserID).Delete(&Session{})
+        }
+    }
     cookie := &http.Cookie{
         Name:     "session",
         Value:    "",
@@ -72,8 +117,10 @@ func handleMe(c echo.Context) error {
         "id":       u.ID,
         "email":    u.Email,
         "role":     u.Role,
+        "permissions": userPermissions(getApp(c), u),
         "disabled": u.Disabled,
         "must_change_password": u.MustChangePassword,
+        "must_enroll_totp": mustEnrollTOTP(getApp(c), u),
     })
 }
 
@@ -101,47 +148,38 @@ func seedAdmin(app *App) error {
 func requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
     return func(c echo.Context) error {
         app := getApp(c)
-        cookie, err := c.Cookie("session")
-        if err != nil || cookie == nil || cookie.Value == "" {
-            return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"})
+        if token := bearerAdminToken(c); token != "" {
+            return authAdminToken(c, token, next)
         }
-        claims, err := parseJWT(app, cookie.Value)
+        u, s, err := sessionUser(c, app)
         if err != nil {
             return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"})
         }
-        var u User
-        if err := app.DB.First(&u, claims.UserID).Error; err != nil {
-            return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"})
-        }
         if u.Disabled {
             return c.JSON(http.StatusForbidden, echo.Map{"error": "account disabled"})
         }
-        c.Set("user", &u)
+        c.Set("user", u)
+        c.Set("session", s)
         return next(c)
     }
 }
 
-func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
-    return requireAuth(func(c echo.Context) error {
-        u := c.Get("user").(*User)
-        if u.Role != "admin" {
-            return c.JSON(http.StatusForbidden, echo.Map{"error": "forbidden"})
-        }
-        return next(c)
-    })
-}
-
-// If user is admin and must change password, block everything except account/auth endpoints
+// If user is admin and must change password, or must enroll two-factor, block
+// everything except account/auth endpoints
 func blockAdminIfMustChange(next echo.HandlerFunc) echo.HandlerFunc {
     return func(c echo.Context) error {
         u := c.Get("user").(*User)
-        if u != nil && u.Role == "admin" && u.MustChangePassword {
-            p := c.Request().URL.Path
-            if strings.HasPrefix(p, "/api/account") || strings.HasPrefix(p, "/api/auth/") {
-                return next(c)
-            }
+        if u == nil {
+            return next(c)
+        }
+        p := c.Request().URL.Path
+        open := strings.HasPrefix(p, "/api/account") || strings.HasPrefix(p, "/api/auth/")
+        if u.Role == "admin" && u.MustChangePassword && !open {
             return c.JSON(http.StatusForbidden, echo.Map{"error": "must_change_password"})
         }
+        if mustEnrollTOTP(getApp(c), u) && !open {
+            return c.JSON(http.StatusForbidden, echo.Map{"error": "must_enroll_totp"})
+        }
         return next(c)
     }
 }
@@ -0,0 +1,441 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+var defaultBudgetThresholds = []int{50, 80, 100}
+
+// Spend totals are re-read from usage_logs this often so that other
+// instances' usage is eventually reflected.
+const budgetResyncInterval = 30 * time.Second
+
+type budgetReq struct {
+    Scope       string  `json:"scope"`
+    ScopeID     uint    `json:"scope_id"`
+    Period      string  `json:"period"`
+    LimitUSD    float64 `json:"limit_usd"`
+    LimitTokens int64   `json:"limit_tokens"`
+    Thresholds  []int   `json:"thresholds"`
+    Enabled     bool    `json:"enabled"`
+}
+
+// budgetStatus is a budget with its current period usage.
+type budgetStatus struct {
+    Budget
+    PeriodStart time.Time `json:"period_start"`
+    SpentUSD    float64   `json:"spent_usd"`
+    SpentTokens int64     `json:"spent_tokens"`
+}
+
+// budgetState is the in-memory running total for one budget in its current
+// period. Reserved amounts belong to requests still in flight.
+type budgetState struct {
+    budget         Budget
+    period         string
+    spentUSD       float64
+    spentTokens    int64
+    reservedUSD    float64
+    reservedTokens int64
+    loadedAt       time.Time
+}
+
+// budgetTracker serializes budget checks so concurrent requests cannot all
+// pass on the same remaining headroom.
+type budgetTracker struct {
+    mu     sync.Mutex
+    states map[uint]*budgetState
+}
+
+func newBudgetTracker() *budgetTracker {
+    return &budgetTracker{states: map[uint]*budgetState{}}
+}
+
+// errBudgetExceeded is returned when a request would exceed a budget.
+type errBudgetExceeded struct {
+    Budget Budget
+}
+
+func (e *errBudgetExceeded) Error() string {
+    return fmt.Sprintf("%s budget for %s %d exceeded", e.Budget.Period, e.Budget.Scope, e.Budget.ScopeID)
+}
+
+func registerBudgetRoutes(g *echo.Group) {
+    g.GET("/budgets/me", requireAuth(blockAdminIfMustChange(myBudgets)))
+    ag := g.Group("/budgets")
+    ag.GET("", requirePermission(permBudgets, blockAdminIfMustChange(listBudgets)))
+    ag.POST("", requirePermission(permBudgets, blockAdminIfMustChange(createBudget)))
+    ag.PUT("/:id", requirePermission(permBudgets, blockAdminIfMustChange(updateBudget)))
+    ag.DELETE("/:id", requirePermission(permBudgets, blockAdminIfMustChange(deleteBudget)))
+}
+
+func listBudgets(c echo.Context) error {
+    app := getApp(c)
+    var budgets []Budget
+    if err := app.DB.Order("id ASC").Find(&budgets).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, budgetStatuses(app, budgets))
+}
+
+// myBudgets lists budgets on the caller, the caller's keys and the caller's team.
+func myBudgets(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    var budgets []Budget
+    keyIDs := app.DB.Model(&APIKey{}).Select("id").Where("user_id = ?", u.ID)
+    if err := app.DB.Where("(scope = ? AND scope_id = ?) OR (scope = ? AND scope_id IN (?)) OR (scope = ? AND scope_id = ?)", "user", u.ID, "key", keyIDs, "team", u.TeamID).Order("id ASC").Find(&budgets).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, budgetStatuses(app, budgets))
+}
+
+func budgetStatuses(app *App, budgets []Budget) []budgetStatus {
+    now := time.Now()
+    out := make([]budgetStatus, 0, len(budgets))
+    for _, b := range budgets {
+        start, _ := budgetPeriod(b.Period, now)
+        usd, tokens := budgetSpend(app.DB, b, start)
+        out = append(out, budgetStatus{Budget: b, PeriodStart: start, SpentUSD: usd, SpentTokens: tokens})
+    }
+    return out
+}
+
+func createBudget(c echo.Context) error {
+    app := getApp(c)
+    var req budgetReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    b := Budget{Enabled: req.Enabled}
+    if err := applyBudgetReq(app, &b, req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if err := app.DB.Create(&b).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.budgets.forget(b.ID)
+    return c.JSON(http.StatusCreated, b)
+}
+
+func updateBudget(c echo.Context) error {
+    app := getApp(c)
+    var b Budget
+    if err := app.DB.First(&b, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req budgetReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if req.Scope == "" { req.Scope = b.Scope; req.ScopeID = b.ScopeID }
+    if req.Period == "" { req.Period = b.Period }
+    if req.Thresholds == nil { req.Thresholds = b.Thresholds }
+    b.Enabled = req.Enabled
+    if err := applyBudgetReq(app, &b, req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if err := app.DB.Save(&b).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.budgets.forget(b.ID)
+    return c.JSON(http.StatusOK, b)
+}
+
+func deleteBudget(c echo.Context) error {
+    app := getApp(c)
+    var b Budget
+    if err := app.DB.First(&b, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := app.DB.Delete(&b).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.budgets.forget(b.ID)
+    return c.NoContent(http.StatusNoContent)
+}
+
+func applyBudgetReq(app *App, b *Budget, req budgetReq) error {
+    scope := strings.ToLower(strings.TrimSpace(req.Scope))
+    switch scope {
+    case "user":
+        var u User
+        if err := app.DB.First(&u, req.ScopeID).Error; err != nil {
+            return fmt.Errorf("unknown user")
+        }
+    case "key":
+        var k APIKey
+        if err := app.DB.First(&k, req.ScopeID).Error; err != nil {
+            return fmt.Errorf("unknown key")
+        }
+    case "team":
+        var t Team
+        if err := app.DB.First(&t, req.ScopeID).Error; err != nil {
+            return fmt.Errorf("unknown team")
+        }
+    default:
+        return fmt.Errorf("scope must be user, key or team")
+    }
+    period := strings.ToLower(strings.TrimSpace(req.Period))
+    if period != "daily" && period != "monthly" {
+        return fmt.Errorf("period must be daily or monthly")
+    }
+    if req.LimitUSD < 0 || req.LimitTokens < 0 || (req.LimitUSD == 0 && req.LimitTokens == 0) {
+        return fmt.Errorf("limit_usd or limit_tokens required")
+    }
+    thresholds := req.Thresholds
+    if thresholds == nil {
+        thresholds = defaultBudgetThresholds
+    }
+    for _, t := range thresholds {
+        if t <= 0 || t > 100 {
+            return fmt.Errorf("thresholds must be between 1 and 100")
+        }
+    }
+    sorted := append([]int{}, thresholds...)
+    sort.Ints(sorted)
+    b.Scope, b.ScopeID, b.Period = scope, req.ScopeID, period
+    b.LimitUSD, b.LimitTokens, b.Thresholds = req.LimitUSD, req.LimitTokens, sorted
+    return nil
+}
+
+// budgetPeriod returns the UTC start of the period containing t and its key.
+func budgetPeriod(period string, t time.Time) (time.Time, string) {
+    t = t.UTC()
+    if period == "daily" {
+        start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+        return start, start.Format("2006-01-02")
+    }
+    start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+    return start, start.Format("2006-01")
+}
+
+// budgetSpend sums logged usage for the budget's scope since start.
+func budgetSpend(db *gorm.DB, b Budget, start time.Time) (float64, int64) {
+    col := "user_id"
+    switch b.Scope {
+    case "key":
+        col = "api_key_id"
+    case "team":
+        col = "team_id"
+    }
+    var agg struct {
+        Cost   float64
+        Tokens int64
+    }
+    db.Model(&UsageLog{}).Select("COALESCE(SUM(cost),0) AS cost, COALESCE(SUM(tokens_in + tokens_out),0) AS tokens").
+        Where(col+" = ? AND created_at >= ?", b.ScopeID, start).Scan(&agg)
+    return agg.Cost, agg.Tokens
+}
+
+// applicableBudgets loads enabled budgets on the user and, if present, the key and team.
+func applicableBudgets(app *App, userID, keyID, teamID uint) []Budget {
+    var budgets []Budget
+    q := app.DB.Where("enabled = ?", true)
+    // 0 never matches a real key or team
+    q = q.Where("(scope = ? AND scope_id = ?) OR (scope = ? AND scope_id = ?) OR (scope = ? AND scope_id = ?)", "user", userID, "key", keyID, "team", teamID)
+    if err := q.Find(&budgets).Error; err != nil {
+        return nil
+    }
+    return budgets
+}
+
+// stateFor returns the running total for b, reloading it from the database
+// when the period rolled over or the cached total went stale. Caller holds mu.
+func (t *budgetTracker) stateFor(db *gorm.DB, b Budget, now time.Time) *budgetState {
+    start, key := budgetPeriod(b.Period, now)
+    st := t.states[b.ID]
+    if st == nil || st.period != key || now.Sub(st.loadedAt) > budgetResyncInterval {
+        usd, tokens := budgetSpend(db, b, start)
+        if st == nil || st.period != key {
+            st = &budgetState{}
+            t.states[b.ID] = st
+        }
+        st.period, st.spentUSD, st.spentTokens, st.loadedAt = key, usd, tokens, now
+    }
+    st.budget = b
+    return st
+}
+
+// reserve checks every budget that applies to the caller and, if all have
+// room, holds the estimate against them until release is called.
+func (t *budgetTracker) reserve(app *App, userID, keyID, teamID uint, estUSD float64, estTokens int64) (func(), error) {
+    budgets := applicableBudgets(app, userID, keyID, teamID)
+    if len(budgets) == 0 {
+        return func() {}, nil
+    }
+    now := time.Now()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    states := make([]*budgetState, 0, len(budgets))
+    for _, b := range budgets {
+        st := t.stateFor(app.DB, b, now)
+        if b.LimitUSD > 0 && (st.spentUSD >= b.LimitUSD || st.spentUSD+st.reservedUSD+estUSD > b.LimitUSD) {
+            return nil, &errBudgetExceeded{Budget: b}
+        }
+        if b.LimitTokens > 0 && (st.spentTokens >= b.LimitTokens || st.spentTokens+st.reservedTokens+estTokens > b.LimitTokens) {
+            return nil, &errBudgetExceeded{Budget: b}
+        }
+        states = append(states, st)
+    }
+    for _, st := range states {
+        st.reservedUSD += estUSD
+        st.reservedTokens += estTokens
+    }
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            t.mu.Lock()
+            defer t.mu.Unlock()
+            for _, st := range states {
+                st.reservedUSD -= estUSD
+                st.reservedTokens -= estTokens
+            }
+        })
+    }, nil
+}
+
+// record adds the actual cost of a finished upstream call to the running
+// totals and fires threshold notifications.
+func (t *budgetTracker) record(app *App, userID, keyID, teamID uint, usd float64, tokens int64) {
+    if usd == 0 && tokens == 0 {
+        return
+    }
+    budgets := applicableBudgets(app, userID, keyID, teamID)
+    if len(budgets) == 0 {
+        return
+    }
+    now := time.Now()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, b := range budgets {
+        st := t.stateFor(app.DB, b, now)
+        st.spentUSD += usd
+        st.spentTokens += tokens
+        t.checkThresholds(app, st)
+    }
+}
+
+// checkThresholds notifies once per period for the highest level crossed. Caller holds mu.
+func (t *budgetTracker) checkThresholds(app *App, st *budgetState) {
+    b := &st.budget
+    pct := 0.0
+    if b.LimitUSD > 0 {
+        pct = st.spentUSD / b.LimitUSD * 100
+    }
+    if b.LimitTokens > 0 {
+        if p := float64(st.spentTokens) / float64(b.LimitTokens) * 100; p > pct {
+            pct = p
+        }
+    }
+    notified := b.NotifiedLevel
+    if b.NotifiedPeriod != st.period {
+        notified = 0
+    }
+    level := 0
+    for _, th := range b.Thresholds {
+        if pct >= float64(th) && th > notified {
+            level = th
+        }
+    }
+    if level == 0 {
+        return
+    }
+    b.NotifiedLevel, b.NotifiedPeriod = level, st.period
+    app.DB.Model(&Budget{}).Where("id = ?", b.ID).Updates(map[string]any{"notified_level": level, "notified_period": st.period})
+    notify(app, "budget.threshold", map[string]any{
+        "budget_id":    b.ID,
+        "scope":        b.Scope,
+        "scope_id":     b.ScopeID,
+        "period":       st.period,
+        "threshold":    level,
+        "spent_usd":    st.spentUSD,
+        "limit_usd":    b.LimitUSD,
+        "spent_tokens": st.spentTokens,
+        "limit_tokens": b.LimitTokens,
+    })
+}
+
+func (t *budgetTracker) forget(budgetID uint) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.states, budgetID)
+}
+
+// estimateTokens roughly sizes a request before dispatch: prompt size from
+// the JSON body (~4 bytes per token) plus the requested completion ceiling.
+func estimateTokens(payload map[string]any) (int, int) {
+    var in []byte
+    for _, field := range []string{"messages", "prompt", "input"} {
+        if v, ok := payload[field]; ok {
+            in, _ = json.Marshal(v)
+            break
+        }
+    }
+    outTok := 0
+    for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+        if v, ok := payload[field].(float64); ok && v > 0 {
+            outTok = int(v)
+            break
+        }
+    }
+    return len(in) / 4, outTok
+}
+
+// requestTarget returns the provider model a request is expected to hit: the
+// model itself, or the first target of a router route.
+func requestTarget(app *App, clientModel string) (uint, string, bool) {
+    if strings.HasPrefix(strings.ToLower(clientModel), "router/") {
+        var route FallbackRoute
+        name := strings.TrimPrefix(strings.ToLower(clientModel), "router/")
+        if err := app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).Where("name = ?", name).First(&route).Error; err == nil && len(route.Targets) > 0 {
+            return route.Targets[0].ProviderID, route.Targets[0].Model, true
+        }
+        return 0, "", false
+    }
+    if p, raw, ok := resolveQualifiedModel(app, clientModel); ok {
+        return p.ID, raw, true
+    }
+    return 0, "", false
+}
+
+// estimateRequest prices a request before dispatch from its estimated tokens.
+func estimateRequest(app *App, clientModel string, payload map[string]any) (float64, int64) {
+    promptTok, outTok := estimateTokens(payload)
+    usd := 0.0
+    if providerID, model, ok := requestTarget(app, clientModel); ok {
+        usd = usageCost(app, providerID, model, tokenUsage{PromptTokens: promptTok, CompletionTokens: outTok}, time.Now())
+    }
+    return usd, int64(promptTok + outTok)
+}
+
+// reserveBudgets applies the caller's budgets to a request about to be dispatched.
+func reserveBudgets(c echo.Context, app *App, clientModel string, payload map[string]any) (func(), error) {
+    user, key, err := getUserFromAuth(c)
+    if err != nil {
+        return func() {}, nil
+    }
+    keyID := uint(0)
+    if key != nil { keyID = key.ID }
+    usd, tokens := estimateRequest(app, clientModel, payload)
+    return app.budgets.reserve(app, user.ID, keyID, usageTeam(user, key), usd, tokens)
+}
+
+// quotaExceeded writes an OpenAI-style insufficient_quota error.
+func quotaExceeded(c echo.Context, err error) error {
+    return c.JSON(http.StatusTooManyRequests, echo.Map{"error": echo.Map{
+        "message": "You exceeded your current quota: " + err.Error() + ".",
+        "type":    "insufficient_quota",
+        "param":   nil,
+        "code":    "insufficient_quota",
+    }})
+}
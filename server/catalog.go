@@ -0,0 +1,228 @@
+package server
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+// upstreamModel captures the optional metadata some OpenAI-compatible
+// providers (OpenRouter, Together, Groq, vLLM) add to /models entries.
+type upstreamModel struct {
+    ID            string `json:"id"`
+    ContextLength int    `json:"context_length"`
+    ContextWindow int    `json:"context_window"`
+    MaxModelLen   int    `json:"max_model_len"`
+    TopProvider   struct {
+        MaxCompletionTokens int `json:"max_completion_tokens"`
+    } `json:"top_provider"`
+    Architecture struct {
+        InputModalities []string `json:"input_modalities"`
+    } `json:"architecture"`
+    SupportedParameters []string       `json:"supported_parameters"`
+    Pricing             map[string]any `json:"pricing"`
+}
+
+type catalogReq struct {
+    // Qualified provider/model id
+    Model           string   `json:"model"`
+    ContextWindow   *int     `json:"context_window"`
+    MaxOutputTokens *int     `json:"max_output_tokens"`
+    Vision          *bool    `json:"vision"`
+    Audio           *bool    `json:"audio"`
+    Tools           *bool    `json:"tools"`
+    JSONMode        *bool    `json:"json_mode"`
+    InputPrice      *float64 `json:"input_price"`
+    OutputPrice     *float64 `json:"output_price"`
+}
+
+// modelCapabilities and modelPricing are the /api/v1/models extensions.
+type modelCapabilities struct {
+    Vision   *bool `json:"vision,omitempty"`
+    Audio    *bool `json:"audio,omitempty"`
+    Tools    *bool `json:"tools,omitempty"`
+    JSONMode *bool `json:"json_mode,omitempty"`
+}
+
+type modelPricing struct {
+    Input  float64 `json:"input"`
+    Output float64 `json:"output"`
+    Unit   string  `json:"unit"`
+}
+
+func registerCatalogRoutes(g *echo.Group) {
+    ag := g.Group("/catalog")
+    ag.GET("", requireAuth(blockAdminIfMustChange(listCatalog)))
+    ag.PUT("", requirePermission(permModels, blockAdminIfMustChange(upsertCatalog)))
+    ag.DELETE("/:id", requirePermission(permModels, blockAdminIfMustChange(deleteCatalog)))
+}
+
+func listCatalog(c echo.Context) error {
+    app := getApp(c)
+    var infos []ModelInfo
+    if err := app.DB.Order("provider_id ASC, model ASC").Find(&infos).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, infos)
+}
+
+// upsertCatalog creates or edits the entry for a qualified provider/model.
+// Only fields present in the body change; the entry is then marked admin-owned.
+func upsertCatalog(c echo.Context) error {
+    app := getApp(c)
+    var req catalogReq
+    if err := c.Bind(&req); err != nil || req.Model == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    p, raw, ok := resolveQualifiedModel(app, req.Model)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
+    }
+    var info ModelInfo
+    if err := app.DB.Where("provider_id = ? AND model = ?", p.ID, raw).First(&info).Error; err != nil {
+        info = ModelInfo{ProviderID: p.ID, Model: raw}
+    }
+    if req.ContextWindow != nil { info.ContextWindow = *req.ContextWindow }
+    if req.MaxOutputTokens != nil { info.MaxOutputTokens = *req.MaxOutputTokens }
+    if req.Vision != nil { info.Vision = req.Vision }
+    if req.Audio != nil { info.Audio = req.Audio }
+    if req.Tools != nil { info.Tools = req.Tools }
+    if req.JSONMode != nil { info.JSONMode = req.JSONMode }
+    if req.InputPrice != nil { info.InputPrice = *req.InputPrice }
+    if req.OutputPrice != nil { info.OutputPrice = *req.OutputPrice }
+    info.Source = "admin"
+    if err := app.DB.Save(&info).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, info)
+}
+
+func deleteCatalog(c echo.Context) error {
+    app := getApp(c)
+    if err := app.DB.Delete(&ModelInfo{}, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.NoContent(http.StatusNoContent)
+}
+
+// seedModelInfo stores metadata found in a provider's /models response.
+// Entries edited by an admin are left untouched.
+func seedModelInfo(app *App, p *Provider, models []upstreamModel) {
+    for _, m := range models {
+        seeded, ok := modelInfoFromUpstream(m)
+        if !ok {
+            continue
+        }
+        var info ModelInfo
+        err := app.DB.Where("provider_id = ? AND model = ?", p.ID, m.ID).First(&info).Error
+        if err == nil && info.Source == "admin" {
+            continue
+        }
+        if err != nil && err != gorm.ErrRecordNotFound {
+            continue
+        }
+        seeded.ID = info.ID
+        seeded.CreatedAt = info.CreatedAt
+        seeded.ProviderID = p.ID
+        seeded.Model = m.ID
+        seeded.Source = "provider"
+        _ = app.DB.Save(&seeded).Error
+    }
+}
+
+func modelInfoFromUpstream(m upstreamModel) (ModelInfo, bool) {
+    var info ModelInfo
+    found := false
+    for _, v := range []int{m.ContextLength, m.ContextWindow, m.MaxModelLen} {
+        if v > 0 {
+            info.ContextWindow = v
+            found = true
+            break
+        }
+    }
+    if m.TopProvider.MaxCompletionTokens > 0 {
+        info.MaxOutputTokens = m.TopProvider.MaxCompletionTokens
+        found = true
+    }
+    if len(m.Architecture.InputModalities) > 0 {
+        vision, audio := false, false
+        for _, mod := range m.Architecture.InputModalities {
+            switch strings.ToLower(mod) {
+            case "image":
+                vision = true
+            case "audio":
+                audio = true
+            }
+        }
+        info.Vision, info.Audio = &vision, &audio
+        found = true
+    }
+    if len(m.SupportedParameters) > 0 {
+        tools, jsonMode := false, false
+        for _, param := range m.SupportedParameters {
+            switch param {
+            case "tools":
+                tools = true
+            case "response_format", "structured_outputs":
+                jsonMode = true
+            }
+        }
+        info.Tools, info.JSONMode = &tools, &jsonMode
+        found = true
+    }
+    // OpenRouter prices are USD per token; Together uses USD per 1M tokens.
+    if v, ok := priceField(m.Pricing, "prompt"); ok {
+        info.InputPrice = v * 1e6
+        found = true
+    } else if v, ok := priceField(m.Pricing, "input"); ok {
+        info.InputPrice = v
+        found = true
+    }
+    if v, ok := priceField(m.Pricing, "completion"); ok {
+        info.OutputPrice = v * 1e6
+        found = true
+    } else if v, ok := priceField(m.Pricing, "output"); ok {
+        info.OutputPrice = v
+        found = true
+    }
+    return info, found
+}
+
+func priceField(pricing map[string]any, key string) (float64, bool) {
+    switch v := pricing[key].(type) {
+    case float64:
+        return v, true
+    case string:
+        f, err := strconv.ParseFloat(v, 64)
+        return f, err == nil
+    }
+    return 0, false
+}
+
+// loadModelInfo returns catalog entries keyed by provider ID and raw model id.
+func loadModelInfo(app *App) map[uint]map[string]ModelInfo {
+    out := map[uint]map[string]ModelInfo{}
+    var infos []ModelInfo
+    if err := app.DB.Find(&infos).Error; err != nil {
+        return out
+    }
+    for _, info := range infos {
+        if out[info.ProviderID] == nil {
+            out[info.ProviderID] = map[string]ModelInfo{}
+        }
+        out[info.ProviderID][info.Model] = info
+    }
+    return out
+}
+
+// lookupModelInfo returns the catalog entry for a provider model, if any.
+func lookupModelInfo(app *App, providerID uint, model string) (ModelInfo, bool) {
+    var info ModelInfo
+    if err := app.DB.Where("provider_id = ? AND model = ?", providerID, model).First(&info).Error; err != nil {
+        return ModelInfo{}, false
+    }
+    return info, true
+}
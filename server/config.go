@@ -14,7 +14,13 @@ type Config struct {
         Dev             bool     `yaml:"dev"`
         StaticDir       string   `yaml:"static_dir"`
         JWTSecret       string   `yaml:"jwt_secret"`
+        // Old signing keys still accepted after rotating jwt_secret
+        JWTPreviousSecrets []string `yaml:"jwt_previous_secrets"`
+        // HMAC key for stored API key hashes; defaults to jwt_secret
+        APIKeySecret    string   `yaml:"api_key_secret"`
         CORSAllowOrigins []string `yaml:"cors_allow_origins"`
+        // Reverse proxies (IPs or CIDRs) whose X-Forwarded-For is believed
+        TrustedProxies  []string `yaml:"trusted_proxies"`
     } `yaml:"server"`
     Database struct {
         Driver     string `yaml:"driver"`      // postgres|sqlite
@@ -25,6 +31,159 @@ type Config struct {
         SeedUser     string `yaml:"seed_user"`
         SeedPassword string `yaml:"seed_password"`
     } `yaml:"admin"`
+    RateLimit struct {
+        Backend string `yaml:"backend"` // memory|database
+    } `yaml:"rate_limit"`
+    Auth struct {
+        // Roles that must enroll two-factor before using the console
+        RequireTOTPRoles []string `yaml:"require_totp_roles"`
+        SessionTTLHours    int `yaml:"session_ttl_hours"`    // default 24
+        IdleTimeoutMinutes int `yaml:"idle_timeout_minutes"` // 0 disables
+        Lockout  LockoutConfig        `yaml:"lockout"`
+        Password PasswordPolicyConfig `yaml:"password"`
+    } `yaml:"auth"`
+    OIDC OIDCConfig `yaml:"oidc"`
+    LDAP LDAPConfig `yaml:"ldap"`
+    Mail MailConfig `yaml:"mail"`
+    Secrets SecretsConfig `yaml:"secrets"`
+    Metrics MetricsConfig `yaml:"metrics"`
+    Tracing TracingConfig `yaml:"tracing"`
+    Notifications struct {
+        WebhookURL string `yaml:"webhook_url"` // POSTed a JSON event for budget alerts etc.
+    } `yaml:"notifications"`
+}
+
+// LockoutConfig throttles failed logins; a zero limit disables that check.
+type LockoutConfig struct {
+    MaxFailures    int `yaml:"max_failures"`    // per account within the window
+    IPMaxFailures  int `yaml:"ip_max_failures"` // per client IP within the window
+    WindowMinutes  int `yaml:"window_minutes"`
+    LockoutMinutes int `yaml:"lockout_minutes"`
+}
+
+// PasswordPolicyConfig applies to every password set through the API.
+type PasswordPolicyConfig struct {
+    MinLength int `yaml:"min_length"`
+    // File of breached passwords or their SHA-1 hashes, one per line
+    BreachedList string `yaml:"breached_list"`
+}
+
+// MailConfig delivers invitation and password-reset links.
+type MailConfig struct {
+    Delivery string `yaml:"delivery"` // display|smtp|webhook; display hands links to the admin
+    // Console URL the links point at; required for self-service reset
+    BaseURL    string     `yaml:"base_url"`
+    From       string     `yaml:"from"`
+    SMTP       SMTPConfig `yaml:"smtp"`
+    WebhookURL string     `yaml:"webhook_url"` // default notifications.webhook_url
+    InviteTTLHours  int `yaml:"invite_ttl_hours"`
+    ResetTTLMinutes int `yaml:"reset_ttl_minutes"`
+}
+
+// SMTPConfig is the mail server used by mail.delivery: smtp.
+type SMTPConfig struct {
+    Host     string `yaml:"host"`
+    Port     int    `yaml:"port"`
+    Username string `yaml:"username"` // empty skips AUTH
+    Password string `yaml:"password"`
+    TLS      string `yaml:"tls"` // starttls|tls|none
+}
+
+// SecretsConfig holds the master key that encrypts provider API keys at rest.
+type SecretsConfig struct {
+    MasterKey     string `yaml:"master_key"`      // 32 bytes, base64
+    MasterKeyFile string `yaml:"master_key_file"` // used when master_key is empty
+    // Old master keys still accepted until rotate-secrets has run
+    PreviousMasterKeys []string `yaml:"previous_master_keys"`
+    // env: and file: references anyone with providers.manage may store;
+    // other references need the full admin role
+    AllowedEnvPrefixes []string `yaml:"allowed_env_prefixes"` // e.g. LLMR_PROVIDER_
+    AllowedFileDirs    []string `yaml:"allowed_file_dirs"`    // absolute, e.g. /run/secrets
+}
+
+// MetricsConfig exposes Prometheus metrics on /metrics.
+type MetricsConfig struct {
+    Enabled bool   `yaml:"enabled"`
+    Token   string `yaml:"token"` // bearer token required to scrape; empty leaves it open
+    // Series kept per metric; label combinations past it are counted as "other"
+    MaxSeries int `yaml:"max_series"`
+}
+
+// TracingConfig exports OpenTelemetry traces of /api/v1 requests.
+type TracingConfig struct {
+    Exporter string `yaml:"exporter"` // none|otlp|console
+    // OTLP/HTTP collector, e.g. http://localhost:4318; spans are POSTed as JSON to <endpoint>/v1/traces
+    Endpoint    string            `yaml:"endpoint"`
+    Headers     map[string]string `yaml:"headers"`
+    ServiceName string            `yaml:"service_name"`
+    // Share of new traces recorded; requests with a traceparent follow its sampled flag
+    SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// OIDCConfig configures single sign-on with an OpenID Connect issuer.
+type OIDCConfig struct {
+    Enabled      bool     `yaml:"enabled"`
+    Issuer       string   `yaml:"issuer"`
+    ClientID     string   `yaml:"client_id"`
+    ClientSecret string   `yaml:"client_secret"`
+    RedirectURL  string   `yaml:"redirect_url"` // default <request origin>/api/auth/oidc/callback
+    Scopes       []string `yaml:"scopes"`
+    Label        string   `yaml:"label"` // login button text
+    EmailClaim   string   `yaml:"email_claim"`
+    // Create users on first login; otherwise only existing users can sign in
+    AutoProvision bool   `yaml:"auto_provision"`
+    DefaultRole   string `yaml:"default_role"`
+    // Claims (dotted paths allowed) mapped to a role and a team on every login
+    RoleClaim   string            `yaml:"role_claim"`
+    RoleMapping []OIDCRoleMapping `yaml:"role_mapping"`
+    TeamClaim   string            `yaml:"team_claim"`
+    TeamMapping []OIDCTeamMapping `yaml:"team_mapping"`
+    // Reject password logins except for the break-glass user
+    DisablePasswordLogin bool   `yaml:"disable_password_login"`
+    BreakGlassUser       string `yaml:"break_glass_user"` // default admin.seed_user
+}
+
+// OIDCRoleMapping maps a claim value to a role; the first match wins.
+type OIDCRoleMapping struct {
+    Value string `yaml:"value"`
+    Role  string `yaml:"role"`
+}
+
+// OIDCTeamMapping maps a claim value to a team name; the first match wins.
+type OIDCTeamMapping struct {
+    Value string `yaml:"value"`
+    Team  string `yaml:"team"`
+}
+
+// LDAPConfig configures password login against an LDAP or Active Directory server.
+type LDAPConfig struct {
+    Enabled            bool   `yaml:"enabled"`
+    URL                string `yaml:"url"` // ldap://host:389 or ldaps://host:636
+    StartTLS           bool   `yaml:"start_tls"`
+    InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+    // Account used to search for users; empty binds anonymously
+    BindDN       string `yaml:"bind_dn"`
+    BindPassword string `yaml:"bind_password"`
+    BaseDN       string `yaml:"base_dn"`
+    // %s is replaced with the escaped login name
+    UserFilter     string `yaml:"user_filter"`
+    EmailAttribute string `yaml:"email_attribute"`
+    GroupAttribute string `yaml:"group_attribute"` // e.g. memberOf
+    // Optional group search for servers without memberOf; %s is the user's DN
+    GroupBaseDN string `yaml:"group_base_dn"`
+    GroupFilter string `yaml:"group_filter"`
+    // Group (DN or CN) to role; the first match wins
+    GroupMapping  []LDAPGroupMapping `yaml:"group_mapping"`
+    DefaultRole   string             `yaml:"default_role"`
+    AutoProvision bool               `yaml:"auto_provision"`
+    TimeoutSeconds      int `yaml:"timeout_seconds"`
+    SyncIntervalMinutes int `yaml:"sync_interval_minutes"` // 0 disables background sync
+}
+
+// LDAPGroupMapping maps a directory group to a role.
+type LDAPGroupMapping struct {
+    Group string `yaml:"group"`
+    Role  string `yaml:"role"`
 }
 
 func defaultConfig() *Config {
@@ -36,6 +195,33 @@ func defaultConfig() *Config {
     c.Database.SQLitePath = "data/app.db"
     c.Admin.SeedUser = "admin"
     c.Admin.SeedPassword = "admin"
+    c.Auth.SessionTTLHours = 24
+    c.Auth.Lockout = LockoutConfig{MaxFailures: 5, IPMaxFailures: 20, WindowMinutes: 15, LockoutMinutes: 15}
+    c.Auth.Password.MinLength = 8
+    c.Mail.Delivery = "display"
+    c.Mail.From = "LLM Router <noreply@localhost>"
+    c.Mail.SMTP.Port = 587
+    c.Mail.SMTP.TLS = "starttls"
+    c.Mail.InviteTTLHours = 72
+    c.Mail.ResetTTLMinutes = 60
+    c.Metrics.Enabled = true
+    c.Metrics.MaxSeries = 1000
+    c.Tracing.Exporter = "none"
+    c.Tracing.ServiceName = "llmrouter"
+    c.Tracing.SampleRatio = 1
+    c.OIDC.Scopes = []string{"openid", "email", "profile"}
+    c.OIDC.Label = "Single sign-on"
+    c.OIDC.EmailClaim = "email"
+    c.OIDC.AutoProvision = true
+    c.OIDC.DefaultRole = "user"
+    c.LDAP.UserFilter = "(uid=%s)"
+    c.LDAP.EmailAttribute = "mail"
+    c.LDAP.GroupAttribute = "memberOf"
+    c.LDAP.GroupFilter = "(|(member=%s)(uniqueMember=%s))"
+    c.LDAP.DefaultRole = "user"
+    c.LDAP.AutoProvision = true
+    c.LDAP.TimeoutSeconds = 10
+    c.LDAP.SyncIntervalMinutes = 15
     return c
 }
 
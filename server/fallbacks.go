@@ -1,6 +1,7 @@
 package server
 
 import (
+    "fmt"
     "net/http"
     "sort"
     "strings"
@@ -18,11 +19,11 @@ type fallbackReq struct {
 
 func registerFallbackRoutes(g *echo.Group) {
     ag := g.Group("/fallbacks")
-    ag.GET("", requireAdmin(blockAdminIfMustChange(listFallbacks)))
-    ag.POST("", requireAdmin(blockAdminIfMustChange(createFallback)))
-    ag.GET("/:id", requireAdmin(blockAdminIfMustChange(getFallback)))
-    ag.PUT("/:id", requireAdmin(blockAdminIfMustChange(updateFallback)))
-    ag.DELETE("/:id", requireAdmin(blockAdminIfMustChange(deleteFallback)))
+    ag.GET("", requirePermission(permRoutes, blockAdminIfMustChange(listFallbacks)))
+    ag.POST("", requirePermission(permRoutes, blockAdminIfMustChange(createFallback)))
+    ag.GET("/:id", requirePermission(permRoutes, blockAdminIfMustChange(getFallback)))
+    ag.PUT("/:id", requirePermission(permRoutes, blockAdminIfMustChange(updateFallback)))
+    ag.DELETE("/:id", requirePermission(permRoutes, blockAdminIfMustChange(deleteFallback)))
 }
 
 func listFallbacks(c echo.Context) error {
@@ -46,10 +47,13 @@ func createFallback(c echo.Context) error {
     }
     if len(req.Targets) > 0 {
         if err := replaceTargets(app, &r, req.Targets); err != nil {
+            // The route itself was still created
+            audit(c, "route.create", "route", r.ID, nil, auditRoute(r))
             return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
         }
     }
     _ = app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).First(&r, r.ID).Error
+    audit(c, "route.create", "route", r.ID, nil, auditRoute(r))
     return c.JSON(http.StatusCreated, r)
 }
 
@@ -65,9 +69,10 @@ func getFallback(c echo.Context) error {
 func updateFallback(c echo.Context) error {
     app := getApp(c)
     var r FallbackRoute
-    if err := app.DB.First(&r, c.Param("id")).Error; err != nil {
+    if err := app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).First(&r, c.Param("id")).Error; err != nil {
         return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
     }
+    before := auditRoute(r)
     var req fallbackReq
     if err := c.Bind(&req); err != nil {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
@@ -81,23 +86,40 @@ func updateFallback(c echo.Context) error {
     }
     if req.Targets != nil { // explicit replace
         if err := replaceTargets(app, &r, req.Targets); err != nil {
+            audit(c, "route.update", "route", r.ID, before, auditRoute(r))
             return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
         }
     }
     _ = app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).First(&r, r.ID).Error
+    audit(c, "route.update", "route", r.ID, before, auditRoute(r))
     return c.JSON(http.StatusOK, r)
 }
 
 func deleteFallback(c echo.Context) error {
     app := getApp(c)
     id := c.Param("id")
+    var r FallbackRoute
+    if err := app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).First(&r, id).Error; err != nil {
+        return c.NoContent(http.StatusNoContent) // already gone
+    }
     app.DB.Unscoped().Where("route_id = ?", id).Delete(&FallbackTarget{})
     if err := app.DB.Unscoped().Delete(&FallbackRoute{}, id).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    audit(c, "route.delete", "route", r.ID, auditRoute(r), nil)
     return c.NoContent(http.StatusNoContent)
 }
 
+// auditRoute is a route as audited: targets as "provider_id/model" in order,
+// since their row IDs change on every replace.
+func auditRoute(r FallbackRoute) echo.Map {
+    targets := make([]string, 0, len(r.Targets))
+    for _, t := range r.Targets {
+        targets = append(targets, fmt.Sprintf("%d/%s", t.ProviderID, t.Model))
+    }
+    return echo.Map{"name": r.Name, "enabled": r.Enabled, "targets": targets}
+}
+
 func replaceTargets(app *App, r *FallbackRoute, qualified []string) error {
     // Resolve qualified provider/model into ProviderID + raw model
     targets := make([]FallbackTarget, 0, len(qualified))
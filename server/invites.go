@@ -0,0 +1,301 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/labstack/echo/v4"
+)
+
+const (
+    purposeInvite = "invite"
+    purposeReset  = "reset"
+)
+
+// One self-service reset email per account per resetCooldown.
+const resetCooldown = 5 * time.Minute
+
+var errTokenInvalid = errors.New("this link is invalid or has expired")
+
+// passwordTokenClaims is an invite or reset link. State fingerprints the
+// account as it was when the link was made, so setting a password (or
+// re-sending the invite) spends every outstanding link.
+type passwordTokenClaims struct {
+    UserID  uint   `json:"user_id"`
+    Purpose string `json:"purpose"`
+    State   string `json:"state"`
+    jwt.RegisteredClaims
+}
+
+type passwordTokenReq struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+// resetLimiter remembers when each account last got a self-service reset email.
+type resetLimiter struct {
+    mu   sync.Mutex
+    sent map[uint]time.Time
+}
+
+func newResetLimiter() *resetLimiter {
+    return &resetLimiter{sent: map[uint]time.Time{}}
+}
+
+// allow reports whether userID may be sent another reset email now.
+func (l *resetLimiter) allow(userID uint) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    for id, t := range l.sent {
+        if now.Sub(t) > resetCooldown {
+            delete(l.sent, id)
+        }
+    }
+    if _, ok := l.sent[userID]; ok {
+        return false
+    }
+    l.sent[userID] = now
+    return true
+}
+
+func registerInviteRoutes(g *echo.Group) {
+    g.POST("/auth/password-reset", handleRequestPasswordReset)
+    g.GET("/auth/password-token", handleCheckPasswordToken)
+    g.POST("/auth/password-token", handleUsePasswordToken)
+    g.POST("/users/:id/invite", requirePermission(permUsers, blockAdminIfMustChange(adminResendInvite)))
+    g.POST("/users/:id/password-reset", requirePermission(permUsers, blockAdminIfMustChange(adminPasswordReset)))
+}
+
+func passwordTokenState(app *App, u *User) string {
+    mac := hmac.New(sha256.New, derivedKey(app, "password-token-state"))
+    invited := ""
+    // Whole seconds: databases keep different precision than time.Now
+    if u.InvitedAt != nil { invited = strconv.FormatInt(u.InvitedAt.Unix(), 10) }
+    mac.Write([]byte(u.Email + "\x00" + u.PasswordHash + "\x00" + invited))
+    return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+func passwordTokenTTL(app *App, purpose string) time.Duration {
+    cfg := app.Config.Mail
+    if purpose == purposeInvite {
+        if cfg.InviteTTLHours > 0 { return time.Duration(cfg.InviteTTLHours) * time.Hour }
+        return 72 * time.Hour
+    }
+    if cfg.ResetTTLMinutes > 0 { return time.Duration(cfg.ResetTTLMinutes) * time.Minute }
+    return time.Hour
+}
+
+func signPasswordToken(app *App, u *User, purpose string) (string, time.Time, error) {
+    exp := time.Now().Add(passwordTokenTTL(app, purpose))
+    claims := passwordTokenClaims{UserID: u.ID, Purpose: purpose, State: passwordTokenState(app, u), RegisteredClaims: jwt.RegisteredClaims{
+        ExpiresAt: jwt.NewNumericDate(exp),
+    }}
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString(derivedKey(app, "password-token"))
+    return token, exp, err
+}
+
+// parsePasswordToken returns the user a live link is for.
+func parsePasswordToken(app *App, token string) (*User, *passwordTokenClaims, error) {
+    var claims passwordTokenClaims
+    if _, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+        return derivedKey(app, "password-token"), nil
+    }, jwt.WithValidMethods([]string{"HS256"})); err != nil {
+        return nil, nil, errTokenInvalid
+    }
+    var u User
+    if err := app.DB.First(&u, claims.UserID).Error; err != nil || u.Disabled || !passwordResettable(&u) {
+        return nil, nil, errTokenInvalid
+    }
+    if !hmac.Equal([]byte(claims.State), []byte(passwordTokenState(app, &u))) {
+        return nil, nil, errTokenInvalid
+    }
+    return &u, &claims, nil
+}
+
+// passwordResettable reports whether u's password is kept here. Directory and
+// single sign-on accounts get theirs elsewhere; service accounts have none.
+func passwordResettable(u *User) bool {
+    return !u.ServiceAccount && u.LDAPDN == "" && u.OIDCSubject == ""
+}
+
+// linkBase is where links point: mail.base_url, or for an admin's request the
+// origin the console was reached on.
+func linkBase(c echo.Context, app *App) string {
+    if b := app.Config.Mail.BaseURL; b != "" {
+        return strings.TrimRight(b, "/")
+    }
+    return c.Scheme() + "://" + c.Request().Host
+}
+
+// sendPasswordLink mails u an invite or reset link. Without a mailer the link
+// is returned instead, for the admin to pass on.
+func sendPasswordLink(app *App, base string, u *User, purpose string) (echo.Map, error) {
+    token, exp, err := signPasswordToken(app, u, purpose)
+    if err != nil {
+        return nil, err
+    }
+    link := base + "/set-password?token=" + token
+    if app.mailer == nil {
+        return echo.Map{"link": link, "expires_at": exp}, nil
+    }
+    msg := mailMessage{To: u.Email, UserID: u.ID, Link: link, ExpiresAt: exp}
+    expires := exp.UTC().Format("2006-01-02 15:04 MST")
+    if purpose == purposeInvite {
+        msg.Event, msg.Subject = "account.invite", "You have been invited to LLM Router"
+        msg.Body = fmt.Sprintf("An account has been created for you on LLM Router.\n\nChoose a password to sign in:\n%s\n\nThe link expires %s.\n", link, expires)
+    } else {
+        msg.Event, msg.Subject = "account.password_reset", "Reset your LLM Router password"
+        msg.Body = fmt.Sprintf("Someone asked to reset the password for %s on LLM Router.\n\nChoose a new password:\n%s\n\nThe link expires %s. If you didn't ask for this, ignore this email.\n", u.Email, link, expires)
+    }
+    if err := app.mailer.send(msg); err != nil {
+        return nil, err
+    }
+    return echo.Map{"sent": true, "expires_at": exp}, nil
+}
+
+// inviteUser marks u as invited, spending any earlier invite, and sends the link.
+func inviteUser(c echo.Context, app *App, u *User) (echo.Map, error) {
+    now := time.Now()
+    u.InvitedAt = &now
+    if err := app.DB.Model(&User{}).Where("id = ?", u.ID).Update("invited_at", now).Error; err != nil {
+        return nil, err
+    }
+    return sendPasswordLink(app, linkBase(c, app), u, purposeInvite)
+}
+
+func adminResendInvite(c echo.Context) error {
+    app := getApp(c)
+    var u User
+    if err := app.DB.First(&u, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    // Without a mailer the link comes back to the caller, who could use it
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    if !passwordResettable(&u) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "user has no local password"})
+    }
+    if u.PasswordHash != "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "user has already set a password"})
+    }
+    out, err := inviteUser(c, app, &u)
+    if err != nil {
+        return c.JSON(http.StatusBadGateway, echo.Map{"error": "invite not sent: " + err.Error()})
+    }
+    audit(c, "user.invite", "user", u.ID, nil, nil)
+    return c.JSON(http.StatusOK, out)
+}
+
+func adminPasswordReset(c echo.Context) error {
+    app := getApp(c)
+    var u User
+    if err := app.DB.First(&u, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    // Without a mailer the link comes back to the caller, who could use it
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    if !passwordResettable(&u) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "user has no local password"})
+    }
+    out, err := sendPasswordLink(app, linkBase(c, app), &u, purposeReset)
+    if err != nil {
+        return c.JSON(http.StatusBadGateway, echo.Map{"error": "reset link not sent: " + err.Error()})
+    }
+    audit(c, "user.password_reset_link", "user", u.ID, nil, nil)
+    return c.JSON(http.StatusOK, out)
+}
+
+// handleRequestPasswordReset emails a reset link. It answers the same whether
+// or not the account exists, and sends in the background so timing doesn't
+// tell either.
+func handleRequestPasswordReset(c echo.Context) error {
+    app := getApp(c)
+    var req struct {
+        Email string `json:"email"`
+    }
+    if err := c.Bind(&req); err != nil || req.Email == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if !selfServiceReset(app) {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "password reset is not enabled"})
+    }
+    if wait := app.logins.blocked(c.RealIP()); wait > 0 {
+        return tooManyLogins(c, wait, "too many failed logins, try again later")
+    }
+    email := strings.ToLower(strings.TrimSpace(req.Email))
+    var u User
+    if err := app.DB.Where("email = ?", email).First(&u).Error; err == nil && !u.Disabled && u.PasswordHash != "" &&
+        passwordResettable(&u) && passwordLoginAllowed(app, u.Email) && app.resets.allow(u.ID) {
+        base := linkBase(c, app)
+        go func() {
+            if _, err := sendPasswordLink(app, base, &u, purposeReset); err != nil {
+                log.Printf("password reset: mail to user %d: %v", u.ID, err)
+            }
+        }()
+    }
+    return c.NoContent(http.StatusAccepted)
+}
+
+// selfServiceReset reports whether users can ask for reset links themselves:
+// that needs a mailer, and a fixed base URL so a forged Host header can't
+// point the link elsewhere.
+func selfServiceReset(app *App) bool {
+    return app.mailer != nil && app.Config.Mail.BaseURL != ""
+}
+
+// handleCheckPasswordToken lets the set-password page show whose link it is.
+func handleCheckPasswordToken(c echo.Context) error {
+    u, claims, err := parsePasswordToken(getApp(c), c.QueryParam("token"))
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    return c.JSON(http.StatusOK, echo.Map{"email": u.Email, "purpose": claims.Purpose, "expires_at": claims.ExpiresAt.Time})
+}
+
+// handleUsePasswordToken sets the password from an invite or reset link. The
+// user then signs in as usual, with two-factor if they have it.
+func handleUsePasswordToken(c echo.Context) error {
+    app := getApp(c)
+    var req passwordTokenReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    u, claims, err := parsePasswordToken(app, req.Token)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if err := app.passwords.check(req.Password); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": app.passwords.errorCode(err), "message": err.Error()})
+    }
+    before := *u
+    if err := u.SetPassword(req.Password); err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "hash error"})
+    }
+    u.MustChangePassword, u.InvitedAt, u.FailedLogins, u.LockedUntil = false, nil, 0, nil
+    if err := app.DB.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]any{
+        "password_hash": u.PasswordHash, "must_change_password": false, "invited_at": nil, "failed_logins": 0, "locked_until": nil,
+    }).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    revokeSessions(app, u.ID, "")
+    // The link stands in for a login, so the event is the user's own
+    c.Set("user", u)
+    action := "user.password_reset"
+    if claims.Purpose == purposeInvite { action = "user.invite_accept" }
+    audit(c, action, "user", u.ID, before, u, "password")
+    return c.NoContent(http.StatusNoContent)
+}
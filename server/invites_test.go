@@ -0,0 +1,47 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+
+    "github.com/labstack/echo/v4"
+)
+
+func TestPasswordLinksNeedTargetRole(t *testing.T) {
+    tests := []struct {
+        name     string
+        handler  echo.HandlerFunc
+        role     string
+        password bool // the target has already set one
+        want     int
+    }{
+        {name: "reset link for admin", handler: adminPasswordReset, role: "admin", password: true, want: http.StatusForbidden},
+        {name: "invite for admin", handler: adminResendInvite, role: "admin", want: http.StatusForbidden},
+        {name: "reset link for user", handler: adminPasswordReset, role: "user", password: true, want: http.StatusOK},
+        {name: "invite for user", handler: adminResendInvite, role: "user", want: http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApp(t)
+            app.JWTSecret = []byte("test-secret")
+            helpdesk := newTestUser(t, app, "helpdesk@example.org", "helpdesk", permUsers)
+            target := &User{Email: "target@example.org", Role: tt.role}
+            if tt.password { target.SetPassword("Initial-pass-123") }
+            if err := app.DB.Create(target).Error; err != nil {
+                t.Fatal(err)
+            }
+            // No mailer is configured, so a link comes back in the response
+            rec := callAs(app, helpdesk, tt.handler, http.MethodPost, "", "id", strconv.Itoa(int(target.ID)))
+            if rec.Code != tt.want {
+                t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+            }
+            var out map[string]any
+            json.Unmarshal(rec.Body.Bytes(), &out)
+            if _, ok := out["link"]; ok != (tt.want == http.StatusOK) {
+                t.Errorf("response = %s", rec.Body)
+            }
+        })
+    }
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// How often pending last-used updates are written.
+const keyUsageFlushInterval = 10 * time.Second
+
+type keyUse struct {
+    at time.Time
+    ip string
+}
+
+// keyUsageTracker batches last-used updates so authenticating a request
+// never waits on a database write.
+type keyUsageTracker struct {
+    mu      sync.Mutex
+    app     *App
+    pending map[uint]keyUse
+}
+
+func newKeyUsageTracker(app *App) *keyUsageTracker {
+    t := &keyUsageTracker{app: app, pending: map[uint]keyUse{}}
+    go func() {
+        for range time.Tick(keyUsageFlushInterval) {
+            t.flush()
+        }
+    }()
+    return t
+}
+
+// touch records that a key was used just now from ip.
+func (t *keyUsageTracker) touch(keyID uint, ip string) {
+    t.mu.Lock()
+    t.pending[keyID] = keyUse{at: time.Now(), ip: ip}
+    t.mu.Unlock()
+}
+
+func (t *keyUsageTracker) flush() {
+    t.mu.Lock()
+    batch := t.pending
+    t.pending = map[uint]keyUse{}
+    t.mu.Unlock()
+    for id, u := range batch {
+        // UpdateColumns keeps updated_at for real edits
+        err := t.app.DB.Model(&APIKey{}).Where("id = ?", id).
+            UpdateColumns(map[string]any{"last_used_at": u.at, "last_used_ip": u.ip}).Error
+        if err != nil {
+            log.Printf("key usage: update key %d: %v", id, err)
+        }
+    }
+}
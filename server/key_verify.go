@@ -0,0 +1,114 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Keys are random 192-bit secrets, so a keyed SHA-256 is enough to store them;
+// bcrypt hashes from before this scheme are migrated on their next use.
+const keyHashScheme = "hmac-sha256:"
+
+// How long a validated key is served from memory before it is re-read.
+const keyCacheTTL = 30 * time.Second
+
+// Entries beyond this trigger a sweep of expired ones.
+const keyCacheSweepAt = 10000
+
+// hashAPIKey returns the stored form of a key value.
+func hashAPIKey(app *App, token string) string {
+    mac := hmac.New(sha256.New, app.KeySecret)
+    mac.Write([]byte(token))
+    return keyHashScheme + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkAPIKeyHash compares a key value with a stored hash; legacy reports a
+// bcrypt hash that should be replaced.
+func checkAPIKeyHash(app *App, stored, token string) (ok, legacy bool) {
+    if stored == "" {
+        return false, false
+    }
+    if strings.HasPrefix(stored, keyHashScheme) {
+        return hmac.Equal([]byte(stored), []byte(hashAPIKey(app, token))), false
+    }
+    return bcrypt.CompareHashAndPassword([]byte(stored), []byte(token)) == nil, true
+}
+
+type keyCacheEntry struct {
+    user    User
+    key     APIKey
+    prev    bool // matched the secret replaced by the last rotation
+    expires time.Time
+}
+
+// keyCache holds recently validated keys by hash, so most requests skip the
+// database. Anything that changes a key or its user must invalidate it.
+type keyCache struct {
+    mu      sync.Mutex
+    entries map[string]keyCacheEntry
+}
+
+func newKeyCache() *keyCache {
+    return &keyCache{entries: map[string]keyCacheEntry{}}
+}
+
+func (kc *keyCache) get(hash string) (keyCacheEntry, bool) {
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+    e, ok := kc.entries[hash]
+    if !ok || time.Now().After(e.expires) {
+        return keyCacheEntry{}, false
+    }
+    return e, true
+}
+
+func (kc *keyCache) put(hash string, e keyCacheEntry) {
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+    now := time.Now()
+    if len(kc.entries) >= keyCacheSweepAt {
+        for h, old := range kc.entries {
+            if now.After(old.expires) {
+                delete(kc.entries, h)
+            }
+        }
+    }
+    e.expires = now.Add(keyCacheTTL)
+    kc.entries[hash] = e
+}
+
+func (kc *keyCache) invalidateKey(keyID uint) {
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+    for h, e := range kc.entries {
+        if e.key.ID == keyID {
+            delete(kc.entries, h)
+        }
+    }
+}
+
+func (kc *keyCache) invalidateTeam(teamID uint) {
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+    for h, e := range kc.entries {
+        if e.key.TeamID == teamID || e.user.TeamID == teamID {
+            delete(kc.entries, h)
+        }
+    }
+}
+
+func (kc *keyCache) invalidateUser(userID uint) {
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+    for h, e := range kc.entries {
+        if e.user.ID == userID {
+            delete(kc.entries, h)
+        }
+    }
+}
@@ -3,31 +3,67 @@ package server
 import (
     "crypto/rand"
     "encoding/hex"
+    "errors"
     "fmt"
     "net/http"
+    "strconv"
     "strings"
+    "time"
 
     "github.com/labstack/echo/v4"
-    "golang.org/x/crypto/bcrypt"
 )
 
 type keyCreateReq struct {
     Name string `json:"name"`
+    // Optional restrictions; only an admin can change them later
+    AllowedModels    []string   `json:"allowed_models"`
+    AllowedEndpoints []string   `json:"allowed_endpoints"`
+    ExpiresAt        *time.Time `json:"expires_at"`
 }
 
 type keyCreateResp struct {
-    ID    uint   `json:"id"`
-    Name  string `json:"name"`
-    Value string `json:"value"` // shown once
+    ID        uint       `json:"id"`
+    Name      string     `json:"name"`
+    Value     string     `json:"value"` // shown once
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
+type keyRotateReq struct {
+    // How long the old secret keeps working; default defaultRotateGrace
+    GraceSeconds *int `json:"grace_seconds"`
+}
+
+type keyRotateResp struct {
+    ID            uint       `json:"id"`
+    Value         string     `json:"value"` // shown once
+    PrevExpiresAt *time.Time `json:"prev_expires_at"`
+}
+
+// inactiveKey is a key in the admin inactive view.
+type inactiveKey struct {
+    APIKey
+    UserEmail string `json:"user_email"`
+    Expired   bool   `json:"expired"`
+}
+
+// Rotation grace period bounds.
+const (
+    defaultRotateGrace = 24 * time.Hour
+    maxRotateGrace     = 30 * 24 * time.Hour
+)
+
+// errKeyExpired is returned for a key (or a rotated-out secret) past its expiry.
+var errKeyExpired = errors.New("api key expired")
+
 func registerKeyRoutes(g *echo.Group) {
     g.GET("/keys", requireAuth(blockAdminIfMustChange(listMyKeys)))
     g.POST("/keys", requireAuth(blockAdminIfMustChange(createKey)))
     g.DELETE("/keys/:id", requireAuth(blockAdminIfMustChange(deleteKey)))
+    g.POST("/keys/:id/rotate", requireAuth(blockAdminIfMustChange(rotateKey)))
 
     ag := g.Group("/admin")
-    ag.GET("/users/:id/keys", requireAdmin(blockAdminIfMustChange(adminListUserKeys)))
+    ag.GET("/users/:id/keys", requirePermission(permUsers, blockAdminIfMustChange(adminListUserKeys)))
+    ag.GET("/keys/inactive", requirePermission(permUsers, blockAdminIfMustChange(adminListInactiveKeys)))
 }
 
 func listMyKeys(c echo.Context) error {
@@ -50,21 +86,80 @@ func createKey(c echo.Context) error {
     if err := c.Bind(&req); err != nil {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
     }
-    // generate random key
+    return issueKey(c, app, u, 0, req)
+}
+
+// issueKey creates a key for u, owned by teamID when non-zero.
+func issueKey(c echo.Context, app *App, u *User, teamID uint, req keyCreateReq) error {
+    scopes, err := normalizeScopes(scopesReq{AllowedModels: req.AllowedModels, AllowedEndpoints: req.AllowedEndpoints})
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "expires_at must be in the future"})
+    }
+    prefix, value, err := newKeySecret("")
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "rng error"})
+    }
+    key := APIKey{UserID: u.ID, Name: strings.TrimSpace(req.Name), Prefix: prefix, Hash: hashAPIKey(app, value), TeamID: teamID, Scopes: scopes, ExpiresAt: req.ExpiresAt}
+    if err := app.DB.Create(&key).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "key.create", "api_key", key.ID, nil, key)
+    return c.JSON(http.StatusCreated, keyCreateResp{ID: key.ID, Name: key.Name, Value: value, ExpiresAt: key.ExpiresAt})
+}
+
+// newKeySecret generates a key value. An empty prefix starts a new key;
+// rotation passes the existing prefix so lookups keep working.
+func newKeySecret(prefix string) (string, string, error) {
     raw := make([]byte, 24)
     if _, err := rand.Read(raw); err != nil {
-        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "rng error"})
+        return "", "", err
     }
     body := hex.EncodeToString(raw)
-    prefix := "sk_" + body[:8]
-    value := fmt.Sprintf("%s_%s", prefix, body[8:])
-    h, _ := bcrypt.GenerateFromPassword([]byte(value), bcrypt.DefaultCost)
+    if prefix == "" {
+        prefix = "sk_" + body[:8]
+    }
+    return prefix, fmt.Sprintf("%s_%s", prefix, body[8:]), nil
+}
 
-    key := APIKey{UserID: u.ID, Name: strings.TrimSpace(req.Name), Prefix: prefix, Hash: string(h)}
-    if err := app.DB.Create(&key).Error; err != nil {
+// rotateKey issues a new secret for a key; the old one keeps working for the grace period.
+func rotateKey(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    var key APIKey
+    if err := app.DB.Where("id = ? AND user_id = ?", c.Param("id"), u.ID).First(&key).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req keyRotateReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    grace := defaultRotateGrace
+    if req.GraceSeconds != nil {
+        grace = time.Duration(*req.GraceSeconds) * time.Second
+    }
+    if grace < 0 || grace > maxRotateGrace {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid grace_seconds"})
+    }
+    _, value, err := newKeySecret(key.Prefix)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "rng error"})
+    }
+    before := key
+    prevUntil := time.Now().Add(grace)
+    key.PrevHash, key.PrevExpiresAt = key.Hash, &prevUntil
+    if grace == 0 {
+        key.PrevHash, key.PrevExpiresAt = "", nil
+    }
+    key.Hash = hashAPIKey(app, value)
+    if err := app.DB.Save(&key).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
-    return c.JSON(http.StatusCreated, keyCreateResp{ID: key.ID, Name: key.Name, Value: value})
+    app.keyCache.invalidateKey(key.ID)
+    audit(c, "key.rotate", "api_key", key.ID, before, key, "key")
+    return c.JSON(http.StatusOK, keyRotateResp{ID: key.ID, Value: value, PrevExpiresAt: key.PrevExpiresAt})
 }
 
 func deleteKey(c echo.Context) error {
@@ -72,9 +167,17 @@ func deleteKey(c echo.Context) error {
     u := c.Get("user").(*User)
     id := c.Param("id")
     // ensure ownership
-    if err := app.DB.Where("id = ? AND user_id = ?", id, u.ID).Delete(&APIKey{}).Error; err != nil {
+    var key APIKey
+    if err := app.DB.Where("id = ? AND user_id = ?", id, u.ID).First(&key).Error; err != nil {
+        return c.NoContent(http.StatusNoContent) // already gone
+    }
+    if err := app.DB.Delete(&key).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    audit(c, "key.delete", "api_key", key.ID, key, nil)
+    if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+        app.keyCache.invalidateKey(uint(n))
+    }
     return c.NoContent(http.StatusNoContent)
 }
 
@@ -91,21 +194,88 @@ func adminListUserKeys(c echo.Context) error {
     return c.JSON(http.StatusOK, keys)
 }
 
+// adminListInactiveKeys lists keys unused for ?days= (default 30), oldest first, including expired keys.
+func adminListInactiveKeys(c echo.Context) error {
+    app := getApp(c)
+    days := 30
+    if v := c.QueryParam("days"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid days"})
+        }
+        days = n
+    }
+    now := time.Now()
+    cutoff := now.AddDate(0, 0, -days)
+    var keys []APIKey
+    err := app.DB.Where("(last_used_at IS NULL AND created_at < ?) OR last_used_at < ? OR expires_at < ?", cutoff, cutoff, now).
+        Order("last_used_at ASC, id ASC").Find(&keys).Error
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    emails := map[uint]string{}
+    var users []User
+    app.DB.Select("id", "email").Find(&users)
+    for _, u := range users {
+        emails[u.ID] = u.Email
+    }
+    out := make([]inactiveKey, 0, len(keys))
+    for _, k := range keys {
+        k.Hash = ""
+        out = append(out, inactiveKey{APIKey: k, UserEmail: emails[k.UserID], Expired: k.ExpiresAt != nil && k.ExpiresAt.Before(now)})
+    }
+    return c.JSON(http.StatusOK, out)
+}
+
+// keyExpired answers 401 with a code clients can act on by rotating.
+func keyExpired(c echo.Context) error {
+    return c.JSON(http.StatusUnauthorized, echo.Map{"error": echo.Map{
+        "message": "This API key has expired. Create or rotate a key.",
+        "type":    "invalid_request_error",
+        "param":   nil,
+        "code":    "api_key_expired",
+    }})
+}
+
 // API key validation for /api/v1 endpoints
-func validateAPIKey(app *App, token string) (*User, *APIKey, error) {
+func validateAPIKey(app *App, token, ip string) (*User, *APIKey, error) {
     // token like sk_xxx_yyyy
     parts := strings.SplitN(token, "_", 3)
     if len(parts) < 2 {
         return nil, nil, echo.ErrUnauthorized
     }
     prefix := strings.Join(parts[:2], "_") // keep sk_xxx
+    hash := hashAPIKey(app, token)
+    now := time.Now()
+    if e, ok := app.keyCache.get(hash); ok {
+        if err := checkKeyExpiry(e.key, e.prev, now); err != nil {
+            return nil, nil, err
+        }
+        app.keyUsage.touch(e.key.ID, ip)
+        // Copies, so callers can't change the cached entry
+        return &e.user, &e.key, nil
+    }
     var key APIKey
     if err := app.DB.Where("prefix = ?", prefix).First(&key).Error; err != nil {
         return nil, nil, echo.ErrUnauthorized
     }
-    if bcrypt.CompareHashAndPassword([]byte(key.Hash), []byte(token)) != nil {
+    ok, legacy := checkAPIKeyHash(app, key.Hash, token)
+    column, prev := "hash", false
+    if !ok {
+        // The secret replaced by the last rotation works until its grace period ends
+        ok, legacy = checkAPIKeyHash(app, key.PrevHash, token)
+        column, prev = "prev_hash", true
+    }
+    if !ok {
         return nil, nil, echo.ErrUnauthorized
     }
+    if legacy {
+        // Replace the bcrypt hash now that we know the value
+        app.DB.Model(&APIKey{}).Where("id = ?", key.ID).UpdateColumn(column, hash)
+    }
+    if err := checkKeyExpiry(key, prev, now); err != nil {
+        return nil, nil, err
+    }
     var user User
     if err := app.DB.First(&user, key.UserID).Error; err != nil {
         return nil, nil, echo.ErrUnauthorized
@@ -113,5 +283,18 @@ func validateAPIKey(app *App, token string) (*User, *APIKey, error) {
     if user.Disabled {
         return nil, nil, echo.ErrForbidden
     }
+    app.keyCache.put(hash, keyCacheEntry{user: user, key: key, prev: prev})
+    app.keyUsage.touch(key.ID, ip)
     return &user, &key, nil
 }
+
+// checkKeyExpiry rejects an expired key, or a rotated-out secret past its grace period.
+func checkKeyExpiry(key APIKey, prev bool, now time.Time) error {
+    if prev && (key.PrevExpiresAt == nil || !now.Before(*key.PrevExpiresAt)) {
+        return errKeyExpired
+    }
+    if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+        return errKeyExpired
+    }
+    return nil
+}
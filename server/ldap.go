@@ -0,0 +1,280 @@
+package server
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// errInvalidCredentials is a failed password login, whichever backend checked it.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// errDirectoryUnavailable means the LDAP server could not be asked.
+var errDirectoryUnavailable = errors.New("directory unavailable")
+
+// Attributes that mark an account disabled in common directories.
+const (
+    adUserAccountControl = "userAccountControl" // Active Directory, bit 0x2
+    nsAccountLock        = "nsAccountLock"       // 389 DS / FreeIPA
+    pwdAccountLocked     = "pwdAccountLockedTime" // OpenLDAP ppolicy
+)
+
+// ldapAuth authenticates users against the configured directory.
+type ldapAuth struct {
+    cfg LDAPConfig
+    tls *tls.Config
+}
+
+func newLDAPAuth(cfg LDAPConfig) (*ldapAuth, error) {
+    if cfg.URL == "" || cfg.BaseDN == "" {
+        return nil, fmt.Errorf("ldap: url and base_dn are required")
+    }
+    if _, err := compileLDAPFilter(strings.ReplaceAll(cfg.UserFilter, "%s", "x")); err != nil {
+        return nil, fmt.Errorf("ldap: user_filter: %w", err)
+    }
+    if cfg.TimeoutSeconds <= 0 { cfg.TimeoutSeconds = 10 }
+    return &ldapAuth{cfg: cfg, tls: &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}}, nil
+}
+
+// ldapAccount is what the directory says about a user.
+type ldapAccount struct {
+    DN       string
+    Email    string
+    Groups   []string
+    Disabled bool
+}
+
+// passwordLogin checks a login against local accounts first, then the directory.
+// Local accounts are those without an LDAP DN; they keep using their own password.
+func passwordLogin(app *App, login, password string) (*User, error) {
+    var u User
+    if app.DB.Where("email = ?", login).First(&u).Error == nil && u.LDAPDN == "" {
+        if u.Disabled || u.ServiceAccount || !u.CheckPassword(password) {
+            return nil, errInvalidCredentials
+        }
+        return &u, nil
+    }
+    if app.ldap == nil {
+        return nil, errInvalidCredentials
+    }
+    acct, err := app.ldap.authenticate(login, password)
+    if err != nil {
+        return nil, err
+    }
+    return syncLDAPUser(app, acct, true)
+}
+
+func (l *ldapAuth) dial() (*ldapConn, error) {
+    conn, err := dialLDAP(l.cfg.URL, l.cfg.StartTLS, l.tls, time.Duration(l.cfg.TimeoutSeconds)*time.Second)
+    if err != nil {
+        return nil, err
+    }
+    if err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("service bind: %w", err)
+    }
+    return conn, nil
+}
+
+func (l *ldapAuth) attributes() []string {
+    return []string{l.cfg.EmailAttribute, l.cfg.GroupAttribute, adUserAccountControl, nsAccountLock, pwdAccountLocked}
+}
+
+// authenticate finds the user's entry with the service account, then binds as
+// the user to check the password.
+func (l *ldapAuth) authenticate(login, password string) (*ldapAccount, error) {
+    if login == "" || password == "" {
+        return nil, errInvalidCredentials
+    }
+    conn, err := l.dial()
+    if err != nil {
+        log.Printf("ldap: %v", err)
+        return nil, errDirectoryUnavailable
+    }
+    defer conn.Close()
+    filter := strings.ReplaceAll(l.cfg.UserFilter, "%s", escapeLDAPValue(login))
+    entries, err := conn.Search(l.cfg.BaseDN, 2, filter, l.attributes())
+    if err != nil {
+        log.Printf("ldap: search: %v", err)
+        return nil, errDirectoryUnavailable
+    }
+    if len(entries) != 1 {
+        // None, or an ambiguous filter; either way nobody to bind as
+        return nil, errInvalidCredentials
+    }
+    acct, err := l.account(conn, entries[0])
+    if err != nil {
+        return nil, err
+    }
+    if err := conn.Bind(acct.DN, password); err != nil {
+        if ldapResultCode(err) == ldapInvalidCredentials {
+            return nil, errInvalidCredentials
+        }
+        log.Printf("ldap: bind %s: %v", acct.DN, err)
+        return nil, errDirectoryUnavailable
+    }
+    if acct.Email == "" { acct.Email = login }
+    return acct, nil
+}
+
+// lookup re-reads a known entry; nil means it no longer exists.
+func (l *ldapAuth) lookup(conn *ldapConn, dn string) (*ldapAccount, error) {
+    entries, err := conn.Search(dn, 0, "(objectClass=*)", l.attributes())
+    if ldapResultCode(err) == ldapNoSuchObject {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if len(entries) == 0 {
+        return nil, nil
+    }
+    return l.account(conn, entries[0])
+}
+
+func (l *ldapAuth) account(conn *ldapConn, e ldapEntry) (*ldapAccount, error) {
+    acct := &ldapAccount{DN: e.DN, Email: strings.ToLower(strings.TrimSpace(e.first(l.cfg.EmailAttribute)))}
+    acct.Groups = e.Attrs[strings.ToLower(l.cfg.GroupAttribute)]
+    if l.cfg.GroupBaseDN != "" {
+        filter := strings.ReplaceAll(l.cfg.GroupFilter, "%s", escapeLDAPValue(e.DN))
+        groups, err := conn.Search(l.cfg.GroupBaseDN, 2, filter, []string{"cn"})
+        if err != nil {
+            return nil, fmt.Errorf("group search: %w", err)
+        }
+        for _, g := range groups {
+            acct.Groups = append(acct.Groups, g.DN)
+        }
+    }
+    if uac, err := strconv.Atoi(e.first(adUserAccountControl)); err == nil && uac&2 != 0 {
+        acct.Disabled = true
+    }
+    if strings.EqualFold(e.first(nsAccountLock), "true") || e.first(pwdAccountLocked) != "" {
+        acct.Disabled = true
+    }
+    return acct, nil
+}
+
+// mapGroups returns the role for the first mapping matching one of groups,
+// by full DN or by the group's CN, case-insensitively.
+func (l *ldapAuth) mapGroups(groups []string) string {
+    for _, m := range l.cfg.GroupMapping {
+        for _, g := range groups {
+            if strings.EqualFold(g, m.Group) || strings.EqualFold(groupCN(g), m.Group) {
+                return m.Role
+            }
+        }
+    }
+    return ""
+}
+
+// groupCN returns the value of a DN's first RDN, e.g. "admins" for "cn=admins,ou=groups,…".
+func groupCN(dn string) string {
+    rdn, _, _ := strings.Cut(dn, ",")
+    _, v, ok := strings.Cut(rdn, "=")
+    if !ok {
+        return ""
+    }
+    return strings.TrimSpace(v)
+}
+
+// syncLDAPUser applies a directory account to its local user, creating it on
+// login when auto-provisioning is on. A directory-disabled account is disabled
+// locally; re-enabling it is left to an admin.
+func syncLDAPUser(app *App, acct *ldapAccount, login bool) (*User, error) {
+    cfg := app.ldap.cfg
+    var u User
+    err := app.DB.Where("ldap_dn = ?", acct.DN).First(&u).Error
+    if err != nil && login {
+        // An LDAP user whose DN changed (renamed or moved) is matched by email
+        err = app.DB.Where("email = ? AND ldap_dn <> ''", acct.Email).First(&u).Error
+    }
+    if err != nil {
+        if !login || !cfg.AutoProvision {
+            return nil, errInvalidCredentials
+        }
+        u = User{Email: acct.Email, Role: cfg.DefaultRole}
+    }
+    if u.ServiceAccount {
+        return nil, errInvalidCredentials
+    }
+    u.LDAPDN = acct.DN
+    prevRole, prevDisabled := u.Role, u.Disabled
+    if len(cfg.GroupMapping) > 0 {
+        u.Role = cfg.DefaultRole
+        if role := app.ldap.mapGroups(acct.Groups); role != "" {
+            u.Role = role
+        }
+    }
+    if !roleExists(app, u.Role) {
+        log.Printf("ldap: role %q for %s does not exist, keeping %q", u.Role, acct.DN, prevRole)
+        u.Role = prevRole
+        if !roleExists(app, u.Role) {
+            return nil, errInvalidCredentials
+        }
+    }
+    if acct.Disabled {
+        u.Disabled = true
+    }
+    if err := app.DB.Save(&u).Error; err != nil {
+        return nil, err
+    }
+    if u.Role != prevRole || u.Disabled != prevDisabled {
+        app.keyCache.invalidateUser(u.ID)
+        revokeSessions(app, u.ID, "")
+    }
+    if u.Disabled {
+        return nil, errInvalidCredentials
+    }
+    return &u, nil
+}
+
+// startLDAPSync periodically re-reads every LDAP-backed user, so removals,
+// disabled accounts and group changes apply to API keys without a login.
+func startLDAPSync(app *App) {
+    every := time.Duration(app.ldap.cfg.SyncIntervalMinutes) * time.Minute
+    if every <= 0 {
+        return
+    }
+    go func() {
+        for range time.Tick(every) {
+            if err := syncLDAPUsers(app); err != nil {
+                log.Printf("ldap: sync: %v", err)
+            }
+        }
+    }()
+}
+
+func syncLDAPUsers(app *App) error {
+    var users []User
+    if err := app.DB.Where("ldap_dn <> '' AND disabled = ?", false).Find(&users).Error; err != nil {
+        return err
+    }
+    if len(users) == 0 {
+        return nil
+    }
+    conn, err := app.ldap.dial()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    for _, u := range users {
+        acct, err := app.ldap.lookup(conn, u.LDAPDN)
+        if err != nil {
+            return err
+        }
+        if acct == nil {
+            // Gone from the directory
+            log.Printf("ldap: %s no longer exists, disabling %s", u.LDAPDN, u.Email)
+            app.DB.Model(&User{}).Where("id = ?", u.ID).Update("disabled", true)
+            app.keyCache.invalidateUser(u.ID)
+            revokeSessions(app, u.ID, "")
+            continue
+        }
+        syncLDAPUser(app, acct, false)
+    }
+    return nil
+}
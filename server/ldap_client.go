@@ -0,0 +1,499 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// A minimal LDAPv3 client: simple bind, search and StartTLS, which is all
+// password login and status sync need.
+
+// BER tags used by the protocol operations below.
+const (
+    berInteger     = 0x02
+    berOctetString = 0x04
+    berEnumerated  = 0x0a
+    berBoolean     = 0x01
+    berSequence    = 0x30
+    berSet         = 0x31
+
+    ldapBindRequest     = 0x60
+    ldapBindResponse    = 0x61
+    ldapUnbindRequest   = 0x42
+    ldapSearchRequest   = 0x63
+    ldapSearchEntry     = 0x64
+    ldapSearchDone      = 0x65
+    ldapSearchReference = 0x73
+    ldapExtendedRequest = 0x77
+    ldapExtendedResp    = 0x78
+)
+
+// LDAP result codes we act on.
+const (
+    ldapSuccess            = 0
+    ldapNoSuchObject       = 32
+    ldapInvalidCredentials = 49
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// ldapError is a non-success LDAP result.
+type ldapError struct {
+    Code    int
+    Message string
+}
+
+func (e *ldapError) Error() string {
+    return fmt.Sprintf("ldap result %d: %s", e.Code, e.Message)
+}
+
+func ldapResultCode(err error) int {
+    var le *ldapError
+    if errors.As(err, &le) {
+        return le.Code
+    }
+    return -1
+}
+
+type ldapEntry struct {
+    DN    string
+    Attrs map[string][]string // lower-cased attribute names
+}
+
+func (e *ldapEntry) first(attr string) string {
+    if v := e.Attrs[strings.ToLower(attr)]; len(v) > 0 {
+        return v[0]
+    }
+    return ""
+}
+
+type ldapConn struct {
+    conn    net.Conn
+    r       *bufio.Reader
+    msgID   int
+    timeout time.Duration
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL, upgrading with StartTLS if asked.
+func dialLDAP(rawURL string, startTLS bool, tlsCfg *tls.Config, timeout time.Duration) (*ldapConn, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    host := u.Host
+    if u.Port() == "" {
+        port := "389"
+        if u.Scheme == "ldaps" { port = "636" }
+        host = net.JoinHostPort(u.Hostname(), port)
+    }
+    if tlsCfg.ServerName == "" {
+        tlsCfg = tlsCfg.Clone()
+        tlsCfg.ServerName = u.Hostname()
+    }
+    d := &net.Dialer{Timeout: timeout}
+    var conn net.Conn
+    switch u.Scheme {
+    case "ldap":
+        conn, err = d.Dial("tcp", host)
+    case "ldaps":
+        conn, err = tls.DialWithDialer(d, "tcp", host, tlsCfg)
+    default:
+        return nil, fmt.Errorf("unsupported ldap scheme %q", u.Scheme)
+    }
+    if err != nil {
+        return nil, err
+    }
+    lc := &ldapConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+    if startTLS && u.Scheme == "ldap" {
+        req := berTLV(ldapExtendedRequest, berTLV(0x80, []byte(startTLSOID)))
+        if _, err := lc.roundTrip(req, ldapExtendedResp); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("starttls: %w", err)
+        }
+        tc := tls.Client(conn, tlsCfg)
+        if err := tc.Handshake(); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("starttls: %w", err)
+        }
+        lc.conn, lc.r = tc, bufio.NewReader(tc)
+    }
+    return lc, nil
+}
+
+func (lc *ldapConn) Close() {
+    lc.msgID++
+    lc.conn.SetDeadline(time.Now().Add(time.Second))
+    lc.conn.Write(berTLV(berSequence, berInt(berInteger, lc.msgID), berTLV(ldapUnbindRequest, nil)))
+    lc.conn.Close()
+}
+
+// Bind performs a simple bind. An empty password would be an unauthenticated
+// bind, which servers accept without checking anything, so it is refused.
+func (lc *ldapConn) Bind(dn, password string) error {
+    if dn != "" && password == "" {
+        return &ldapError{Code: ldapInvalidCredentials, Message: "empty password"}
+    }
+    req := berTLV(ldapBindRequest, berInt(berInteger, 3), berTLV(berOctetString, []byte(dn)), berTLV(0x80, []byte(password)))
+    _, err := lc.roundTrip(req, ldapBindResponse)
+    return err
+}
+
+// Search runs a search; scope is 0 (base object) or 2 (whole subtree).
+func (lc *ldapConn) Search(baseDN string, scope int, filter string, attrs []string) ([]ldapEntry, error) {
+    f, err := compileLDAPFilter(filter)
+    if err != nil {
+        return nil, err
+    }
+    var attrList []byte
+    for _, a := range attrs {
+        attrList = append(attrList, berTLV(berOctetString, []byte(a))...)
+    }
+    req := berTLV(ldapSearchRequest,
+        berTLV(berOctetString, []byte(baseDN)),
+        berInt(berEnumerated, scope),
+        berInt(berEnumerated, 0), // never deref aliases
+        berInt(berInteger, 0),    // no size limit
+        berInt(berInteger, int(lc.timeout/time.Second)),
+        berTLV(berBoolean, []byte{0}),
+        f,
+        berTLV(berSequence, attrList),
+    )
+    lc.msgID++
+    if err := lc.send(req); err != nil {
+        return nil, err
+    }
+    var entries []ldapEntry
+    for {
+        op, err := lc.readResponse()
+        if err != nil {
+            return nil, err
+        }
+        switch op.tag {
+        case ldapSearchEntry:
+            e, err := parseLDAPEntry(op)
+            if err != nil {
+                return nil, err
+            }
+            entries = append(entries, e)
+        case ldapSearchReference:
+            // Referrals to other servers aren't followed
+        case ldapSearchDone:
+            return entries, ldapResult(op)
+        default:
+            return nil, fmt.Errorf("ldap: unexpected response 0x%x", op.tag)
+        }
+    }
+}
+
+func (lc *ldapConn) roundTrip(op []byte, want byte) (berElement, error) {
+    lc.msgID++
+    if err := lc.send(op); err != nil {
+        return berElement{}, err
+    }
+    resp, err := lc.readResponse()
+    if err != nil {
+        return berElement{}, err
+    }
+    if resp.tag != want {
+        return berElement{}, fmt.Errorf("ldap: unexpected response 0x%x", resp.tag)
+    }
+    return resp, ldapResult(resp)
+}
+
+func (lc *ldapConn) send(op []byte) error {
+    lc.conn.SetDeadline(time.Now().Add(lc.timeout))
+    _, err := lc.conn.Write(berTLV(berSequence, berInt(berInteger, lc.msgID), op))
+    return err
+}
+
+// readResponse reads the next message for the current request and returns its protocol op.
+func (lc *ldapConn) readResponse() (berElement, error) {
+    for {
+        msg, err := readBER(lc.r)
+        if err != nil {
+            return berElement{}, err
+        }
+        parts, err := msg.children()
+        if err != nil || len(parts) < 2 {
+            return berElement{}, errors.New("ldap: malformed message")
+        }
+        if id, _ := parts[0].int(); id != lc.msgID {
+            continue // e.g. a notice of disconnection (id 0)
+        }
+        return parts[1], nil
+    }
+}
+
+// ldapResult turns an LDAPResult (code, matched DN, message) into an error.
+func ldapResult(op berElement) error {
+    parts, err := op.children()
+    if err != nil || len(parts) < 3 {
+        return errors.New("ldap: malformed result")
+    }
+    code, _ := parts[0].int()
+    if code == ldapSuccess {
+        return nil
+    }
+    return &ldapError{Code: code, Message: string(parts[2].data)}
+}
+
+func parseLDAPEntry(op berElement) (ldapEntry, error) {
+    parts, err := op.children()
+    if err != nil || len(parts) < 2 {
+        return ldapEntry{}, errors.New("ldap: malformed entry")
+    }
+    e := ldapEntry{DN: string(parts[0].data), Attrs: map[string][]string{}}
+    attrs, err := parts[1].children()
+    if err != nil {
+        return ldapEntry{}, err
+    }
+    for _, a := range attrs {
+        kv, err := a.children()
+        if err != nil || len(kv) < 2 {
+            return ldapEntry{}, errors.New("ldap: malformed attribute")
+        }
+        vals, err := kv[1].children()
+        if err != nil {
+            return ldapEntry{}, err
+        }
+        name := strings.ToLower(string(kv[0].data))
+        for _, v := range vals {
+            e.Attrs[name] = append(e.Attrs[name], string(v.data))
+        }
+    }
+    return e, nil
+}
+
+// BER encoding
+
+type berElement struct {
+    tag  byte
+    data []byte
+}
+
+func (b berElement) children() ([]berElement, error) {
+    var out []berElement
+    r := bufio.NewReader(bytes.NewReader(b.data))
+    for {
+        el, err := readBER(r)
+        if err == io.EOF {
+            return out, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, el)
+    }
+}
+
+func (b berElement) int() (int, error) {
+    if len(b.data) == 0 || len(b.data) > 8 {
+        return 0, errors.New("ber: bad integer")
+    }
+    n := int64(int8(b.data[0])) // sign-extend
+    for _, c := range b.data[1:] {
+        n = n<<8 | int64(c)
+    }
+    return int(n), nil
+}
+
+// Responses larger than this are refused.
+const berMaxLen = 16 << 20
+
+func readBER(r *bufio.Reader) (berElement, error) {
+    tag, err := r.ReadByte()
+    if err != nil {
+        return berElement{}, err
+    }
+    l, err := r.ReadByte()
+    if err != nil {
+        return berElement{}, io.ErrUnexpectedEOF
+    }
+    n := int(l)
+    if l&0x80 != 0 {
+        count := int(l & 0x7f)
+        if count == 0 || count > 4 {
+            return berElement{}, errors.New("ber: unsupported length")
+        }
+        n = 0
+        for i := 0; i < count; i++ {
+            c, err := r.ReadByte()
+            if err != nil {
+                return berElement{}, io.ErrUnexpectedEOF
+            }
+            n = n<<8 | int(c)
+        }
+    }
+    if n > berMaxLen {
+        return berElement{}, errors.New("ber: element too large")
+    }
+    data := make([]byte, n)
+    if _, err := io.ReadFull(r, data); err != nil {
+        return berElement{}, io.ErrUnexpectedEOF
+    }
+    return berElement{tag: tag, data: data}, nil
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+    var body []byte
+    for _, c := range content {
+        body = append(body, c...)
+    }
+    out := []byte{tag}
+    switch n := len(body); {
+    case n < 0x80:
+        out = append(out, byte(n))
+    case n < 0x100:
+        out = append(out, 0x81, byte(n))
+    case n < 0x10000:
+        out = append(out, 0x82, byte(n>>8), byte(n))
+    default:
+        out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+    }
+    return append(out, body...)
+}
+
+func berInt(tag byte, v int) []byte {
+    var b []byte
+    for {
+        b = append([]byte{byte(v)}, b...)
+        if v < 0x80 && v >= -0x80 {
+            break
+        }
+        v >>= 8
+    }
+    return berTLV(tag, b)
+}
+
+// Filters (RFC 4515): &, |, !, =, >=, <=, presence (attr=*) and substrings (a*b*c).
+
+func compileLDAPFilter(s string) ([]byte, error) {
+    s = strings.TrimSpace(s)
+    f, rest, err := parseLDAPFilter(s)
+    if err != nil {
+        return nil, err
+    }
+    if rest != "" {
+        return nil, fmt.Errorf("ldap filter: trailing %q", rest)
+    }
+    return f, nil
+}
+
+func parseLDAPFilter(s string) ([]byte, string, error) {
+    if !strings.HasPrefix(s, "(") {
+        return nil, "", fmt.Errorf("ldap filter: expected ( at %q", s)
+    }
+    s = s[1:]
+    if s == "" {
+        return nil, "", errors.New("ldap filter: unexpected end")
+    }
+    switch s[0] {
+    case '&', '|', '!':
+        tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[s[0]]
+        s = s[1:]
+        var body []byte
+        count := 0
+        for strings.HasPrefix(s, "(") {
+            f, rest, err := parseLDAPFilter(s)
+            if err != nil {
+                return nil, "", err
+            }
+            body, s, count = append(body, f...), rest, count+1
+        }
+        if !strings.HasPrefix(s, ")") || (tag == 0xa2 && count != 1) {
+            return nil, "", fmt.Errorf("ldap filter: bad composite at %q", s)
+        }
+        return berTLV(tag, body), s[1:], nil
+    }
+    end := strings.IndexByte(s, ')')
+    if end < 0 {
+        return nil, "", errors.New("ldap filter: missing )")
+    }
+    item, rest := s[:end], s[end+1:]
+    eq := strings.IndexByte(item, '=')
+    if eq <= 0 {
+        return nil, "", fmt.Errorf("ldap filter: bad item %q", item)
+    }
+    attr, value := item[:eq], item[eq+1:]
+    tag := byte(0xa3) // equalityMatch
+    switch attr[len(attr)-1] {
+    case '>':
+        tag, attr = 0xa5, attr[:len(attr)-1]
+    case '<':
+        tag, attr = 0xa6, attr[:len(attr)-1]
+    case ':', '~':
+        return nil, "", fmt.Errorf("ldap filter: unsupported match in %q", item)
+    }
+    if tag == 0xa3 && value == "*" {
+        return berTLV(0x87, []byte(attr)), rest, nil
+    }
+    if tag == 0xa3 && strings.Contains(value, "*") {
+        pieces := strings.Split(value, "*")
+        var subs []byte
+        for i, p := range pieces {
+            if p == "" {
+                continue
+            }
+            v, err := unescapeLDAPValue(p)
+            if err != nil {
+                return nil, "", err
+            }
+            t := byte(0x81) // any
+            if i == 0 {
+                t = 0x80 // initial
+            } else if i == len(pieces)-1 {
+                t = 0x82 // final
+            }
+            subs = append(subs, berTLV(t, v)...)
+        }
+        return berTLV(0xa4, berTLV(berOctetString, []byte(attr)), berTLV(berSequence, subs)), rest, nil
+    }
+    v, err := unescapeLDAPValue(value)
+    if err != nil {
+        return nil, "", err
+    }
+    return berTLV(tag, berTLV(berOctetString, []byte(attr)), berTLV(berOctetString, v)), rest, nil
+}
+
+func unescapeLDAPValue(s string) ([]byte, error) {
+    var out []byte
+    for i := 0; i < len(s); i++ {
+        if s[i] != '\\' {
+            out = append(out, s[i])
+            continue
+        }
+        if i+3 > len(s) {
+            return nil, fmt.Errorf("ldap filter: bad escape in %q", s)
+        }
+        n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+        if err != nil {
+            return nil, fmt.Errorf("ldap filter: bad escape in %q", s)
+        }
+        out = append(out, byte(n))
+        i += 2
+    }
+    return out, nil
+}
+
+// escapeLDAPValue escapes a value for use inside a filter.
+func escapeLDAPValue(s string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        switch c := s[i]; c {
+        case '\\', '*', '(', ')', 0:
+            fmt.Fprintf(&b, "\\%02x", c)
+        default:
+            b.WriteByte(c)
+        }
+    }
+    return b.String()
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+    "bufio"
+    "errors"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// fakeDirectory is an LDAP server speaking just enough of the protocol for
+// ldapConn: simple bind, base and subtree search with &, |, !, = and presence.
+type fakeDirectory struct {
+    ln        net.Listener
+    mu        sync.Mutex
+    entries   map[string]map[string][]string // DN to lower-cased attributes
+    passwords map[string]string              // DN to password
+    bindCodes map[string]int                 // DN to a forced bind result
+}
+
+const testBaseDN = "dc=example,dc=org"
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &fakeDirectory{ln: ln, entries: map[string]map[string][]string{}, passwords: map[string]string{}, bindCodes: map[string]int{}}
+    d.passwords["cn=svc,"+testBaseDN] = "svc-pass"
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go d.serve(conn)
+        }
+    }()
+    return d
+}
+
+func (d *fakeDirectory) add(dn, password string, attrs map[string][]string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    lower := map[string][]string{}
+    for k, v := range attrs {
+        lower[strings.ToLower(k)] = v
+    }
+    d.entries[dn] = lower
+    d.passwords[dn] = password
+}
+
+// set replaces one attribute of an entry.
+func (d *fakeDirectory) set(dn, attr string, vals ...string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.entries[dn][strings.ToLower(attr)] = vals
+}
+
+func (d *fakeDirectory) setBind(dn, password string, code int) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.passwords[dn] = password
+    if code != ldapSuccess { d.bindCodes[dn] = code }
+}
+
+func (d *fakeDirectory) remove(dn string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    delete(d.entries, dn)
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    for {
+        msg, err := readBER(r)
+        if err != nil {
+            return
+        }
+        parts, err := msg.children()
+        if err != nil || len(parts) < 2 {
+            return
+        }
+        id, _ := parts[0].int()
+        reply := func(op []byte) { conn.Write(berTLV(berSequence, berInt(berInteger, id), op)) }
+        result := func(tag byte, code int) []byte {
+            return berTLV(tag, berInt(berEnumerated, code), berTLV(berOctetString, nil), berTLV(berOctetString, nil))
+        }
+        fields, _ := parts[1].children()
+        switch parts[1].tag {
+        case ldapUnbindRequest:
+            return
+        case ldapBindRequest:
+            dn, password := string(fields[1].data), string(fields[2].data)
+            d.mu.Lock()
+            code, forced := d.bindCodes[dn]
+            if !forced {
+                code = ldapInvalidCredentials
+                if want, ok := d.passwords[dn]; dn == "" || ok && want == password {
+                    code = ldapSuccess
+                }
+            }
+            d.mu.Unlock()
+            reply(result(ldapBindResponse, code))
+        case ldapSearchRequest:
+            base := string(fields[0].data)
+            scope, _ := fields[1].int()
+            d.mu.Lock()
+            if _, ok := d.entries[base]; scope == 0 && !ok {
+                d.mu.Unlock()
+                reply(result(ldapSearchDone, ldapNoSuchObject))
+                continue
+            }
+            for dn, attrs := range d.entries {
+                inScope := dn == base || scope == 2 && strings.HasSuffix(dn, ","+base)
+                if !inScope || !ldapFilterMatches(fields[6], attrs) {
+                    continue
+                }
+                var list []byte
+                for name, vals := range attrs {
+                    var set []byte
+                    for _, v := range vals {
+                        set = append(set, berTLV(berOctetString, []byte(v))...)
+                    }
+                    list = append(list, berTLV(berSequence, berTLV(berOctetString, []byte(name)), berTLV(berSet, set))...)
+                }
+                reply(berTLV(ldapSearchEntry, berTLV(berOctetString, []byte(dn)), berTLV(berSequence, list)))
+            }
+            d.mu.Unlock()
+            reply(result(ldapSearchDone, ldapSuccess))
+        default:
+            return
+        }
+    }
+}
+
+func ldapFilterMatches(f berElement, attrs map[string][]string) bool {
+    switch f.tag {
+    case 0xa0, 0xa1:
+        subs, _ := f.children()
+        for _, s := range subs {
+            if ldapFilterMatches(s, attrs) == (f.tag == 0xa1) {
+                return f.tag == 0xa1
+            }
+        }
+        return f.tag == 0xa0
+    case 0xa2:
+        subs, _ := f.children()
+        return len(subs) == 1 && !ldapFilterMatches(subs[0], attrs)
+    case 0x87:
+        return strings.EqualFold(string(f.data), "objectClass") || len(attrs[strings.ToLower(string(f.data))]) > 0
+    case 0xa3:
+        kv, _ := f.children()
+        for _, v := range attrs[strings.ToLower(string(kv[0].data))] {
+            if strings.EqualFold(v, string(kv[1].data)) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func newTestLDAPApp(t *testing.T, d *fakeDirectory, edit func(*LDAPConfig)) *App {
+    t.Helper()
+    app := newTestApp(t)
+    cfg := app.Config.LDAP
+    cfg.Enabled = true
+    cfg.URL = "ldap://" + d.ln.Addr().String()
+    cfg.BaseDN = testBaseDN
+    cfg.BindDN = "cn=svc," + testBaseDN
+    cfg.BindPassword = "svc-pass"
+    cfg.TimeoutSeconds = 2
+    cfg.GroupMapping = []LDAPGroupMapping{{Group: "llm-admins", Role: "admin"}}
+    if edit != nil { edit(&cfg) }
+    la, err := newLDAPAuth(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    app.Config.LDAP, app.ldap = cfg, la
+    return app
+}
+
+func TestLDAPPasswordLogin(t *testing.T) {
+    aliceDN := "uid=alice,ou=people," + testBaseDN
+    tests := []struct {
+        name     string
+        login    string
+        password string
+        setup    func(*fakeDirectory, *App)
+        cfg      func(*LDAPConfig)
+        wantErr  error
+        wantRole string
+    }{
+        {name: "valid", login: "alice", password: "alice-pass", wantRole: "user"},
+        {name: "group mapped to role", login: "alice", password: "alice-pass", wantRole: "admin",
+            setup: func(d *fakeDirectory, _ *App) {
+                d.set(aliceDN, "memberOf", "cn=LLM-Admins,ou=groups,"+testBaseDN)
+            }},
+        {name: "wrong password", login: "alice", password: "nope", wantErr: errInvalidCredentials},
+        {name: "empty password", login: "alice", password: "", wantErr: errInvalidCredentials},
+        {name: "unknown user", login: "bob", password: "alice-pass", wantErr: errInvalidCredentials},
+        {name: "filter injection", login: "*", password: "alice-pass", wantErr: errInvalidCredentials},
+        {name: "service bind rejected", login: "alice", password: "alice-pass", wantErr: errDirectoryUnavailable,
+            cfg: func(c *LDAPConfig) { c.BindPassword = "wrong" }},
+        {name: "user bind fails otherwise", login: "alice", password: "alice-pass", wantErr: errDirectoryUnavailable,
+            setup: func(d *fakeDirectory, _ *App) { d.setBind(aliceDN, "alice-pass", 51) }}, // busy
+        {name: "directory down", login: "alice", password: "alice-pass", wantErr: errDirectoryUnavailable,
+            setup: func(d *fakeDirectory, _ *App) { d.ln.Close() }},
+        {name: "disabled in directory", login: "alice", password: "alice-pass", wantErr: errInvalidCredentials,
+            setup: func(d *fakeDirectory, _ *App) { d.set(aliceDN, "nsAccountLock", "TRUE") }},
+        {name: "no auto provisioning", login: "alice", password: "alice-pass", wantErr: errInvalidCredentials,
+            cfg: func(c *LDAPConfig) { c.AutoProvision = false }},
+        {name: "local account checked locally", login: "alice@example.org", password: "local-pass", wantRole: "user",
+            setup: func(d *fakeDirectory, app *App) {
+                u := User{Email: "alice@example.org", Role: "user"}
+                u.SetPassword("local-pass")
+                app.DB.Create(&u)
+            }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := newFakeDirectory(t)
+            d.add(aliceDN, "alice-pass", map[string][]string{"uid": {"alice"}, "mail": {"Alice@Example.org"}})
+            app := newTestLDAPApp(t, d, tt.cfg)
+            if tt.setup != nil { tt.setup(d, app) }
+            u, err := passwordLogin(app, tt.login, tt.password)
+            if tt.wantErr != nil {
+                if !errors.Is(err, tt.wantErr) {
+                    t.Fatalf("err = %v, want %v", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("login: %v", err)
+            }
+            if u.Email != "alice@example.org" || u.Role != tt.wantRole {
+                t.Errorf("user = %s/%s, want alice@example.org/%s", u.Email, u.Role, tt.wantRole)
+            }
+        })
+    }
+}
+
+func TestLDAPDisabledInDirectoryDisablesLocalUser(t *testing.T) {
+    d := newFakeDirectory(t)
+    dn := "uid=alice,ou=people," + testBaseDN
+    d.add(dn, "alice-pass", map[string][]string{"uid": {"alice"}, "mail": {"alice@example.org"}})
+    app := newTestLDAPApp(t, d, nil)
+    if _, err := passwordLogin(app, "alice", "alice-pass"); err != nil {
+        t.Fatal(err)
+    }
+    d.set(dn, "userAccountControl", "514")
+    if _, err := passwordLogin(app, "alice", "alice-pass"); !errors.Is(err, errInvalidCredentials) {
+        t.Fatalf("err = %v", err)
+    }
+    var u User
+    app.DB.Where("ldap_dn = ?", dn).First(&u)
+    if !u.Disabled {
+        t.Error("local user still enabled")
+    }
+}
+
+func TestSyncLDAPUsers(t *testing.T) {
+    d := newFakeDirectory(t)
+    alice, bob := "uid=alice,ou=people,"+testBaseDN, "uid=bob,ou=people,"+testBaseDN
+    d.add(alice, "alice-pass", map[string][]string{"uid": {"alice"}, "mail": {"alice@example.org"}})
+    d.add(bob, "bob-pass", map[string][]string{"uid": {"bob"}, "mail": {"bob@example.org"}})
+    app := newTestLDAPApp(t, d, nil)
+    for _, login := range []string{"alice", "bob"} {
+        if _, err := passwordLogin(app, login, login+"-pass"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    d.remove(bob)
+    d.set(alice, "memberOf", "cn=llm-admins,ou=groups,"+testBaseDN)
+    if err := syncLDAPUsers(app); err != nil {
+        t.Fatal(err)
+    }
+    var a, b User
+    app.DB.Where("ldap_dn = ?", alice).First(&a)
+    app.DB.Where("ldap_dn = ?", bob).First(&b)
+    if a.Role != "admin" || a.Disabled {
+        t.Errorf("alice = %s disabled=%v, want admin enabled", a.Role, a.Disabled)
+    }
+    if !b.Disabled {
+        t.Error("bob is gone from the directory but still enabled")
+    }
+
+    d.setBind("cn=svc,"+testBaseDN, "rotated", ldapSuccess)
+    if err := syncLDAPUsers(app); err == nil {
+        t.Error("sync succeeded with a rejected service bind")
+    }
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+// loginThrottle counts failed logins per client IP. Per-account failures are
+// kept on the user row so an admin can see and clear them.
+type loginThrottle struct {
+    mu  sync.Mutex
+    ips map[string]*ipFailures
+}
+
+type ipFailures struct {
+    count   int
+    since   time.Time
+    blocked time.Time // until
+}
+
+func newLoginThrottle() *loginThrottle {
+    return &loginThrottle{ips: map[string]*ipFailures{}}
+}
+
+// blocked returns how long ip must wait before trying again.
+func (t *loginThrottle) blocked(ip string) time.Duration {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if f := t.ips[ip]; f != nil {
+        return time.Until(f.blocked)
+    }
+    return 0
+}
+
+// fail records a failure from ip and reports whether it just got blocked.
+func (t *loginThrottle) fail(ip string, cfg LockoutConfig) bool {
+    if cfg.IPMaxFailures <= 0 {
+        return false
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    now := time.Now()
+    window := time.Duration(cfg.WindowMinutes) * time.Minute
+    for k, f := range t.ips {
+        if now.Sub(f.since) > window && now.After(f.blocked) {
+            delete(t.ips, k)
+        }
+    }
+    f := t.ips[ip]
+    if f == nil {
+        f = &ipFailures{since: now}
+        t.ips[ip] = f
+    }
+    f.count++
+    if f.count < cfg.IPMaxFailures {
+        return false
+    }
+    f.count, f.since = 0, now
+    f.blocked = now.Add(time.Duration(cfg.LockoutMinutes) * time.Minute)
+    return true
+}
+
+func registerLockoutRoutes(g *echo.Group) {
+    g.POST("/users/:id/unlock", requirePermission(permUsers, blockAdminIfMustChange(adminUnlockUser)))
+}
+
+// loginLockout returns how long the client IP or the account is locked out, and why.
+func loginLockout(c echo.Context, app *App, u *User) (time.Duration, string) {
+    if wait := app.logins.blocked(c.RealIP()); wait > 0 {
+        return wait, "too many failed logins, try again later"
+    }
+    if u != nil && u.LockedUntil != nil && time.Now().Before(*u.LockedUntil) {
+        return time.Until(*u.LockedUntil), "account temporarily locked"
+    }
+    return 0, ""
+}
+
+func tooManyLogins(c echo.Context, wait time.Duration, msg string) error {
+    c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+    return c.JSON(http.StatusTooManyRequests, echo.Map{"error": msg})
+}
+
+// recordLoginFailure counts a wrong password or code against the client IP
+// and, when known, the account, locking either once it reaches its limit.
+func recordLoginFailure(c echo.Context, app *App, u *User) {
+    cfg := app.Config.Auth.Lockout
+    ip := c.RealIP()
+    if app.logins.fail(ip, cfg) {
+        notify(app, "auth.lockout", map[string]any{"ip": ip, "minutes": cfg.LockoutMinutes})
+        auditSystem(app, "ip.lockout", "ip", ip, ip)
+    }
+    if u == nil || cfg.MaxFailures <= 0 {
+        return
+    }
+    now := time.Now()
+    // Counted in the database so concurrent attempts can't lose increments;
+    // a failure after the window has passed starts a new count
+    windowStart := now.Add(-time.Duration(cfg.WindowMinutes) * time.Minute)
+    count := gorm.Expr("CASE WHEN last_failed_login_at IS NULL OR last_failed_login_at < ? THEN 1 ELSE failed_logins + 1 END", windowStart)
+    app.DB.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]any{"failed_logins": count, "last_failed_login_at": now})
+    until := now.Add(time.Duration(cfg.LockoutMinutes) * time.Minute)
+    res := app.DB.Model(&User{}).Where("id = ? AND failed_logins >= ?", u.ID, cfg.MaxFailures).Updates(map[string]any{"failed_logins": 0, "locked_until": until})
+    if res.Error == nil && res.RowsAffected > 0 {
+        notify(app, "auth.lockout", map[string]any{"user_id": u.ID, "email": u.Email, "ip": ip, "until": until.UTC()})
+        auditSystem(app, "user.lockout", "user", u.ID, ip)
+    }
+}
+
+// clearLoginFailures resets the account's count after a successful login.
+func clearLoginFailures(app *App, u *User) {
+    if u.FailedLogins == 0 && u.LockedUntil == nil {
+        return
+    }
+    app.DB.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]any{"failed_logins": 0, "locked_until": nil})
+}
+
+func adminUnlockUser(c echo.Context) error {
+    app := getApp(c)
+    var u User
+    if err := app.DB.First(&u, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    app.DB.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]any{"failed_logins": 0, "locked_until": nil})
+    audit(c, "user.unlock", "user", u.ID, nil, nil)
+    return c.NoContent(http.StatusNoContent)
+}
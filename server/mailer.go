@@ -0,0 +1,152 @@
+package server
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime"
+    "net"
+    "net/http"
+    "net/mail"
+    "net/smtp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var errNoAddress = errors.New("user has no email address")
+
+// mailMessage is an account email: an invite or a password-reset link.
+type mailMessage struct {
+    Event     string // account.invite|account.password_reset
+    To        string
+    UserID    uint
+    Subject   string
+    Body      string
+    Link      string
+    ExpiresAt time.Time
+}
+
+// mailer delivers account emails. With mail.delivery: display there is no
+// mailer and links are returned to the admin who asked for them.
+type mailer interface {
+    send(msg mailMessage) error
+}
+
+func newMailer(cfg MailConfig, notifications string) (mailer, error) {
+    switch cfg.Delivery {
+    case "", "display":
+        return nil, nil
+    case "smtp":
+        if cfg.SMTP.Host == "" {
+            return nil, errors.New("mail: smtp.host is required")
+        }
+        switch cfg.SMTP.TLS {
+        case "", "starttls", "tls", "none":
+        default:
+            return nil, fmt.Errorf("mail: unknown smtp.tls %q", cfg.SMTP.TLS)
+        }
+        from, err := mail.ParseAddress(cfg.From)
+        if err != nil {
+            return nil, fmt.Errorf("mail: from: %w", err)
+        }
+        return &smtpMailer{cfg: cfg.SMTP, from: from}, nil
+    case "webhook":
+        url := cfg.WebhookURL
+        if url == "" { url = notifications }
+        if url == "" {
+            return nil, errors.New("mail: webhook_url is required")
+        }
+        return &webhookMailer{url: url}, nil
+    }
+    return nil, fmt.Errorf("mail: unknown delivery %q", cfg.Delivery)
+}
+
+type smtpMailer struct {
+    cfg  SMTPConfig
+    from *mail.Address
+}
+
+func (m *smtpMailer) send(msg mailMessage) error {
+    to, err := mail.ParseAddress(msg.To)
+    if err != nil {
+        return errNoAddress
+    }
+    addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+    tlsConfig := &tls.Config{ServerName: m.cfg.Host}
+    var conn net.Conn
+    if m.cfg.TLS == "tls" {
+        conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, tlsConfig)
+    } else {
+        conn, err = net.DialTimeout("tcp", addr, 10*time.Second)
+    }
+    if err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Now().Add(30 * time.Second))
+    c, err := smtp.NewClient(conn, m.cfg.Host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer c.Close()
+    if m.cfg.TLS == "" || m.cfg.TLS == "starttls" {
+        if ok, _ := c.Extension("STARTTLS"); !ok {
+            return errors.New("smtp server does not offer STARTTLS")
+        }
+        if err := c.StartTLS(tlsConfig); err != nil {
+            return err
+        }
+    }
+    if m.cfg.Username != "" {
+        // PlainAuth refuses to send credentials unencrypted except to localhost
+        if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+            return err
+        }
+    }
+    if err := c.Mail(m.from.Address); err != nil {
+        return err
+    }
+    if err := c.Rcpt(to.Address); err != nil {
+        return err
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", m.from, to, mime.QEncoding.Encode("utf-8", msg.Subject), time.Now().Format(time.RFC1123Z))
+    b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    if _, err := w.Write(b.Bytes()); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return c.Quit()
+}
+
+// webhookMailer POSTs the message in the notifications envelope and leaves
+// delivery to the receiver, e.g. a chat bot or a mail relay.
+type webhookMailer struct {
+    url string
+}
+
+func (m *webhookMailer) send(msg mailMessage) error {
+    body, _ := json.Marshal(map[string]any{"event": msg.Event, "time": time.Now().UTC(), "data": map[string]any{
+        "to": msg.To, "user_id": msg.UserID, "subject": msg.Subject, "body": msg.Body, "link": msg.Link, "expires_at": msg.ExpiresAt.UTC(),
+    }})
+    client := &http.Client{Timeout: 10 * time.Second}
+    resp, err := client.Post(m.url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook status %d", resp.StatusCode)
+    }
+    return nil
+}
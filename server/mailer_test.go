@@ -0,0 +1,261 @@
+package server
+
+import (
+    "bufio"
+    "encoding/base64"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeSMTP is a plaintext SMTP server that records what it is sent.
+type fakeSMTP struct {
+    ln         net.Listener
+    auth       string // expected "user\x00password"; empty doesn't offer AUTH
+    rejectRcpt bool
+    mu         sync.Mutex
+    gotAuth    string
+    from, to   string
+    data       string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &fakeSMTP{ln: ln}
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go s.serve(conn)
+        }
+    }()
+    return s
+}
+
+func (s *fakeSMTP) port() int {
+    return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    say := func(line string) { conn.Write([]byte(line + "\r\n")) }
+    say("220 fake ESMTP")
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return
+        }
+        line = strings.TrimRight(line, "\r\n")
+        verb, arg, _ := strings.Cut(line, " ")
+        s.mu.Lock()
+        switch strings.ToUpper(verb) {
+        case "EHLO", "HELO":
+            if s.auth != "" {
+                say("250-fake")
+                say("250 AUTH PLAIN")
+            } else {
+                say("250 fake")
+            }
+        case "AUTH":
+            raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+            s.gotAuth = strings.TrimPrefix(string(raw), "\x00")
+            if s.gotAuth == s.auth {
+                say("235 ok")
+            } else {
+                say("535 authentication failed")
+            }
+        case "MAIL":
+            s.from = arg
+            say("250 ok")
+        case "RCPT":
+            if s.rejectRcpt {
+                say("550 no such user")
+                break
+            }
+            s.to = arg
+            say("250 ok")
+        case "DATA":
+            say("354 go ahead")
+            var b strings.Builder
+            for {
+                l, err := r.ReadString('\n')
+                if err != nil || l == ".\r\n" {
+                    break
+                }
+                b.WriteString(l)
+            }
+            s.data = b.String()
+            say("250 queued")
+        case "QUIT":
+            say("221 bye")
+            s.mu.Unlock()
+            return
+        default:
+            say("502 not implemented")
+        }
+        s.mu.Unlock()
+    }
+}
+
+func TestNewMailer(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     MailConfig
+        notify  string
+        want    string // mailer type, or "" for none
+        wantErr bool
+    }{
+        {name: "display", cfg: MailConfig{Delivery: "display"}},
+        {name: "smtp", cfg: MailConfig{Delivery: "smtp", From: "Router <router@example.org>", SMTP: SMTPConfig{Host: "mail.example.org"}}, want: "smtp"},
+        {name: "smtp without host", cfg: MailConfig{Delivery: "smtp", From: "router@example.org"}, wantErr: true},
+        {name: "smtp bad tls", cfg: MailConfig{Delivery: "smtp", From: "router@example.org", SMTP: SMTPConfig{Host: "h", TLS: "ssl"}}, wantErr: true},
+        {name: "smtp bad from", cfg: MailConfig{Delivery: "smtp", From: "not an address", SMTP: SMTPConfig{Host: "h"}}, wantErr: true},
+        {name: "webhook", cfg: MailConfig{Delivery: "webhook", WebhookURL: "https://hooks.example.org"}, want: "webhook"},
+        {name: "webhook falls back to notifications", cfg: MailConfig{Delivery: "webhook"}, notify: "https://hooks.example.org", want: "webhook"},
+        {name: "webhook without url", cfg: MailConfig{Delivery: "webhook"}, wantErr: true},
+        {name: "unknown", cfg: MailConfig{Delivery: "pigeon"}, wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            m, err := newMailer(tt.cfg, tt.notify)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+            }
+            got := ""
+            switch m.(type) {
+            case *smtpMailer:
+                got = "smtp"
+            case *webhookMailer:
+                got = "webhook"
+            }
+            if got != tt.want {
+                t.Errorf("mailer = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestSMTPMailer(t *testing.T) {
+    msg := mailMessage{Event: "account.invite", To: "ann@example.org", Subject: "Your invitation", Body: "Hello\nSet a password: https://router.example.org/x"}
+    tests := []struct {
+        name       string
+        cfg        func(*SMTPConfig)
+        auth       string
+        rejectRcpt bool
+        to         string
+        down       bool
+        wantErr    string
+    }{
+        {name: "delivered", cfg: func(c *SMTPConfig) {}},
+        {name: "with auth", cfg: func(c *SMTPConfig) { c.Username, c.Password = "router", "s3cret" }, auth: "router\x00s3cret"},
+        {name: "auth rejected", cfg: func(c *SMTPConfig) { c.Username, c.Password = "router", "wrong" }, auth: "router\x00s3cret", wantErr: "535"},
+        {name: "recipient rejected", cfg: func(c *SMTPConfig) {}, rejectRcpt: true, wantErr: "550"},
+        {name: "starttls not offered", cfg: func(c *SMTPConfig) { c.TLS = "starttls" }, wantErr: "STARTTLS"},
+        {name: "server down", cfg: func(c *SMTPConfig) {}, down: true, wantErr: "refused"},
+        {name: "bad recipient", cfg: func(c *SMTPConfig) {}, to: "not an address", wantErr: errNoAddress.Error()},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newFakeSMTP(t)
+            s.auth, s.rejectRcpt = tt.auth, tt.rejectRcpt
+            cfg := SMTPConfig{Host: "127.0.0.1", Port: s.port(), TLS: "none"}
+            tt.cfg(&cfg)
+            if tt.down { s.ln.Close() }
+            m, err := newMailer(MailConfig{Delivery: "smtp", From: "Router <router@example.org>", SMTP: cfg}, "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            send := msg
+            if tt.to != "" { send.To = tt.to }
+            err = m.send(send)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("send: %v", err)
+            }
+            s.mu.Lock()
+            defer s.mu.Unlock()
+            if s.from != "FROM:<router@example.org>" || !strings.HasPrefix(s.to, "TO:<ann@example.org>") {
+                t.Errorf("envelope = %q -> %q", s.from, s.to)
+            }
+            if s.gotAuth != tt.auth {
+                t.Errorf("auth = %q, want %q", s.gotAuth, tt.auth)
+            }
+            for _, want := range []string{"Subject: Your invitation\r\n", "To: <ann@example.org>\r\n", "\r\n\r\nHello\r\nSet a password: https://router.example.org/x"} {
+                if !strings.Contains(s.data, want) {
+                    t.Errorf("message missing %q:\n%s", want, s.data)
+                }
+            }
+        })
+    }
+}
+
+func TestWebhookMailer(t *testing.T) {
+    expires := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+    msg := mailMessage{Event: "account.password_reset", To: "ann@example.org", UserID: 7, Subject: "Reset", Body: "b", Link: "https://router.example.org/reset#t", ExpiresAt: expires}
+    tests := []struct {
+        name    string
+        status  int
+        down    bool
+        wantErr string
+    }{
+        {name: "delivered", status: http.StatusNoContent},
+        {name: "receiver error", status: http.StatusInternalServerError, wantErr: "webhook status 500"},
+        {name: "receiver rejects", status: http.StatusBadRequest, wantErr: "webhook status 400"},
+        {name: "receiver down", down: true, wantErr: "refused"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var got struct {
+                Event string         `json:"event"`
+                Data  map[string]any `json:"data"`
+            }
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+                    t.Errorf("content type = %q", ct)
+                }
+                json.NewDecoder(r.Body).Decode(&got)
+                w.WriteHeader(tt.status)
+            }))
+            defer srv.Close()
+            if tt.down { srv.Close() }
+            m, err := newMailer(MailConfig{Delivery: "webhook", WebhookURL: srv.URL}, "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = m.send(msg)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("send: %v", err)
+            }
+            if got.Event != msg.Event || got.Data["to"] != msg.To || got.Data["link"] != msg.Link || got.Data["user_id"] != float64(7) {
+                t.Errorf("payload = %+v", got)
+            }
+            if got.Data["expires_at"] != expires.Format(time.RFC3339) {
+                t.Errorf("expires_at = %v", got.Data["expires_at"])
+            }
+        })
+    }
+}
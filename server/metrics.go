@@ -0,0 +1,391 @@
+package server
+
+import (
+    "context"
+    "crypto/subtle"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Label value that stands in for every series past a metric's max_series.
+const metricsOverflow = "other"
+
+var (
+    durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+    ttftBuckets     = []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30}
+)
+
+// metricVec is one metric family in the Prometheus text format: a counter,
+// gauge or histogram with a series per combination of label values.
+type metricVec struct {
+    name      string
+    help      string
+    kind      string // counter|gauge|histogram
+    labels    []string
+    buckets   []float64
+    maxSeries int
+    mu        sync.Mutex
+    series    map[string]*metricSeries
+}
+
+type metricSeries struct {
+    values []string
+    value  float64
+    counts []uint64 // per bucket, not cumulative
+    sum    float64
+    count  uint64
+}
+
+func newMetricVec(name, help, kind string, maxSeries int, labels ...string) *metricVec {
+    return &metricVec{name: name, help: help, kind: kind, labels: labels, maxSeries: maxSeries, series: map[string]*metricSeries{}}
+}
+
+// get returns the series for values; the caller holds m.mu. Once the family
+// has maxSeries series, new label combinations all land in one overflow series.
+func (m *metricVec) get(values []string) *metricSeries {
+    key := strings.Join(values, "\xff")
+    if s := m.series[key]; s != nil {
+        return s
+    }
+    if m.maxSeries > 0 && len(m.series) >= m.maxSeries {
+        values = make([]string, len(m.labels))
+        for i := range values { values[i] = metricsOverflow }
+        key = strings.Join(values, "\xff")
+        if s := m.series[key]; s != nil {
+            return s
+        }
+    }
+    s := &metricSeries{values: values}
+    if m.kind == "histogram" { s.counts = make([]uint64, len(m.buckets)) }
+    m.series[key] = s
+    return s
+}
+
+func (m *metricVec) add(v float64, values ...string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.get(values).value += v
+}
+
+func (m *metricVec) set(v float64, values ...string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.get(values).value = v
+}
+
+func (m *metricVec) observe(v float64, values ...string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s := m.get(values)
+    for i, le := range m.buckets {
+        if v <= le {
+            s.counts[i]++
+            break
+        }
+    }
+    s.sum += v
+    s.count++
+}
+
+func (m *metricVec) write(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+    keys := make([]string, 0, len(m.series))
+    for k := range m.series { keys = append(keys, k) }
+    sort.Strings(keys)
+    for _, k := range keys {
+        s := m.series[k]
+        if m.kind != "histogram" {
+            fmt.Fprintf(w, "%s%s %s\n", m.name, labelPairs(m.labels, s.values, ""), formatMetric(s.value))
+            continue
+        }
+        var cum uint64
+        for i, le := range m.buckets {
+            cum += s.counts[i]
+            fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelPairs(m.labels, s.values, formatMetric(le)), cum)
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelPairs(m.labels, s.values, "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelPairs(m.labels, s.values, ""), formatMetric(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelPairs(m.labels, s.values, ""), s.count)
+    }
+}
+
+// labelPairs renders {a="x",b="y"}, adding le for a histogram bucket.
+func labelPairs(names, values []string, le string) string {
+    if len(names) == 0 && le == "" {
+        return ""
+    }
+    var b strings.Builder
+    b.WriteByte('{')
+    for i, n := range names {
+        if i > 0 { b.WriteByte(',') }
+        b.WriteString(n + `="` + escapeLabel(values[i]) + `"`)
+    }
+    if le != "" {
+        if len(names) > 0 { b.WriteByte(',') }
+        b.WriteString(`le="` + le + `"`)
+    }
+    b.WriteByte('}')
+    return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string { return labelEscaper.Replace(v) }
+
+func formatMetric(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics holds what the router records as it serves requests. State that
+// already lives elsewhere (queues, rate limit blocks, the DB pool) is read
+// when /metrics is scraped. A nil *metrics records nothing.
+type metrics struct {
+    maxSeries        int
+    httpRequests     *metricVec
+    httpDuration     *metricVec
+    upstreamRequests *metricVec
+    upstreamDuration *metricVec
+    upstreamErrors   *metricVec
+    ttft             *metricVec
+    streams          *metricVec
+    tokens           *metricVec
+    fallbacks        *metricVec
+    fallbackFailures *metricVec
+    all              []*metricVec
+
+    namesMu sync.Mutex
+    names   map[uint]string // provider ID -> name, for logUsage
+}
+
+func newMetrics(cfg MetricsConfig) *metrics {
+    if !cfg.Enabled {
+        return nil
+    }
+    n := cfg.MaxSeries
+    m := &metrics{maxSeries: n, names: map[uint]string{}}
+    m.httpRequests = newMetricVec("llmrouter_http_requests_total", "API requests served, by route pattern and status code.", "counter", n, "endpoint", "method", "code")
+    m.httpDuration = newMetricVec("llmrouter_http_request_duration_seconds", "Time to serve an API request, including streaming.", "histogram", n, "endpoint", "method")
+    m.httpDuration.buckets = durationBuckets
+    m.upstreamRequests = newMetricVec("llmrouter_upstream_requests_total", "Calls to providers, by status code (\"error\" when no response arrived).", "counter", n, "provider", "model", "endpoint", "route", "code")
+    m.upstreamDuration = newMetricVec("llmrouter_upstream_request_duration_seconds", "Time until a provider's response headers arrive, including queueing.", "histogram", n, "provider", "model", "endpoint", "route")
+    m.upstreamDuration.buckets = durationBuckets
+    m.upstreamErrors = newMetricVec("llmrouter_upstream_errors_total", "Provider calls that failed or answered with a 4xx or 5xx status.", "counter", n, "provider", "endpoint", "code")
+    m.ttft = newMetricVec("llmrouter_time_to_first_token_seconds", "Time until the first bytes of a streamed response arrive.", "histogram", n, "provider", "model", "route")
+    m.ttft.buckets = ttftBuckets
+    m.streams = newMetricVec("llmrouter_streams_in_flight", "Streamed responses currently being relayed.", "gauge", n, "provider")
+    m.tokens = newMetricVec("llmrouter_tokens_total", "Tokens reported by providers.", "counter", n, "provider", "model", "direction")
+    m.fallbacks = newMetricVec("llmrouter_fallback_attempts_total", "Targets tried by router/ routes, by outcome.", "counter", n, "route", "provider", "outcome")
+    m.fallbackFailures = newMetricVec("llmrouter_fallback_exhausted_total", "Router requests for which no target succeeded.", "counter", n, "route")
+    m.all = []*metricVec{m.httpRequests, m.httpDuration, m.upstreamRequests, m.upstreamDuration, m.upstreamErrors, m.ttft, m.streams, m.tokens, m.fallbacks, m.fallbackFailures}
+    return m
+}
+
+type routeCtxKey struct{}
+
+// withRoute labels the upstream calls made for a router/ route.
+func withRoute(ctx context.Context, route string) context.Context {
+    return context.WithValue(ctx, routeCtxKey{}, route)
+}
+
+func routeFrom(ctx context.Context) string {
+    r, _ := ctx.Value(routeCtxKey{}).(string)
+    return r
+}
+
+// upstream records one call to a provider. resp is nil when none arrived.
+// A streamed response gets its body wrapped to time the first bytes and to
+// count it as in flight until it is drained or closed.
+func (m *metrics) upstream(ctx context.Context, p Provider, model, endpoint string, started time.Time, resp *http.Response, err error) {
+    if m == nil {
+        return
+    }
+    m.namesMu.Lock()
+    m.names[p.ID] = p.Name
+    m.namesMu.Unlock()
+    route := routeFrom(ctx)
+    code := "error"
+    if err == nil { code = strconv.Itoa(resp.StatusCode) }
+    m.upstreamRequests.add(1, p.Name, model, endpoint, route, code)
+    m.upstreamDuration.observe(time.Since(started).Seconds(), p.Name, model, endpoint, route)
+    if err != nil || resp.StatusCode >= 400 {
+        m.upstreamErrors.add(1, p.Name, endpoint, code)
+    }
+    if err == nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+        m.streams.add(1, p.Name)
+        resp.Body = &meteredStream{ReadCloser: resp.Body, m: m, provider: p.Name, model: model, route: route, started: started}
+    }
+}
+
+// meteredStream observes time to first token and the in-flight stream gauge.
+type meteredStream struct {
+    io.ReadCloser
+    m                      *metrics
+    provider, model, route string
+    started                time.Time
+    first, done            sync.Once
+}
+
+func (s *meteredStream) Read(p []byte) (int, error) {
+    n, err := s.ReadCloser.Read(p)
+    if n > 0 {
+        s.first.Do(func() { s.m.ttft.observe(time.Since(s.started).Seconds(), s.provider, s.model, s.route) })
+    }
+    if err != nil {
+        s.finish()
+    }
+    return n, err
+}
+
+func (s *meteredStream) Close() error {
+    err := s.ReadCloser.Close()
+    s.finish()
+    return err
+}
+
+func (s *meteredStream) finish() {
+    s.done.Do(func() { s.m.streams.add(-1, s.provider) })
+}
+
+// usage records the tokens of a logged request.
+func (m *metrics) usage(providerID uint, model string, u tokenUsage) {
+    if m == nil || u.PromptTokens+u.CompletionTokens == 0 {
+        return
+    }
+    m.namesMu.Lock()
+    name, ok := m.names[providerID]
+    m.namesMu.Unlock()
+    if !ok {
+        return
+    }
+    m.tokens.add(float64(u.PromptTokens), name, model, "in")
+    m.tokens.add(float64(u.CompletionTokens), name, model, "out")
+}
+
+// fallback records how one target of a router/ route fared: success,
+// next (5xx or 429, moved on), error (no response), rejected (other 4xx,
+// returned to the client), throttled (out of upstream quota) or queue_full.
+func (m *metrics) fallback(route, provider, outcome string) {
+    if m == nil {
+        return
+    }
+    m.fallbacks.add(1, route, provider, outcome)
+}
+
+func (m *metrics) fallbackExhausted(route string) {
+    if m == nil {
+        return
+    }
+    m.fallbackFailures.add(1, route)
+}
+
+// observeRequests counts API requests by route pattern, so IDs in paths
+// don't each become a series.
+func observeRequests(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        m := getApp(c).metrics
+        if m == nil {
+            return next(c)
+        }
+        started := time.Now()
+        err := next(c)
+        code := c.Response().Status
+        if !c.Response().Committed {
+            // The error handler writes the status after us
+            code = http.StatusInternalServerError
+            if he, ok := err.(*echo.HTTPError); ok { code = he.Code }
+        }
+        method := c.Request().Method
+        m.httpRequests.add(1, c.Path(), method, strconv.Itoa(code))
+        m.httpDuration.observe(time.Since(started).Seconds(), c.Path(), method)
+        return err
+    }
+}
+
+// handleMetrics serves the Prometheus text format, guarded by metrics.token
+// when one is set.
+func handleMetrics(c echo.Context) error {
+    app := getApp(c)
+    if token := app.Config.Metrics.Token; token != "" {
+        got := c.Request().Header.Get("Authorization")
+        if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+            return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"})
+        }
+    }
+    var b strings.Builder
+    for _, v := range app.metrics.all {
+        v.write(&b)
+    }
+    for _, v := range scrapeMetrics(app) {
+        v.write(&b)
+    }
+    return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+// scrapeMetrics reads the gauges whose state is kept elsewhere.
+func scrapeMetrics(app *App) []*metricVec {
+    n := app.metrics.maxSeries
+    active := newMetricVec("llmrouter_queue_active_requests", "Upstream calls holding a concurrency slot, for providers with max_concurrent.", "gauge", n, "provider")
+    waiting := newMetricVec("llmrouter_queue_waiting_requests", "Requests waiting for a concurrency slot.", "gauge", n, "provider")
+    queueFailures := newMetricVec("llmrouter_queue_failures_total", "Requests that got no concurrency slot, by reason.", "counter", n, "provider", "reason")
+    creds := newMetricVec("llmrouter_upstream_credentials", "Enabled API keys per provider (1 without a key pool).", "gauge", n, "provider")
+    blocked := newMetricVec("llmrouter_upstream_credentials_blocked", "Keys out of rotation after a 401 or 429, or until their rate limit resets.", "gauge", n, "provider")
+    open := newMetricVec("llmrouter_upstream_circuit_open", "1 while every key of a provider is blocked and requests are held back or answered 429.", "gauge", n, "provider")
+    out := []*metricVec{active, waiting, queueFailures, creds, blocked, open}
+
+    var providers []Provider
+    app.DB.Where("enabled = ?", true).Find(&providers)
+    var keys []ProviderKey
+    app.DB.Select("id", "provider_id").Where("enabled = ?", true).Find(&keys)
+    pool := map[uint][]credential{}
+    for _, k := range keys {
+        pool[k.ProviderID] = append(pool[k.ProviderID], credential{k.ProviderID, k.ID})
+    }
+    for _, p := range providers {
+        if st := app.gates.stats(p); st != nil {
+            active.set(float64(st.Active), p.Name)
+            waiting.set(float64(st.Waiting), p.Name)
+            queueFailures.set(float64(st.RejectedTotal), p.Name, "queue_full")
+            queueFailures.set(float64(st.TimeoutsTotal), p.Name, "queue_timeout")
+        }
+        cs := pool[p.ID]
+        if len(cs) == 0 { cs = []credential{{ProviderID: p.ID}} }
+        nBlocked := 0
+        for _, cr := range cs {
+            if app.quotas.wait(cr, 0) > 0 { nBlocked++ }
+        }
+        creds.set(float64(len(cs)), p.Name)
+        blocked.set(float64(nBlocked), p.Name)
+        isOpen := 0.0
+        if nBlocked == len(cs) { isOpen = 1 }
+        open.set(isOpen, p.Name)
+    }
+
+    if sqlDB, err := app.DB.DB(); err == nil {
+        st := sqlDB.Stats()
+        conns := newMetricVec("llmrouter_db_connections", "Database pool connections by state.", "gauge", n, "state")
+        conns.set(float64(st.InUse), "in_use")
+        conns.set(float64(st.Idle), "idle")
+        maxOpen := newMetricVec("llmrouter_db_max_open_connections", "Database pool size limit (0 is unlimited).", "gauge", n)
+        maxOpen.set(float64(st.MaxOpenConnections))
+        waits := newMetricVec("llmrouter_db_wait_total", "Times a query waited for a free connection.", "counter", n)
+        waits.set(float64(st.WaitCount))
+        waited := newMetricVec("llmrouter_db_wait_seconds_total", "Time spent waiting for a free connection.", "counter", n)
+        waited.set(st.WaitDuration.Seconds())
+        out = append(out, conns, maxOpen, waits, waited)
+    }
+    return out
+}
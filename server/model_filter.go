@@ -0,0 +1,165 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/labstack/echo/v4"
+)
+
+type manualModelReq struct {
+    Name        string `json:"name"`
+    DisplayName string `json:"display_name"`
+    Enabled     *bool  `json:"enabled"`
+}
+
+// compileModelPattern turns a glob ("gpt-4o*", "ft:*") or a "re:"-prefixed
+// regular expression into an anchored regexp.
+func compileModelPattern(pattern string) (*regexp.Regexp, error) {
+    pattern = strings.TrimSpace(pattern)
+    if strings.HasPrefix(pattern, "re:") {
+        return regexp.Compile("^(?:" + strings.TrimPrefix(pattern, "re:") + ")$")
+    }
+    var b strings.Builder
+    b.WriteString("^")
+    for _, r := range pattern {
+        switch r {
+        case '*':
+            b.WriteString(".*")
+        case '?':
+            b.WriteString(".")
+        default:
+            b.WriteString(regexp.QuoteMeta(string(r)))
+        }
+    }
+    b.WriteString("$")
+    return regexp.Compile(b.String())
+}
+
+func compileModelPatterns(patterns []string) ([]*regexp.Regexp, error) {
+    out := make([]*regexp.Regexp, 0, len(patterns))
+    for _, p := range patterns {
+        if strings.TrimSpace(p) == "" {
+            continue
+        }
+        re, err := compileModelPattern(p)
+        if err != nil {
+            return nil, fmt.Errorf("invalid pattern %q", p)
+        }
+        out = append(out, re)
+    }
+    return out, nil
+}
+
+func matchAny(res []*regexp.Regexp, name string) bool {
+    for _, re := range res {
+        if re.MatchString(name) {
+            return true
+        }
+    }
+    return false
+}
+
+// filterModels applies the provider's include/exclude patterns to upstream IDs
+// and merges enabled manual entries, which bypass the filters.
+func filterModels(p *Provider, upstream []string, manual []ModelEntry) []string {
+    include, err := compileModelPatterns(p.ModelInclude)
+    if err != nil {
+        include = nil
+    }
+    exclude, err := compileModelPatterns(p.ModelExclude)
+    if err != nil {
+        exclude = nil
+    }
+    seen := map[string]bool{}
+    out := make([]string, 0, len(upstream)+len(manual))
+    for _, name := range upstream {
+        if len(include) > 0 && !matchAny(include, name) {
+            continue
+        }
+        if matchAny(exclude, name) || seen[name] {
+            continue
+        }
+        seen[name] = true
+        out = append(out, name)
+    }
+    for _, m := range manual {
+        if !m.Enabled || m.Pulled || seen[m.Name] {
+            continue
+        }
+        seen[m.Name] = true
+        out = append(out, m.Name)
+    }
+    sort.Strings(out)
+    return out
+}
+
+// publishModels filters upstream IDs for p and stores the result in the runtime cache.
+func publishModels(app *App, p *Provider, upstream []string) []string {
+    var manual []ModelEntry
+    _ = app.DB.Where("provider_id = ?", p.ID).Find(&manual).Error
+    names := filterModels(p, upstream, manual)
+    app.SetPulled(p.ID, names)
+    return names
+}
+
+func listManualModels(c echo.Context) error {
+    app := getApp(c)
+    var models []ModelEntry
+    if err := app.DB.Where("provider_id = ?", c.Param("id")).Order("name ASC").Find(&models).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, models)
+}
+
+func createManualModel(c echo.Context) error {
+    app := getApp(c)
+    var p Provider
+    if err := app.DB.First(&p, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req manualModelReq
+    if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    m := ModelEntry{ProviderID: p.ID, Name: strings.TrimSpace(req.Name), DisplayName: req.DisplayName, Enabled: true}
+    if req.Enabled != nil {
+        m.Enabled = *req.Enabled
+    }
+    if err := app.DB.Create(&m).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "model exists"})
+    }
+    audit(c, "provider.model_create", "provider", p.ID, nil, m)
+    refreshAfterManualChange(app, &p)
+    return c.JSON(http.StatusCreated, m)
+}
+
+func deleteManualModel(c echo.Context) error {
+    app := getApp(c)
+    var p Provider
+    if err := app.DB.First(&p, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var m ModelEntry
+    if err := app.DB.Where("id = ? AND provider_id = ?", c.Param("mid"), p.ID).First(&m).Error; err != nil {
+        return c.NoContent(http.StatusNoContent) // already gone
+    }
+    if err := app.DB.Unscoped().Delete(&m).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "provider.model_delete", "provider", p.ID, m, nil)
+    refreshAfterManualChange(app, &p)
+    return c.NoContent(http.StatusNoContent)
+}
+
+// refreshAfterManualChange republishes the cache from the last upstream pull
+// so manual additions and removals apply without calling the provider.
+func refreshAfterManualChange(app *App, p *Provider) {
+    if !p.Enabled {
+        return
+    }
+    publishModels(app, p, app.getUpstream(p.ID))
+}
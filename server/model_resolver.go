@@ -1,6 +1,10 @@
 package server
 
-import "strings"
+import (
+    "strings"
+
+    "github.com/labstack/echo/v4"
+)
 
 // resolveQualifiedModel requires the form "provider/model" and returns
 // the matched Provider and the raw upstream model id (without provider prefix).
@@ -34,3 +38,19 @@ func resolveQualifiedModel(app *App, qualified string) (Provider, string, bool)
     }
     return Provider{}, "", false
 }
+
+// resolveRequestModel is resolveQualifiedModel for a proxied request, traced
+// as part of the request.
+func resolveRequestModel(c echo.Context, app *App, qualified string) (Provider, string, bool) {
+    _, sp := app.tracer.start(c.Request().Context(), "model.resolve", spanInternal)
+    defer sp.finish()
+    sp.set("llmrouter.model", qualified)
+    p, raw, ok := resolveQualifiedModel(app, qualified)
+    if !ok {
+        sp.fail("unknown model")
+        return p, raw, ok
+    }
+    sp.set("llmrouter.provider", p.Name)
+    sp.set("gen_ai.request.model", raw)
+    return p, raw, ok
+}
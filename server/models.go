@@ -17,6 +17,32 @@ type User struct {
     Role         string         `gorm:"size:32" json:"role"`
     Disabled     bool           `json:"disabled"`
     MustChangePassword bool     `gorm:"default:false" json:"must_change_password"`
+    // Service accounts have no password and authenticate with admin tokens or API keys
+    ServiceAccount bool         `gorm:"default:false" json:"service_account"`
+    // Team membership (0 = none); TeamRole is member|admin
+    TeamID       uint           `gorm:"index" json:"team_id"`
+    TeamRole     string         `gorm:"size:16" json:"team_role"`
+    // OIDC subject ("sub") of a linked single sign-on identity
+    OIDCSubject  string         `gorm:"column:oidc_subject;index;size:255" json:"oidc_subject,omitempty"`
+    // Directory entry of an LDAP account; its password lives in the directory
+    LDAPDN       string         `gorm:"column:ldap_dn;index;size:512" json:"ldap_dn,omitempty"`
+    // Two-factor: the TOTP secret once enrolled, and one offered by setup until confirmed
+    TOTPSecret        string   `gorm:"column:totp_secret;size:64" json:"-"`
+    TOTPPendingSecret string   `gorm:"column:totp_pending_secret;size:64" json:"-"`
+    TOTPEnabled       bool     `gorm:"column:totp_enabled;default:false" json:"totp_enabled"`
+    // Set by an admin to make two-factor mandatory for this user
+    TOTPRequired      bool     `gorm:"column:totp_required;default:false" json:"totp_required"`
+    TOTPLastStep      int64    `gorm:"column:totp_last_step" json:"-"` // last accepted step, against replay
+    RecoveryCodes     []string `gorm:"serializer:json" json:"-"`       // hashed, each usable once
+    // Failed logins within the lockout window, and the lockout they led to
+    FailedLogins      int        `gorm:"default:0" json:"-"`
+    LastFailedLoginAt *time.Time `json:"-"`
+    LockedUntil       *time.Time `json:"locked_until"`
+    // When the outstanding invite was sent; cleared once the user sets a password
+    InvitedAt         *time.Time `json:"invited_at,omitempty"`
+    RateLimits
+    // Ceiling for all of the user's requests, including every key
+    Scopes
     APIKeys      []APIKey       `json:"-"`
 }
 
@@ -41,8 +67,109 @@ type APIKey struct {
     Name      string    `gorm:"size:255" json:"name"`
     Prefix    string    `gorm:"size:24;index" json:"prefix"`
     Hash      string    `json:"-"`
+    // Team that owns the key (0 = personal); UserID is then its creator
+    TeamID    uint      `gorm:"index" json:"team_id"`
+    // Optional; expired keys are rejected with api_key_expired
+    ExpiresAt *time.Time `json:"expires_at"`
+    // Updated in the background, so may lag a few seconds
+    LastUsedAt *time.Time `json:"last_used_at"`
+    LastUsedIP string     `gorm:"size:64" json:"last_used_ip"`
+    // Secret replaced by the last rotation, accepted until PrevExpiresAt
+    PrevHash      string     `json:"-"`
+    PrevExpiresAt *time.Time `json:"prev_expires_at"`
+    RateLimits
+    Scopes
+    // Upstream queue priority: low|normal|high (empty = normal)
+    Priority  string    `gorm:"size:16" json:"priority"`
 }
 
+// Team groups users and owns shared keys, budgets and usage. Empty
+// ProviderIDs/Routes make every provider/route visible to members.
+type Team struct {
+    ID          uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+    Name        string    `gorm:"uniqueIndex;size:255" json:"name"`
+    ProviderIDs []uint    `gorm:"serializer:json" json:"provider_ids"`
+    Routes      []string  `gorm:"serializer:json" json:"routes"`
+}
+
+// Role is a named set of permissions assigned to users by name.
+type Role struct {
+    ID          uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+    Name        string    `gorm:"uniqueIndex;size:64" json:"name"`
+    Description string    `gorm:"size:255" json:"description"`
+    Permissions []string  `gorm:"serializer:json" json:"permissions"`
+    BuiltIn     bool      `json:"built_in"`
+}
+
+// AdminToken authenticates a service account on the admin API with a fixed set of permissions.
+type AdminToken struct {
+    ID          uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt   time.Time  `json:"created_at"`
+    UpdatedAt   time.Time  `json:"updated_at"`
+    UserID      uint       `gorm:"index" json:"user_id"`
+    Name        string     `gorm:"size:255" json:"name"`
+    Prefix      string     `gorm:"size:24;index" json:"prefix"`
+    Hash        string     `json:"-"`
+    // resource:read|write|* or "*"
+    Permissions []string   `gorm:"serializer:json" json:"permissions"`
+    ExpiresAt   *time.Time `json:"expires_at"`
+    LastUsedAt  *time.Time `json:"last_used_at"`
+}
+
+// Session is a signed-in browser. The session cookie's JWT carries its ID;
+// deleting the row signs that browser out.
+type Session struct {
+    ID         string    `gorm:"primaryKey;size:64" json:"id"`
+    CreatedAt  time.Time `json:"created_at"`
+    UserID     uint      `gorm:"index" json:"user_id"`
+    IP         string    `gorm:"size:64" json:"ip"`
+    UserAgent  string    `gorm:"size:512" json:"user_agent"`
+    LastSeenAt time.Time `json:"last_seen_at"`
+    ExpiresAt  time.Time `gorm:"index" json:"expires_at"`
+}
+
+// AuditEvent records one administrative change. Events are only ever
+// appended; nothing in the API updates or deletes them.
+type AuditEvent struct {
+    ID         uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt  time.Time `gorm:"index" json:"created_at"`
+    ActorID    uint      `gorm:"index" json:"actor_id"` // 0 for the system
+    Actor      string    `gorm:"size:255" json:"actor"`
+    Action     string    `gorm:"size:64;index" json:"action"` // e.g. provider.update
+    TargetType string    `gorm:"size:32;index" json:"target_type"`
+    TargetID   string    `gorm:"size:255;index" json:"target_id"`
+    // Changed fields; secrets show only whether they were set
+    Changes    map[string]AuditChange `gorm:"serializer:json" json:"changes,omitempty"`
+    IP         string    `gorm:"size:64" json:"ip"`
+    RequestID  string    `gorm:"size:64;index" json:"request_id"`
+}
+
+type AuditChange struct {
+    Before any `json:"before"`
+    After  any `json:"after"`
+}
+
+// RateLimits caps traffic per minute and in flight; zero means unlimited.
+type RateLimits struct {
+    RPM           int `json:"rpm"`            // requests per minute
+    TPM           int `json:"tpm"`            // tokens per minute
+    MaxConcurrent int `json:"max_concurrent"` // requests in flight
+}
+
+// Scopes restrict which models and /api/v1 endpoints a caller may use; empty lists allow everything.
+type Scopes struct {
+    // Patterns over qualified ids (provider/model, router/<name>, aliases); glob or "re:" regex
+    AllowedModels    []string `gorm:"serializer:json" json:"allowed_models"`
+    // chat|completions|embeddings|models
+    AllowedEndpoints []string `gorm:"serializer:json" json:"allowed_endpoints"`
+}
+
+func (l RateLimits) limited() bool { return l.RPM > 0 || l.TPM > 0 || l.MaxConcurrent > 0 }
+
 type Provider struct {
     ID          uint           `gorm:"primaryKey" json:"id"`
     CreatedAt   time.Time      `json:"created_at"`
@@ -52,12 +179,25 @@ type Provider struct {
     Type        string         `gorm:"size:64" json:"type"` // e.g., "openai"
     BaseURL     string         `gorm:"size:512" json:"base_url"`
     APIKey      string         `gorm:"size:1024" json:"-"` // never expose in API responses
+    // How requests pick among Keys: round_robin (default) or least_limited
+    KeyStrategy string         `gorm:"size:32" json:"key_strategy"`
+    // Upstream concurrency cap (0 = unlimited) and the wait queue in front of it
+    MaxConcurrent       int    `json:"max_concurrent"`
+    MaxQueue            int    `json:"max_queue"`
+    QueueTimeoutSeconds int    `json:"queue_timeout_seconds"`
     // PullModels field is removed: models are always pulled at runtime for OpenAI providers.
     Enabled     bool           `json:"enabled"`
-    // Models contains only DB-persisted models (for non-runtime providers, if any).
-    Models      []ModelEntry   `json:"-"`
+    // Include/exclude patterns applied to pulled model IDs (glob, or regex with "re:" prefix).
+    ModelInclude []string      `gorm:"serializer:json" json:"model_include"`
+    ModelExclude []string      `gorm:"serializer:json" json:"model_exclude"`
+    // Models contains DB-persisted manual models, added to the runtime list when enabled.
+    Models      []ModelEntry   `json:"models"`
     // RuntimeModels contains the list of models pulled at runtime (not persisted; source of truth for OpenAI providers).
     RuntimeModels []string     `gorm:"-" json:"runtime_models,omitempty"`
+    // Quota is the upstream rate limit headroom last reported by the provider.
+    Quota       *providerHeadroom `gorm:"-" json:"quota,omitempty"`
+    // Queue is the live state of the concurrency gate when MaxConcurrent is set.
+    Queue       *queueStats       `gorm:"-" json:"queue,omitempty"`
 }
 
 type ModelEntry struct {
@@ -70,26 +210,34 @@ type ModelEntry struct {
     DisplayName string         `gorm:"size:255" json:"display_name"`
     Enabled     bool           `json:"enabled"`
     Pulled      bool           `json:"pulled"` // if true, not editable; for legacy/manual models only
-    // Note: For OpenAI providers, models are not persisted in the DB; see Provider.RuntimeModels.
+    // Note: Pulled models are not persisted in the DB; see Provider.RuntimeModels.
+    // Manual entries (Pulled=false) cover IDs missing from a provider's /models.
 }
 
 type UsageLog struct {
     ID         uint      `gorm:"primaryKey" json:"id"`
-    CreatedAt  time.Time `json:"created_at"`
+    CreatedAt  time.Time `gorm:"index" json:"created_at"`
     UserID     uint      `gorm:"index" json:"user_id"`
     APIKeyID   uint      `gorm:"index" json:"api_key_id"`
+    TeamID     uint      `gorm:"index" json:"team_id"`
     ProviderID uint      `gorm:"index" json:"provider_id"`
-    Model      string    `gorm:"size:255" json:"model"`
+    Model      string    `gorm:"size:255;index" json:"model"`
+    // Raw provider model the request was billed against (differs from Model for router/ and aliases)
+    UpstreamModel string `gorm:"size:255" json:"upstream_model"`
     Status     int       `json:"status"`
     LatencyMs  int64     `json:"latency_ms"`
     Messages   int       `json:"messages"`
     TokensIn   int       `json:"tokens_in"`
     TokensOut  int       `json:"tokens_out"`
+    CachedTokens int     `json:"cached_tokens"`
+    Images     int       `json:"images"`
+    AudioSeconds float64 `json:"audio_seconds"`
+    // USD, computed at log time from the price in effect then
     Cost       float64   `json:"cost"`
 }
 
 func migrate(db *gorm.DB) error {
-    return db.AutoMigrate(&User{}, &APIKey{}, &Provider{}, &ModelEntry{}, &UsageLog{}, &FallbackRoute{}, &FallbackTarget{})
+    return db.AutoMigrate(&User{}, &APIKey{}, &Provider{}, &ModelEntry{}, &UsageLog{}, &FallbackRoute{}, &FallbackTarget{}, &ModelAlias{}, &ModelInfo{}, &ModelPrice{}, &Budget{}, &ModelRateLimit{}, &RateLimitWindow{}, &ProviderKey{}, &AdminToken{}, &Team{}, &Role{}, &Session{}, &AuditEvent{})
 }
 
 // Fallback routing models
@@ -115,3 +263,123 @@ type FallbackTarget struct {
     // 0-based priority (lower is higher priority)
     Position    int            `gorm:"index" json:"position"`
 }
+
+// ModelAlias maps an admin-defined model id (e.g. "gpt-default" or "team/chat")
+// to a qualified provider/model, a router/<name> route, or another alias.
+// Deprecated entries name a real provider/model id and redirect requests for it
+// to Target once the upstream model is no longer in the pulled cache.
+type ModelAlias struct {
+    ID          uint           `gorm:"primaryKey" json:"id"`
+    CreatedAt   time.Time      `json:"created_at"`
+    UpdatedAt   time.Time      `json:"updated_at"`
+    DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+    Name        string         `gorm:"size:255;uniqueIndex" json:"name"`
+    Target      string         `gorm:"size:255" json:"target"`
+    // Optional scheduled retarget: from SwitchAt onwards NextTarget is used
+    NextTarget  string         `gorm:"size:255" json:"next_target"`
+    SwitchAt    *time.Time     `json:"switch_at"`
+    Deprecated  bool           `json:"deprecated"`
+    Enabled     bool           `json:"enabled"`
+    // EffectiveTarget is the target in force right now (not persisted)
+    EffectiveTarget string     `gorm:"-" json:"effective_target,omitempty"`
+}
+
+// TargetAt returns the target that applies at time t, honoring a scheduled switch.
+func (a *ModelAlias) TargetAt(t time.Time) string {
+    if a.NextTarget != "" && a.SwitchAt != nil && !t.Before(*a.SwitchAt) {
+        return a.NextTarget
+    }
+    return a.Target
+}
+
+// ModelInfo is the metadata catalog entry for one provider/model. Zero values
+// and nil capabilities mean unknown. Prices are USD per 1M tokens.
+type ModelInfo struct {
+    ID              uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt       time.Time `json:"created_at"`
+    UpdatedAt       time.Time `json:"updated_at"`
+    ProviderID      uint      `gorm:"index:provider_model_info,unique" json:"provider_id"`
+    Model           string    `gorm:"size:255;index:provider_model_info,unique" json:"model"`
+    ContextWindow   int       `json:"context_window"`
+    MaxOutputTokens int       `json:"max_output_tokens"`
+    Vision          *bool     `json:"vision"`
+    Audio           *bool     `json:"audio"`
+    Tools           *bool     `json:"tools"`
+    JSONMode        *bool     `json:"json_mode"`
+    InputPrice      float64   `json:"input_price"`
+    OutputPrice     float64   `json:"output_price"`
+    // "provider" when seeded from a /models response, "admin" once edited (never overwritten by pulls)
+    Source          string    `gorm:"size:16" json:"source"`
+}
+
+// ModelPrice is one entry in a model's price history. Rows are append-only:
+// a reprice adds a row with a later EffectiveFrom, so past usage keeps the
+// cost it was logged with. Token prices are USD per 1M tokens.
+type ModelPrice struct {
+    ID              uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt       time.Time `json:"created_at"`
+    ProviderID      uint      `gorm:"index:provider_model_price" json:"provider_id"`
+    Model           string    `gorm:"size:255;index:provider_model_price" json:"model"`
+    EffectiveFrom   time.Time `gorm:"index" json:"effective_from"`
+    InputPerM       float64   `json:"input_per_m"`
+    OutputPerM      float64   `json:"output_per_m"`
+    CachedInputPerM float64   `json:"cached_input_per_m"`
+    PerImage        float64   `json:"per_image"`
+    PerAudioSecond  float64   `json:"per_audio_second"`
+}
+
+// Budget caps spend for a user, an API key or a team over a daily or monthly period,
+// in USD, tokens, or both (zero means no limit for that unit).
+type Budget struct {
+    ID          uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+    Scope       string    `gorm:"size:16;index:budget_scope" json:"scope"` // user|key|team
+    ScopeID     uint      `gorm:"index:budget_scope" json:"scope_id"`
+    Period      string    `gorm:"size:16" json:"period"` // daily|monthly (UTC)
+    LimitUSD    float64   `json:"limit_usd"`
+    LimitTokens int64     `json:"limit_tokens"`
+    // Percent levels that trigger a notification once per period
+    Thresholds  []int     `gorm:"serializer:json" json:"thresholds"`
+    Enabled     bool      `json:"enabled"`
+    // Highest threshold already notified in NotifiedPeriod
+    NotifiedLevel  int    `json:"notified_level"`
+    NotifiedPeriod string `gorm:"size:16" json:"notified_period"`
+}
+
+// ModelRateLimit caps traffic to one provider model across all callers.
+type ModelRateLimit struct {
+    ID         uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt  time.Time `json:"created_at"`
+    UpdatedAt  time.Time `json:"updated_at"`
+    ProviderID uint      `gorm:"index:provider_model_limit,unique" json:"provider_id"`
+    Model      string    `gorm:"size:255;index:provider_model_limit,unique" json:"model"`
+    RateLimits
+}
+
+// RateLimitWindow is a per-minute counter used by the database rate limit
+// backend so that several instances share RPM/TPM usage.
+type RateLimitWindow struct {
+    Subject  string `gorm:"primaryKey;size:128"`
+    Minute   int64  `gorm:"primaryKey;autoIncrement:false"` // unix time / 60
+    Requests int64
+    Tokens   int64
+}
+
+// ProviderKey is one upstream credential in a provider's key pool. When a
+// provider has enabled pool keys they are used instead of Provider.APIKey.
+type ProviderKey struct {
+    ID          uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt   time.Time  `json:"created_at"`
+    UpdatedAt   time.Time  `json:"updated_at"`
+    ProviderID  uint       `gorm:"index" json:"provider_id"`
+    Name        string     `gorm:"size:255" json:"name"`
+    Key         string     `gorm:"size:1024" json:"-"`
+    Enabled     bool       `json:"enabled"`
+    // Usage counters, updated as requests are sent
+    Requests     int64      `json:"requests"`
+    RateLimited  int64      `json:"rate_limited"`
+    AuthFailures int64      `json:"auth_failures"`
+    LastUsedAt   *time.Time `json:"last_used_at"`
+    LastRateLimitedAt *time.Time `json:"last_rate_limited_at"`
+}
@@ -2,6 +2,7 @@ package server
 
 import (
     "net/http"
+    "strings"
 
     "github.com/labstack/echo/v4"
 )
@@ -18,6 +19,8 @@ func listModels(c echo.Context) error {
         ProviderID   uint   `json:"provider_id"`
         ProviderName string `json:"provider_name"`
         Name         string `json:"name"`
+        // Qualified id clients send as "model"
+        ID           string `json:"id"`
     }
     var providers []Provider
     // Query all enabled providers (pull_models is deprecated/removed)
@@ -27,15 +30,29 @@ func listModels(c echo.Context) error {
     resp := []runtimeModel{}
     for _, p := range providers {
         for _, name := range app.GetPulled(p.ID) {
-            resp = append(resp, runtimeModel{ProviderID: p.ID, ProviderName: p.Name, Name: name})
+            id := strings.ToLower(p.Name) + "/" + name
+            if !callerAllowsModel(c, id, "") {
+                continue
+            }
+            resp = append(resp, runtimeModel{ProviderID: p.ID, ProviderName: p.Name, Name: name, ID: id})
         }
     }
     // Include enabled router fallback entries for discovery purposes
     var routes []FallbackRoute
     if err := app.DB.Where("enabled = ?", true).Find(&routes).Error; err == nil {
         for _, r := range routes {
-            resp = append(resp, runtimeModel{ProviderID: 0, ProviderName: "router", Name: r.Name})
+            if !callerAllowsModel(c, "router/"+r.Name, "") {
+                continue
+            }
+            resp = append(resp, runtimeModel{ProviderID: 0, ProviderName: "router", Name: r.Name, ID: "router/" + r.Name})
         }
     }
+    // Aliases are addressed by their own name
+    for _, name := range listAliasIDs(app) {
+        if target, _ := resolveAlias(app, name); !callerAllowsModel(c, name, target) {
+            continue
+        }
+        resp = append(resp, runtimeModel{ProviderID: 0, ProviderName: "alias", Name: name, ID: name})
+    }
     return c.JSON(http.StatusOK, resp)
 }
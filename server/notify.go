@@ -0,0 +1,34 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "time"
+)
+
+// notify records an operational event in the log and, when configured, POSTs
+// it to the notifications webhook. Delivery is best-effort and asynchronous.
+func notify(app *App, event string, fields map[string]any) {
+    log.Printf("notify: %s %v", event, fields)
+    url := app.Config.Notifications.WebhookURL
+    if v := os.Getenv("NOTIFY_WEBHOOK_URL"); v != "" { url = v }
+    if url == "" {
+        return
+    }
+    body, _ := json.Marshal(map[string]any{"event": event, "time": time.Now().UTC(), "data": fields})
+    go func() {
+        client := &http.Client{Timeout: 10 * time.Second}
+        resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+        if err != nil {
+            log.Printf("notify: webhook error: %v", err)
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+            log.Printf("notify: webhook status %d", resp.StatusCode)
+        }
+    }()
+}
@@ -0,0 +1,487 @@
+package server
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/labstack/echo/v4"
+)
+
+// The login flow keeps its state, nonce and PKCE verifier in a short-lived
+// signed cookie, so any instance can handle the callback.
+const (
+    oidcStateCookie = "oidc_state"
+    oidcStateTTL    = 10 * time.Minute
+    // Unknown key IDs refetch the JWKS at most this often
+    oidcJWKSRefresh = time.Minute
+)
+
+// oidcClient holds the issuer's discovered endpoints and signing keys.
+type oidcClient struct {
+    cfg      OIDCConfig
+    http     *http.Client
+    mu       sync.Mutex
+    meta     *oidcMetadata
+    keys     map[string]any // kid -> *rsa.PublicKey | *ecdsa.PublicKey
+    keysAt   time.Time
+}
+
+type oidcMetadata struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+    State    string `json:"state"`
+    Nonce    string `json:"nonce"`
+    Verifier string `json:"verifier"`
+    Next     string `json:"next"`
+    jwt.RegisteredClaims
+}
+
+func newOIDCClient(cfg OIDCConfig) (*oidcClient, error) {
+    if cfg.Issuer == "" || cfg.ClientID == "" {
+        return nil, fmt.Errorf("oidc: issuer and client_id are required")
+    }
+    cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+    return &oidcClient{cfg: cfg, http: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func registerOIDCRoutes(g *echo.Group) {
+    g.GET("/auth/methods", handleAuthMethods)
+    g.GET("/auth/oidc/login", handleOIDCLogin)
+    g.GET("/auth/oidc/callback", handleOIDCCallback)
+}
+
+// handleAuthMethods tells the login page which sign-in options to offer.
+func handleAuthMethods(c echo.Context) error {
+    cfg := getApp(c).Config.OIDC
+    resp := echo.Map{"password_login": true, "password_min_length": getApp(c).passwords.minLength, "password_reset": selfServiceReset(getApp(c)), "oidc": echo.Map{"enabled": false}}
+    if cfg.Enabled {
+        resp["password_login"] = !cfg.DisablePasswordLogin
+        resp["oidc"] = echo.Map{"enabled": true, "label": cfg.Label}
+    }
+    return c.JSON(http.StatusOK, resp)
+}
+
+// passwordLoginAllowed reports whether email may sign in with a password.
+func passwordLoginAllowed(app *App, email string) bool {
+    cfg := app.Config.OIDC
+    if !cfg.Enabled || !cfg.DisablePasswordLogin {
+        return true
+    }
+    breakGlass := cfg.BreakGlassUser
+    if breakGlass == "" { breakGlass = app.Config.Admin.SeedUser }
+    return email == strings.ToLower(breakGlass)
+}
+
+// handleOIDCLogin redirects to the issuer's authorization endpoint (code flow with PKCE).
+func handleOIDCLogin(c echo.Context) error {
+    app := getApp(c)
+    if app.oidc == nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "oidc disabled"})
+    }
+    meta, err := app.oidc.metadata()
+    if err != nil {
+        log.Printf("oidc: discovery: %v", err)
+        return c.JSON(http.StatusBadGateway, echo.Map{"error": "oidc issuer unavailable"})
+    }
+    st := oidcState{State: randomToken(16), Nonce: randomToken(16), Verifier: randomToken(32), Next: safeNext(c.QueryParam("next"))}
+    st.ExpiresAt = jwt.NewNumericDate(time.Now().Add(oidcStateTTL))
+    signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &st).SignedString(derivedKey(app, "oidc-state"))
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "auth error"})
+    }
+    c.SetCookie(&http.Cookie{
+        Name:     oidcStateCookie,
+        Value:    signed,
+        Path:     "/api/auth/oidc",
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+        Expires:  time.Now().Add(oidcStateTTL),
+    })
+    challenge := sha256.Sum256([]byte(st.Verifier))
+    q := url.Values{
+        "response_type":         {"code"},
+        "client_id":             {app.oidc.cfg.ClientID},
+        "redirect_uri":          {oidcRedirectURL(c, app)},
+        "scope":                 {strings.Join(app.oidc.cfg.Scopes, " ")},
+        "state":                 {st.State},
+        "nonce":                 {st.Nonce},
+        "code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+        "code_challenge_method": {"S256"},
+    }
+    sep := "?"
+    if strings.Contains(meta.AuthorizationEndpoint, "?") { sep = "&" }
+    return c.Redirect(http.StatusFound, meta.AuthorizationEndpoint+sep+q.Encode())
+}
+
+// handleOIDCCallback exchanges the code, verifies the ID token, provisions the
+// user and starts a normal session. Failures go back to the login page.
+func handleOIDCCallback(c echo.Context) error {
+    app := getApp(c)
+    if app.oidc == nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "oidc disabled"})
+    }
+    fail := func(msg string) error {
+        return c.Redirect(http.StatusFound, "/?sso_error="+url.QueryEscape(msg))
+    }
+    c.SetCookie(&http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/auth/oidc", HttpOnly: true, MaxAge: -1})
+    cookie, err := c.Cookie(oidcStateCookie)
+    if err != nil {
+        return fail("login expired, try again")
+    }
+    var st oidcState
+    if _, err := jwt.ParseWithClaims(cookie.Value, &st, func(*jwt.Token) (interface{}, error) {
+        return derivedKey(app, "oidc-state"), nil
+    }, jwt.WithValidMethods([]string{"HS256"})); err != nil {
+        return fail("login expired, try again")
+    }
+    if e := c.QueryParam("error"); e != "" {
+        return fail("issuer error: " + e)
+    }
+    if !hmac.Equal([]byte(c.QueryParam("state")), []byte(st.State)) {
+        return fail("invalid state")
+    }
+    claims, err := app.oidc.exchange(c.QueryParam("code"), st.Verifier, oidcRedirectURL(c, app))
+    if err != nil {
+        log.Printf("oidc: %v", err)
+        return fail("sign-in failed")
+    }
+    if nonce, _ := claims["nonce"].(string); !hmac.Equal([]byte(nonce), []byte(st.Nonce)) {
+        return fail("invalid nonce")
+    }
+    u, err := provisionOIDCUser(app, claims)
+    if err != nil {
+        return fail(err.Error())
+    }
+    if err := setSessionCookie(c, app, u); err != nil {
+        return fail("auth error")
+    }
+    return c.Redirect(http.StatusFound, st.Next)
+}
+
+// exchange redeems an authorization code and returns the verified ID token claims.
+func (o *oidcClient) exchange(code, verifier, redirectURL string) (jwt.MapClaims, error) {
+    meta, err := o.metadata()
+    if err != nil {
+        return nil, fmt.Errorf("discovery: %w", err)
+    }
+    form := url.Values{
+        "grant_type":    {"authorization_code"},
+        "code":          {code},
+        "redirect_uri":  {redirectURL},
+        "client_id":     {o.cfg.ClientID},
+        "code_verifier": {verifier},
+    }
+    req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if o.cfg.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+    }
+    resp, err := o.http.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("token request: %w", err)
+    }
+    defer resp.Body.Close()
+    var tok struct {
+        IDToken string `json:"id_token"`
+        Error   string `json:"error"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+        return nil, fmt.Errorf("token response: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+        return nil, fmt.Errorf("token endpoint: status %d %s", resp.StatusCode, tok.Error)
+    }
+    claims := jwt.MapClaims{}
+    _, err = jwt.ParseWithClaims(tok.IDToken, claims, o.keyFor,
+        jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384"}),
+        jwt.WithIssuer(meta.Issuer),
+        jwt.WithAudience(o.cfg.ClientID),
+        jwt.WithExpirationRequired(),
+        jwt.WithLeeway(time.Minute))
+    if err != nil {
+        return nil, fmt.Errorf("id token: %w", err)
+    }
+    return claims, nil
+}
+
+// metadata fetches the issuer's discovery document once and caches it.
+func (o *oidcClient) metadata() (*oidcMetadata, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if o.meta != nil {
+        return o.meta, nil
+    }
+    var meta oidcMetadata
+    if err := o.getJSON(o.cfg.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+        return nil, err
+    }
+    if strings.TrimSuffix(meta.Issuer, "/") != o.cfg.Issuer {
+        return nil, fmt.Errorf("issuer mismatch: %q", meta.Issuer)
+    }
+    if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+        return nil, fmt.Errorf("incomplete discovery document")
+    }
+    o.meta = &meta
+    return o.meta, nil
+}
+
+// keyFor returns the issuer key that signed an ID token, refetching the JWKS
+// when the key ID is unknown (the issuer rotated its keys).
+func (o *oidcClient) keyFor(t *jwt.Token) (interface{}, error) {
+    kid, _ := t.Header["kid"].(string)
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if k, ok := o.keys[kid]; ok {
+        return k, nil
+    }
+    if time.Since(o.keysAt) < oidcJWKSRefresh {
+        return nil, fmt.Errorf("unknown key %q", kid)
+    }
+    var set struct {
+        Keys []struct {
+            Kid string `json:"kid"`
+            Kty string `json:"kty"`
+            Use string `json:"use"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+            Crv string `json:"crv"`
+            X   string `json:"x"`
+            Y   string `json:"y"`
+        } `json:"keys"`
+    }
+    if err := o.getJSON(o.meta.JWKSURI, &set); err != nil {
+        return nil, fmt.Errorf("jwks: %w", err)
+    }
+    o.keys, o.keysAt = map[string]any{}, time.Now()
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        switch k.Kty {
+        case "RSA":
+            n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+            e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+            if err1 != nil || err2 != nil {
+                continue
+            }
+            o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+        case "EC":
+            var curve elliptic.Curve
+            switch k.Crv {
+            case "P-256":
+                curve = elliptic.P256()
+            case "P-384":
+                curve = elliptic.P384()
+            default:
+                continue
+            }
+            x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+            y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+            if err1 != nil || err2 != nil {
+                continue
+            }
+            o.keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        }
+    }
+    if k, ok := o.keys[kid]; ok {
+        return k, nil
+    }
+    return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (o *oidcClient) getJSON(u string, out any) error {
+    resp, err := o.http.Get(u)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s: status %d", u, resp.StatusCode)
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// errOIDCConflict is returned when an ID token's email belongs to an account
+// it may not claim: the issuer didn't verify the email, or the account is
+// already bound to another subject.
+var errOIDCConflict = errors.New("an account with this email already exists")
+
+// provisionOIDCUser finds the user for an ID token, by subject and then by
+// verified email, creating it when auto-provisioning is on. An account found
+// by email is linked only if it has no subject yet. Role and team are synced
+// from the mapped claims on every login.
+func provisionOIDCUser(app *App, claims jwt.MapClaims) (*User, error) {
+    cfg := app.Config.OIDC
+    sub, _ := claims["sub"].(string)
+    if sub == "" {
+        return nil, errors.New("id token has no subject")
+    }
+    email := ""
+    if v := claimValues(claims, cfg.EmailClaim); len(v) > 0 {
+        email = strings.ToLower(strings.TrimSpace(v[0]))
+    }
+    var u User
+    err := app.DB.Where("oidc_subject = ?", sub).First(&u).Error
+    if err != nil && email != "" {
+        var existing User
+        if app.DB.Where("email = ?", email).First(&existing).Error == nil {
+            if claims["email_verified"] != true || existing.OIDCSubject != "" {
+                return nil, errOIDCConflict
+            }
+            u, err = existing, nil
+        }
+    }
+    if err != nil {
+        if !cfg.AutoProvision {
+            return nil, errors.New("no account for " + email)
+        }
+        if email == "" {
+            return nil, errors.New("id token has no email")
+        }
+        u = User{Email: email, Role: cfg.DefaultRole}
+    }
+    if u.Disabled || u.ServiceAccount {
+        return nil, errors.New("account disabled")
+    }
+    u.OIDCSubject = sub
+    prevRole, prevTeam := u.Role, u.TeamID
+    if cfg.RoleClaim != "" {
+        u.Role = cfg.DefaultRole
+        if role := mapOIDCRole(cfg, claimValues(claims, cfg.RoleClaim)); role != "" {
+            u.Role = role
+        }
+    }
+    if !roleExists(app, u.Role) {
+        log.Printf("oidc: role %q for %s does not exist, keeping %q", u.Role, email, prevRole)
+        u.Role = prevRole
+        if !roleExists(app, u.Role) {
+            return nil, errors.New("no valid role for " + email)
+        }
+    }
+    if cfg.TeamClaim != "" {
+        u.TeamID = 0
+        if name := mapOIDCTeam(cfg, claimValues(claims, cfg.TeamClaim)); name != "" {
+            var t Team
+            if err := app.DB.Where("name = ?", name).First(&t).Error; err == nil {
+                u.TeamID = t.ID
+            } else {
+                log.Printf("oidc: team %q for %s does not exist", name, email)
+            }
+        }
+        if u.TeamID != prevTeam {
+            u.TeamRole = ""
+            if u.TeamID != 0 { u.TeamRole = "member" }
+        }
+    }
+    if err := app.DB.Save(&u).Error; err != nil {
+        return nil, errors.New("could not save account")
+    }
+    if u.Role != prevRole || u.TeamID != prevTeam {
+        app.keyCache.invalidateUser(u.ID)
+    }
+    if u.Role != prevRole {
+        revokeSessions(app, u.ID, "")
+    }
+    return &u, nil
+}
+
+func roleExists(app *App, name string) bool {
+    return name != "" && app.DB.Where("name = ?", name).First(&Role{}).Error == nil
+}
+
+func mapOIDCRole(cfg OIDCConfig, values []string) string {
+    for _, m := range cfg.RoleMapping {
+        for _, v := range values {
+            if v == m.Value {
+                return m.Role
+            }
+        }
+    }
+    return ""
+}
+
+func mapOIDCTeam(cfg OIDCConfig, values []string) string {
+    for _, m := range cfg.TeamMapping {
+        for _, v := range values {
+            if v == m.Value {
+                return m.Team
+            }
+        }
+    }
+    return ""
+}
+
+// claimValues reads a string or string-array claim; path may be dotted
+// (e.g. "realm_access.roles").
+func claimValues(claims jwt.MapClaims, path string) []string {
+    var cur any = map[string]any(claims)
+    for _, part := range strings.Split(path, ".") {
+        m, ok := cur.(map[string]any)
+        if !ok {
+            return nil
+        }
+        cur = m[part]
+    }
+    switch v := cur.(type) {
+    case string:
+        return []string{v}
+    case []any:
+        out := make([]string, 0, len(v))
+        for _, x := range v {
+            if s, ok := x.(string); ok {
+                out = append(out, s)
+            }
+        }
+        return out
+    }
+    return nil
+}
+
+func oidcRedirectURL(c echo.Context, app *App) string {
+    if app.oidc.cfg.RedirectURL != "" {
+        return app.oidc.cfg.RedirectURL
+    }
+    return c.Scheme() + "://" + c.Request().Host + "/api/auth/oidc/callback"
+}
+
+// safeNext keeps post-login redirects on this site.
+func safeNext(next string) string {
+    if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+        return "/"
+    }
+    return next
+}
+
+func randomToken(n int) string {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(b)
+}
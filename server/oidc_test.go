@@ -0,0 +1,293 @@
+package server
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "gorm.io/driver/sqlite"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+)
+
+// newTestApp returns an App on a fresh SQLite database with the built-in roles.
+func newTestApp(t *testing.T) *App {
+    t.Helper()
+    db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "app.db")), &gorm.Config{Logger: logger.Discard})
+    if err != nil {
+        t.Fatalf("open db: %v", err)
+    }
+    if err := migrate(db); err != nil {
+        t.Fatalf("migrate: %v", err)
+    }
+    app := &App{Config: defaultConfig(), DB: db, keyCache: newKeyCache(), creds: newCredCache(), quotas: newQuotaTracker()}
+    if app.passwords, err = newPasswordPolicy(app.Config.Auth.Password); err != nil {
+        t.Fatal(err)
+    }
+    if err := seedRoles(app); err != nil {
+        t.Fatalf("seed roles: %v", err)
+    }
+    return app
+}
+
+// fakeIdP is an OpenID provider that issues whatever ID token claims the test sets.
+type fakeIdP struct {
+    srv      *httptest.Server
+    key      *rsa.PrivateKey
+    kid      string
+    claims   jwt.MapClaims
+    tokenErr string // returned by the token endpoint instead of a token
+    form     map[string]string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &fakeIdP{key: key, kid: "k1"}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(oidcMetadata{
+            Issuer:                idp.srv.URL,
+            AuthorizationEndpoint: idp.srv.URL + "/authorize",
+            TokenEndpoint:         idp.srv.URL + "/token",
+            JWKSURI:               idp.srv.URL + "/jwks",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+            "kid": "k1", "kty": "RSA", "use": "sig",
+            "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }}})
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        idp.form = map[string]string{}
+        for k := range r.PostForm {
+            idp.form[k] = r.PostForm.Get(k)
+        }
+        if idp.tokenErr != "" {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": idp.tokenErr})
+            return
+        }
+        tok := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims)
+        tok.Header["kid"] = idp.kid
+        signed, err := tok.SignedString(key)
+        if err != nil {
+            t.Errorf("sign: %v", err)
+        }
+        json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+    })
+    idp.srv = httptest.NewServer(mux)
+    t.Cleanup(idp.srv.Close)
+    return idp
+}
+
+func (idp *fakeIdP) validClaims() jwt.MapClaims {
+    return jwt.MapClaims{
+        "iss":   idp.srv.URL,
+        "aud":   "router",
+        "sub":   "sub-1",
+        "email": "Ann@Example.com",
+        "exp":   time.Now().Add(time.Hour).Unix(),
+        "nonce": "n1",
+    }
+}
+
+func TestOIDCExchange(t *testing.T) {
+    idp := newFakeIdP(t)
+    tests := []struct {
+        name    string
+        edit    func(jwt.MapClaims)
+        kid     string
+        tokErr  string
+        wantErr string
+    }{
+        {name: "valid", edit: func(jwt.MapClaims) {}},
+        {name: "wrong audience", edit: func(c jwt.MapClaims) { c["aud"] = "someone-else" }, wantErr: "audience"},
+        {name: "wrong issuer", edit: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }, wantErr: "issuer"},
+        {name: "expired", edit: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "expired"},
+        {name: "no expiry", edit: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: "exp"},
+        {name: "unknown key", edit: func(jwt.MapClaims) {}, kid: "other", wantErr: "unknown key"},
+        {name: "token endpoint error", edit: func(jwt.MapClaims) {}, tokErr: "invalid_grant", wantErr: "invalid_grant"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            // A fresh client per case, so a failed key lookup doesn't hold back the JWKS refetch
+            o, err := newOIDCClient(OIDCConfig{Issuer: idp.srv.URL, ClientID: "router"})
+            if err != nil {
+                t.Fatal(err)
+            }
+            idp.claims = idp.validClaims()
+            tt.edit(idp.claims)
+            idp.kid = "k1"
+            if tt.kid != "" { idp.kid = tt.kid }
+            idp.tokenErr = tt.tokErr
+            claims, err := o.exchange("code-1", "verifier-1", "https://router.example/api/auth/oidc/callback")
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("exchange: %v", err)
+            }
+            if claims["sub"] != "sub-1" {
+                t.Errorf("sub = %v", claims["sub"])
+            }
+            if idp.form["code_verifier"] != "verifier-1" || idp.form["code"] != "code-1" || idp.form["grant_type"] != "authorization_code" {
+                t.Errorf("token request form = %v", idp.form)
+            }
+        })
+    }
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+    idp := newFakeIdP(t)
+    o, _ := newOIDCClient(OIDCConfig{Issuer: idp.srv.URL + "/realms/other", ClientID: "router"})
+    if _, err := o.metadata(); err == nil {
+        t.Fatal("metadata accepted a document for another issuer")
+    }
+}
+
+func TestProvisionOIDCUser(t *testing.T) {
+    tests := []struct {
+        name     string
+        existing *User
+        cfg      func(*OIDCConfig)
+        claims   jwt.MapClaims
+        wantErr  error // errOIDCConflict, or any error when errAny
+        errAny   bool
+        wantRole string
+        linked   bool // the existing account is the one returned
+    }{
+        {
+            name:     "known subject",
+            existing: &User{Email: "ann@example.com", Role: "user", OIDCSubject: "sub-1"},
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "renamed@example.com"},
+            wantRole: "user", linked: true,
+        },
+        {
+            name:     "verified email links unbound account",
+            existing: &User{Email: "ann@example.com", Role: "user"},
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "Ann@Example.com", "email_verified": true},
+            wantRole: "user", linked: true,
+        },
+        {
+            name:     "unverified email",
+            existing: &User{Email: "ann@example.com", Role: "admin"},
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "ann@example.com", "email_verified": false},
+            wantErr:  errOIDCConflict,
+        },
+        {
+            name:     "missing email_verified",
+            existing: &User{Email: "ann@example.com", Role: "admin"},
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "ann@example.com"},
+            wantErr:  errOIDCConflict,
+        },
+        {
+            name:     "email_verified as string",
+            existing: &User{Email: "ann@example.com", Role: "admin"},
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "ann@example.com", "email_verified": "true"},
+            wantErr:  errOIDCConflict,
+        },
+        {
+            name:     "account bound to another subject",
+            existing: &User{Email: "ann@example.com", Role: "admin", OIDCSubject: "sub-0"},
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "ann@example.com", "email_verified": true},
+            wantErr:  errOIDCConflict,
+        },
+        {
+            name:     "new user provisioned",
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "new@example.com"},
+            wantRole: "user",
+        },
+        {
+            name:    "auto provisioning off",
+            cfg:     func(c *OIDCConfig) { c.AutoProvision = false },
+            claims:  jwt.MapClaims{"sub": "sub-1", "email": "new@example.com"},
+            errAny:  true,
+        },
+        {
+            name:    "no subject",
+            claims:  jwt.MapClaims{"email": "new@example.com"},
+            errAny:  true,
+        },
+        {
+            name:     "disabled account",
+            existing: &User{Email: "ann@example.com", Role: "user", OIDCSubject: "sub-1", Disabled: true},
+            claims:   jwt.MapClaims{"sub": "sub-1"},
+            errAny:   true,
+        },
+        {
+            name: "role from claim",
+            cfg: func(c *OIDCConfig) {
+                c.RoleClaim = "realm_access.roles"
+                c.RoleMapping = []OIDCRoleMapping{{Value: "llm-admin", Role: "admin"}}
+            },
+            claims:   jwt.MapClaims{"sub": "sub-1", "email": "new@example.com", "realm_access": map[string]any{"roles": []any{"x", "llm-admin"}}},
+            wantRole: "admin",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApp(t)
+            app.Config.OIDC.Enabled = true
+            if tt.cfg != nil { tt.cfg(&app.Config.OIDC) }
+            var existing User
+            if tt.existing != nil {
+                existing = *tt.existing
+                if err := app.DB.Create(&existing).Error; err != nil {
+                    t.Fatal(err)
+                }
+                if existing.Disabled {
+                    app.DB.Model(&existing).Update("disabled", true)
+                }
+            }
+            u, err := provisionOIDCUser(app, tt.claims)
+            if tt.wantErr != nil || tt.errAny {
+                if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+                    t.Fatalf("err = %v, want %v", err, tt.wantErr)
+                }
+                if tt.existing != nil {
+                    var after User
+                    app.DB.First(&after, existing.ID)
+                    if after.OIDCSubject != existing.OIDCSubject {
+                        t.Errorf("subject changed to %q on a refused login", after.OIDCSubject)
+                    }
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("provision: %v", err)
+            }
+            if tt.linked && u.ID != existing.ID {
+                t.Errorf("got user %d, want existing %d", u.ID, existing.ID)
+            }
+            if !tt.linked && tt.existing == nil && u.Email != "new@example.com" {
+                t.Errorf("email = %q", u.Email)
+            }
+            if u.OIDCSubject != "sub-1" {
+                t.Errorf("subject = %q", u.OIDCSubject)
+            }
+            if u.Role != tt.wantRole {
+                t.Errorf("role = %q, want %q", u.Role, tt.wantRole)
+            }
+        })
+    }
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
-    "bytes"
+    "context"
     "encoding/json"
+    "errors"
     "io"
     "net/http"
+    "strconv"
     "strings"
     "time"
 
@@ -13,37 +15,72 @@ import (
 )
 
 func registerOpenAIRoutes(g *echo.Group) {
+    g.Use(traceRequests, apiAuth, rateLimit)
     g.GET("/models", openaiListModels)
     g.POST("/chat/completions", openaiChatCompletions)
     g.POST("/completions", openaiCompletions)
     g.POST("/embeddings", openaiEmbeddings)
 }
 
+// apiAuth authenticates /api/v1 callers once, before any handler runs, and
+// keeps the result in the context for getUserFromAuth.
+func apiAuth(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        _, sp := getApp(c).tracer.start(c.Request().Context(), "auth", spanInternal)
+        user, key, err := getUserFromAuth(c)
+        traceAuth(sp, user, key, err)
+        if errors.Is(err, errKeyExpired) {
+            return keyExpired(c)
+        }
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"})
+        }
+        c.Set("user", user)
+        c.Set("api_key", key)
+        if name := endpointScope(c.Request().URL.Path); name != "" {
+            for _, s := range callerScopes(c) {
+                if !s.allowsEndpoint(name) {
+                    return scopeForbidden(c, "endpoint_not_allowed", "This API key is not allowed to call "+c.Request().URL.Path+".")
+                }
+            }
+        }
+        c.SetRequest(c.Request().WithContext(withPriority(c.Request().Context(), requestPriority(c, key))))
+        return next(c)
+    }
+}
+
+// traceAuth ends the auth span with who the caller turned out to be.
+func traceAuth(sp *span, user *User, key *APIKey, err error) {
+    if errors.Is(err, errKeyExpired) {
+        sp.fail(err.Error())
+    } else if err != nil {
+        sp.fail("unauthorized")
+    } else {
+        sp.set("enduser.id", strconv.FormatUint(uint64(user.ID), 10))
+        if key != nil { sp.set("llmrouter.api_key_id", key.ID) }
+    }
+    sp.finish()
+}
+
 // Auth for these endpoints uses Bearer user API key
 func getUserFromAuth(c echo.Context) (*User, *APIKey, error) {
+    // Already authenticated by apiAuth or requireAuth
+    if u, ok := c.Get("user").(*User); ok && u != nil {
+        key, _ := c.Get("api_key").(*APIKey)
+        return u, key, nil
+    }
     app := getApp(c)
     auth := c.Request().Header.Get("Authorization")
     if auth != "" && strings.HasPrefix(strings.ToLower(auth), "bearer ") {
         token := strings.TrimSpace(auth[len("bearer "):])
-        return validateAPIKey(app, token)
+        return validateAPIKey(app, token, c.RealIP())
     }
     // Fallback: try session cookie
-    cookie, err := c.Cookie("session")
-    if err != nil || cookie == nil || cookie.Value == "" {
-        return nil, nil, echo.ErrUnauthorized
-    }
-    claims, err := parseJWT(app, cookie.Value)
-    if err != nil {
-        return nil, nil, echo.ErrUnauthorized
-    }
-    var u User
-    if err := app.DB.First(&u, claims.UserID).Error; err != nil {
-        return nil, nil, echo.ErrUnauthorized
-    }
-    if u.Disabled {
+    u, _, err := sessionUser(c, app)
+    if err != nil || u.Disabled {
         return nil, nil, echo.ErrUnauthorized
     }
-    return &u, nil, nil
+    return u, nil, nil
 }
 
 func openaiListModels(c echo.Context) error {
@@ -55,12 +92,32 @@ func openaiListModels(c echo.Context) error {
         ID      string `json:"id"`
         Object  string `json:"object"`
         OwnedBy string `json:"owned_by"`
+        // Catalog extensions (omitted when unknown)
+        ContextWindow   int                `json:"context_window,omitempty"`
+        MaxOutputTokens int                `json:"max_output_tokens,omitempty"`
+        Capabilities    *modelCapabilities `json:"capabilities,omitempty"`
+        Pricing         *modelPricing      `json:"pricing,omitempty"`
     }
     var models []modelObj
     var providers []Provider
     if err := app.DB.Where("enabled = ?", true).Find(&providers).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    catalog := loadModelInfo(app)
+    withInfo := func(m modelObj, info ModelInfo, ok bool) modelObj {
+        if !ok {
+            return m
+        }
+        m.ContextWindow = info.ContextWindow
+        m.MaxOutputTokens = info.MaxOutputTokens
+        if info.Vision != nil || info.Audio != nil || info.Tools != nil || info.JSONMode != nil {
+            m.Capabilities = &modelCapabilities{Vision: info.Vision, Audio: info.Audio, Tools: info.Tools, JSONMode: info.JSONMode}
+        }
+        if info.InputPrice > 0 || info.OutputPrice > 0 {
+            m.Pricing = &modelPricing{Input: info.InputPrice, Output: info.OutputPrice, Unit: "usd_per_1m_tokens"}
+        }
+        return m
+    }
     for _, p := range providers {
         names := app.GetPulled(p.ID)
         if len(names) == 0 {
@@ -68,16 +125,39 @@ func openaiListModels(c echo.Context) error {
         }
         for _, name := range names {
             qualified := strings.ToLower(p.Name) + "/" + name
-            models = append(models, modelObj{ID: qualified, Object: "model", OwnedBy: p.Name})
+            if !callerAllowsModel(c, qualified, "") {
+                continue
+            }
+            info, ok := catalog[p.ID][name]
+            models = append(models, withInfo(modelObj{ID: qualified, Object: "model", OwnedBy: p.Name}, info, ok))
         }
     }
     // Add router/ fallbacks
     var routes []FallbackRoute
     if err := app.DB.Where("enabled = ?", true).Find(&routes).Error; err == nil {
         for _, r := range routes {
+            if !callerAllowsModel(c, "router/"+r.Name, "") {
+                continue
+            }
             models = append(models, modelObj{ID: "router/" + r.Name, Object: "model", OwnedBy: "router"})
         }
     }
+    // Add admin-defined aliases
+    for _, name := range listAliasIDs(app) {
+        // Aliases report the metadata of the model they currently resolve to
+        var info ModelInfo
+        ok := false
+        target, _ := resolveAlias(app, name)
+        if !callerAllowsModel(c, name, target) {
+            continue
+        }
+        if target != name {
+            if p, raw, found := resolveQualifiedModel(app, target); found {
+                info, ok = catalog[p.ID][raw]
+            }
+        }
+        models = append(models, withInfo(modelObj{ID: name, Object: "model", OwnedBy: "alias"}, info, ok))
+    }
     return c.JSON(http.StatusOK, echo.Map{"object": "list", "data": models})
 }
 
@@ -89,141 +169,201 @@ func forwardOpenAIWithStream(c echo.Context, p Provider, clientModel string, ups
     if key != nil {
         keyID = key.ID
     }
+    teamID := usageTeam(user, key)
 
-    // Determine message count if present in body
-    msgCount := 0
+    // Determine message/image counts and upstream model if present in body
+    msgCount, images := 0, 0
+    upstreamModel := ""
     var payload map[string]any
     if err := json.Unmarshal(upstreamBody, &payload); err == nil {
-        if v, ok := payload["messages"]; ok {
-            if arr, ok := v.([]any); ok { msgCount = len(arr) }
-        }
+        msgCount, images = countRequestItems(payload)
+        upstreamModel, _ = payload["model"].(string)
     }
 
-    // build request to provider
-    started := time.Now()
-    url := strings.TrimSuffix(p.BaseURL, "/") + endpoint
-    req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(upstreamBody))
-    req.Header.Set("Content-Type", "application/json")
-    if p.APIKey != "" { req.Header.Set("Authorization", "Bearer "+p.APIKey) }
+    promptTok, outTok := estimateTokens(payload)
+    estTokens := int64(promptTok + outTok)
+    clientUsage := true
+    if stream && payload != nil {
+        clientUsage = requestStreamUsage(payload)
+        upstreamBody, _ = json.Marshal(payload)
+    }
+    // Hold back while the provider reports no headroom, or answer 429 for it
+    if wait, err := throttleUpstream(c, app, p.ID, estTokens); err != nil {
+        if wait > 0 { return upstreamThrottled(c, p, wait) }
+        return err
+    }
 
-    resp, err := http.DefaultClient.Do(req)
+    ctx, sp := startGenAI(c.Request().Context(), app, p, endpoint, upstreamModel, payload)
+    defer sp.finish()
+    started := time.Now()
+    resp, err := sendUpstream(ctx, app, p, endpoint, upstreamModel, upstreamBody, estTokens)
+    if qerr, ok := err.(*errQueue); ok {
+        logUsage(ctx, app, user.ID, keyID, teamID, p.ID, clientModel, upstreamModel, http.StatusServiceUnavailable, started, msgCount, tokenUsage{})
+        return queueUnavailable(c, qerr)
+    }
     if err != nil {
-        logUsage(app, user.ID, keyID, p.ID, clientModel, 0, started, msgCount, 0, 0)
+        logUsage(ctx, app, user.ID, keyID, teamID, p.ID, clientModel, upstreamModel, 0, started, msgCount, tokenUsage{})
         return c.JSON(http.StatusBadGateway, echo.Map{"error": "provider error"})
     }
     defer resp.Body.Close()
 
     if stream && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-        // Stream response directly to client
-        c.Response().Header().Set("Content-Type", "text/event-stream")
-        c.Response().WriteHeader(http.StatusOK)
-        buf := make([]byte, 4096)
-        for {
-            n, err := resp.Body.Read(buf)
-            if n > 0 {
-                if _, werr := c.Response().Write(buf[:n]); werr != nil {
-                    break
-                }
-                c.Response().Flush()
-            }
-            if err != nil {
-                break
-            }
-        }
-        // Log minimal usage for streaming (tokens unknown)
-        logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, 0, 0)
+        // Stream response directly to client; usage comes in the final chunk
+        // (stream_options.include_usage), or is estimated if the provider sends none
+        usage := relayStream(c, resp.Body, clientUsage).orEstimate(promptTok, outTok)
+        usage.Images = images
+        logUsage(ctx, app, user.ID, keyID, teamID, p.ID, clientModel, upstreamModel, resp.StatusCode, started, msgCount, usage)
         return nil
     }
 
     b, _ := io.ReadAll(resp.Body)
 
     // try to extract usage for logging
-    var usage struct {
-        Usage struct {
-            PromptTokens     int `json:"prompt_tokens"`
-            CompletionTokens int `json:"completion_tokens"`
-            TotalTokens      int `json:"total_tokens"`
-        } `json:"usage"`
-    }
-    _ = json.Unmarshal(b, &usage)
-    logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, usage.Usage.PromptTokens, usage.Usage.CompletionTokens)
+    usage := parseUsage(b)
+    usage.Images = images
+    logUsage(ctx, app, user.ID, keyID, teamID, p.ID, clientModel, upstreamModel, resp.StatusCode, started, msgCount, usage)
 
     // mirror status code and body
     return c.Blob(resp.StatusCode, "application/json", b)
 }
 
 // Router fallback helpers
+
+// loadRoute finds the enabled route for a router/<name> model, with its targets in order.
+func loadRoute(c echo.Context, app *App, clientModel string) (FallbackRoute, bool) {
+    _, sp := app.tracer.start(c.Request().Context(), "model.resolve", spanInternal)
+    defer sp.finish()
+    sp.set("llmrouter.model", clientModel)
+    name := strings.TrimPrefix(strings.ToLower(clientModel), "router/")
+    var route FallbackRoute
+    if err := app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).Where("enabled = ? AND name = ?", true, name).First(&route).Error; err != nil {
+        sp.fail("unknown model")
+        return route, false
+    }
+    // A team limited to some providers only reaches the targets on them
+    if team := callerModelFilter(c).team; team != nil && len(team.ProviderIDs) > 0 {
+        targets := route.Targets[:0]
+        for _, t := range route.Targets {
+            if team.visibleProvider(t.ProviderID) { targets = append(targets, t) }
+        }
+        if len(targets) == 0 {
+            sp.fail("no visible targets")
+            return route, false
+        }
+        route.Targets = targets
+    }
+    sp.set("llmrouter.route", route.Name)
+    sp.set("llmrouter.route.targets", len(route.Targets))
+    return route, true
+}
+
+// startAttempt begins the span for trying one target of a router/ route.
+func startAttempt(ctx context.Context, app *App, route string, n int, p Provider, endpoint, model string, payload map[string]any) (context.Context, *span) {
+    ctx, sp := startGenAI(ctx, app, p, endpoint, model, payload)
+    sp.set("llmrouter.route", route)
+    sp.set("llmrouter.fallback.attempt", n)
+    return ctx, sp
+}
+
+// endAttempt records how a router target fared, in metrics and on its span.
+func endAttempt(app *App, sp *span, route, provider, outcome string) {
+    app.metrics.fallback(route, provider, outcome)
+    sp.set("llmrouter.fallback.outcome", outcome)
+    if outcome != "success" { sp.fail(outcome) }
+    sp.finish()
+}
+
 func handleRouterChat(c echo.Context, app *App, clientModel string, payload map[string]any) error {
     user, key, err := getUserFromAuth(c)
     if err != nil { return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"}) }
     keyID := uint(0); if key != nil { keyID = key.ID }
+    teamID := usageTeam(user, key)
     stream := false
     if s, ok := payload["stream"].(bool); ok { stream = s }
     // resolve route
-    name := strings.TrimPrefix(strings.ToLower(clientModel), "router/")
-    var route FallbackRoute
-    if err := app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).Where("enabled = ? AND name = ?", true, name).First(&route).Error; err != nil {
+    route, ok := loadRoute(c, app, clientModel)
+    if !ok {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
     }
-    // message count for logging
-    msgCount := 0
-    if v, ok := payload["messages"]; ok { if arr, ok := v.([]any); ok { msgCount = len(arr) } }
+    // message/image counts for logging
+    msgCount, images := countRequestItems(payload)
+
+    promptTok, outTok := estimateTokens(payload)
+    estTokens := int64(promptTok + outTok)
+    clientUsage := true
+    if stream { clientUsage = requestStreamUsage(payload) }
 
     body, _ := json.Marshal(payload)
     var lastBody []byte
     var lastStatus int
-    for _, t := range route.Targets {
+    var throttled Provider
+    var throttledWait time.Duration
+    var queueErr *errQueue
+    ctx := withRoute(c.Request().Context(), route.Name)
+    // Targets whose provider is out of upstream quota are tried last
+    for i, t := range orderByHeadroom(app, route.Targets, estTokens) {
         // confirm provider still enabled and model available in cache
         var p Provider
         if err := app.DB.Where("id = ? AND enabled = ?", t.ProviderID, true).First(&p).Error; err != nil { continue }
+        actx, sp := startAttempt(ctx, app, route.Name, i, p, "/chat/completions", t.Model, payload)
+        if wait, terr := throttleUpstream(c, app, p.ID, estTokens); terr != nil {
+            if wait == 0 { sp.finish(); return terr }
+            throttled, throttledWait = p, wait
+            endAttempt(app, sp, route.Name, p.Name, "throttled")
+            continue
+        }
         // replace model
         var pl map[string]any
         _ = json.Unmarshal(body, &pl)
         pl["model"] = t.Model
         upBody, _ := json.Marshal(pl)
         started := time.Now()
-        url := strings.TrimSuffix(p.BaseURL, "/") + "/chat/completions"
-        req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(upBody))
-        req.Header.Set("Content-Type", "application/json")
-        if p.APIKey != "" { req.Header.Set("Authorization", "Bearer "+p.APIKey) }
-        resp, rerr := http.DefaultClient.Do(req)
+        resp, rerr := sendUpstream(actx, app, p, "/chat/completions", t.Model, upBody, estTokens)
+        if qerr, ok := rerr.(*errQueue); ok {
+            // provider saturated; try the next target
+            queueErr = qerr
+            endAttempt(app, sp, route.Name, p.Name, "queue_full")
+            continue
+        }
         if rerr != nil {
-            logUsage(app, user.ID, keyID, p.ID, clientModel, 0, started, msgCount, 0, 0)
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, 0, started, msgCount, tokenUsage{})
+            endAttempt(app, sp, route.Name, p.Name, "error")
             continue
         }
         defer resp.Body.Close()
-        // fallback on 5xx; 4xx is returned to client
+        // fallback on 5xx and upstream 429; other 4xx is returned to client
         if stream && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-            c.Response().Header().Set("Content-Type", "text/event-stream")
-            c.Response().WriteHeader(http.StatusOK)
-            buf := make([]byte, 4096)
-            for {
-                n, err := resp.Body.Read(buf)
-                if n > 0 { if _, werr := c.Response().Write(buf[:n]); werr != nil { break }; c.Response().Flush() }
-                if err != nil { break }
-            }
-            logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, 0, 0)
+            usage := relayStream(c, resp.Body, clientUsage).orEstimate(promptTok, outTok)
+            usage.Images = images
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, usage)
+            endAttempt(app, sp, route.Name, p.Name, "success")
             return nil
         }
         b, _ := io.ReadAll(resp.Body)
         if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-            var usage struct{ Usage struct{ PromptTokens int `json:"prompt_tokens"`; CompletionTokens int `json:"completion_tokens"` } `json:"usage"` }
-            _ = json.Unmarshal(b, &usage)
-            logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, usage.Usage.PromptTokens, usage.Usage.CompletionTokens)
+            usage := parseUsage(b)
+            usage.Images = images
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, usage)
+            endAttempt(app, sp, route.Name, p.Name, "success")
             return c.Blob(resp.StatusCode, "application/json", b)
         }
-        if resp.StatusCode >= 500 {
+        if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
             // try next
             lastBody = b; lastStatus = resp.StatusCode
-            logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, 0, 0)
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, tokenUsage{})
+            endAttempt(app, sp, route.Name, p.Name, "next")
             continue
         }
         // 4xx: return immediately
-        logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, 0, 0)
+        logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, tokenUsage{})
+        endAttempt(app, sp, route.Name, p.Name, "rejected")
         return c.Blob(resp.StatusCode, "application/json", b)
     }
+    app.metrics.fallbackExhausted(route.Name)
     // exhausted
     if lastBody != nil && lastStatus != 0 { return c.Blob(lastStatus, "application/json", lastBody) }
+    if throttledWait > 0 { return upstreamThrottled(c, throttled, throttledWait) }
+    if queueErr != nil { return queueUnavailable(c, queueErr) }
     return c.JSON(http.StatusBadGateway, echo.Map{"error": "no_available_target"})
 }
 
@@ -231,49 +371,70 @@ func handleRouterNonStream(c echo.Context, app *App, clientModel string, payload
     user, key, err := getUserFromAuth(c)
     if err != nil { return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"}) }
     keyID := uint(0); if key != nil { keyID = key.ID }
-    name := strings.TrimPrefix(strings.ToLower(clientModel), "router/")
-    var route FallbackRoute
-    if err := app.DB.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC, id ASC") }).Where("enabled = ? AND name = ?", true, name).First(&route).Error; err != nil {
+    teamID := usageTeam(user, key)
+    route, ok := loadRoute(c, app, clientModel)
+    if !ok {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
     }
-    msgCount := 0
-    if v, ok := payload["messages"]; ok { if arr, ok := v.([]any); ok { msgCount = len(arr) } }
+    msgCount, images := countRequestItems(payload)
+    promptTok, outTok := estimateTokens(payload)
+    estTokens := int64(promptTok + outTok)
     body, _ := json.Marshal(payload)
     var lastBody []byte
     var lastStatus int
-    for _, t := range route.Targets {
+    var throttled Provider
+    var throttledWait time.Duration
+    var queueErr *errQueue
+    ctx := withRoute(c.Request().Context(), route.Name)
+    for i, t := range orderByHeadroom(app, route.Targets, estTokens) {
         var p Provider
         if err := app.DB.Where("id = ? AND enabled = ?", t.ProviderID, true).First(&p).Error; err != nil { continue }
+        actx, sp := startAttempt(ctx, app, route.Name, i, p, endpoint, t.Model, payload)
+        if wait, terr := throttleUpstream(c, app, p.ID, estTokens); terr != nil {
+            if wait == 0 { sp.finish(); return terr }
+            throttled, throttledWait = p, wait
+            endAttempt(app, sp, route.Name, p.Name, "throttled")
+            continue
+        }
         var pl map[string]any; _ = json.Unmarshal(body, &pl)
         pl["model"] = t.Model
         upBody, _ := json.Marshal(pl)
         started := time.Now()
-        url := strings.TrimSuffix(p.BaseURL, "/") + endpoint
-        req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(upBody))
-        req.Header.Set("Content-Type", "application/json")
-        if p.APIKey != "" { req.Header.Set("Authorization", "Bearer "+p.APIKey) }
-        resp, rerr := http.DefaultClient.Do(req)
+        resp, rerr := sendUpstream(actx, app, p, endpoint, t.Model, upBody, estTokens)
+        if qerr, ok := rerr.(*errQueue); ok {
+            // provider saturated; try the next target
+            queueErr = qerr
+            endAttempt(app, sp, route.Name, p.Name, "queue_full")
+            continue
+        }
         if rerr != nil {
-            logUsage(app, user.ID, keyID, p.ID, clientModel, 0, started, msgCount, 0, 0)
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, 0, started, msgCount, tokenUsage{})
+            endAttempt(app, sp, route.Name, p.Name, "error")
             continue
         }
         defer resp.Body.Close()
         b, _ := io.ReadAll(resp.Body)
         if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-            var usage struct{ Usage struct{ PromptTokens int `json:"prompt_tokens"`; CompletionTokens int `json:"completion_tokens"` } `json:"usage"` }
-            _ = json.Unmarshal(b, &usage)
-            logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, usage.Usage.PromptTokens, usage.Usage.CompletionTokens)
+            usage := parseUsage(b)
+            usage.Images = images
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, usage)
+            endAttempt(app, sp, route.Name, p.Name, "success")
             return c.Blob(resp.StatusCode, "application/json", b)
         }
-        if resp.StatusCode >= 500 {
+        if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
             lastBody = b; lastStatus = resp.StatusCode
-            logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, 0, 0)
+            logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, tokenUsage{})
+            endAttempt(app, sp, route.Name, p.Name, "next")
             continue
         }
-        logUsage(app, user.ID, keyID, p.ID, clientModel, resp.StatusCode, started, msgCount, 0, 0)
+        logUsage(actx, app, user.ID, keyID, teamID, p.ID, clientModel, t.Model, resp.StatusCode, started, msgCount, tokenUsage{})
+        endAttempt(app, sp, route.Name, p.Name, "rejected")
         return c.Blob(resp.StatusCode, "application/json", b)
     }
+    app.metrics.fallbackExhausted(route.Name)
     if lastBody != nil && lastStatus != 0 { return c.Blob(lastStatus, "application/json", lastBody) }
+    if throttledWait > 0 { return upstreamThrottled(c, throttled, throttledWait) }
+    if queueErr != nil { return queueUnavailable(c, queueErr) }
     return c.JSON(http.StatusBadGateway, echo.Map{"error": "no_available_target"})
 }
 
@@ -287,11 +448,21 @@ func openaiChatCompletions(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "model required"})
     }
     app := getApp(c)
+    requested := clientModel
+    clientModel = applyModelAlias(c, app, clientModel)
+    if !callerAllowsModel(c, requested, clientModel) {
+        return modelNotAllowed(c, requested)
+    }
+    release, err := reserveBudgets(c, app, clientModel, payload)
+    if err != nil {
+        return quotaExceeded(c, err)
+    }
+    defer release()
     // Router fallback path
     if strings.HasPrefix(strings.ToLower(clientModel), "router/") {
         return handleRouterChat(c, app, clientModel, payload)
     }
-    p, raw, ok := resolveQualifiedModel(app, clientModel)
+    p, raw, ok := resolveRequestModel(c, app, clientModel)
     if !ok {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
     }
@@ -315,10 +486,20 @@ func openaiCompletions(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "model required"})
     }
     app := getApp(c)
+    requested := clientModel
+    clientModel = applyModelAlias(c, app, clientModel)
+    if !callerAllowsModel(c, requested, clientModel) {
+        return modelNotAllowed(c, requested)
+    }
+    release, err := reserveBudgets(c, app, clientModel, payload)
+    if err != nil {
+        return quotaExceeded(c, err)
+    }
+    defer release()
     if strings.HasPrefix(strings.ToLower(clientModel), "router/") {
         return handleRouterNonStream(c, app, clientModel, payload, "/completions")
     }
-    p, raw, ok := resolveQualifiedModel(app, clientModel)
+    p, raw, ok := resolveRequestModel(c, app, clientModel)
     if !ok {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
     }
@@ -337,10 +518,20 @@ func openaiEmbeddings(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "model required"})
     }
     app := getApp(c)
+    requested := clientModel
+    clientModel = applyModelAlias(c, app, clientModel)
+    if !callerAllowsModel(c, requested, clientModel) {
+        return modelNotAllowed(c, requested)
+    }
+    release, err := reserveBudgets(c, app, clientModel, payload)
+    if err != nil {
+        return quotaExceeded(c, err)
+    }
+    defer release()
     if strings.HasPrefix(strings.ToLower(clientModel), "router/") {
         return handleRouterNonStream(c, app, clientModel, payload, "/embeddings")
     }
-    p, raw, ok := resolveQualifiedModel(app, clientModel)
+    p, raw, ok := resolveRequestModel(c, app, clientModel)
     if !ok {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
     }
@@ -0,0 +1,108 @@
+package server
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// bcrypt ignores everything past 72 bytes, so longer passwords are refused
+// rather than silently truncated.
+const maxPasswordBytes = 72
+
+var (
+    errPasswordTooLong  = fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+    errPasswordBreached = errors.New("password appears in a list of breached passwords")
+)
+
+// Always rejected, whether or not a breached list is configured.
+var commonPasswords = []string{
+    "password", "password1", "passw0rd", "123456", "1234567", "12345678", "123456789", "1234567890",
+    "qwerty", "qwertyuiop", "111111", "abc123", "iloveyou", "admin", "admin123", "administrator",
+    "letmein", "welcome", "monkey", "dragon", "football", "baseball", "sunshine", "princess",
+    "trustno1", "changeme", "secret", "llmrouter",
+}
+
+// passwordPolicy decides which new passwords are acceptable.
+type passwordPolicy struct {
+    minLength int
+    breached  map[string]struct{} // lowercase hex SHA-1 of breached passwords
+}
+
+// newPasswordPolicy loads the breached-password list, one password or SHA-1
+// hash per line. Lines in the "HASH:count" format of breach dumps work as is.
+func newPasswordPolicy(cfg PasswordPolicyConfig) (*passwordPolicy, error) {
+    p := &passwordPolicy{minLength: cfg.MinLength, breached: map[string]struct{}{}}
+    for _, pw := range commonPasswords {
+        p.breached[sha1Hex(pw)] = struct{}{}
+    }
+    if cfg.BreachedList == "" {
+        return p, nil
+    }
+    f, err := os.Open(cfg.BreachedList)
+    if err != nil {
+        return nil, fmt.Errorf("password breached_list: %w", err)
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        line := strings.TrimSpace(sc.Text())
+        if line == "" {
+            continue
+        }
+        if h, _, _ := strings.Cut(line, ":"); isSHA1Hex(h) {
+            p.breached[strings.ToLower(h)] = struct{}{}
+            continue
+        }
+        p.breached[sha1Hex(line)] = struct{}{}
+    }
+    if err := sc.Err(); err != nil {
+        return nil, fmt.Errorf("password breached_list: %w", err)
+    }
+    return p, nil
+}
+
+// check returns why pw can't be used as a new password, or nil.
+func (p *passwordPolicy) check(pw string) error {
+    if len([]rune(pw)) < p.minLength {
+        return fmt.Errorf("password must be at least %d characters", p.minLength)
+    }
+    if len(pw) > maxPasswordBytes {
+        return errPasswordTooLong
+    }
+    if _, ok := p.breached[sha1Hex(pw)]; ok {
+        return errPasswordBreached
+    }
+    if _, ok := p.breached[sha1Hex(strings.ToLower(pw))]; ok {
+        return errPasswordBreached
+    }
+    return nil
+}
+
+// errorCode maps a policy failure to the snake_case codes of /api/account.
+func (p *passwordPolicy) errorCode(err error) string {
+    switch err {
+    case errPasswordTooLong:
+        return "new_password_too_long"
+    case errPasswordBreached:
+        return "new_password_breached"
+    }
+    return "new_password_too_short"
+}
+
+func sha1Hex(s string) string {
+    sum := sha1.Sum([]byte(s))
+    return hex.EncodeToString(sum[:])
+}
+
+func isSHA1Hex(s string) bool {
+    if len(s) != 40 {
+        return false
+    }
+    _, err := hex.DecodeString(s)
+    return err == nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+type priceReq struct {
+    // Qualified provider/model id
+    Model           string     `json:"model"`
+    EffectiveFrom   *time.Time `json:"effective_from"`
+    InputPerM       float64    `json:"input_per_m"`
+    OutputPerM      float64    `json:"output_per_m"`
+    CachedInputPerM float64    `json:"cached_input_per_m"`
+    PerImage        float64    `json:"per_image"`
+    PerAudioSecond  float64    `json:"per_audio_second"`
+}
+
+func registerPriceRoutes(g *echo.Group) {
+    ag := g.Group("/prices")
+    ag.GET("", requirePermission(permModels, blockAdminIfMustChange(listPrices)))
+    ag.POST("", requirePermission(permModels, blockAdminIfMustChange(createPrice)))
+    ag.DELETE("/:id", requirePermission(permModels, blockAdminIfMustChange(deletePrice)))
+}
+
+// listPrices returns the full price history, optionally for one provider/model.
+func listPrices(c echo.Context) error {
+    app := getApp(c)
+    q := app.DB.Order("provider_id ASC, model ASC, effective_from DESC")
+    if m := c.QueryParam("model"); m != "" {
+        p, raw, ok := resolveQualifiedModel(app, m)
+        if !ok {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
+        }
+        q = q.Where("provider_id = ? AND model = ?", p.ID, raw)
+    }
+    var prices []ModelPrice
+    if err := q.Find(&prices).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, prices)
+}
+
+// createPrice appends a price; existing rows are never edited.
+func createPrice(c echo.Context) error {
+    app := getApp(c)
+    var req priceReq
+    if err := c.Bind(&req); err != nil || req.Model == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if req.InputPerM < 0 || req.OutputPerM < 0 || req.CachedInputPerM < 0 || req.PerImage < 0 || req.PerAudioSecond < 0 {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "negative price"})
+    }
+    p, raw, ok := resolveQualifiedModel(app, req.Model)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
+    }
+    effective := time.Now()
+    if req.EffectiveFrom != nil {
+        effective = *req.EffectiveFrom
+    }
+    price := ModelPrice{
+        ProviderID:      p.ID,
+        Model:           raw,
+        EffectiveFrom:   effective,
+        InputPerM:       req.InputPerM,
+        OutputPerM:      req.OutputPerM,
+        CachedInputPerM: req.CachedInputPerM,
+        PerImage:        req.PerImage,
+        PerAudioSecond:  req.PerAudioSecond,
+    }
+    if err := app.DB.Create(&price).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusCreated, price)
+}
+
+// deletePrice only removes prices that have not taken effect yet, so history stays intact.
+func deletePrice(c echo.Context) error {
+    app := getApp(c)
+    var price ModelPrice
+    if err := app.DB.First(&price, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if !price.EffectiveFrom.After(time.Now()) {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "price already in effect"})
+    }
+    if err := app.DB.Delete(&price).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.NoContent(http.StatusNoContent)
+}
+
+// priceAt returns the price in effect for a provider model at time t. Without
+// a price history entry it falls back to the catalog's input/output prices.
+func priceAt(app *App, providerID uint, model string, t time.Time) (ModelPrice, bool) {
+    var price ModelPrice
+    err := app.DB.Where("provider_id = ? AND model = ? AND effective_from <= ?", providerID, model, t).
+        Order("effective_from DESC, id DESC").First(&price).Error
+    if err == nil {
+        return price, true
+    }
+    if info, ok := lookupModelInfo(app, providerID, model); ok && (info.InputPrice > 0 || info.OutputPrice > 0) {
+        return ModelPrice{ProviderID: providerID, Model: model, InputPerM: info.InputPrice, OutputPerM: info.OutputPrice}, true
+    }
+    return ModelPrice{}, false
+}
+
+// usageCost prices one request in USD. Cached prompt tokens use the cached
+// rate when one is set and the input rate otherwise.
+func usageCost(app *App, providerID uint, model string, usage tokenUsage, at time.Time) float64 {
+    if model == "" {
+        return 0
+    }
+    price, ok := priceAt(app, providerID, model, at)
+    if !ok {
+        return 0
+    }
+    cached := usage.CachedTokens
+    if cached > usage.PromptTokens {
+        cached = usage.PromptTokens
+    }
+    cachedRate := price.CachedInputPerM
+    if cachedRate == 0 {
+        cachedRate = price.InputPerM
+    }
+    cost := float64(usage.PromptTokens-cached) * price.InputPerM / 1e6
+    cost += float64(cached) * cachedRate / 1e6
+    cost += float64(usage.CompletionTokens) * price.OutputPerM / 1e6
+    cost += float64(usage.Images) * price.PerImage
+    cost += usage.AudioSeconds * price.PerAudioSecond
+    return cost
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+// A key that fails authentication is kept out of rotation this long.
+const keyAuthBench = 5 * time.Minute
+
+type providerKeyReq struct {
+    Name    string `json:"name"`
+    Key     string `json:"key"`
+    Enabled *bool  `json:"enabled"`
+}
+
+// providerKeyView adds the live rotation state to a pool key.
+type providerKeyView struct {
+    ProviderKey
+    Hint  string            `json:"hint"`
+    Quota *providerHeadroom `json:"quota,omitempty"`
+}
+
+// upstreamCred is a credential together with its secret.
+type upstreamCred struct {
+    credential
+    secret string
+    key    *ProviderKey
+}
+
+func registerProviderKeyRoutes(g *echo.Group) {
+    ag := g.Group("/providers/:id/keys")
+    ag.GET("", requirePermission(permProviders, blockAdminIfMustChange(listProviderKeys)))
+    ag.POST("", requirePermission(permProviders, blockAdminIfMustChange(createProviderKey)))
+    ag.PUT("/:kid", requirePermission(permProviders, blockAdminIfMustChange(updateProviderKey)))
+    ag.DELETE("/:kid", requirePermission(permProviders, blockAdminIfMustChange(deleteProviderKey)))
+}
+
+func listProviderKeys(c echo.Context) error {
+    app := getApp(c)
+    var p Provider
+    if err := app.DB.First(&p, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var keys []ProviderKey
+    if err := app.DB.Where("provider_id = ?", p.ID).Order("id ASC").Find(&keys).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    out := make([]providerKeyView, 0, len(keys))
+    for _, k := range keys {
+        out = append(out, providerKeyView{ProviderKey: k, Hint: secretHint(app, k.Key), Quota: app.quotas.headroom(credential{p.ID, k.ID})})
+    }
+    return c.JSON(http.StatusOK, out)
+}
+
+func createProviderKey(c echo.Context) error {
+    app := getApp(c)
+    var p Provider
+    if err := app.DB.First(&p, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req providerKeyReq
+    if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Key) == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    secret, err := storeSecret(c, strings.TrimSpace(req.Key))
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "key: " + err.Error()})
+    }
+    k := ProviderKey{ProviderID: p.ID, Name: strings.TrimSpace(req.Name), Key: secret, Enabled: true}
+    if req.Enabled != nil { k.Enabled = *req.Enabled }
+    if err := app.DB.Create(&k).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.creds.invalidate(p.ID)
+    audit(c, "provider.key_create", "provider_key", k.ID, nil, k, "key")
+    return c.JSON(http.StatusCreated, providerKeyView{ProviderKey: k, Hint: secretHint(app, k.Key)})
+}
+
+func updateProviderKey(c echo.Context) error {
+    app := getApp(c)
+    var k ProviderKey
+    if err := app.DB.Where("id = ? AND provider_id = ?", c.Param("kid"), c.Param("id")).First(&k).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    before := k
+    var req providerKeyReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if req.Name != "" { k.Name = strings.TrimSpace(req.Name) }
+    if strings.TrimSpace(req.Key) != "" {
+        secret, err := storeSecret(c, strings.TrimSpace(req.Key))
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "key: " + err.Error()})
+        }
+        k.Key = secret
+        // A new secret gets a clean slate
+        app.quotas.forgetKey(credential{k.ProviderID, k.ID})
+    }
+    if req.Enabled != nil { k.Enabled = *req.Enabled }
+    if err := app.DB.Save(&k).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.creds.invalidate(k.ProviderID)
+    var secrets []string
+    if k.Key != before.Key { secrets = append(secrets, "key") }
+    audit(c, "provider.key_update", "provider_key", k.ID, before, k, secrets...)
+    return c.JSON(http.StatusOK, providerKeyView{ProviderKey: k, Hint: secretHint(app, k.Key), Quota: app.quotas.headroom(credential{k.ProviderID, k.ID})})
+}
+
+func deleteProviderKey(c echo.Context) error {
+    app := getApp(c)
+    var k ProviderKey
+    if err := app.DB.Where("id = ? AND provider_id = ?", c.Param("kid"), c.Param("id")).First(&k).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := app.DB.Delete(&k).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.quotas.forgetKey(credential{k.ProviderID, k.ID})
+    app.creds.invalidate(k.ProviderID)
+    audit(c, "provider.key_delete", "provider_key", k.ID, k, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+// keyHint shows only the last characters of a secret.
+func keyHint(secret string) string {
+    if len(secret) <= 4 {
+        return "****"
+    }
+    return "…" + secret[len(secret)-4:]
+}
+
+// A provider's decrypted key pool is cached this long. Changes made through
+// the API invalidate it at once; changes by other instances show up after this.
+const credCacheTTL = 30 * time.Second
+
+// credPool is a provider's usable credentials with their secrets decrypted.
+// env: and file: references are kept as is and read on every use.
+type credPool struct {
+    creds   []upstreamCred
+    refs    []string
+    expires time.Time
+}
+
+// credCache holds each provider's credential pool, so upstream calls skip
+// the key query and decryption. Anything that changes a provider's keys, or
+// the fields key selection reads, must invalidate it.
+type credCache struct {
+    mu    sync.Mutex
+    pools map[uint]credPool
+}
+
+func newCredCache() *credCache {
+    return &credCache{pools: map[uint]credPool{}}
+}
+
+func (cc *credCache) get(providerID uint) (credPool, bool) {
+    cc.mu.Lock()
+    defer cc.mu.Unlock()
+    pool, ok := cc.pools[providerID]
+    if !ok || time.Now().After(pool.expires) {
+        return credPool{}, false
+    }
+    return pool, true
+}
+
+func (cc *credCache) put(providerID uint, pool credPool) {
+    cc.mu.Lock()
+    defer cc.mu.Unlock()
+    pool.expires = time.Now().Add(credCacheTTL)
+    cc.pools[providerID] = pool
+}
+
+func (cc *credCache) invalidate(providerID uint) {
+    cc.mu.Lock()
+    defer cc.mu.Unlock()
+    delete(cc.pools, providerID)
+}
+
+// loadCredPool reads and decrypts a provider's enabled pool keys, or its own
+// APIKey when the pool is empty.
+func loadCredPool(app *App, p Provider) credPool {
+    var keys []ProviderKey
+    app.DB.Where("provider_id = ? AND enabled = ?", p.ID, true).Order("id ASC").Find(&keys)
+    stored := []string{p.APIKey}
+    creds := []upstreamCred{{credential: credential{ProviderID: p.ID}}}
+    if len(keys) > 0 {
+        stored = make([]string, len(keys))
+        creds = make([]upstreamCred, len(keys))
+        for i := range keys {
+            stored[i] = keys[i].Key
+            creds[i] = upstreamCred{credential: credential{p.ID, keys[i].ID}, key: &keys[i]}
+        }
+    }
+    pool := credPool{creds: creds, refs: make([]string, len(creds))}
+    for i, v := range stored {
+        if isSecretRef(v) {
+            pool.refs[i] = v
+        } else {
+            creds[i].secret = revealSecret(app, p, v)
+        }
+    }
+    return pool
+}
+
+// providerCredentials lists the credentials a provider can use: its enabled
+// pool keys, or its own APIKey when the pool is empty.
+func providerCredentials(app *App, p Provider) []upstreamCred {
+    pool, ok := app.creds.get(p.ID)
+    if !ok {
+        pool = loadCredPool(app, p)
+        app.creds.put(p.ID, pool)
+    }
+    creds := make([]upstreamCred, len(pool.creds))
+    copy(creds, pool.creds)
+    for i, ref := range pool.refs {
+        if ref != "" {
+            creds[i].secret = revealSecret(app, p, ref)
+        }
+    }
+    return creds
+}
+
+// revealSecret decrypts or looks up a stored secret for an upstream call. A
+// secret that can't be read is logged and the call goes out without one.
+func revealSecret(app *App, p Provider, stored string) string {
+    v, err := app.secrets.reveal(stored)
+    if err != nil {
+        log.Printf("provider %s: api key unavailable: %v", p.Name, err)
+    }
+    return v
+}
+
+// pickCredential chooses the key for the next request. Keys that are benched
+// or out of upstream quota are skipped; if none is usable it returns the one
+// that frees up first and how long that takes.
+func pickCredential(app *App, p Provider, estTokens int64) (upstreamCred, time.Duration) {
+    creds := providerCredentials(app, p)
+    if len(creds) == 1 {
+        return creds[0], app.quotas.wait(creds[0].credential, estTokens)
+    }
+    var ready []upstreamCred
+    best, bestWait := creds[0], time.Duration(-1)
+    for _, cr := range creds {
+        w := app.quotas.wait(cr.credential, estTokens)
+        if w == 0 {
+            ready = append(ready, cr)
+        } else if bestWait < 0 || w < bestWait {
+            best, bestWait = cr, w
+        }
+    }
+    if len(ready) == 0 {
+        return best, bestWait
+    }
+    if p.KeyStrategy == "least_limited" {
+        // Prefer the key that was rate limited longest ago (or never)
+        pick := ready[0]
+        for _, cr := range ready[1:] {
+            a, b := cr.key.LastRateLimitedAt, pick.key.LastRateLimitedAt
+            if b != nil && (a == nil || a.Before(*b)) {
+                pick = cr
+            }
+        }
+        return pick, 0
+    }
+    app.quotas.mu.Lock()
+    i := app.quotas.next[p.ID] % len(ready)
+    app.quotas.next[p.ID] = i + 1
+    app.quotas.mu.Unlock()
+    return ready[i], 0
+}
+
+// providerWait is how long until any of a provider's keys can take a request.
+func providerWait(app *App, providerID uint, estTokens int64) time.Duration {
+    pool, ok := app.creds.get(providerID)
+    if !ok {
+        var p Provider
+        if err := app.DB.First(&p, providerID).Error; err != nil {
+            return 0
+        }
+        pool = loadCredPool(app, p)
+        app.creds.put(p.ID, pool)
+    }
+    wait := time.Duration(-1)
+    for _, cr := range pool.creds {
+        if w := app.quotas.wait(cr.credential, estTokens); wait < 0 || w < wait {
+            wait = w
+        }
+    }
+    if wait < 0 {
+        return 0
+    }
+    return wait
+}
+
+// recordKeyUse updates a pool key's counters and benches it on 401/429.
+func recordKeyUse(app *App, cred upstreamCred, status int) {
+    if cred.key == nil {
+        return
+    }
+    now := time.Now()
+    updates := map[string]any{"requests": gorm.Expr("requests + 1"), "last_used_at": now}
+    switch status {
+    case http.StatusUnauthorized:
+        updates["auth_failures"] = gorm.Expr("auth_failures + 1")
+        app.quotas.bench(cred.credential, now.Add(keyAuthBench))
+    case http.StatusTooManyRequests:
+        // observe already blocked the key until Retry-After
+        updates["rate_limited"] = gorm.Expr("rate_limited + 1")
+        updates["last_rate_limited_at"] = now
+    }
+    app.DB.Model(&ProviderKey{}).Where("id = ?", cred.key.ID).Updates(updates)
+    if status == http.StatusTooManyRequests {
+        // least_limited picks by last_rate_limited_at
+        app.creds.invalidate(cred.ProviderID)
+    }
+}
+
+// providerKeyFor returns the secret to use for non-proxied calls such as model discovery.
+func providerKeyFor(app *App, p Provider) string {
+    cred, _ := pickCredential(app, p, 0)
+    return cred.secret
+}
+
+func parseKeyStrategy(s string) (string, bool) {
+    switch strings.ToLower(strings.TrimSpace(s)) {
+    case "", "round_robin":
+        return "round_robin", true
+    case "least_limited":
+        return "least_limited", true
+    }
+    return "", false
+}
@@ -19,16 +19,27 @@ type providerReq struct {
     BaseURL    string `json:"base_url"`
     APIKey     string `json:"api_key"`
     Enabled    bool   `json:"enabled"`
+    KeyStrategy string `json:"key_strategy"`
+    // nil leaves existing queue settings untouched on update
+    MaxConcurrent       *int `json:"max_concurrent"`
+    MaxQueue            *int `json:"max_queue"`
+    QueueTimeoutSeconds *int `json:"queue_timeout_seconds"`
+    // nil leaves existing patterns untouched on update
+    ModelInclude []string `json:"model_include"`
+    ModelExclude []string `json:"model_exclude"`
 }
 
 func registerProviderRoutes(g *echo.Group) {
     ag := g.Group("/providers")
     ag.GET("", requireAuth(blockAdminIfMustChange(listProviders)))
-    ag.POST("", requireAdmin(blockAdminIfMustChange(createProvider)))
-    ag.GET("/:id", requireAdmin(blockAdminIfMustChange(getProvider)))
-    ag.PUT("/:id", requireAdmin(blockAdminIfMustChange(updateProvider)))
-    ag.DELETE("/:id", requireAdmin(blockAdminIfMustChange(deleteProvider)))
-    ag.POST("/:id/refresh_models", requireAdmin(blockAdminIfMustChange(refreshProviderModels)))
+    ag.POST("", requirePermission(permProviders, blockAdminIfMustChange(createProvider)))
+    ag.GET("/:id", requirePermission(permProviders, blockAdminIfMustChange(getProvider)))
+    ag.PUT("/:id", requirePermission(permProviders, blockAdminIfMustChange(updateProvider)))
+    ag.DELETE("/:id", requirePermission(permProviders, blockAdminIfMustChange(deleteProvider)))
+    ag.POST("/:id/refresh_models", requirePermission(permProviders, blockAdminIfMustChange(refreshProviderModels)))
+    ag.GET("/:id/models", requirePermission(permProviders, blockAdminIfMustChange(listManualModels)))
+    ag.POST("/:id/models", requirePermission(permProviders, blockAdminIfMustChange(createManualModel)))
+    ag.DELETE("/:id/models/:mid", requirePermission(permProviders, blockAdminIfMustChange(deleteManualModel)))
 }
 
 func listProviders(c echo.Context) error {
@@ -37,9 +48,21 @@ func listProviders(c echo.Context) error {
     if err := app.DB.Preload("Models").Order("id ASC").Find(&ps).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    // Team members only see their team's providers
+    if !hasPermission(c, permProviders) {
+        if t := callerTeam(c); t != nil {
+            visible := ps[:0]
+            for _, p := range ps {
+                if t.visibleProvider(p.ID) { visible = append(visible, p) }
+            }
+            ps = visible
+        }
+    }
     // attach runtime pulled models to response
     for i := range ps {
         ps[i].RuntimeModels = app.GetPulled(ps[i].ID)
+        ps[i].Quota = app.quotas.forProvider(ps[i].ID)
+        ps[i].Queue = app.gates.stats(ps[i])
     }
     return c.JSON(http.StatusOK, ps)
 }
@@ -50,16 +73,37 @@ func createProvider(c echo.Context) error {
     if err := c.Bind(&req); err != nil || req.Name == "" || req.Type == "" {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
     }
+    if _, err := compileModelPatterns(append(append([]string{}, req.ModelInclude...), req.ModelExclude...)); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    strategy, ok := parseKeyStrategy(req.KeyStrategy)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid key_strategy"})
+    }
+    if !validQueueSettings(req) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "negative queue setting"})
+    }
+    apiKey, err := storeSecret(c, req.APIKey)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "api_key: " + err.Error()})
+    }
     p := Provider{
         Name:       req.Name,
         Type:       strings.ToLower(req.Type),
         BaseURL:    defaultStr(req.BaseURL, "https://api.openai.com/v1"),
-        APIKey:     req.APIKey,
+        APIKey:     apiKey,
         Enabled:    req.Enabled,
+        KeyStrategy: strategy,
+        ModelInclude: req.ModelInclude,
+        ModelExclude: req.ModelExclude,
     }
+    applyQueueSettings(&p, req)
     if err := app.DB.Create(&p).Error; err != nil {
         return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
     }
+    var secrets []string
+    if p.APIKey != "" { secrets = append(secrets, "api_key") }
+    audit(c, "provider.create", "provider", p.ID, nil, p, secrets...)
     // Always attempt to pull models
     _ = fetchAndStoreModels(app, &p)
     if err := app.DB.Preload("Models").First(&p, p.ID).Error; err == nil {
@@ -76,6 +120,8 @@ func getProvider(c echo.Context) error {
         return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
     }
     p.RuntimeModels = app.GetPulled(p.ID)
+    p.Quota = app.quotas.forProvider(p.ID)
+    p.Queue = app.gates.stats(p)
     return c.JSON(http.StatusOK, p)
 }
 
@@ -90,16 +136,43 @@ func updateProvider(c echo.Context) error {
     if err := c.Bind(&req); err != nil {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
     }
+    before := p
     if req.Name != "" { p.Name = req.Name }
     if req.Type != "" { p.Type = strings.ToLower(req.Type) }
     if req.BaseURL != "" { p.BaseURL = req.BaseURL }
     // Allow clearing API key by sending explicit empty? Keep as: only set if provided non-empty
-    if req.APIKey != "" { p.APIKey = req.APIKey }
+    if req.APIKey != "" {
+        apiKey, err := storeSecret(c, req.APIKey)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "api_key: " + err.Error()})
+        }
+        p.APIKey = apiKey
+    }
+    if _, err := compileModelPatterns(append(append([]string{}, req.ModelInclude...), req.ModelExclude...)); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if req.KeyStrategy != "" {
+        strategy, ok := parseKeyStrategy(req.KeyStrategy)
+        if !ok {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid key_strategy"})
+        }
+        p.KeyStrategy = strategy
+    }
+    if !validQueueSettings(req) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "negative queue setting"})
+    }
+    applyQueueSettings(&p, req)
+    if req.ModelInclude != nil { p.ModelInclude = req.ModelInclude }
+    if req.ModelExclude != nil { p.ModelExclude = req.ModelExclude }
     prevEnabled := p.Enabled
     p.Enabled = req.Enabled
     if err := app.DB.Save(&p).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    app.creds.invalidate(p.ID)
+    var secrets []string
+    if p.APIKey != before.APIKey { secrets = append(secrets, "api_key") }
+    audit(c, "provider.update", "provider", p.ID, before, p, secrets...)
     // Refresh cache; clear if disabled now
     if p.Enabled {
         _ = fetchAndStoreModels(app, &p)
@@ -120,6 +193,7 @@ func refreshProviderModels(c echo.Context) error {
     if err := fetchAndStoreModels(app, &p); err != nil {
         return c.JSON(http.StatusBadGateway, echo.Map{"error": "refresh_failed"})
     }
+    audit(c, "provider.refresh_models", "provider", p.ID, nil, nil)
     _ = app.DB.Preload("Models").First(&p, p.ID).Error
     return c.JSON(http.StatusOK, p)
 }
@@ -127,30 +201,54 @@ func refreshProviderModels(c echo.Context) error {
 func deleteProvider(c echo.Context) error {
     app := getApp(c)
     id := c.Param("id")
+    var p Provider
+    if err := app.DB.First(&p, id).Error; err != nil {
+        return c.NoContent(http.StatusNoContent) // already gone
+    }
     // hard-delete associated models and provider so name can be reused
     app.DB.Unscoped().Where("provider_id = ?", id).Delete(&ModelEntry{})
+    app.DB.Where("provider_id = ?", id).Delete(&ModelInfo{})
+    app.DB.Where("provider_id = ?", id).Delete(&ProviderKey{})
     if err := app.DB.Unscoped().Delete(&Provider{}, id).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
     if n, err := strconv.ParseUint(id, 10, 64); err == nil {
         app.ClearPulled(uint(n))
+        app.quotas.forget(uint(n))
     }
+    app.creds.invalidate(p.ID)
+    audit(c, "provider.delete", "provider", p.ID, p, nil)
     return c.NoContent(http.StatusNoContent)
 }
 
+func validQueueSettings(req providerReq) bool {
+    for _, v := range []*int{req.MaxConcurrent, req.MaxQueue, req.QueueTimeoutSeconds} {
+        if v != nil && *v < 0 { return false }
+    }
+    return true
+}
+
+func applyQueueSettings(p *Provider, req providerReq) {
+    if req.MaxConcurrent != nil { p.MaxConcurrent = *req.MaxConcurrent }
+    if req.MaxQueue != nil { p.MaxQueue = *req.MaxQueue }
+    if req.QueueTimeoutSeconds != nil { p.QueueTimeoutSeconds = *req.QueueTimeoutSeconds }
+}
+
 func defaultStr(s, def string) string { if s == "" { return def }; return s }
 
 // Fetch models from provider and store
 func fetchAndStoreModels(app *App, p *Provider) error {
     if p.Type != "openai" {
+        // No discovery endpoint; only manual models are exposed
+        publishModels(app, p, nil)
         return nil
     }
     // Call GET {base}/models
     base := strings.TrimSuffix(p.BaseURL, "/")
     u, _ := url.Parse(base + "/models")
     req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
-    if p.APIKey != "" {
-        req.Header.Set("Authorization", "Bearer "+p.APIKey)
+    if key := providerKeyFor(app, *p); key != "" {
+        req.Header.Set("Authorization", "Bearer "+key)
     }
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
@@ -164,18 +262,29 @@ func fetchAndStoreModels(app *App, p *Provider) error {
         return fmt.Errorf("status %d", resp.StatusCode)
     }
     var payload struct {
-        Data []struct {
-            ID string `json:"id"`
-        } `json:"data"`
+        Data []json.RawMessage `json:"data"`
     }
     if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
         fmt.Printf("provider %s decode models error: %v\n", p.Name, err)
         return err
     }
-    // cache models in memory (do not persist)
-    names := make([]string, 0, len(payload.Data))
-    for _, m := range payload.Data { names = append(names, m.ID) }
-    app.SetPulled(p.ID, names)
-    log.Printf("models: pulled %d models from provider=%s", len(names), p.Name)
+    // Decode entries one by one so odd metadata types only cost that entry's metadata
+    models := make([]upstreamModel, 0, len(payload.Data))
+    for _, raw := range payload.Data {
+        var m upstreamModel
+        if err := json.Unmarshal(raw, &m); err != nil {
+            var idOnly struct{ ID string `json:"id"` }
+            if json.Unmarshal(raw, &idOnly) != nil { continue }
+            m = upstreamModel{ID: idOnly.ID}
+        }
+        if m.ID != "" { models = append(models, m) }
+    }
+    seedModelInfo(app, p, models)
+    // cache models in memory (do not persist), filtered by include/exclude patterns
+    names := make([]string, 0, len(models))
+    for _, m := range models { names = append(names, m.ID) }
+    app.setUpstream(p.ID, names)
+    exposed := publishModels(app, p, names)
+    log.Printf("models: pulled %d models from provider=%s (%d exposed)", len(names), p.Name, len(exposed))
     return nil
 }
@@ -0,0 +1,314 @@
+package server
+
+import (
+    "container/heap"
+    "context"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Request priorities; higher is served first.
+const (
+    priorityLow = iota
+    priorityNormal
+    priorityHigh
+)
+
+// Queue defaults for providers with max_concurrent set but no queue settings.
+const (
+    defaultMaxQueue     = 100
+    defaultQueueTimeout = 30 * time.Second
+)
+
+// upstreamClient is shared by all proxied calls so connections to each
+// provider are pooled instead of relying on http.DefaultClient's small
+// per-host idle pool.
+var upstreamClient = &http.Client{Transport: newUpstreamTransport()}
+
+func newUpstreamTransport() *http.Transport {
+    return &http.Transport{
+        Proxy:                 http.ProxyFromEnvironment,
+        DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+        ForceAttemptHTTP2:     true,
+        MaxIdleConns:          256,
+        MaxIdleConnsPerHost:   64,
+        IdleConnTimeout:       90 * time.Second,
+        TLSHandshakeTimeout:   10 * time.Second,
+        ExpectContinueTimeout: time.Second,
+    }
+}
+
+func parsePriority(s string) (int, bool) {
+    switch strings.ToLower(strings.TrimSpace(s)) {
+    case "low", "batch":
+        return priorityLow, true
+    case "", "normal":
+        return priorityNormal, true
+    case "high", "interactive":
+        return priorityHigh, true
+    }
+    return priorityNormal, false
+}
+
+func priorityName(p int) string {
+    switch p {
+    case priorityLow:
+        return "low"
+    case priorityHigh:
+        return "high"
+    }
+    return "normal"
+}
+
+type priorityCtxKey struct{}
+
+func withPriority(ctx context.Context, p int) context.Context {
+    return context.WithValue(ctx, priorityCtxKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) int {
+    if p, ok := ctx.Value(priorityCtxKey{}).(int); ok {
+        return p
+    }
+    return priorityNormal
+}
+
+// requestPriority derives a request's priority from its API key, lowered
+// (never raised) by an X-Request-Priority header.
+func requestPriority(c echo.Context, key *APIKey) int {
+    prio := priorityNormal
+    if key != nil {
+        prio, _ = parsePriority(key.Priority)
+    }
+    if h := c.Request().Header.Get("X-Request-Priority"); h != "" {
+        if p, ok := parsePriority(h); ok && p < prio {
+            prio = p
+        }
+    }
+    return prio
+}
+
+// errQueue is returned when a request could not get an upstream slot.
+type errQueue struct {
+    provider string
+    reason   string // queue_full|queue_timeout
+}
+
+func (e *errQueue) Error() string {
+    if e.reason == "queue_full" {
+        return fmt.Sprintf("Provider %s is at capacity and its queue is full", e.provider)
+    }
+    return fmt.Sprintf("Timed out waiting for capacity on provider %s", e.provider)
+}
+
+// queueUnavailable answers 503 for a request that could not be queued.
+func queueUnavailable(c echo.Context, err *errQueue) error {
+    c.Response().Header().Set("Retry-After", "1")
+    return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": echo.Map{
+        "message": err.Error() + ".",
+        "type":    "server_error",
+        "param":   nil,
+        "code":    err.reason,
+    }})
+}
+
+type waiter struct {
+    prio    int
+    seq     uint64
+    ready   chan struct{}
+    granted bool
+    index   int
+}
+
+// waitQueue orders waiters by priority, then arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+    if q[i].prio != q[j].prio {
+        return q[i].prio > q[j].prio
+    }
+    return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int)  { q[i], q[j] = q[j], q[i]; q[i].index = i; q[j].index = j }
+func (q *waitQueue) Push(x any)    { w := x.(*waiter); w.index = len(*q); *q = append(*q, w) }
+func (q *waitQueue) Pop() any {
+    old := *q
+    w := old[len(old)-1]
+    *q = old[:len(old)-1]
+    w.index = -1
+    return w
+}
+
+// providerGate caps in-flight upstream calls for one provider and queues the rest.
+type providerGate struct {
+    mu       sync.Mutex
+    active   int
+    waiting  waitQueue
+    seq      uint64
+    limit    int
+    // cumulative counters
+    queued   int64
+    timeouts int64
+    rejected int64
+}
+
+// queueStats is the live state of a provider's gate.
+type queueStats struct {
+    MaxConcurrent int   `json:"max_concurrent"`
+    MaxQueue      int   `json:"max_queue"`
+    Active        int   `json:"active"`
+    Waiting       int   `json:"waiting"`
+    QueuedTotal   int64 `json:"queued_total"`
+    TimeoutsTotal int64 `json:"timeouts_total"`
+    RejectedTotal int64 `json:"rejected_total"`
+}
+
+type gateSet struct {
+    mu    sync.Mutex
+    gates map[uint]*providerGate
+}
+
+func newGateSet() *gateSet {
+    return &gateSet{gates: map[uint]*providerGate{}}
+}
+
+func (s *gateSet) get(providerID uint) *providerGate {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    g := s.gates[providerID]
+    if g == nil {
+        g = &providerGate{}
+        s.gates[providerID] = g
+    }
+    return g
+}
+
+func (s *gateSet) stats(p Provider) *queueStats {
+    if p.MaxConcurrent <= 0 {
+        return nil
+    }
+    g := s.get(p.ID)
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return &queueStats{
+        MaxConcurrent: p.MaxConcurrent,
+        MaxQueue:      providerMaxQueue(p),
+        Active:        g.active,
+        Waiting:       len(g.waiting),
+        QueuedTotal:   g.queued,
+        TimeoutsTotal: g.timeouts,
+        RejectedTotal: g.rejected,
+    }
+}
+
+func providerMaxQueue(p Provider) int {
+    if p.MaxQueue > 0 {
+        return p.MaxQueue
+    }
+    return defaultMaxQueue
+}
+
+func providerQueueTimeout(p Provider) time.Duration {
+    if p.QueueTimeoutSeconds > 0 {
+        return time.Duration(p.QueueTimeoutSeconds) * time.Second
+    }
+    return defaultQueueTimeout
+}
+
+// acquire takes an upstream slot for p, waiting in priority order when the
+// provider is at its concurrency cap. The returned release must be called
+// exactly once.
+func (s *gateSet) acquire(ctx context.Context, p Provider) (func(), error) {
+    if p.MaxConcurrent <= 0 {
+        return func() {}, nil
+    }
+    g := s.get(p.ID)
+    g.mu.Lock()
+    g.limit = p.MaxConcurrent
+    if g.active < g.limit && len(g.waiting) == 0 {
+        g.active++
+        g.mu.Unlock()
+        return g.releaseOnce(), nil
+    }
+    if len(g.waiting) >= providerMaxQueue(p) {
+        g.rejected++
+        g.mu.Unlock()
+        return nil, &errQueue{provider: p.Name, reason: "queue_full"}
+    }
+    g.seq++
+    w := &waiter{prio: priorityFrom(ctx), seq: g.seq, ready: make(chan struct{})}
+    heap.Push(&g.waiting, w)
+    g.queued++
+    g.mu.Unlock()
+
+    timer := time.NewTimer(providerQueueTimeout(p))
+    defer timer.Stop()
+    select {
+    case <-w.ready:
+        return g.releaseOnce(), nil
+    case <-timer.C:
+    case <-ctx.Done():
+    }
+    g.mu.Lock()
+    if w.granted {
+        // Slot was handed over while we were giving up; pass it on
+        g.mu.Unlock()
+        g.release()
+    } else {
+        heap.Remove(&g.waiting, w.index)
+        g.mu.Unlock()
+    }
+    if ctx.Err() != nil {
+        return nil, ctx.Err()
+    }
+    g.mu.Lock()
+    g.timeouts++
+    g.mu.Unlock()
+    return nil, &errQueue{provider: p.Name, reason: "queue_timeout"}
+}
+
+// release hands the slot to the next waiter, or frees it.
+func (g *providerGate) release() {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if len(g.waiting) > 0 && g.active <= g.limit {
+        w := heap.Pop(&g.waiting).(*waiter)
+        w.granted = true
+        close(w.ready)
+        return
+    }
+    g.active--
+}
+
+func (g *providerGate) releaseOnce() func() {
+    var once sync.Once
+    return func() { once.Do(g.release) }
+}
+
+// gatedBody releases the provider slot once the response body is drained or closed.
+type gatedBody struct {
+    io.ReadCloser
+    release func()
+}
+
+func (b *gatedBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    if err != nil {
+        b.release()
+    }
+    return n, err
+}
+
+func (b *gatedBody) Close() error {
+    err := b.ReadCloser.Close()
+    b.release()
+    return err
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const rateWindow = time.Minute
+
+// rateStore counts requests and tokens per subject over the last minute.
+type rateStore interface {
+    // add counts requests and tokens (negative to undo) and returns what the
+    // subject has consumed in the current window, this included, and how long
+    // until that usage starts to expire. Concurrent adds never lose counts.
+    add(subject string, now time.Time, requests, tokens int64) (int64, int64, time.Duration)
+}
+
+// memRateStore is a sliding one-minute log kept in process memory.
+type memRateStore struct {
+    mu        sync.Mutex
+    events    map[string][]rateEvent
+    lastSweep time.Time
+}
+
+type rateEvent struct {
+    at       time.Time
+    requests int64
+    tokens   int64
+}
+
+func (s *memRateStore) prune(subject string, now time.Time) []rateEvent {
+    evs := s.events[subject]
+    i := 0
+    for i < len(evs) && now.Sub(evs[i].at) >= rateWindow {
+        i++
+    }
+    evs = evs[i:]
+    if len(evs) == 0 {
+        delete(s.events, subject)
+    } else {
+        s.events[subject] = evs
+    }
+    return evs
+}
+
+func (s *memRateStore) add(subject string, now time.Time, requests, tokens int64) (int64, int64, time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    // Subjects that went idle would otherwise keep their last window forever
+    if now.Sub(s.lastSweep) >= rateWindow {
+        for k := range s.events {
+            s.prune(k, now)
+        }
+        s.lastSweep = now
+    }
+    evs := append(s.prune(subject, now), rateEvent{at: now, requests: requests, tokens: tokens})
+    s.events[subject] = evs
+    var req, tok int64
+    for _, e := range evs {
+        req += e.requests
+        tok += e.tokens
+    }
+    return req, tok, evs[0].at.Add(rateWindow).Sub(now)
+}
+
+// dbRateStore keeps fixed one-minute counters in the database so several
+// instances share the same RPM/TPM budget.
+type dbRateStore struct {
+    db          *gorm.DB
+    mu          sync.Mutex
+    lastCleanup int64
+}
+
+func (s *dbRateStore) add(subject string, now time.Time, requests, tokens int64) (int64, int64, time.Duration) {
+    minute := now.Unix() / 60
+    reset := time.Unix((minute+1)*60, 0).Sub(now)
+    // The upsert is atomic; reading back afterwards may include other
+    // instances' concurrent adds, which only errs on the side of the limit
+    err := s.db.Clauses(clause.OnConflict{
+        Columns: []clause.Column{{Name: "subject"}, {Name: "minute"}},
+        DoUpdates: clause.Assignments(map[string]any{
+            "requests": gorm.Expr("rate_limit_windows.requests + ?", requests),
+            "tokens":   gorm.Expr("rate_limit_windows.tokens + ?", tokens),
+        }),
+    }).Create(&RateLimitWindow{Subject: subject, Minute: minute, Requests: requests, Tokens: tokens}).Error
+    if err != nil {
+        log.Printf("ratelimit: store error: %v", err)
+    }
+    var w RateLimitWindow
+    s.db.Where("subject = ? AND minute = ?", subject, minute).Limit(1).Find(&w)
+    s.mu.Lock()
+    stale := s.lastCleanup != minute
+    s.lastCleanup = minute
+    s.mu.Unlock()
+    if stale {
+        s.db.Where("minute < ?", minute-1).Delete(&RateLimitWindow{})
+    }
+    return w.Requests, w.Tokens, reset
+}
+
+// rateLimiter enforces RPM/TPM through a rateStore and tracks in-flight
+// requests and their estimated tokens locally.
+type rateLimiter struct {
+    mu       sync.Mutex
+    store    rateStore
+    inflight map[string]int
+    reserved map[string]int64
+    // subjects with a TPM limit; only these get actual token usage recorded
+    tracked  map[string]bool
+}
+
+func newRateLimiter(app *App) *rateLimiter {
+    backend := app.Config.RateLimit.Backend
+    if v := os.Getenv("RATE_LIMIT_BACKEND"); v != "" { backend = v }
+    l := &rateLimiter{inflight: map[string]int{}, reserved: map[string]int64{}, tracked: map[string]bool{}}
+    if strings.ToLower(backend) == "database" {
+        l.store = &dbRateStore{db: app.DB}
+    } else {
+        l.store = &memRateStore{events: map[string][]rateEvent{}}
+    }
+    return l
+}
+
+type rateSubject struct {
+    key    string
+    label  string
+    limits RateLimits
+}
+
+// rateStatus is reported to clients in x-ratelimit-* headers for the most
+// constrained subject.
+type rateStatus struct {
+    limitReq, remainingReq int64
+    resetReq               time.Duration
+    limitTok, remainingTok int64
+    resetTok               time.Duration
+}
+
+type errRateLimited struct {
+    kind       string // requests|tokens|concurrency
+    subject    string
+    limit      int64
+    retryAfter time.Duration
+}
+
+func (e *errRateLimited) Error() string {
+    switch e.kind {
+    case "tokens":
+        return fmt.Sprintf("Rate limit reached for %s on tokens per min (TPM): Limit %d", e.subject, e.limit)
+    case "concurrency":
+        return fmt.Sprintf("Too many concurrent requests for %s: Limit %d", e.subject, e.limit)
+    }
+    return fmt.Sprintf("Rate limit reached for %s on requests per min (RPM): Limit %d", e.subject, e.limit)
+}
+
+// admit checks every subject and, if all have room, counts the request and
+// holds its estimated tokens until release. Only the in-process concurrency
+// and reservation step runs under the limiter's lock; RPM and TPM are decided
+// on the store's own atomic count, so concurrent requests can't both take the
+// last slot.
+func (l *rateLimiter) admit(subjects []rateSubject, estTokens int64) (func(), rateStatus, error) {
+    now := time.Now()
+    st := rateStatus{remainingReq: -1, remainingTok: -1}
+    others := make([]int64, len(subjects)) // tokens reserved by other in-flight requests
+    l.mu.Lock()
+    for _, s := range subjects {
+        if lim := s.limits.MaxConcurrent; lim > 0 && l.inflight[s.key] >= lim {
+            l.mu.Unlock()
+            return nil, st, &errRateLimited{kind: "concurrency", subject: s.label, limit: int64(lim), retryAfter: time.Second}
+        }
+    }
+    for i, s := range subjects {
+        others[i] = l.reserved[s.key]
+        if s.limits.TPM > 0 {
+            l.tracked[s.key] = true
+        }
+        l.inflight[s.key]++
+        l.reserved[s.key] += estTokens
+    }
+    l.mu.Unlock()
+    var once sync.Once
+    release := func() {
+        once.Do(func() {
+            l.mu.Lock()
+            defer l.mu.Unlock()
+            for _, s := range subjects {
+                if l.inflight[s.key]--; l.inflight[s.key] <= 0 {
+                    delete(l.inflight, s.key)
+                }
+                if l.reserved[s.key] -= estTokens; l.reserved[s.key] <= 0 {
+                    delete(l.reserved, s.key)
+                }
+            }
+        })
+    }
+    var counted []string
+    reject := func(rl *errRateLimited) (func(), rateStatus, error) {
+        for _, k := range counted {
+            l.store.add(k, now, -1, 0)
+        }
+        release()
+        return nil, st, rl
+    }
+    for i, s := range subjects {
+        lim := s.limits
+        if lim.RPM == 0 && lim.TPM == 0 {
+            continue
+        }
+        req, tok, reset := l.store.add(s.key, now, 1, 0)
+        counted = append(counted, s.key)
+        if reset <= 0 {
+            reset = rateWindow
+        }
+        if lim.RPM > 0 {
+            if req > int64(lim.RPM) {
+                st.limitReq, st.remainingReq, st.resetReq = int64(lim.RPM), 0, reset
+                return reject(&errRateLimited{kind: "requests", subject: s.label, limit: int64(lim.RPM), retryAfter: reset})
+            }
+            if rem := int64(lim.RPM) - req; st.remainingReq < 0 || rem < st.remainingReq {
+                st.limitReq, st.remainingReq, st.resetReq = int64(lim.RPM), rem, reset
+            }
+        }
+        if lim.TPM > 0 {
+            used := tok + others[i]
+            if used+estTokens > int64(lim.TPM) {
+                rem := int64(lim.TPM) - used
+                if rem < 0 { rem = 0 }
+                st.limitTok, st.remainingTok, st.resetTok = int64(lim.TPM), rem, reset
+                return reject(&errRateLimited{kind: "tokens", subject: s.label, limit: int64(lim.TPM), retryAfter: reset})
+            }
+            if rem := int64(lim.TPM) - used - estTokens; st.remainingTok < 0 || rem < st.remainingTok {
+                st.limitTok, st.remainingTok, st.resetTok = int64(lim.TPM), rem, reset
+            }
+        }
+    }
+    return release, st, nil
+}
+
+// record adds the tokens a finished upstream call actually used.
+func (l *rateLimiter) record(userID, keyID, providerID uint, model string, tokens int64) {
+    if tokens == 0 {
+        return
+    }
+    keys := []string{rateKeyUser(userID), rateKeyModel(providerID, model)}
+    if keyID != 0 {
+        keys = append(keys, rateKeyAPIKey(keyID))
+    }
+    now := time.Now()
+    for _, k := range keys {
+        l.mu.Lock()
+        tracked := l.tracked[k]
+        l.mu.Unlock()
+        if tracked {
+            l.store.add(k, now, 0, tokens)
+        }
+    }
+}
+
+func rateKeyUser(id uint) string   { return "user:" + strconv.FormatUint(uint64(id), 10) }
+func rateKeyAPIKey(id uint) string { return "key:" + strconv.FormatUint(uint64(id), 10) }
+func rateKeyModel(providerID uint, model string) string {
+    return "model:" + strconv.FormatUint(uint64(providerID), 10) + ":" + model
+}
+
+// rateLimit enforces user, key and model limits on /api/v1 before the
+// request is forwarded. It runs after apiAuth.
+func rateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        app := getApp(c)
+        user, _ := c.Get("user").(*User)
+        key, _ := c.Get("api_key").(*APIKey)
+        if user == nil {
+            return next(c)
+        }
+        var subjects []rateSubject
+        if user.RateLimits.limited() {
+            subjects = append(subjects, rateSubject{key: rateKeyUser(user.ID), label: "user " + user.Email, limits: user.RateLimits})
+        }
+        if key != nil && key.RateLimits.limited() {
+            subjects = append(subjects, rateSubject{key: rateKeyAPIKey(key.ID), label: "key " + key.Prefix, limits: key.RateLimits})
+        }
+        var estTokens int64
+        if c.Request().Method == http.MethodPost && c.Request().Body != nil {
+            // Peek at the body for the model and a token estimate, then restore it for the handler
+            b, err := io.ReadAll(c.Request().Body)
+            if err != nil {
+                return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid body"})
+            }
+            c.Request().Body = io.NopCloser(bytes.NewReader(b))
+            var payload map[string]any
+            if json.Unmarshal(b, &payload) == nil {
+                promptTok, outTok := estimateTokens(payload)
+                estTokens = int64(promptTok + outTok)
+                if model, _ := payload["model"].(string); model != "" {
+                    resolved, _ := resolveAlias(app, model)
+                    if pid, raw, ok := requestTarget(app, resolved); ok {
+                        var ml ModelRateLimit
+                        if app.DB.Where("provider_id = ? AND model = ?", pid, raw).Limit(1).Find(&ml).RowsAffected > 0 && ml.RateLimits.limited() {
+                            subjects = append(subjects, rateSubject{key: rateKeyModel(pid, raw), label: "model " + resolved, limits: ml.RateLimits})
+                        }
+                    }
+                }
+            }
+        }
+        if len(subjects) == 0 {
+            return next(c)
+        }
+        release, st, err := app.limiter.admit(subjects, estTokens)
+        setRateHeaders(c, st)
+        if err != nil {
+            rl := err.(*errRateLimited)
+            secs := int(rl.retryAfter.Round(time.Second) / time.Second)
+            if secs < 1 { secs = 1 }
+            c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+            kind := rl.kind
+            if kind == "concurrency" { kind = "requests" }
+            return c.JSON(http.StatusTooManyRequests, echo.Map{"error": echo.Map{
+                "message": rl.Error() + ".",
+                "type":    kind,
+                "param":   nil,
+                "code":    "rate_limit_exceeded",
+            }})
+        }
+        defer release()
+        return next(c)
+    }
+}
+
+func setRateHeaders(c echo.Context, st rateStatus) {
+    h := c.Response().Header()
+    if st.remainingReq >= 0 {
+        h.Set("x-ratelimit-limit-requests", strconv.FormatInt(st.limitReq, 10))
+        h.Set("x-ratelimit-remaining-requests", strconv.FormatInt(st.remainingReq, 10))
+        h.Set("x-ratelimit-reset-requests", formatReset(st.resetReq))
+    }
+    if st.remainingTok >= 0 {
+        h.Set("x-ratelimit-limit-tokens", strconv.FormatInt(st.limitTok, 10))
+        h.Set("x-ratelimit-remaining-tokens", strconv.FormatInt(st.remainingTok, 10))
+        h.Set("x-ratelimit-reset-tokens", formatReset(st.resetTok))
+    }
+}
+
+// formatReset renders durations the way OpenAI does ("1s", "6m0s", "20ms").
+func formatReset(d time.Duration) string {
+    if d <= 0 {
+        return "0s"
+    }
+    if d < time.Second {
+        return d.Round(time.Millisecond).String()
+    }
+    return d.Round(time.Second).String()
+}
+
+type modelLimitReq struct {
+    // Qualified provider/model id
+    Model string `json:"model"`
+    RateLimits
+}
+
+type keyLimitsReq struct {
+    RateLimits
+    // nil leaves the key's queue priority unchanged
+    Priority *string `json:"priority"`
+}
+
+func registerRateLimitRoutes(g *echo.Group) {
+    ag := g.Group("/ratelimits")
+    ag.GET("/models", requirePermission(permBudgets, blockAdminIfMustChange(listModelLimits)))
+    ag.PUT("/models", requirePermission(permBudgets, blockAdminIfMustChange(putModelLimit)))
+    ag.DELETE("/models/:id", requirePermission(permBudgets, blockAdminIfMustChange(deleteModelLimit)))
+    g.PUT("/admin/keys/:id/limits", requirePermission(permUsers, blockAdminIfMustChange(adminSetKeyLimits)))
+}
+
+func listModelLimits(c echo.Context) error {
+    app := getApp(c)
+    var limits []ModelRateLimit
+    if err := app.DB.Order("provider_id ASC, model ASC").Find(&limits).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, limits)
+}
+
+// putModelLimit creates or replaces the limits for one provider model.
+func putModelLimit(c echo.Context) error {
+    app := getApp(c)
+    var req modelLimitReq
+    if err := c.Bind(&req); err != nil || req.Model == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if req.RPM < 0 || req.TPM < 0 || req.MaxConcurrent < 0 {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "negative limit"})
+    }
+    p, raw, ok := resolveQualifiedModel(app, req.Model)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
+    }
+    var ml ModelRateLimit
+    app.DB.Where("provider_id = ? AND model = ?", p.ID, raw).Limit(1).Find(&ml)
+    var before any
+    if ml.ID != 0 { before = ml }
+    ml.ProviderID, ml.Model, ml.RateLimits = p.ID, raw, req.RateLimits
+    if err := app.DB.Save(&ml).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "ratelimit.model_update", "model_rate_limit", ml.ID, before, ml)
+    return c.JSON(http.StatusOK, ml)
+}
+
+func deleteModelLimit(c echo.Context) error {
+    app := getApp(c)
+    var ml ModelRateLimit
+    if err := app.DB.First(&ml, c.Param("id")).Error; err != nil {
+        return c.NoContent(http.StatusNoContent) // already gone
+    }
+    if err := app.DB.Delete(&ml).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "ratelimit.model_delete", "model_rate_limit", ml.ID, ml, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+func adminSetKeyLimits(c echo.Context) error {
+    app := getApp(c)
+    var key APIKey
+    if err := app.DB.First(&key, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req keyLimitsReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if req.RPM < 0 || req.TPM < 0 || req.MaxConcurrent < 0 {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "negative limit"})
+    }
+    before := key
+    key.RateLimits = req.RateLimits
+    if req.Priority != nil {
+        prio, ok := parsePriority(*req.Priority)
+        if !ok {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid priority"})
+        }
+        key.Priority = priorityName(prio)
+    }
+    if err := app.DB.Save(&key).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "key.limits_update", "api_key", key.ID, before, key)
+    app.keyCache.invalidateKey(key.ID)
+    key.Hash = ""
+    return c.JSON(http.StatusOK, key)
+}
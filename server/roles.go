@@ -0,0 +1,224 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Permissions a role can grant.
+const (
+    permProviders = "providers.manage" // providers, their keys and models
+    permRoutes    = "routes.manage"    // fallback routes and aliases
+    permModels    = "models.manage"    // model catalog and prices
+    permUsers     = "users.manage"     // users, their keys, service accounts and teams
+    permBudgets   = "budgets.manage"   // budgets and rate limits
+    permStats     = "stats.view_all"   // everyone's stats and spend
+    permLogs      = "logs.view"        // request logs
+    permRoles     = "roles.manage"     // custom roles
+    permAudit     = "audit.view"       // audit log of administrative changes
+)
+
+var allPermissions = []string{permProviders, permRoutes, permModels, permUsers, permBudgets, permStats, permLogs, permRoles, permAudit}
+
+// Built-in roles; they can't be edited or deleted.
+var builtinRoles = []Role{
+    {Name: "admin", Description: "Full access", Permissions: []string{"*"}, BuiltIn: true},
+    {Name: "user", Description: "Own keys, chat and stats", Permissions: []string{}, BuiltIn: true},
+}
+
+type roleReq struct {
+    Name        string    `json:"name"`
+    Description *string   `json:"description"`
+    Permissions *[]string `json:"permissions"`
+}
+
+func registerRoleRoutes(g *echo.Group) {
+    g.GET("/permissions", requireAuth(blockAdminIfMustChange(listPermissions)))
+    ag := g.Group("/roles")
+    ag.GET("", requireAuth(blockAdminIfMustChange(listRoles)))
+    ag.POST("", requirePermission(permRoles, blockAdminIfMustChange(createRole)))
+    ag.PUT("/:id", requirePermission(permRoles, blockAdminIfMustChange(updateRole)))
+    ag.DELETE("/:id", requirePermission(permRoles, blockAdminIfMustChange(deleteRole)))
+}
+
+// seedRoles creates the built-in roles if missing.
+func seedRoles(app *App) error {
+    for _, r := range builtinRoles {
+        var existing Role
+        if app.DB.Where("name = ?", r.Name).First(&existing).Error == nil {
+            continue
+        }
+        if err := app.DB.Create(&r).Error; err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func listPermissions(c echo.Context) error {
+    return c.JSON(http.StatusOK, allPermissions)
+}
+
+func listRoles(c echo.Context) error {
+    app := getApp(c)
+    var roles []Role
+    if err := app.DB.Order("id ASC").Find(&roles).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, roles)
+}
+
+func createRole(c echo.Context) error {
+    app := getApp(c)
+    var req roleReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    r := Role{Name: strings.ToLower(strings.TrimSpace(req.Name)), Permissions: []string{}}
+    if r.Name == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "name required"})
+    }
+    if err := applyRoleReq(c, &r, req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if err := app.DB.Create(&r).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    audit(c, "role.create", "role", r.ID, nil, r)
+    return c.JSON(http.StatusCreated, r)
+}
+
+func updateRole(c echo.Context) error {
+    app := getApp(c)
+    var r Role
+    if err := app.DB.First(&r, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if r.BuiltIn {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "built-in role"})
+    }
+    before := r
+    var req roleReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if err := applyRoleReq(c, &r, req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    if err := app.DB.Save(&r).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "role.update", "role", r.ID, before, r)
+    return c.JSON(http.StatusOK, r)
+}
+
+// deleteRole removes a custom role that no user holds.
+func deleteRole(c echo.Context) error {
+    app := getApp(c)
+    var r Role
+    if err := app.DB.First(&r, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if r.BuiltIn {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "built-in role"})
+    }
+    var holders int64
+    app.DB.Model(&User{}).Where("role = ?", r.Name).Count(&holders)
+    if holders > 0 {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "role in use"})
+    }
+    if err := app.DB.Delete(&r).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "role.delete", "role", r.ID, r, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+// applyRoleReq validates permissions; a caller can only grant permissions it holds.
+func applyRoleReq(c echo.Context, r *Role, req roleReq) error {
+    if req.Description != nil { r.Description = strings.TrimSpace(*req.Description) }
+    if req.Permissions == nil {
+        return nil
+    }
+    perms := []string{}
+    for _, p := range *req.Permissions {
+        p = strings.TrimSpace(p)
+        known := p == "*"
+        for _, k := range allPermissions {
+            if k == p { known = true }
+        }
+        if !known {
+            return fmt.Errorf("unknown permission %q", p)
+        }
+        if !hasPermission(c, p) {
+            return fmt.Errorf("cannot grant %s", p)
+        }
+        perms = append(perms, p)
+    }
+    r.Permissions = perms
+    return nil
+}
+
+// roleAssignable checks that a role exists and the caller holds all of its permissions.
+func roleAssignable(c echo.Context, name string) error {
+    var r Role
+    if err := getApp(c).DB.Where("name = ?", name).First(&r).Error; err != nil {
+        return fmt.Errorf("unknown role")
+    }
+    for _, p := range r.Permissions {
+        if !hasPermission(c, p) {
+            return fmt.Errorf("cannot grant %s", p)
+        }
+    }
+    return nil
+}
+
+// userPermissions returns the permissions of u's role.
+func userPermissions(app *App, u *User) []string {
+    var r Role
+    if err := app.DB.Where("name = ?", u.Role).First(&r).Error; err != nil {
+        return nil
+    }
+    return r.Permissions
+}
+
+// hasPermission reports whether the authenticated caller's role grants perm.
+func hasPermission(c echo.Context, perm string) bool {
+    u, ok := c.Get("user").(*User)
+    if !ok || u == nil {
+        return false
+    }
+    perms, ok := c.Get("permissions").([]string)
+    if !ok {
+        perms = userPermissions(getApp(c), u)
+        c.Set("permissions", perms)
+    }
+    for _, p := range perms {
+        if p == "*" || p == perm {
+            return true
+        }
+    }
+    return false
+}
+
+// isFullAdmin reports whether the caller holds every permission: a role with
+// "*", and for token callers a token that grants "*" too.
+func isFullAdmin(c echo.Context) bool {
+    if tok, ok := c.Get("admin_token").(*AdminToken); ok && !tok.grants("*") {
+        return false
+    }
+    return hasPermission(c, "*")
+}
+
+// requirePermission authenticates the caller and requires perm from its role.
+func requirePermission(perm string, next echo.HandlerFunc) echo.HandlerFunc {
+    return requireAuth(func(c echo.Context) error {
+        if !hasPermission(c, perm) {
+            return c.JSON(http.StatusForbidden, echo.Map{"error": "forbidden"})
+        }
+        return next(c)
+    })
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Endpoint scopes for /api/v1. Listing models is always allowed (filtered);
+// a key scoped to "models" alone is read-only.
+var scopeEndpoints = map[string]string{
+    "/chat/completions": "chat",
+    "/completions":      "completions",
+    "/embeddings":       "embeddings",
+    "/models":           "models",
+}
+
+type scopesReq struct {
+    AllowedModels    []string `json:"allowed_models"`
+    AllowedEndpoints []string `json:"allowed_endpoints"`
+}
+
+func registerScopeRoutes(g *echo.Group) {
+    g.PUT("/admin/keys/:id/scopes", requirePermission(permUsers, blockAdminIfMustChange(adminSetKeyScopes)))
+}
+
+// adminSetKeyScopes replaces a key's scopes; owners can only set them when creating the key.
+func adminSetKeyScopes(c echo.Context) error {
+    app := getApp(c)
+    var key APIKey
+    if err := app.DB.First(&key, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req scopesReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    scopes, err := normalizeScopes(req)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    before := key
+    key.Scopes = scopes
+    if err := app.DB.Save(&key).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "key.scopes_update", "api_key", key.ID, before, key)
+    app.keyCache.invalidateKey(key.ID)
+    key.Hash = ""
+    return c.JSON(http.StatusOK, key)
+}
+
+// normalizeScopes validates patterns and endpoint names.
+func normalizeScopes(req scopesReq) (Scopes, error) {
+    var s Scopes
+    for _, p := range req.AllowedModels {
+        if p = strings.TrimSpace(p); p != "" {
+            s.AllowedModels = append(s.AllowedModels, p)
+        }
+    }
+    if _, err := compileModelPatterns(s.AllowedModels); err != nil {
+        return Scopes{}, err
+    }
+    for _, e := range req.AllowedEndpoints {
+        e = strings.ToLower(strings.TrimSpace(e))
+        if e == "" {
+            continue
+        }
+        known := false
+        for _, name := range scopeEndpoints {
+            if e == name { known = true }
+        }
+        if !known {
+            return Scopes{}, fmt.Errorf("unknown endpoint %q", e)
+        }
+        s.AllowedEndpoints = append(s.AllowedEndpoints, e)
+    }
+    return s, nil
+}
+
+// allowsEndpoint reports whether the scopes permit an endpoint scope name.
+func (s Scopes) allowsEndpoint(name string) bool {
+    if len(s.AllowedEndpoints) == 0 || name == "models" {
+        return true
+    }
+    for _, e := range s.AllowedEndpoints {
+        if e == name {
+            return true
+        }
+    }
+    return false
+}
+
+// callerScopes returns the user's and, if present, the key's scopes; both must allow a request.
+func callerScopes(c echo.Context) []Scopes {
+    var out []Scopes
+    if u, ok := c.Get("user").(*User); ok && u != nil {
+        out = append(out, u.Scopes)
+    }
+    if k, ok := c.Get("api_key").(*APIKey); ok && k != nil {
+        out = append(out, k.Scopes)
+    }
+    return out
+}
+
+// modelFilter holds the caller's compiled model patterns and team, loaded
+// once per request so listing models doesn't redo it for every id.
+type modelFilter struct {
+    patterns  [][]*regexp.Regexp // one list per scope that restricts models
+    invalid   bool               // a stored pattern doesn't compile; nothing is allowed
+    team      *Team
+    providers map[string]uint // lower-case provider name to id, for team visibility
+}
+
+// callerModelFilter builds the caller's modelFilter, or returns the one built
+// earlier in the request.
+func callerModelFilter(c echo.Context) *modelFilter {
+    if f, ok := c.Get("model_filter").(*modelFilter); ok {
+        return f
+    }
+    f := &modelFilter{}
+    for _, s := range callerScopes(c) {
+        if len(s.AllowedModels) == 0 {
+            continue
+        }
+        res, err := compileModelPatterns(s.AllowedModels)
+        if err != nil {
+            f.invalid = true
+            continue
+        }
+        f.patterns = append(f.patterns, res)
+    }
+    if f.team = callerTeam(c); f.team != nil && len(f.team.ProviderIDs) > 0 {
+        var providers []Provider
+        getApp(c).DB.Select("id", "name").Find(&providers)
+        f.providers = make(map[string]uint, len(providers))
+        for _, p := range providers {
+            f.providers[strings.ToLower(p.Name)] = p.ID
+        }
+    }
+    c.Set("model_filter", f)
+    return f
+}
+
+// allows checks a model id (before and after alias resolution) against every
+// scope, and the resolved id against the team's visibility.
+func (f *modelFilter) allows(requested, resolved string) bool {
+    if f.invalid {
+        return false
+    }
+    for _, res := range f.patterns {
+        if !matchAny(res, requested) && (resolved == "" || !matchAny(res, resolved)) {
+            return false
+        }
+    }
+    if f.team != nil {
+        target := resolved
+        if target == "" { target = requested }
+        return f.team.visible(target, f.providers)
+    }
+    return true
+}
+
+// callerAllowsModel checks a model id (before and after alias resolution)
+// against the caller's scopes and team visibility.
+func callerAllowsModel(c echo.Context, requested, resolved string) bool {
+    return callerModelFilter(c).allows(requested, resolved)
+}
+
+// endpointScope maps an /api/v1 request path to its scope name.
+func endpointScope(path string) string {
+    for suffix, name := range scopeEndpoints {
+        if strings.HasSuffix(path, "/v1"+suffix) {
+            return name
+        }
+    }
+    return ""
+}
+
+func scopeForbidden(c echo.Context, code, message string) error {
+    return c.JSON(http.StatusForbidden, echo.Map{"error": echo.Map{
+        "message": message,
+        "type":    "invalid_request_error",
+        "param":   nil,
+        "code":    code,
+    }})
+}
+
+func modelNotAllowed(c echo.Context, model string) error {
+    return scopeForbidden(c, "model_not_allowed", fmt.Sprintf("This API key is not allowed to use model %s.", model))
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+// Stored secrets look like enc:v1:<key id>:<wrapped data key>:<ciphertext>.
+// Each value has its own data key, so rotating the master key only re-wraps
+// data keys; the ciphertext stays as it is.
+const sealedPrefix = "enc:v1:"
+
+// secretBox encrypts provider API keys at rest. Values that reference an
+// environment variable or a file ("env:NAME", "file:/path") are stored as the
+// reference and read when used. Without a master key, secrets are stored as given.
+type secretBox struct {
+    keys        []masterKey // current first
+    envPrefixes []string
+    fileDirs    []string
+    keyFile     string
+}
+
+type masterKey struct {
+    id   string
+    aead cipher.AEAD
+}
+
+// newSecretBox loads the master keys from config, overridden by SECRETS_MASTER_KEY,
+// SECRETS_MASTER_KEY_FILE and SECRETS_PREVIOUS_MASTER_KEYS (comma-separated).
+func newSecretBox(cfg SecretsConfig) (*secretBox, error) {
+    if v := os.Getenv("SECRETS_MASTER_KEY"); v != "" { cfg.MasterKey = v }
+    if v := os.Getenv("SECRETS_MASTER_KEY_FILE"); v != "" { cfg.MasterKeyFile = v }
+    if v := os.Getenv("SECRETS_PREVIOUS_MASTER_KEYS"); v != "" { cfg.PreviousMasterKeys = strings.Split(v, ",") }
+    current := cfg.MasterKey
+    if current == "" && cfg.MasterKeyFile != "" {
+        b, err := os.ReadFile(cfg.MasterKeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("secrets: master_key_file: %w", err)
+        }
+        current = strings.TrimSpace(string(b))
+    }
+    box := &secretBox{envPrefixes: cfg.AllowedEnvPrefixes, keyFile: cfg.MasterKeyFile}
+    for _, d := range cfg.AllowedFileDirs {
+        if !filepath.IsAbs(d) {
+            return nil, fmt.Errorf("secrets: allowed_file_dirs: %s is not an absolute path", d)
+        }
+        box.fileDirs = append(box.fileDirs, filepath.Clean(d))
+    }
+    if current == "" {
+        if len(cfg.PreviousMasterKeys) > 0 {
+            return nil, errors.New("secrets: previous_master_keys set without a master_key")
+        }
+        return box, nil
+    }
+    for _, s := range append([]string{current}, cfg.PreviousMasterKeys...) {
+        if s = strings.TrimSpace(s); s == "" {
+            continue
+        }
+        k, err := newMasterKey(s)
+        if err != nil {
+            return nil, err
+        }
+        box.keys = append(box.keys, k)
+    }
+    return box, nil
+}
+
+func newMasterKey(encoded string) (masterKey, error) {
+    raw, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil || len(raw) != 32 {
+        return masterKey{}, errors.New("secrets: a master key must be 32 random bytes, base64-encoded")
+    }
+    aead, err := newGCM(raw)
+    if err != nil {
+        return masterKey{}, err
+    }
+    sum := sha256.Sum256(append([]byte("llmrouter-secrets:"), raw...))
+    return masterKey{id: hex.EncodeToString(sum[:6]), aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+func (b *secretBox) enabled() bool { return len(b.keys) > 0 }
+
+// isSecretRef reports whether v names where the secret lives instead of holding it.
+func isSecretRef(v string) bool {
+    return strings.HasPrefix(v, "env:") || strings.HasPrefix(v, "file:")
+}
+
+var errSecretRef = errors.New("secret reference is not allowed or can't be read")
+
+// Variables holding the router's own secrets; no reference may name them.
+var reservedSecretEnv = map[string]bool{
+    "JWT_SECRET": true, "JWT_PREVIOUS_SECRETS": true, "API_KEY_SECRET": true, "DATABASE_URL": true,
+    "SMTP_PASSWORD": true, "OIDC_CLIENT_SECRET": true, "LDAP_BIND_PASSWORD": true, "METRICS_TOKEN": true,
+}
+
+// reserved reports whether a reference names one of the router's own secrets.
+func (b *secretBox) reserved(ref string) bool {
+    if name, ok := strings.CutPrefix(ref, "env:"); ok {
+        return reservedSecretEnv[name] || strings.HasPrefix(name, "SECRETS_") || strings.HasPrefix(name, "OTEL_")
+    }
+    path := filepath.Clean(strings.TrimPrefix(ref, "file:"))
+    return strings.HasPrefix(path, "/proc/") || (b.keyFile != "" && path == filepath.Clean(b.keyFile))
+}
+
+// refAllowed reports whether a reference is covered by secrets.allowed_env_prefixes
+// or secrets.allowed_file_dirs. Symlinks are resolved so they can't point outside.
+func (b *secretBox) refAllowed(ref string) bool {
+    if b.reserved(ref) {
+        return false
+    }
+    if name, ok := strings.CutPrefix(ref, "env:"); ok {
+        for _, p := range b.envPrefixes {
+            if p != "" && strings.HasPrefix(name, p) {
+                return true
+            }
+        }
+        return false
+    }
+    path, err := filepath.EvalSymlinks(strings.TrimPrefix(ref, "file:"))
+    if err != nil || !filepath.IsAbs(path) {
+        return false
+    }
+    for _, d := range b.fileDirs {
+        if strings.HasPrefix(path, d+string(filepath.Separator)) {
+            return true
+        }
+    }
+    return false
+}
+
+// seal returns the stored form of a secret as entered by an admin.
+func (b *secretBox) seal(plain string) (string, error) {
+    if plain == "" || isSecretRef(plain) || !b.enabled() {
+        return plain, nil
+    }
+    dek := make([]byte, 32)
+    if _, err := rand.Read(dek); err != nil {
+        return "", err
+    }
+    aead, err := newGCM(dek)
+    if err != nil {
+        return "", err
+    }
+    k := b.keys[0]
+    enc := base64.RawURLEncoding
+    return sealedPrefix + k.id + ":" + enc.EncodeToString(gcmSeal(k.aead, dek)) + ":" + enc.EncodeToString(gcmSeal(aead, []byte(plain))), nil
+}
+
+func gcmSeal(aead cipher.AEAD, plain []byte) []byte {
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        panic(err)
+    }
+    return aead.Seal(nonce, nonce, plain, nil)
+}
+
+func gcmOpen(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+    if len(sealed) < aead.NonceSize() {
+        return nil, errors.New("ciphertext too short")
+    }
+    return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// reveal returns the secret itself: decrypted, or read from the variable or
+// file it references.
+func (b *secretBox) reveal(stored string) (string, error) {
+    if isSecretRef(stored) && b.reserved(stored) {
+        return "", errSecretRef
+    }
+    switch {
+    case strings.HasPrefix(stored, "env:"):
+        name := strings.TrimPrefix(stored, "env:")
+        v, ok := os.LookupEnv(name)
+        if !ok {
+            return "", fmt.Errorf("environment variable %s is not set", name)
+        }
+        return strings.TrimSpace(v), nil
+    case strings.HasPrefix(stored, "file:"):
+        data, err := os.ReadFile(strings.TrimPrefix(stored, "file:"))
+        if err != nil {
+            return "", err
+        }
+        return strings.TrimSpace(string(data)), nil
+    case strings.HasPrefix(stored, sealedPrefix):
+        dek, ct, err := b.unwrap(stored)
+        if err != nil {
+            return "", err
+        }
+        aead, err := newGCM(dek)
+        if err != nil {
+            return "", err
+        }
+        plain, err := gcmOpen(aead, ct)
+        if err != nil {
+            return "", errors.New("secret does not decrypt")
+        }
+        return string(plain), nil
+    }
+    return stored, nil
+}
+
+// unwrap splits a sealed value and decrypts its data key.
+func (b *secretBox) unwrap(stored string) (dek, ciphertext []byte, err error) {
+    parts := strings.Split(strings.TrimPrefix(stored, sealedPrefix), ":")
+    if len(parts) != 3 {
+        return nil, nil, errors.New("malformed encrypted secret")
+    }
+    wrapped, err1 := base64.RawURLEncoding.DecodeString(parts[1])
+    ciphertext, err2 := base64.RawURLEncoding.DecodeString(parts[2])
+    if err1 != nil || err2 != nil {
+        return nil, nil, errors.New("malformed encrypted secret")
+    }
+    for _, k := range b.keys {
+        if k.id != parts[0] {
+            continue
+        }
+        if dek, err = gcmOpen(k.aead, wrapped); err != nil {
+            return nil, nil, errors.New("secret does not decrypt")
+        }
+        return dek, ciphertext, nil
+    }
+    return nil, nil, fmt.Errorf("secret was encrypted with master key %s, which is not configured", parts[0])
+}
+
+// reseal brings a stored value up to date: plaintext gets encrypted and,
+// with rotate, a data key wrapped by an older master key is re-wrapped by the
+// current one. It reports whether the value changed.
+func (b *secretBox) reseal(stored string, rotate bool) (string, bool, error) {
+    if !b.enabled() || stored == "" || isSecretRef(stored) {
+        return stored, false, nil
+    }
+    if !strings.HasPrefix(stored, sealedPrefix) {
+        v, err := b.seal(stored)
+        return v, err == nil, err
+    }
+    kid, _, _ := strings.Cut(strings.TrimPrefix(stored, sealedPrefix), ":")
+    if !rotate || kid == b.keys[0].id {
+        // Still fails loudly if the key is missing
+        _, _, err := b.unwrap(stored)
+        return stored, false, err
+    }
+    dek, ct, err := b.unwrap(stored)
+    if err != nil {
+        return "", false, err
+    }
+    k := b.keys[0]
+    enc := base64.RawURLEncoding
+    return sealedPrefix + k.id + ":" + enc.EncodeToString(gcmSeal(k.aead, dek)) + ":" + enc.EncodeToString(ct), true, nil
+}
+
+// secretHint is what the console shows for a stored secret: a reference as
+// is, otherwise the last characters of the secret.
+func secretHint(app *App, stored string) string {
+    if isSecretRef(stored) {
+        return stored
+    }
+    plain, err := app.secrets.reveal(stored)
+    if err != nil {
+        return "****"
+    }
+    return keyHint(plain)
+}
+
+// storeSecret validates and seals a secret entered through the API. A
+// reference must be allowed by the secrets config unless the caller has the
+// full admin role, and either way must not name the router's own secrets.
+// Errors don't say why a reference failed, so they can't be used to probe
+// the server's files or environment.
+func storeSecret(c echo.Context, value string) (string, error) {
+    app := getApp(c)
+    if isSecretRef(value) {
+        if app.secrets.reserved(value) || (!app.secrets.refAllowed(value) && !isFullAdmin(c)) {
+            return "", errSecretRef
+        }
+        if _, err := app.secrets.reveal(value); err != nil {
+            return "", errSecretRef
+        }
+        return value, nil
+    }
+    return app.secrets.seal(value)
+}
+
+// resealSecrets updates every stored provider secret (see reseal), including
+// those of deleted providers, and returns how many rows changed. With no
+// master key it only checks that nothing is encrypted.
+func resealSecrets(db *gorm.DB, box *secretBox, rotate bool) (int, error) {
+    changed := 0
+    fix := func(table, column string, id uint, stored string) error {
+        if !box.enabled() && strings.HasPrefix(stored, sealedPrefix) {
+            return fmt.Errorf("%s %d: secret is encrypted but no secrets.master_key is set", table, id)
+        }
+        v, ok, err := box.reseal(stored, rotate)
+        if err != nil {
+            return fmt.Errorf("%s %d: %w", table, id, err)
+        }
+        if !ok {
+            return nil
+        }
+        changed++
+        return db.Table(table).Where("id = ?", id).UpdateColumn(column, v).Error
+    }
+    var providers []Provider
+    if err := db.Unscoped().Select("id", "api_key").Find(&providers).Error; err != nil {
+        return changed, err
+    }
+    for _, p := range providers {
+        if err := fix("providers", "api_key", p.ID, p.APIKey); err != nil {
+            return changed, err
+        }
+    }
+    var keys []ProviderKey
+    if err := db.Select("id", "key").Find(&keys).Error; err != nil {
+        return changed, err
+    }
+    for _, k := range keys {
+        if err := fix("provider_keys", "key", k.ID, k.Key); err != nil {
+            return changed, err
+        }
+    }
+    return changed, nil
+}
+
+// RotateSecrets re-encrypts every stored provider secret under the current
+// master key. Run it after moving the old key to previous_master_keys; the
+// old key can be dropped once it succeeds.
+func RotateSecrets(cfg *Config) (int, error) {
+    box, err := newSecretBox(cfg.Secrets)
+    if err != nil {
+        return 0, err
+    }
+    if !box.enabled() {
+        return 0, errors.New("secrets.master_key is not set")
+    }
+    db, err := openDB(cfg)
+    if err != nil {
+        return 0, err
+    }
+    if err := migrate(db); err != nil {
+        return 0, err
+    }
+    return resealSecrets(db, box, true)
+}
+
+// sealStoredSecrets runs at startup: it encrypts secrets stored before a
+// master key was configured and refuses to start if one can't be decrypted.
+func sealStoredSecrets(app *App) error {
+    n, err := resealSecrets(app.DB, app.secrets, false)
+    if err != nil {
+        return fmt.Errorf("provider secrets: %w", err)
+    }
+    if n > 0 {
+        log.Printf("secrets: encrypted %d stored provider secrets", n)
+    }
+    if !app.secrets.enabled() {
+        log.Printf("warn: secrets.master_key is not set; provider API keys are stored unencrypted")
+    }
+    return nil
+}
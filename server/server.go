@@ -21,9 +21,29 @@ import (
 type App struct {
     DB        *gorm.DB
     JWTSecret []byte
+    jwtKeys   []jwtKey // session signing keys, current first
+    KeySecret []byte // HMAC key for stored API key hashes
     Config    *Config
     pulledMu  sync.RWMutex
     pulled    map[uint][]string // providerID -> model IDs fetched from provider
+    upstream  map[uint][]string // providerID -> unfiltered IDs from the last pull
+    budgets   *budgetTracker
+    limiter   *rateLimiter
+    quotas    *quotaTracker
+    gates     *gateSet
+    keyUsage  *keyUsageTracker
+    keyCache  *keyCache
+    oidc      *oidcClient // nil unless oidc.enabled
+    ldap      *ldapAuth   // nil unless ldap.enabled
+    totp      *totpChallenges
+    logins    *loginThrottle
+    passwords *passwordPolicy
+    mailer    mailer // nil when links are displayed to the admin
+    resets    *resetLimiter
+    secrets   *secretBox // provider API keys at rest
+    creds     *credCache // decrypted provider key pools
+    metrics   *metrics   // nil unless metrics.enabled
+    tracer    *tracer    // nil unless tracing.exporter is set
 }
 
 func getEnv(key, def string) string {
@@ -36,12 +56,59 @@ func getEnv(key, def string) string {
 
 // Boot initializes DB, auth, and routes
 func Boot(e *echo.Echo, cfg *Config) error {
-    app := &App{Config: cfg, pulled: map[uint][]string{}}
+    app := &App{Config: cfg, pulled: map[uint][]string{}, upstream: map[uint][]string{}, budgets: newBudgetTracker(), quotas: newQuotaTracker(), gates: newGateSet(), keyCache: newKeyCache(), creds: newCredCache(), totp: newTOTPChallenges(), logins: newLoginThrottle(), resets: newResetLimiter()}
 
     // JWT Secret
     secret := cfg.Server.JWTSecret
     if v := os.Getenv("JWT_SECRET"); v != "" { secret = v }
     app.JWTSecret = []byte(secret)
+    app.jwtKeys = []jwtKey{newJWTKey(secret)}
+    previous := cfg.Server.JWTPreviousSecrets
+    if v := os.Getenv("JWT_PREVIOUS_SECRETS"); v != "" { previous = strings.Split(v, ",") }
+    for _, s := range previous {
+        if s = strings.TrimSpace(s); s != "" && s != secret {
+            app.jwtKeys = append(app.jwtKeys, newJWTKey(s))
+        }
+    }
+    keySecret := cfg.Server.APIKeySecret
+    if v := os.Getenv("API_KEY_SECRET"); v != "" { keySecret = v }
+    if keySecret == "" { keySecret = secret }
+    app.KeySecret = []byte(keySecret)
+    pp, err := newPasswordPolicy(cfg.Auth.Password)
+    if err != nil {
+        return err
+    }
+    app.passwords = pp
+    if v := os.Getenv("SMTP_PASSWORD"); v != "" { cfg.Mail.SMTP.Password = v }
+    notifyURL := cfg.Notifications.WebhookURL
+    if v := os.Getenv("NOTIFY_WEBHOOK_URL"); v != "" { notifyURL = v }
+    if app.mailer, err = newMailer(cfg.Mail, notifyURL); err != nil {
+        return err
+    }
+    if app.secrets, err = newSecretBox(cfg.Secrets); err != nil {
+        return err
+    }
+    if v := os.Getenv("METRICS_TOKEN"); v != "" { cfg.Metrics.Token = v }
+    app.metrics = newMetrics(cfg.Metrics)
+    if app.tracer, err = newTracer(cfg.Tracing); err != nil {
+        return err
+    }
+    if v := os.Getenv("OIDC_CLIENT_SECRET"); v != "" { cfg.OIDC.ClientSecret = v }
+    if cfg.OIDC.Enabled {
+        oc, err := newOIDCClient(cfg.OIDC)
+        if err != nil {
+            return err
+        }
+        app.oidc = oc
+    }
+    if v := os.Getenv("LDAP_BIND_PASSWORD"); v != "" { cfg.LDAP.BindPassword = v }
+    if cfg.LDAP.Enabled {
+        la, err := newLDAPAuth(cfg.LDAP)
+        if err != nil {
+            return err
+        }
+        app.ldap = la
+    }
 
     // DB
     db, err := openDB(cfg)
@@ -52,9 +119,20 @@ func Boot(e *echo.Echo, cfg *Config) error {
     if err := migrate(db); err != nil {
         return err
     }
+    if err := sealStoredSecrets(app); err != nil {
+        return err
+    }
+    if err := seedRoles(app); err != nil {
+        return err
+    }
     if err := seedAdmin(app); err != nil {
         return err
     }
+    app.limiter = newRateLimiter(app)
+    app.keyUsage = newKeyUsageTracker(app)
+    if app.ldap != nil {
+        startLDAPSync(app)
+    }
 
     // Warm pulled models cache for enabled providers with pull_models
     if err := warmPulledModels(app); err != nil {
@@ -68,13 +146,30 @@ func Boot(e *echo.Echo, cfg *Config) error {
 
     // API routes
     api := e.Group("/api")
+    api.Use(observeRequests)
     registerAuthRoutes(api)
+    registerOIDCRoutes(api)
+    registerTOTPRoutes(api)
+    registerSessionRoutes(api)
+    registerLockoutRoutes(api)
+    registerInviteRoutes(api)
+    registerAuditRoutes(api)
     registerAccountRoutes(api)
     registerUserRoutes(api)
     registerKeyRoutes(api)
+    registerScopeRoutes(api)
+    registerServiceAccountRoutes(api)
+    registerTeamRoutes(api)
+    registerRoleRoutes(api)
     registerProviderRoutes(api)
+    registerProviderKeyRoutes(api)
     registerModelRoutes(api)
     registerFallbackRoutes(api)
+    registerAliasRoutes(api)
+    registerCatalogRoutes(api)
+    registerPriceRoutes(api)
+    registerBudgetRoutes(api)
+    registerRateLimitRoutes(api)
     registerStatsRoutes(api)
     registerSessionChatRoutes(api)
 
@@ -84,6 +179,9 @@ func Boot(e *echo.Echo, cfg *Config) error {
 
     // Health
     e.GET("/healthz", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+    if app.metrics != nil {
+        e.GET("/metrics", handleMetrics)
+    }
     return nil
 }
 
@@ -108,6 +206,22 @@ func (a *App) ClearPulled(providerID uint) {
     a.pulledMu.Lock()
     defer a.pulledMu.Unlock()
     delete(a.pulled, providerID)
+    delete(a.upstream, providerID)
+}
+
+func (a *App) setUpstream(providerID uint, models []string) {
+    a.pulledMu.Lock()
+    defer a.pulledMu.Unlock()
+    a.upstream[providerID] = models
+}
+
+func (a *App) getUpstream(providerID uint) []string {
+    a.pulledMu.RLock()
+    defer a.pulledMu.RUnlock()
+    v := a.upstream[providerID]
+    out := make([]string, len(v))
+    copy(out, v)
+    return out
 }
 
 func warmPulledModels(app *App) error {
@@ -186,29 +300,43 @@ func getApp(c echo.Context) *App {
 }
 
 // JWT utilities
+// The registered ID ("jti") is the server-side Session's ID.
 type Claims struct {
     UserID uint   `json:"user_id"`
     Role   string `json:"role"`
+    KeyID  string `json:"-"` // kid of the key that verified the token
     jwt.RegisteredClaims
 }
 
-func signJWT(app *App, uid uint, role string, ttl time.Duration) (string, error) {
+func signJWT(app *App, uid uint, role, sid string, ttl time.Duration) (string, error) {
     now := time.Now()
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
         UserID: uid,
         Role:   role,
         RegisteredClaims: jwt.RegisteredClaims{
+            ID:        sid,
             ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
             IssuedAt:  jwt.NewNumericDate(now),
         },
     })
-    return token.SignedString(app.JWTSecret)
+    key := app.jwtKeys[0]
+    token.Header["kid"] = key.id
+    return token.SignedString(key.secret)
 }
 
+// parseJWT verifies with the key named by the token's kid, so tokens signed
+// before a rotation stay valid while their key is listed in jwt_previous_secrets.
 func parseJWT(app *App, tokenStr string) (*Claims, error) {
+    var kid string
     token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-        return app.JWTSecret, nil
-    })
+        kid, _ = token.Header["kid"].(string)
+        for _, k := range app.jwtKeys {
+            if k.id == kid {
+                return k.secret, nil
+            }
+        }
+        return nil, errors.New("unknown signing key")
+    }, jwt.WithValidMethods([]string{"HS256"}))
     if err != nil || !token.Valid {
         return nil, errors.New("invalid token")
     }
@@ -216,5 +344,6 @@ func parseJWT(app *App, tokenStr string) (*Claims, error) {
     if !ok {
         return nil, errors.New("invalid claims")
     }
+    claims.KeyID = kid
     return claims, nil
 }
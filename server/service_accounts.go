@@ -0,0 +1,345 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Admin tokens look like lrt_xxxxxxxx_yyyy…, so they can't be mistaken for API keys.
+const adminTokenPrefix = "lrt_"
+
+// Resources a token permission can name; the first path segment under /api
+// (or under /api/admin).
+var tokenResources = []string{
+    "account", "aliases", "audit", "auth", "budgets", "catalog", "chat", "fallbacks", "keys", "logs", "models",
+    "permissions", "prices", "providers", "ratelimits", "roles", "service-accounts", "stats", "teams", "users",
+}
+
+// Role permission needed to grant a token resource; "" for routes any user may call.
+// Resources that span user and admin routes need the admin one.
+var tokenResourcePermission = map[string]string{
+    "aliases": permRoutes, "audit": permAudit, "budgets": permBudgets, "catalog": permModels, "fallbacks": permRoutes,
+    "keys": permUsers, "logs": permLogs, "prices": permModels, "providers": permProviders, "ratelimits": permBudgets,
+    "roles": permRoles, "service-accounts": permUsers, "stats": permStats, "teams": permUsers, "users": permUsers,
+}
+
+type serviceAccountReq struct {
+    Name string `json:"name"`
+    Role string `json:"role"` // default admin
+}
+
+type adminTokenReq struct {
+    Name        string     `json:"name"`
+    Permissions []string   `json:"permissions"`
+    ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+type adminTokenResp struct {
+    AdminToken
+    Value string `json:"value"` // shown once
+}
+
+func registerServiceAccountRoutes(g *echo.Group) {
+    ag := g.Group("/service-accounts")
+    ag.GET("", requirePermission(permUsers, blockAdminIfMustChange(listServiceAccounts)))
+    ag.POST("", requirePermission(permUsers, blockAdminIfMustChange(createServiceAccount)))
+    ag.DELETE("/:id", requirePermission(permUsers, blockAdminIfMustChange(deleteServiceAccount)))
+    ag.GET("/:id/tokens", requirePermission(permUsers, blockAdminIfMustChange(listAdminTokens)))
+    ag.POST("/:id/tokens", requirePermission(permUsers, blockAdminIfMustChange(createAdminToken)))
+    ag.DELETE("/:id/tokens/:tid", requirePermission(permUsers, blockAdminIfMustChange(deleteAdminToken)))
+}
+
+func listServiceAccounts(c echo.Context) error {
+    app := getApp(c)
+    var users []User
+    if err := app.DB.Where("service_account = ?", true).Order("id ASC").Find(&users).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, users)
+}
+
+// createServiceAccount adds a user without a password; it can only act through tokens and API keys.
+func createServiceAccount(c echo.Context) error {
+    app := getApp(c)
+    var req serviceAccountReq
+    if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if req.Role == "" { req.Role = "admin" }
+    if err := roleAssignable(c, req.Role); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    u := User{Email: strings.ToLower(strings.TrimSpace(req.Name)), Role: req.Role, ServiceAccount: true}
+    if err := app.DB.Create(&u).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    audit(c, "service_account.create", "user", u.ID, nil, u)
+    return c.JSON(http.StatusCreated, u)
+}
+
+func deleteServiceAccount(c echo.Context) error {
+    app := getApp(c)
+    u, err := findServiceAccount(app, c.Param("id"))
+    if err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := app.DB.Where("user_id = ?", u.ID).Delete(&AdminToken{}).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    if err := app.DB.Delete(&u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    app.keyCache.invalidateUser(u.ID)
+    audit(c, "service_account.delete", "user", u.ID, u, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+func listAdminTokens(c echo.Context) error {
+    app := getApp(c)
+    u, err := findServiceAccount(app, c.Param("id"))
+    if err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    var tokens []AdminToken
+    if err := app.DB.Where("user_id = ?", u.ID).Order("id ASC").Find(&tokens).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, tokens)
+}
+
+func createAdminToken(c echo.Context) error {
+    app := getApp(c)
+    u, err := findServiceAccount(app, c.Param("id"))
+    if err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    // The token acts with the account's role, so the caller must hold all of it
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    var req adminTokenReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    perms, err := normalizePermissions(req.Permissions)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    for _, p := range perms {
+        if !tokenPermissionGrantable(c, p) {
+            return c.JSON(http.StatusForbidden, echo.Map{"error": "cannot grant " + p})
+        }
+    }
+    if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "expires_at must be in the future"})
+    }
+    prefix, value, err := newAdminTokenSecret()
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "rng error"})
+    }
+    tok := AdminToken{UserID: u.ID, Name: strings.TrimSpace(req.Name), Prefix: prefix, Hash: hashAPIKey(app, value), Permissions: perms, ExpiresAt: req.ExpiresAt}
+    if err := app.DB.Create(&tok).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "admin_token.create", "admin_token", tok.ID, nil, tok)
+    return c.JSON(http.StatusCreated, adminTokenResp{AdminToken: tok, Value: value})
+}
+
+func deleteAdminToken(c echo.Context) error {
+    app := getApp(c)
+    u, err := findServiceAccount(app, c.Param("id"))
+    if err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    var tok AdminToken
+    if err := app.DB.Where("id = ? AND user_id = ?", c.Param("tid"), u.ID).First(&tok).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    res := app.DB.Delete(&tok)
+    if res.Error != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    if res.RowsAffected == 0 {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    audit(c, "admin_token.delete", "admin_token", tok.ID, tok, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+// tokenPermissionGrantable reports whether the caller may put perm on a token:
+// a token caller's own token must grant it, and the caller's role must hold
+// the permission behind the resource ("*" needs a full admin).
+func tokenPermissionGrantable(c echo.Context, perm string) bool {
+    if tok, ok := c.Get("admin_token").(*AdminToken); ok && !tok.grants(perm) {
+        return false
+    }
+    if perm == "*" {
+        return isFullAdmin(c)
+    }
+    res, _, _ := strings.Cut(perm, ":")
+    need := tokenResourcePermission[res]
+    return need == "" || hasPermission(c, need)
+}
+
+func findServiceAccount(app *App, id string) (User, error) {
+    var u User
+    err := app.DB.Where("id = ? AND service_account = ?", id, true).First(&u).Error
+    return u, err
+}
+
+func newAdminTokenSecret() (string, string, error) {
+    raw := make([]byte, 24)
+    if _, err := rand.Read(raw); err != nil {
+        return "", "", err
+    }
+    body := hex.EncodeToString(raw)
+    prefix := adminTokenPrefix + body[:8]
+    return prefix, fmt.Sprintf("%s_%s", prefix, body[8:]), nil
+}
+
+// normalizePermissions validates "resource:read|write|*" entries; "*" grants everything.
+func normalizePermissions(in []string) ([]string, error) {
+    var out []string
+    for _, p := range in {
+        p = strings.ToLower(strings.TrimSpace(p))
+        if p == "" {
+            continue
+        }
+        if p == "*" {
+            out = append(out, p)
+            continue
+        }
+        res, action, ok := strings.Cut(p, ":")
+        if !ok || (action != "read" && action != "write" && action != "*") {
+            return nil, fmt.Errorf("invalid permission %q", p)
+        }
+        known := false
+        for _, r := range tokenResources {
+            if r == res { known = true }
+        }
+        if !known {
+            return nil, fmt.Errorf("unknown resource %q", res)
+        }
+        out = append(out, p)
+    }
+    if len(out) == 0 {
+        return nil, fmt.Errorf("permissions required")
+    }
+    return out, nil
+}
+
+// grants reports whether the token holds a permission; write implies read.
+func (t *AdminToken) grants(perm string) bool {
+    res, action, _ := strings.Cut(perm, ":")
+    for _, p := range t.Permissions {
+        if p == "*" || p == res+":*" || p == perm || (action == "read" && p == res+":write") {
+            return true
+        }
+    }
+    return false
+}
+
+// requiredPermission maps an admin API request to the permission it needs.
+func requiredPermission(r *http.Request) string {
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+    res := parts[0]
+    if res == "admin" && len(parts) > 1 {
+        res = parts[1]
+    }
+    action := "write"
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+        action = "read"
+    }
+    return res + ":" + action
+}
+
+// validateAdminToken authenticates a bearer admin token and returns its service account.
+func validateAdminToken(app *App, token string) (*User, *AdminToken, error) {
+    parts := strings.SplitN(token, "_", 3)
+    if len(parts) < 3 {
+        return nil, nil, echo.ErrUnauthorized
+    }
+    var tok AdminToken
+    if err := app.DB.Where("prefix = ?", parts[0]+"_"+parts[1]).First(&tok).Error; err != nil {
+        return nil, nil, echo.ErrUnauthorized
+    }
+    if ok, _ := checkAPIKeyHash(app, tok.Hash, token); !ok {
+        return nil, nil, echo.ErrUnauthorized
+    }
+    now := time.Now()
+    if tok.ExpiresAt != nil && !now.Before(*tok.ExpiresAt) {
+        return nil, nil, errKeyExpired
+    }
+    var u User
+    if err := app.DB.Where("id = ? AND service_account = ?", tok.UserID, true).First(&u).Error; err != nil {
+        return nil, nil, echo.ErrUnauthorized
+    }
+    if u.Disabled {
+        return nil, nil, echo.ErrForbidden
+    }
+    app.DB.Model(&AdminToken{}).Where("id = ?", tok.ID).UpdateColumn("last_used_at", now)
+    return &u, &tok, nil
+}
+
+// bearerAdminToken returns the admin token from the Authorization header, if any.
+func bearerAdminToken(c echo.Context) string {
+    auth := c.Request().Header.Get("Authorization")
+    if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+        return ""
+    }
+    if token := strings.TrimSpace(auth[7:]); strings.HasPrefix(token, adminTokenPrefix) {
+        return token
+    }
+    return ""
+}
+
+// authAdminToken is requireAuth's path for token callers; changes are logged
+// with the token so they can be told apart from people.
+func authAdminToken(c echo.Context, token string, next echo.HandlerFunc) error {
+    u, tok, err := validateAdminToken(getApp(c), token)
+    if errors.Is(err, errKeyExpired) {
+        return c.JSON(http.StatusUnauthorized, echo.Map{"error": "token expired"})
+    }
+    if errors.Is(err, echo.ErrForbidden) {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": "account disabled"})
+    }
+    if err != nil {
+        return c.JSON(http.StatusUnauthorized, echo.Map{"error": "unauthorized"})
+    }
+    perm := requiredPermission(c.Request())
+    if !tok.grants(perm) {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": "token lacks permission " + perm})
+    }
+    c.Set("user", u)
+    c.Set("admin_token", tok)
+    if strings.HasSuffix(perm, ":write") {
+        log.Printf("admin token: %s %s by %s", c.Request().Method, c.Request().URL.Path, actorName(c))
+    }
+    return next(c)
+}
+
+// actorName identifies who is acting on a request, telling tokens apart from people.
+func actorName(c echo.Context) string {
+    u, _ := c.Get("user").(*User)
+    if u == nil {
+        return "anonymous"
+    }
+    if tok, ok := c.Get("admin_token").(*AdminToken); ok {
+        return fmt.Sprintf("token:%s#%d (service account %s)", tok.Name, tok.ID, u.Email)
+    }
+    return "user:" + u.Email
+}
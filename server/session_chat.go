@@ -1,7 +1,6 @@
 package server
 
 import (
-    "bytes"
     "encoding/json"
     "io"
     "net/http"
@@ -18,6 +17,8 @@ func registerSessionChatRoutes(g *echo.Group) {
 func sessionChatCompletions(c echo.Context) error {
     app := getApp(c)
     user := c.Get("user").(*User)
+    // The UI chat is interactive, so it goes ahead of API traffic in provider queues
+    c.SetRequest(c.Request().WithContext(withPriority(c.Request().Context(), priorityHigh)))
 
     var payload map[string]any
     if err := json.NewDecoder(c.Request().Body).Decode(&payload); err != nil {
@@ -27,17 +28,23 @@ func sessionChatCompletions(c echo.Context) error {
     if clientModel == "" {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "model required"})
     }
+    requested := clientModel
+    clientModel = applyModelAlias(c, app, clientModel)
+    if !callerAllowsModel(c, requested, clientModel) {
+        return modelNotAllowed(c, requested)
+    }
+    release, err := reserveBudgets(c, app, clientModel, payload)
+    if err != nil {
+        return quotaExceeded(c, err)
+    }
+    defer release()
     // If router/ fallback is requested, delegate to router handler (non-stream)
     if strings.HasPrefix(strings.ToLower(clientModel), "router/") {
         return handleRouterNonStream(c, app, clientModel, payload, "/chat/completions")
     }
-    // Count messages if present
-    msgCount := 0
-    if v, ok := payload["messages"]; ok {
-        if arr, ok := v.([]any); ok { msgCount = len(arr) }
-    }
+    // Count messages/images if present
+    msgCount, images := countRequestItems(payload)
     payload["stream"] = false
-    body, _ := json.Marshal(payload)
 
     // Resolve provider/model strictly
     p, raw, ok := resolveQualifiedModel(app, clientModel)
@@ -45,30 +52,31 @@ func sessionChatCompletions(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown model"})
     }
     payload["model"] = raw
+    body, _ := json.Marshal(payload)
 
-    // Build request to provider
-    started := time.Now()
-    url := strings.TrimSuffix(p.BaseURL, "/") + "/chat/completions"
-    req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-    req.Header.Set("Content-Type", "application/json")
-    if p.APIKey != "" { req.Header.Set("Authorization", "Bearer "+p.APIKey) }
+    promptTok, outTok := estimateTokens(payload)
+    estTokens := int64(promptTok + outTok)
+    if wait, err := throttleUpstream(c, app, p.ID, estTokens); err != nil {
+        if wait > 0 { return upstreamThrottled(c, p, wait) }
+        return err
+    }
 
-    resp, err := http.DefaultClient.Do(req)
+    started := time.Now()
+    resp, err := sendUpstream(c.Request().Context(), app, p, "/chat/completions", raw, body, estTokens)
+    if qerr, ok := err.(*errQueue); ok {
+        logUsage(c.Request().Context(), app, user.ID, 0, user.TeamID, p.ID, clientModel, raw, http.StatusServiceUnavailable, started, msgCount, tokenUsage{})
+        return queueUnavailable(c, qerr)
+    }
     if err != nil {
-        logUsage(app, user.ID, 0, p.ID, clientModel, 0, started, msgCount, 0, 0)
+        logUsage(c.Request().Context(), app, user.ID, 0, user.TeamID, p.ID, clientModel, raw, 0, started, msgCount, tokenUsage{})
         return c.JSON(http.StatusBadGateway, echo.Map{"error": "provider error"})
     }
     defer resp.Body.Close()
     b, _ := io.ReadAll(resp.Body)
 
-    var usage struct {
-        Usage struct {
-            PromptTokens     int `json:"prompt_tokens"`
-            CompletionTokens int `json:"completion_tokens"`
-        } `json:"usage"`
-    }
-    _ = json.Unmarshal(b, &usage)
-    logUsage(app, user.ID, 0, p.ID, clientModel, resp.StatusCode, started, msgCount, usage.Usage.PromptTokens, usage.Usage.CompletionTokens)
+    usage := parseUsage(b)
+    usage.Images = images
+    logUsage(c.Request().Context(), app, user.ID, 0, user.TeamID, p.ID, clientModel, raw, resp.StatusCode, started, msgCount, usage)
 
     return c.Blob(resp.StatusCode, "application/json", b)
 }
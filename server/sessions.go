@@ -0,0 +1,176 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+var errSessionExpired = errors.New("session expired")
+
+// jwtKey signs session tokens; id goes in the token's "kid" header so a
+// rotated-out key can still be found while its tokens live.
+type jwtKey struct {
+    id     string
+    secret []byte
+}
+
+func newJWTKey(secret string) jwtKey {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte("jwt-kid"))
+    return jwtKey{id: hex.EncodeToString(mac.Sum(nil)[:6]), secret: []byte(secret)}
+}
+
+func registerSessionRoutes(g *echo.Group) {
+    g.GET("/account/sessions", requireAuth(blockAdminIfMustChange(handleListSessions)))
+    g.DELETE("/account/sessions", requireAuth(blockAdminIfMustChange(handleRevokeOtherSessions)))
+    g.DELETE("/account/sessions/:id", requireAuth(blockAdminIfMustChange(handleRevokeSession)))
+    g.DELETE("/users/:id/sessions", requirePermission(permUsers, blockAdminIfMustChange(adminRevokeSessions)))
+}
+
+func sessionTTL(app *App) time.Duration {
+    if h := app.Config.Auth.SessionTTLHours; h > 0 {
+        return time.Duration(h) * time.Hour
+    }
+    return 24 * time.Hour
+}
+
+func idleTimeout(app *App) time.Duration {
+    return time.Duration(app.Config.Auth.IdleTimeoutMinutes) * time.Minute
+}
+
+// createSession records a new sign-in for u, pruning sessions that have run out.
+func createSession(c echo.Context, app *App, u *User) (*Session, error) {
+    now := time.Now()
+    q := app.DB.Where("expires_at < ?", now)
+    if idle := idleTimeout(app); idle > 0 {
+        q = q.Or("last_seen_at < ?", now.Add(-idle))
+    }
+    q.Delete(&Session{})
+    ua := c.Request().UserAgent()
+    if len(ua) > 512 { ua = ua[:512] }
+    s := &Session{ID: randomToken(16), UserID: u.ID, IP: c.RealIP(), UserAgent: ua, LastSeenAt: now, ExpiresAt: now.Add(sessionTTL(app))}
+    if err := app.DB.Create(s).Error; err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// sessionUser resolves the session cookie to its session and user. Revoked,
+// expired and idle sessions fail; a token signed with a previous key is
+// re-signed with the current one.
+func sessionUser(c echo.Context, app *App) (*User, *Session, error) {
+    cookie, err := c.Cookie("session")
+    if err != nil || cookie == nil || cookie.Value == "" {
+        return nil, nil, errSessionExpired
+    }
+    claims, err := parseJWT(app, cookie.Value)
+    if err != nil || claims.ID == "" {
+        return nil, nil, errSessionExpired
+    }
+    var s Session
+    now := time.Now()
+    if err := app.DB.Where("id = ? AND user_id = ? AND expires_at > ?", claims.ID, claims.UserID, now).First(&s).Error; err != nil {
+        return nil, nil, errSessionExpired
+    }
+    if idle := idleTimeout(app); idle > 0 && now.Sub(s.LastSeenAt) > idle {
+        app.DB.Delete(&s)
+        return nil, nil, errSessionExpired
+    }
+    var u User
+    if err := app.DB.First(&u, s.UserID).Error; err != nil {
+        return nil, nil, errSessionExpired
+    }
+    // Recording every request would be a write per call; a minute is plenty for idle checks
+    if now.Sub(s.LastSeenAt) > time.Minute {
+        s.LastSeenAt, s.IP = now, c.RealIP()
+        app.DB.Model(&s).Updates(map[string]any{"last_seen_at": s.LastSeenAt, "ip": s.IP})
+    }
+    if claims.KeyID != app.jwtKeys[0].id {
+        writeSessionCookie(c, app, &u, &s)
+    }
+    return &u, &s, nil
+}
+
+// currentSessionID is the session the request came in on, if any.
+func currentSessionID(c echo.Context) string {
+    if s, ok := c.Get("session").(*Session); ok && s != nil {
+        return s.ID
+    }
+    return ""
+}
+
+// revokeSessions signs a user out everywhere except the session keep ("" for all).
+func revokeSessions(app *App, userID uint, keep string) {
+    q := app.DB.Where("user_id = ?", userID)
+    if keep != "" {
+        q = q.Where("id <> ?", keep)
+    }
+    q.Delete(&Session{})
+}
+
+func handleListSessions(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    q := app.DB.Where("user_id = ? AND expires_at > ?", u.ID, time.Now())
+    if idle := idleTimeout(app); idle > 0 {
+        q = q.Where("last_seen_at > ?", time.Now().Add(-idle))
+    }
+    var sessions []Session
+    if err := q.Order("last_seen_at desc").Find(&sessions).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    current := currentSessionID(c)
+    out := make([]echo.Map, 0, len(sessions))
+    for _, s := range sessions {
+        out = append(out, echo.Map{
+            "id": s.ID,
+            "created_at": s.CreatedAt,
+            "last_seen_at": s.LastSeenAt,
+            "expires_at": s.ExpiresAt,
+            "ip": s.IP,
+            "user_agent": s.UserAgent,
+            "current": s.ID == current,
+        })
+    }
+    return c.JSON(http.StatusOK, out)
+}
+
+func handleRevokeSession(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    res := app.DB.Where("id = ? AND user_id = ?", c.Param("id"), u.ID).Delete(&Session{})
+    if res.Error != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    if res.RowsAffected == 0 {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    return c.NoContent(http.StatusNoContent)
+}
+
+// handleRevokeOtherSessions signs the user out everywhere but here.
+func handleRevokeOtherSessions(c echo.Context) error {
+    u := c.Get("user").(*User)
+    revokeSessions(getApp(c), u.ID, currentSessionID(c))
+    return c.NoContent(http.StatusNoContent)
+}
+
+func adminRevokeSessions(c echo.Context) error {
+    app := getApp(c)
+    var u User
+    if err := app.DB.First(&u, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    revokeSessions(app, u.ID, "")
+    audit(c, "user.sessions_revoke", "user", u.ID, nil, nil)
+    return c.NoContent(http.StatusNoContent)
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+    "context"
+    "fmt"
     "net/http"
+    "strconv"
     "time"
 
     "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
 )
 
 type statsResp struct {
@@ -13,80 +17,270 @@ type statsResp struct {
     TokensIn int64 `json:"tokens_in"`
     TokensOut int64 `json:"tokens_out"`
     Messages int64 `json:"messages"`
+    Cost     float64 `json:"cost"`
+}
+
+// spendRow is one group in a spend breakdown.
+type spendRow struct {
+    Key       string  `gorm:"column:group_key" json:"key"`
+    Label     string  `json:"label"`
+    Requests  int64   `json:"requests"`
+    TokensIn  int64   `json:"tokens_in"`
+    TokensOut int64   `json:"tokens_out"`
+    Cost      float64 `json:"cost"`
+    // Set when grouped by model: the priced provider model
+    ProviderID    uint   `json:"provider_id,omitempty"`
+    UpstreamModel string `json:"upstream_model,omitempty"`
+}
+
+// Columns a spend breakdown may be grouped by. model is the provider model
+// cost was computed from; requested_model is what the client asked for,
+// such as an alias or router/ name.
+var spendGroupColumns = map[string]string{
+    "user":            "user_id",
+    "key":             "api_key_id",
+    "team":            "team_id",
+    "provider":        "provider_id",
+    "model":           "provider_id, upstream_model",
+    "requested_model": "model",
 }
 
 func registerStatsRoutes(g *echo.Group) {
     g.GET("/stats/me", requireAuth(blockAdminIfMustChange(statsMe)))
+    g.GET("/stats/me/spend", requireAuth(blockAdminIfMustChange(spendMe)))
     ag := g.Group("/admin")
-    ag.GET("/stats/user/:id", requireAdmin(blockAdminIfMustChange(adminStatsUser)))
+    ag.GET("/stats/user/:id", requirePermission(permStats, blockAdminIfMustChange(adminStatsUser)))
+    ag.GET("/stats/spend", requirePermission(permStats, blockAdminIfMustChange(adminSpend)))
+    ag.GET("/logs", requirePermission(permLogs, blockAdminIfMustChange(adminListLogs)))
 }
 
-func statsMe(c echo.Context) error {
+// Page size bounds for the request log.
+const (
+    defaultLogLimit = 100
+    maxLogLimit     = 1000
+)
+
+// adminListLogs pages through usage logs, newest first. Filters match
+// adminSpend; before_id continues from the last row of a previous page.
+func adminListLogs(c echo.Context) error {
     app := getApp(c)
-    u := c.Get("user").(*User)
-    var count int64
-    var totalMs int64
-    var inT, outT int64
-    var msgs int64
-    rows, err := app.DB.Model(&UsageLog{}).Select("latency_ms, tokens_in, tokens_out, messages").Where("user_id = ?", u.ID).Rows()
+    q, err := usageQuery(c, app.DB)
     if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    for param, col := range map[string]string{"user_id": "user_id", "api_key_id": "api_key_id", "team_id": "team_id", "provider_id": "provider_id", "model": "model", "status": "status"} {
+        if v := c.QueryParam(param); v != "" {
+            q = q.Where(col+" = ?", v)
+        }
+    }
+    if v := c.QueryParam("before_id"); v != "" {
+        q = q.Where("id < ?", v)
+    }
+    limit := defaultLogLimit
+    if v := c.QueryParam("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n <= 0 {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid limit"})
+        }
+        limit = min(n, maxLogLimit)
+    }
+    var logs []UsageLog
+    if err := q.Order("id DESC").Limit(limit).Find(&logs).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
-    defer rows.Close()
-    for rows.Next() {
-        var ms int64
-        var tin, tout, m int
-        _ = rows.Scan(&ms, &tin, &tout, &m)
-        count++
-        totalMs += ms
-        inT += int64(tin)
-        outT += int64(tout)
-        msgs += int64(m)
+    if logs == nil { logs = []UsageLog{} }
+    return c.JSON(http.StatusOK, logs)
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or plain YYYY-MM-DD dates.
+func parseTimeParam(v string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, v); err == nil {
+        return t, nil
+    }
+    return time.Parse("2006-01-02", v)
+}
+
+// usageQuery scopes UsageLog to the optional from/to query params (to is exclusive).
+func usageQuery(c echo.Context, db *gorm.DB) (*gorm.DB, error) {
+    q := db.Model(&UsageLog{})
+    if v := c.QueryParam("from"); v != "" {
+        t, err := parseTimeParam(v)
+        if err != nil {
+            return nil, fmt.Errorf("invalid from")
+        }
+        q = q.Where("created_at >= ?", t)
+    }
+    if v := c.QueryParam("to"); v != "" {
+        t, err := parseTimeParam(v)
+        if err != nil {
+            return nil, fmt.Errorf("invalid to")
+        }
+        q = q.Where("created_at < ?", t)
+    }
+    return q, nil
+}
+
+func collectStats(q *gorm.DB) (statsResp, error) {
+    var agg struct {
+        Requests  int64
+        TotalMs   int64
+        TokensIn  int64
+        TokensOut int64
+        Messages  int64
+        Cost      float64
+    }
+    err := q.Select("COUNT(*) AS requests, COALESCE(SUM(latency_ms),0) AS total_ms, COALESCE(SUM(tokens_in),0) AS tokens_in, COALESCE(SUM(tokens_out),0) AS tokens_out, COALESCE(SUM(messages),0) AS messages, COALESCE(SUM(cost),0) AS cost").Scan(&agg).Error
+    if err != nil {
+        return statsResp{}, err
     }
     avg := int64(0)
-    if count > 0 { avg = totalMs / count }
-    return c.JSON(http.StatusOK, statsResp{Requests: count, AvgMs: avg, TokensIn: inT, TokensOut: outT, Messages: msgs})
+    if agg.Requests > 0 { avg = agg.TotalMs / agg.Requests }
+    return statsResp{Requests: agg.Requests, AvgMs: avg, TokensIn: agg.TokensIn, TokensOut: agg.TokensOut, Messages: agg.Messages, Cost: agg.Cost}, nil
+}
+
+func statsMe(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    q, err := usageQuery(c, app.DB)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    resp, err := collectStats(q.Where("user_id = ?", u.ID))
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, resp)
 }
 
 func adminStatsUser(c echo.Context) error {
     app := getApp(c)
     id := c.Param("id")
-    var count int64
-    var totalMs int64
-    var inT, outT int64
-    var msgs int64
-    rows, err := app.DB.Model(&UsageLog{}).Select("latency_ms, tokens_in, tokens_out, messages").Where("user_id = ?", id).Rows()
+    q, err := usageQuery(c, app.DB)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    resp, err := collectStats(q.Where("user_id = ?", id))
     if err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
-    defer rows.Close()
-    for rows.Next() {
-        var ms int64
-        var tin, tout, m int
-        _ = rows.Scan(&ms, &tin, &tout, &m)
-        count++
-        totalMs += ms
-        inT += int64(tin)
-        outT += int64(tout)
-        msgs += int64(m)
+    return c.JSON(http.StatusOK, resp)
+}
+
+// spendMe breaks down the caller's own spend by key, provider or model.
+func spendMe(c echo.Context) error {
+    u := c.Get("user").(*User)
+    if g := c.QueryParam("group_by"); g == "user" || g == "team" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid group_by"})
     }
-    avg := int64(0)
-    if count > 0 { avg = totalMs / count }
-    return c.JSON(http.StatusOK, statsResp{Requests: count, AvgMs: avg, TokensIn: inT, TokensOut: outT, Messages: msgs})
+    return spendBreakdown(c, func(q *gorm.DB) *gorm.DB { return q.Where("user_id = ?", u.ID) })
 }
 
-// Convenience for usage logs
-func logUsage(app *App, userID uint, keyID uint, providerID uint, model string, status int, started time.Time, messages, promptTok, compTok int) {
+// adminSpend breaks down spend across all users, optionally filtered by
+// user_id, api_key_id, team_id, provider_id, model (upstream) or requested_model.
+func adminSpend(c echo.Context) error {
+    return spendBreakdown(c, func(q *gorm.DB) *gorm.DB {
+        for param, col := range map[string]string{"user_id": "user_id", "api_key_id": "api_key_id", "team_id": "team_id", "provider_id": "provider_id", "model": "upstream_model", "requested_model": "model"} {
+            if v := c.QueryParam(param); v != "" {
+                q = q.Where(col+" = ?", v)
+            }
+        }
+        return q
+    })
+}
+
+func spendBreakdown(c echo.Context, scope func(*gorm.DB) *gorm.DB) error {
+    app := getApp(c)
+    groupBy := c.QueryParam("group_by")
+    if groupBy == "" { groupBy = "model" }
+    col, ok := spendGroupColumns[groupBy]
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid group_by"})
+    }
+    q, err := usageQuery(c, app.DB)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
+    key := col + " AS group_key"
+    if groupBy == "model" { key = col } // keyed in labelSpendRows
+    var rows []spendRow
+    err = scope(q).Select(key + ", COUNT(*) AS requests, COALESCE(SUM(tokens_in),0) AS tokens_in, COALESCE(SUM(tokens_out),0) AS tokens_out, COALESCE(SUM(cost),0) AS cost").
+        Group(col).Order("cost DESC").Scan(&rows).Error
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    labelSpendRows(app, groupBy, rows)
+    if rows == nil { rows = []spendRow{} }
+    return c.JSON(http.StatusOK, echo.Map{"group_by": groupBy, "from": c.QueryParam("from"), "to": c.QueryParam("to"), "rows": rows})
+}
+
+// labelSpendRows fills human-readable labels for ID-based groups.
+func labelSpendRows(app *App, groupBy string, rows []spendRow) {
+    for i := range rows {
+        rows[i].Label = rows[i].Key
+        switch groupBy {
+        case "user":
+            var u User
+            if app.DB.Unscoped().Select("email").First(&u, rows[i].Key).Error == nil { rows[i].Label = u.Email }
+        case "key":
+            var k APIKey
+            if rows[i].Key == "0" {
+                rows[i].Label = "session"
+            } else if app.DB.Select("name", "prefix").First(&k, rows[i].Key).Error == nil {
+                rows[i].Label = k.Name + " (" + k.Prefix + ")"
+            }
+        case "team":
+            var t Team
+            if rows[i].Key == "0" {
+                rows[i].Label = "no team"
+            } else if app.DB.Select("name").First(&t, rows[i].Key).Error == nil {
+                rows[i].Label = t.Name
+            }
+        case "provider":
+            var p Provider
+            if app.DB.Unscoped().Select("name").First(&p, rows[i].Key).Error == nil { rows[i].Label = p.Name }
+        case "model":
+            rows[i].Key = strconv.FormatUint(uint64(rows[i].ProviderID), 10) + "/" + rows[i].UpstreamModel
+            rows[i].Label = rows[i].Key
+            var p Provider
+            if app.DB.Unscoped().Select("name").First(&p, rows[i].ProviderID).Error == nil { rows[i].Label = p.Name + "/" + rows[i].UpstreamModel }
+        }
+    }
+}
+
+// Convenience for usage logs. model is the client-facing id; upstreamModel is
+// the raw provider model used to price the request.
+func logUsage(ctx context.Context, app *App, userID uint, keyID uint, teamID uint, providerID uint, model, upstreamModel string, status int, started time.Time, messages int, usage tokenUsage) {
+    traceUsage(spanFrom(ctx), status, usage)
+    _, sp := app.tracer.start(ctx, "usage.log", spanInternal)
+    defer sp.finish()
+    sp.set("db.system", dbSystem(app))
+    sp.set("db.operation.name", "INSERT")
+    sp.set("db.collection.name", "usage_logs")
     took := time.Since(started).Milliseconds()
-    _ = app.DB.Create(&UsageLog{
+    cost := 0.0
+    if status >= 200 && status < 300 {
+        cost = usageCost(app, providerID, upstreamModel, usage, started)
+    }
+    if err := app.DB.Create(&UsageLog{
         UserID:     userID,
         APIKeyID:   keyID,
+        TeamID:     teamID,
         ProviderID: providerID,
         Model:      model,
+        UpstreamModel: upstreamModel,
         Status:     status,
         LatencyMs:  took,
         Messages:   messages,
-        TokensIn:   promptTok,
-        TokensOut:  compTok,
-    }).Error
+        TokensIn:   usage.PromptTokens,
+        TokensOut:  usage.CompletionTokens,
+        CachedTokens: usage.CachedTokens,
+        Images:     usage.Images,
+        AudioSeconds: usage.AudioSeconds,
+        Cost:       cost,
+    }).Error; err != nil {
+        sp.fail(err.Error())
+    }
+    app.budgets.record(app, userID, keyID, teamID, cost, int64(usage.PromptTokens+usage.CompletionTokens))
+    app.limiter.record(userID, keyID, providerID, upstreamModel, int64(usage.PromptTokens+usage.CompletionTokens))
+    app.metrics.usage(providerID, upstreamModel, usage)
 }
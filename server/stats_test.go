@@ -0,0 +1,58 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "testing"
+
+    "github.com/labstack/echo/v4"
+)
+
+func TestSpendByModel(t *testing.T) {
+    app := newTestApp(t)
+    admin := newTestUser(t, app, "admin@example.org", "admin")
+    openai := Provider{Name: "OpenAI", Enabled: true}
+    app.DB.Create(&openai)
+    for _, l := range []UsageLog{
+        {UserID: admin.ID, ProviderID: openai.ID, Model: "openai/gpt-4o", UpstreamModel: "gpt-4o", Status: 200, Cost: 1},
+        {UserID: admin.ID, ProviderID: openai.ID, Model: "gpt-default", UpstreamModel: "gpt-4o", Status: 200, Cost: 2},
+        {UserID: admin.ID, ProviderID: openai.ID, Model: "router/fast", UpstreamModel: "gpt-4o-mini", Status: 200, Cost: 0.5},
+    } {
+        app.DB.Create(&l)
+    }
+    tests := []struct {
+        name  string
+        query string
+        want  map[string]float64 // label to cost
+    }{
+        {name: "default groups by priced model", query: "", want: map[string]float64{"OpenAI/gpt-4o": 3, "OpenAI/gpt-4o-mini": 0.5}},
+        {name: "by requested model", query: "group_by=requested_model", want: map[string]float64{"openai/gpt-4o": 1, "gpt-default": 2, "router/fast": 0.5}},
+        {name: "filter by priced model", query: "group_by=requested_model&model=gpt-4o", want: map[string]float64{"openai/gpt-4o": 1, "gpt-default": 2}},
+        {name: "filter by requested model", query: "requested_model=router/fast", want: map[string]float64{"OpenAI/gpt-4o-mini": 0.5}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rec := callAs(app, admin, func(c echo.Context) error {
+                c.Request().URL.RawQuery = tt.query
+                return adminSpend(c)
+            }, http.MethodGet, "")
+            if rec.Code != http.StatusOK {
+                t.Fatalf("status %d: %s", rec.Code, rec.Body)
+            }
+            var out struct {
+                Rows []spendRow `json:"rows"`
+            }
+            json.Unmarshal(rec.Body.Bytes(), &out)
+            got := map[string]float64{}
+            for _, r := range out.Rows { got[r.Label] = r.Cost }
+            if len(got) != len(tt.want) {
+                t.Fatalf("rows = %v, want %v", got, tt.want)
+            }
+            for label, cost := range tt.want {
+                if got[label] != cost {
+                    t.Errorf("rows = %v, want %v", got, tt.want)
+                }
+            }
+        })
+    }
+}
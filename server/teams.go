@@ -0,0 +1,385 @@
+package server
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+)
+
+// Team roles; a team admin manages the team's members and keys.
+const (
+    teamRoleMember = "member"
+    teamRoleAdmin  = "admin"
+)
+
+type teamReq struct {
+    Name        string    `json:"name"`
+    ProviderIDs *[]uint   `json:"provider_ids"`
+    Routes      *[]string `json:"routes"`
+}
+
+type teamMemberReq struct {
+    Email    string `json:"email"`
+    TeamRole string `json:"team_role"`
+}
+
+// teamView is a team with its members.
+type teamView struct {
+    Team
+    Members []User `json:"members"`
+}
+
+func registerTeamRoutes(g *echo.Group) {
+    ag := g.Group("/teams")
+    ag.GET("", requireAuth(blockAdminIfMustChange(listTeams)))
+    ag.POST("", requirePermission(permUsers, blockAdminIfMustChange(createTeam)))
+    ag.GET("/:id", requireAuth(blockAdminIfMustChange(requireTeamMember(getTeam))))
+    ag.PUT("/:id", requirePermission(permUsers, blockAdminIfMustChange(updateTeam)))
+    ag.DELETE("/:id", requirePermission(permUsers, blockAdminIfMustChange(deleteTeam)))
+    ag.POST("/:id/members", requireAuth(blockAdminIfMustChange(requireTeamAdmin(addTeamMember))))
+    ag.PUT("/:id/members/:uid", requireAuth(blockAdminIfMustChange(requireTeamAdmin(updateTeamMember))))
+    ag.DELETE("/:id/members/:uid", requireAuth(blockAdminIfMustChange(requireTeamAdmin(removeTeamMember))))
+    ag.GET("/:id/keys", requireAuth(blockAdminIfMustChange(requireTeamAdmin(listTeamKeys))))
+    ag.POST("/:id/keys", requireAuth(blockAdminIfMustChange(requireTeamAdmin(createTeamKey))))
+    ag.DELETE("/:id/keys/:kid", requireAuth(blockAdminIfMustChange(requireTeamAdmin(deleteTeamKey))))
+    ag.GET("/:id/spend", requireAuth(blockAdminIfMustChange(requireTeamAdmin(teamSpend))))
+}
+
+// requireTeamMember allows user managers and members of the team in :id.
+func requireTeamMember(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        u := c.Get("user").(*User)
+        if !hasPermission(c, permUsers) && strconv.FormatUint(uint64(u.TeamID), 10) != c.Param("id") {
+            return c.JSON(http.StatusForbidden, echo.Map{"error": "forbidden"})
+        }
+        return next(c)
+    }
+}
+
+// requireTeamAdmin allows user managers and team admins of the team in :id.
+func requireTeamAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+    return requireTeamMember(func(c echo.Context) error {
+        u := c.Get("user").(*User)
+        if !hasPermission(c, permUsers) && u.TeamRole != teamRoleAdmin {
+            return c.JSON(http.StatusForbidden, echo.Map{"error": "forbidden"})
+        }
+        return next(c)
+    })
+}
+
+// listTeams returns every team to user managers and the caller's own team to others.
+func listTeams(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    q := app.DB.Order("id ASC")
+    if !hasPermission(c, permUsers) {
+        q = q.Where("id = ?", u.TeamID)
+    }
+    var teams []Team
+    if err := q.Find(&teams).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, teams)
+}
+
+func getTeam(c echo.Context) error {
+    app := getApp(c)
+    var t Team
+    if err := app.DB.First(&t, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var members []User
+    if err := app.DB.Where("team_id = ?", t.ID).Order("id ASC").Find(&members).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, teamView{Team: t, Members: members})
+}
+
+func createTeam(c echo.Context) error {
+    app := getApp(c)
+    var req teamReq
+    if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    var t Team
+    applyTeamReq(&t, req)
+    if err := app.DB.Create(&t).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    audit(c, "team.create", "team", t.ID, nil, t)
+    return c.JSON(http.StatusCreated, t)
+}
+
+func updateTeam(c echo.Context) error {
+    app := getApp(c)
+    var t Team
+    if err := app.DB.First(&t, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    before := t
+    var req teamReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    applyTeamReq(&t, req)
+    if err := app.DB.Save(&t).Error; err != nil {
+        return c.JSON(http.StatusConflict, echo.Map{"error": "name exists"})
+    }
+    audit(c, "team.update", "team", t.ID, before, t)
+    return c.JSON(http.StatusOK, t)
+}
+
+func applyTeamReq(t *Team, req teamReq) {
+    if name := strings.TrimSpace(req.Name); name != "" { t.Name = name }
+    if req.ProviderIDs != nil { t.ProviderIDs = *req.ProviderIDs }
+    if req.Routes != nil {
+        t.Routes = nil
+        for _, r := range *req.Routes {
+            // Route names are stored lower-case, as loadRoute looks them up
+            if r = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(r)), "router/"); r != "" {
+                t.Routes = append(t.Routes, r)
+            }
+        }
+    }
+}
+
+// deleteTeam removes the team, its keys and its members' membership.
+func deleteTeam(c echo.Context) error {
+    app := getApp(c)
+    var t Team
+    if err := app.DB.First(&t, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var keyIDs []uint
+    app.DB.Model(&APIKey{}).Where("team_id = ?", t.ID).Pluck("id", &keyIDs)
+    err := app.DB.Model(&User{}).Where("team_id = ?", t.ID).Updates(map[string]any{"team_id": 0, "team_role": ""}).Error
+    if err == nil {
+        err = app.DB.Where("team_id = ?", t.ID).Delete(&APIKey{}).Error
+    }
+    if err == nil {
+        err = app.DB.Delete(&t).Error
+    }
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    for _, id := range keyIDs {
+        app.keyCache.invalidateKey(id)
+    }
+    app.keyCache.invalidateTeam(t.ID)
+    audit(c, "team.delete", "team", t.ID, t, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+// addTeamMember adds an existing user, or sets the team role of a member.
+// Only user managers can bring in users from outside the team; to a team
+// admin anyone else is an unknown user, so emails can't be probed.
+func addTeamMember(c echo.Context) error {
+    app := getApp(c)
+    var t Team
+    if err := app.DB.First(&t, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req teamMemberReq
+    if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    role, ok := parseTeamRole(req.TeamRole)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid team_role"})
+    }
+    q := app.DB.Where("email = ?", strings.ToLower(strings.TrimSpace(req.Email)))
+    manager := hasPermission(c, permUsers)
+    if !manager { q = q.Where("team_id = ?", t.ID) }
+    var u User
+    if err := q.First(&u).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "unknown user"})
+    }
+    if manager {
+        if err := roleAssignable(c, u.Role); err != nil {
+            return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+        }
+    }
+    before := u
+    u.TeamID, u.TeamRole = t.ID, role
+    if err := app.DB.Save(&u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "team.member_add", "user", u.ID, before, u)
+    app.keyCache.invalidateUser(u.ID)
+    return c.JSON(http.StatusOK, u)
+}
+
+func updateTeamMember(c echo.Context) error {
+    app := getApp(c)
+    u, err := findTeamMember(app, c.Param("id"), c.Param("uid"))
+    if err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req teamMemberReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    role, ok := parseTeamRole(req.TeamRole)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid team_role"})
+    }
+    before := u
+    u.TeamRole = role
+    if err := app.DB.Save(&u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "team.member_update", "user", u.ID, before, u)
+    app.keyCache.invalidateUser(u.ID)
+    return c.JSON(http.StatusOK, u)
+}
+
+// removeTeamMember takes a user out of the team; team keys they created stay with the team.
+func removeTeamMember(c echo.Context) error {
+    app := getApp(c)
+    u, err := findTeamMember(app, c.Param("id"), c.Param("uid"))
+    if err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    before := u
+    u.TeamID, u.TeamRole = 0, ""
+    if err := app.DB.Save(&u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "team.member_remove", "user", u.ID, before, u)
+    app.keyCache.invalidateUser(u.ID)
+    return c.NoContent(http.StatusNoContent)
+}
+
+func findTeamMember(app *App, teamID, userID string) (User, error) {
+    var u User
+    err := app.DB.Where("id = ? AND team_id = ?", userID, teamID).First(&u).Error
+    return u, err
+}
+
+func parseTeamRole(s string) (string, bool) {
+    switch strings.ToLower(strings.TrimSpace(s)) {
+    case "", teamRoleMember:
+        return teamRoleMember, true
+    case teamRoleAdmin:
+        return teamRoleAdmin, true
+    }
+    return "", false
+}
+
+func listTeamKeys(c echo.Context) error {
+    app := getApp(c)
+    var keys []APIKey
+    if err := app.DB.Where("team_id = ?", c.Param("id")).Order("id DESC").Find(&keys).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    for i := range keys {
+        keys[i].Hash = ""
+    }
+    return c.JSON(http.StatusOK, keys)
+}
+
+// createTeamKey issues a key owned by the team; the caller is recorded as its creator.
+func createTeamKey(c echo.Context) error {
+    app := getApp(c)
+    var t Team
+    if err := app.DB.First(&t, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    var req keyCreateReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    return issueKey(c, app, c.Get("user").(*User), t.ID, req)
+}
+
+func deleteTeamKey(c echo.Context) error {
+    app := getApp(c)
+    var key APIKey
+    if err := app.DB.Where("id = ? AND team_id = ?", c.Param("kid"), c.Param("id")).First(&key).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := app.DB.Delete(&key).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    audit(c, "key.delete", "api_key", key.ID, key, nil)
+    app.keyCache.invalidateKey(key.ID)
+    return c.NoContent(http.StatusNoContent)
+}
+
+// teamSpend breaks down the team's spend by user, key, provider or model.
+func teamSpend(c echo.Context) error {
+    id := c.Param("id")
+    if c.QueryParam("group_by") == "team" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid group_by"})
+    }
+    return spendBreakdown(c, func(q *gorm.DB) *gorm.DB { return q.Where("team_id = ?", id) })
+}
+
+// usageTeam is the team a request is billed to: the key's team for team
+// keys, otherwise the caller's team (0 = none).
+func usageTeam(user *User, key *APIKey) uint {
+    if key != nil && key.TeamID != 0 {
+        return key.TeamID
+    }
+    if user != nil {
+        return user.TeamID
+    }
+    return 0
+}
+
+// callerTeam loads the team a request is billed to, if any.
+func callerTeam(c echo.Context) *Team {
+    user, _ := c.Get("user").(*User)
+    key, _ := c.Get("api_key").(*APIKey)
+    id := usageTeam(user, key)
+    if id == 0 {
+        return nil
+    }
+    var t Team
+    if err := getApp(c).DB.First(&t, id).Error; err != nil {
+        return nil
+    }
+    return &t
+}
+
+// visible reports whether a provider/model or router/<name> id is visible
+// to the team. Empty provider or route lists mean everything is visible.
+// providers maps lower-case provider names to ids; a provider missing from
+// it is not visible to a team limited to some providers.
+func (t *Team) visible(id string, providers map[string]uint) bool {
+    if name, ok := strings.CutPrefix(strings.ToLower(id), "router/"); ok {
+        if len(t.Routes) == 0 {
+            return true
+        }
+        for _, r := range t.Routes {
+            if strings.EqualFold(r, name) {
+                return true
+            }
+        }
+        return false
+    }
+    provider, _, ok := strings.Cut(id, "/")
+    if !ok || len(t.ProviderIDs) == 0 {
+        return true
+    }
+    pid, found := providers[strings.ToLower(strings.TrimSpace(provider))]
+    if !found {
+        return false
+    }
+    return t.visibleProvider(pid)
+}
+
+func (t *Team) visibleProvider(id uint) bool {
+    if len(t.ProviderIDs) == 0 {
+        return true
+    }
+    for _, pid := range t.ProviderIDs {
+        if pid == id {
+            return true
+        }
+    }
+    return false
+}
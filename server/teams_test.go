@@ -0,0 +1,138 @@
+package server
+
+import (
+    "net/http"
+    "strconv"
+    "testing"
+
+    "github.com/labstack/echo/v4"
+)
+
+func TestTeamVisible(t *testing.T) {
+    providers := map[string]uint{"openai": 1, "anthropic": 2}
+    limited := &Team{ProviderIDs: []uint{1}, Routes: []string{"fast"}}
+    open := &Team{}
+    tests := []struct {
+        name string
+        team *Team
+        id   string
+        want bool
+    }{
+        {name: "listed route", team: limited, id: "router/fast", want: true},
+        {name: "listed route, any case", team: limited, id: "Router/FAST", want: true},
+        {name: "hidden route", team: limited, id: "router/smart", want: false},
+        {name: "hidden route, upper-case prefix", team: limited, id: "Router/smart", want: false},
+        {name: "visible provider", team: limited, id: "OpenAI/gpt-4o", want: true},
+        {name: "hidden provider", team: limited, id: "anthropic/claude", want: false},
+        {name: "unknown provider", team: limited, id: "nowhere/model", want: false},
+        {name: "no provider", team: limited, id: "gpt-4o", want: true},
+        {name: "unlimited team, any route", team: open, id: "router/smart", want: true},
+        {name: "unlimited team, any provider", team: open, id: "nowhere/model", want: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := tt.team.visible(tt.id, providers); got != tt.want {
+                t.Errorf("visible(%q) = %v, want %v", tt.id, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestLoadRouteKeepsTeamProviders(t *testing.T) {
+    app := newTestApp(t)
+    openai, anthropic := Provider{Name: "OpenAI", Enabled: true}, Provider{Name: "Anthropic", Enabled: true}
+    app.DB.Create(&openai)
+    app.DB.Create(&anthropic)
+    app.DB.Create(&FallbackRoute{Name: "mixed", Enabled: true, Targets: []FallbackTarget{
+        {ProviderID: anthropic.ID, Model: "claude", Position: 0},
+        {ProviderID: openai.ID, Model: "gpt-4o", Position: 1},
+    }})
+    app.DB.Create(&FallbackRoute{Name: "elsewhere", Enabled: true, Targets: []FallbackTarget{{ProviderID: anthropic.ID, Model: "claude"}}})
+    team := Team{Name: "limited", ProviderIDs: []uint{openai.ID}}
+    app.DB.Create(&team)
+    member := newTestUser(t, app, "member@example.org", "user")
+    outsider := newTestUser(t, app, "outsider@example.org", "user")
+    app.DB.Model(member).Updates(map[string]any{"team_id": team.ID, "team_role": teamRoleMember})
+    member.TeamID = team.ID
+
+    tests := []struct {
+        name   string
+        caller *User
+        model  string
+        want   []string // models of the targets left, nil when the route isn't usable
+    }{
+        {name: "team member", caller: member, model: "router/mixed", want: []string{"gpt-4o"}},
+        {name: "team member, no visible target", caller: member, model: "Router/elsewhere"},
+        {name: "no team", caller: outsider, model: "router/mixed", want: []string{"claude", "gpt-4o"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var got []string
+            var found bool
+            callAs(app, tt.caller, func(c echo.Context) error {
+                route, ok := loadRoute(c, app, tt.model)
+                found = ok
+                for _, target := range route.Targets { got = append(got, target.Model) }
+                return c.NoContent(http.StatusNoContent)
+            }, http.MethodPost, "")
+            if found != (tt.want != nil) {
+                t.Fatalf("found = %v, want targets %v", found, tt.want)
+            }
+            if found && len(got) != len(tt.want) {
+                t.Fatalf("targets = %v, want %v", got, tt.want)
+            }
+            for i := range tt.want {
+                if got[i] != tt.want[i] {
+                    t.Errorf("targets = %v, want %v", got, tt.want)
+                }
+            }
+        })
+    }
+}
+
+func TestAddTeamMember(t *testing.T) {
+    tests := []struct {
+        name   string
+        caller string // helpdesk (users.manage only), lead (team admin) or admin
+        email  string
+        want   int
+        joined bool
+    }{
+        {name: "team admin adds outsider", caller: "lead", email: "loner@example.org", want: http.StatusNotFound},
+        {name: "team admin adds admin", caller: "lead", email: "admin@example.org", want: http.StatusNotFound},
+        {name: "team admin probes unknown email", caller: "lead", email: "nobody@example.org", want: http.StatusNotFound},
+        {name: "team admin promotes member", caller: "lead", email: "member@example.org", want: http.StatusOK, joined: true},
+        {name: "user manager adds outsider", caller: "helpdesk", email: "loner@example.org", want: http.StatusOK, joined: true},
+        {name: "user manager adds admin", caller: "helpdesk", email: "admin@example.org", want: http.StatusForbidden},
+        {name: "admin adds admin", caller: "admin", email: "admin@example.org", want: http.StatusOK, joined: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApp(t)
+            team := Team{Name: "core"}
+            app.DB.Create(&team)
+            callers := map[string]*User{
+                "admin":    newTestUser(t, app, "admin@example.org", "admin"),
+                "helpdesk": newTestUser(t, app, "helpdesk@example.org", "helpdesk", permUsers),
+                "lead":     newTestUser(t, app, "lead@example.org", "user"),
+            }
+            member := newTestUser(t, app, "member@example.org", "user")
+            newTestUser(t, app, "loner@example.org", "user")
+            for _, u := range []*User{callers["lead"], member} {
+                u.TeamID, u.TeamRole = team.ID, teamRoleMember
+                app.DB.Save(u)
+            }
+            callers["lead"].TeamRole = teamRoleAdmin
+            app.DB.Save(callers["lead"])
+
+            rec := callAs(app, callers[tt.caller], addTeamMember, http.MethodPost, `{"email":"`+tt.email+`","team_role":"admin"}`, "id", strconv.Itoa(int(team.ID)))
+            if rec.Code != tt.want {
+                t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+            }
+            var u User
+            if app.DB.Where("email = ?", tt.email).First(&u).Error == nil && (u.TeamID == team.ID) != tt.joined {
+                t.Errorf("team_id = %d, joined want %v", u.TeamID, tt.joined)
+            }
+        })
+    }
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/base32"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/labstack/echo/v4"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports).
+const (
+    totpStep   = 30 // seconds
+    totpDigits = 6
+    totpSkew   = 1 // steps accepted either side of now
+)
+
+// The second login step must complete within this window and attempt budget.
+const (
+    totpChallengeTTL  = 5 * time.Minute
+    totpMaxAttempts   = 5
+    recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type totpCodeReq struct {
+    Code string `json:"code"`
+}
+
+type totpLoginReq struct {
+    Challenge string `json:"challenge"`
+    Code      string `json:"code"` // TOTP code or recovery code
+}
+
+type totpChallengeClaims struct {
+    UserID uint `json:"user_id"`
+    jwt.RegisteredClaims
+}
+
+// totpChallenges counts failed codes per login challenge.
+type totpChallenges struct {
+    mu    sync.Mutex
+    fails map[string]int
+    exp   map[string]time.Time
+}
+
+func newTOTPChallenges() *totpChallenges {
+    return &totpChallenges{fails: map[string]int{}, exp: map[string]time.Time{}}
+}
+
+// fail records a wrong code and reports whether the challenge is used up.
+func (t *totpChallenges) fail(id string, expires time.Time) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    now := time.Now()
+    for k, e := range t.exp {
+        if now.After(e) {
+            delete(t.exp, k)
+            delete(t.fails, k)
+        }
+    }
+    t.fails[id]++
+    t.exp[id] = expires
+    return t.fails[id] >= totpMaxAttempts
+}
+
+func (t *totpChallenges) spent(id string) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.fails[id] >= totpMaxAttempts
+}
+
+func (t *totpChallenges) done(id string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    // Keep it spent until it expires, so a challenge can't be reused
+    t.fails[id] = totpMaxAttempts
+}
+
+func registerTOTPRoutes(g *echo.Group) {
+    g.POST("/auth/totp", handleTOTPLogin)
+    g.POST("/account/totp/setup", requireAuth(blockAdminIfMustChange(handleTOTPSetup)))
+    g.POST("/account/totp/enable", requireAuth(blockAdminIfMustChange(handleTOTPEnable)))
+    g.POST("/account/totp/disable", requireAuth(blockAdminIfMustChange(handleTOTPDisable)))
+    g.POST("/account/totp/recovery-codes", requireAuth(blockAdminIfMustChange(handleRecoveryCodes)))
+    g.DELETE("/users/:id/totp", requirePermission(permUsers, blockAdminIfMustChange(adminResetTOTP)))
+}
+
+// mustEnrollTOTP reports whether u has to set up two-factor before doing anything else.
+// Single sign-on users are exempt; their issuer handles the second factor.
+func mustEnrollTOTP(app *App, u *User) bool {
+    if u.TOTPEnabled || u.ServiceAccount || u.OIDCSubject != "" {
+        return false
+    }
+    if u.TOTPRequired {
+        return true
+    }
+    for _, r := range app.Config.Auth.RequireTOTPRoles {
+        if r == u.Role {
+            return true
+        }
+    }
+    return false
+}
+
+// totpChallenge answers a correct password for a user with two-factor on:
+// no session yet, just a token for the second step.
+func totpChallenge(c echo.Context, app *App, u *User) error {
+    now := time.Now()
+    claims := totpChallengeClaims{UserID: u.ID, RegisteredClaims: jwt.RegisteredClaims{
+        ID:        randomToken(16),
+        ExpiresAt: jwt.NewNumericDate(now.Add(totpChallengeTTL)),
+    }}
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString(derivedKey(app, "totp-challenge"))
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "auth error"})
+    }
+    return c.JSON(http.StatusOK, echo.Map{"totp_required": true, "challenge": token})
+}
+
+// handleTOTPLogin is the second login step; it starts the session.
+func handleTOTPLogin(c echo.Context) error {
+    app := getApp(c)
+    var req totpLoginReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    var claims totpChallengeClaims
+    if _, err := jwt.ParseWithClaims(req.Challenge, &claims, func(*jwt.Token) (interface{}, error) {
+        return derivedKey(app, "totp-challenge"), nil
+    }, jwt.WithValidMethods([]string{"HS256"})); err != nil || app.totp.spent(claims.ID) {
+        return c.JSON(http.StatusUnauthorized, echo.Map{"error": "login expired, sign in again"})
+    }
+    var u User
+    if err := app.DB.First(&u, claims.UserID).Error; err != nil || u.Disabled || !u.TOTPEnabled {
+        return c.JSON(http.StatusUnauthorized, echo.Map{"error": "login expired, sign in again"})
+    }
+    if wait, msg := loginLockout(c, app, &u); wait > 0 {
+        return tooManyLogins(c, wait, msg)
+    }
+    if !checkSecondFactor(app, &u, req.Code) {
+        // Wrong codes count like wrong passwords, so fresh challenges can't be used to guess codes
+        recordLoginFailure(c, app, &u)
+        if app.totp.fail(claims.ID, claims.ExpiresAt.Time) {
+            return c.JSON(http.StatusUnauthorized, echo.Map{"error": "too many attempts, sign in again"})
+        }
+        return c.JSON(http.StatusUnauthorized, echo.Map{"error": "invalid code"})
+    }
+    app.totp.done(claims.ID)
+    clearLoginFailures(app, &u)
+    if err := setSessionCookie(c, app, &u); err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "auth error"})
+    }
+    return c.JSON(http.StatusOK, echo.Map{"ok": true})
+}
+
+// handleTOTPSetup starts enrollment with a fresh secret; it only takes effect
+// once a code from it is confirmed.
+func handleTOTPSetup(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    if u.TOTPEnabled {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "two-factor already enabled"})
+    }
+    raw := make([]byte, 20)
+    if _, err := rand.Read(raw); err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "rng error"})
+    }
+    secret := totpEncoding.EncodeToString(raw)
+    if err := app.DB.Model(u).UpdateColumn("totp_pending_secret", secret).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    label := url.PathEscape("LLM Router:" + u.Email)
+    q := url.Values{"secret": {secret}, "issuer": {"LLM Router"}, "digits": {strconv.Itoa(totpDigits)}, "period": {strconv.Itoa(totpStep)}}
+    return c.JSON(http.StatusOK, echo.Map{"secret": secret, "otpauth_url": "otpauth://totp/" + label + "?" + q.Encode()})
+}
+
+// handleTOTPEnable confirms enrollment and returns recovery codes, shown once.
+func handleTOTPEnable(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    var req totpCodeReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if u.TOTPEnabled {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "two-factor already enabled"})
+    }
+    if u.TOTPPendingSecret == "" {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "run setup first"})
+    }
+    step, ok := verifyTOTP(u.TOTPPendingSecret, req.Code, time.Now(), 0)
+    if !ok {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid code"})
+    }
+    codes, hashed := newRecoveryCodes(app)
+    u.TOTPSecret, u.TOTPPendingSecret, u.TOTPEnabled, u.TOTPLastStep, u.RecoveryCodes = u.TOTPPendingSecret, "", true, step, hashed
+    if err := app.DB.Save(u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
+// handleTOTPDisable turns two-factor off; it takes a current code, so a
+// hijacked session alone can't do it.
+func handleTOTPDisable(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    var req totpCodeReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if !u.TOTPEnabled {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "two-factor not enabled"})
+    }
+    off := *u
+    off.TOTPEnabled = false
+    if mustEnrollTOTP(app, &off) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "two-factor is required for your account"})
+    }
+    if !checkSecondFactor(app, u, req.Code) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid code"})
+    }
+    clearTOTP(u)
+    if err := app.DB.Save(u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.NoContent(http.StatusNoContent)
+}
+
+// handleRecoveryCodes replaces all recovery codes.
+func handleRecoveryCodes(c echo.Context) error {
+    app := getApp(c)
+    u := c.Get("user").(*User)
+    var req totpCodeReq
+    if err := c.Bind(&req); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
+    }
+    if !u.TOTPEnabled {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "two-factor not enabled"})
+    }
+    if !checkSecondFactor(app, u, req.Code) {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid code"})
+    }
+    codes, hashed := newRecoveryCodes(app)
+    u.RecoveryCodes = hashed
+    if err := app.DB.Save(u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
+// adminResetTOTP clears a user's two-factor, e.g. after a lost phone. If it is
+// required, the user has to enroll again on next login.
+func adminResetTOTP(c echo.Context) error {
+    app := getApp(c)
+    var u User
+    if err := app.DB.First(&u, c.Param("id")).Error; err != nil {
+        return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+    }
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
+    clearTOTP(&u)
+    if err := app.DB.Save(&u).Error; err != nil {
+        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
+    }
+    // Sessions that passed the old second factor end with it
+    revokeSessions(app, u.ID, "")
+    audit(c, "user.totp_reset", "user", u.ID, nil, nil)
+    return c.NoContent(http.StatusNoContent)
+}
+
+func clearTOTP(u *User) {
+    u.TOTPSecret, u.TOTPPendingSecret, u.TOTPEnabled, u.TOTPLastStep, u.RecoveryCodes = "", "", false, 0, nil
+}
+
+// checkSecondFactor accepts a TOTP code (each step only once) or an unused
+// recovery code, which is then spent.
+func checkSecondFactor(app *App, u *User, code string) bool {
+    code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+    if step, ok := verifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); ok {
+        u.TOTPLastStep = step
+        // Conditional, so two concurrent logins can't both use the same code
+        res := app.DB.Model(&User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).UpdateColumn("totp_last_step", step)
+        return res.Error == nil && res.RowsAffected == 1
+    }
+    h := hashAPIKey(app, strings.ToLower(strings.ReplaceAll(code, "-", "")))
+    for i, stored := range u.RecoveryCodes {
+        if hmac.Equal([]byte(stored), []byte(h)) {
+            prev, err := json.Marshal(u.RecoveryCodes)
+            if err != nil {
+                return false
+            }
+            u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+            // A struct update, so the column goes through its JSON serializer.
+            // Conditional on the list we read, so two concurrent logins can't
+            // both spend the same code.
+            res := app.DB.Model(&User{ID: u.ID}).Where("recovery_codes = ?", string(prev)).Select("recovery_codes").UpdateColumns(&User{RecoveryCodes: u.RecoveryCodes})
+            return res.Error == nil && res.RowsAffected == 1
+        }
+    }
+    return false
+}
+
+// verifyTOTP checks code against the steps around now, rejecting steps at or
+// before last (already used). It returns the matching step.
+func verifyTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil || secret == "" || len(code) != totpDigits {
+        return 0, false
+    }
+    cur := now.Unix() / totpStep
+    for s := cur - totpSkew; s <= cur+totpSkew; s++ {
+        if s > last && hmac.Equal([]byte(totpCode(key, s)), []byte(code)) {
+            return s, true
+        }
+    }
+    return 0, false
+}
+
+// totpCode is the HOTP value (RFC 4226) for one time step.
+func totpCode(key []byte, step int64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+    off := sum[len(sum)-1] & 0x0f
+    v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// newRecoveryCodes returns fresh codes and their stored hashes.
+func newRecoveryCodes(app *App) ([]string, []string) {
+    codes := make([]string, recoveryCodeCount)
+    hashed := make([]string, recoveryCodeCount)
+    for i := range codes {
+        raw := make([]byte, 5)
+        if _, err := rand.Read(raw); err != nil {
+            panic(err)
+        }
+        h := hex.EncodeToString(raw)
+        codes[i] = h[:5] + "-" + h[5:]
+        hashed[i] = hashAPIKey(app, h)
+    }
+    return codes, hashed
+}
+
+// derivedKey derives a signing key for one purpose from the JWT secret, so
+// tokens made for one purpose can't pass as another (or as a session).
+func derivedKey(app *App, purpose string) []byte {
+    mac := hmac.New(sha256.New, app.JWTSecret)
+    mac.Write([]byte(purpose))
+    return mac.Sum(nil)
+}
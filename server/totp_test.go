@@ -0,0 +1,49 @@
+package server
+
+import (
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestAdminResetTOTP(t *testing.T) {
+    tests := []struct {
+        name   string
+        caller string // helpdesk (users.manage only) or admin
+        target string
+        want   int
+    }{
+        {name: "helpdesk on admin", caller: "helpdesk", target: "admin", want: http.StatusForbidden},
+        {name: "helpdesk on user", caller: "helpdesk", target: "user", want: http.StatusNoContent},
+        {name: "admin on admin", caller: "admin", target: "admin", want: http.StatusNoContent},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApp(t)
+            callers := map[string]*User{
+                "helpdesk": newTestUser(t, app, "helpdesk@example.org", "helpdesk", permUsers),
+                "admin":    newTestUser(t, app, "admin@example.org", "admin"),
+            }
+            target := newTestUser(t, app, "target@example.org", tt.target)
+            app.DB.Model(target).Updates(map[string]any{"totp_enabled": true, "totp_secret": "enc-secret"})
+            app.DB.Create(&Session{ID: "s1", UserID: target.ID, ExpiresAt: time.Now().Add(time.Hour)})
+
+            rec := callAs(app, callers[tt.caller], adminResetTOTP, http.MethodDelete, "", "id", strconv.Itoa(int(target.ID)))
+            if rec.Code != tt.want {
+                t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+            }
+            var after User
+            app.DB.First(&after, target.ID)
+            var sessions int64
+            app.DB.Model(&Session{}).Where("user_id = ?", target.ID).Count(&sessions)
+            reset := tt.want == http.StatusNoContent
+            if after.TOTPEnabled == reset || (after.TOTPSecret == "") != reset {
+                t.Errorf("totp enabled %v secret %q after reset=%v", after.TOTPEnabled, after.TOTPSecret, reset)
+            }
+            if (sessions == 0) != reset {
+                t.Errorf("%d sessions left after reset=%v", sessions, reset)
+            }
+        })
+    }
+}
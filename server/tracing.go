@@ -0,0 +1,461 @@
+package server
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Span kinds and the error status as numbered in OTLP.
+const (
+    spanInternal = 1
+    spanServer   = 2
+    spanClient   = 3
+
+    statusError = 2
+)
+
+// Spans are exported in batches of up to traceBatchSize, at least every
+// traceFlushInterval; spans that arrive while traceQueueSize are waiting are dropped.
+const (
+    traceBatchSize     = 256
+    traceFlushInterval = 2 * time.Second
+    traceQueueSize     = 4096
+)
+
+// tracer records spans for /api/v1 requests and exports them over OTLP/HTTP
+// (JSON encoding) or to stdout. A nil *tracer records nothing, but incoming
+// traceparent headers are still passed on to providers.
+type tracer struct {
+    service string
+    ratio   float64
+    export  func([]*span) error
+    queue   chan *span
+}
+
+// span is one timed operation. Its methods are safe on a nil span, which is
+// what the tracer hands out when there is nothing to record.
+type span struct {
+    t          *tracer
+    traceID    [16]byte
+    spanID     [8]byte
+    parentID   [8]byte
+    sampled    bool
+    remote     bool   // parent taken from a traceparent header; never exported
+    traceState string // passed on unchanged
+    name       string
+    kind       int
+    start      time.Time
+
+    mu        sync.Mutex
+    end       time.Time
+    attrs     []spanAttr
+    status    int
+    statusMsg string
+}
+
+type spanAttr struct {
+    key   string
+    value any
+}
+
+func newTracer(cfg TracingConfig) (*tracer, error) {
+    if v := os.Getenv("OTEL_TRACES_EXPORTER"); v != "" { cfg.Exporter = v }
+    if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" { cfg.Endpoint = v }
+    if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" { cfg.ServiceName = v }
+    if v := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+        cfg.Headers = map[string]string{}
+        for _, kv := range strings.Split(v, ",") {
+            if k, val, ok := strings.Cut(kv, "="); ok {
+                cfg.Headers[strings.TrimSpace(k)] = strings.TrimSpace(val)
+            }
+        }
+    }
+    if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+        return nil, errors.New("tracing: sample_ratio must be between 0 and 1")
+    }
+    t := &tracer{service: cfg.ServiceName, ratio: cfg.SampleRatio, queue: make(chan *span, traceQueueSize)}
+    if t.service == "" { t.service = "llmrouter" }
+    switch cfg.Exporter {
+    case "", "none":
+        return nil, nil
+    case "otlp":
+        if cfg.Endpoint == "" {
+            return nil, errors.New("tracing: endpoint is required for the otlp exporter")
+        }
+        url := strings.TrimRight(cfg.Endpoint, "/")
+        if !strings.HasSuffix(url, "/v1/traces") { url += "/v1/traces" }
+        client := &http.Client{Timeout: 10 * time.Second}
+        t.export = func(spans []*span) error { return t.postOTLP(client, url, cfg.Headers, spans) }
+    case "console":
+        t.export = func(spans []*span) error { return t.printSpans(os.Stdout, spans) }
+    default:
+        return nil, fmt.Errorf("tracing: unknown exporter %q", cfg.Exporter)
+    }
+    go t.run()
+    return t, nil
+}
+
+// run batches finished spans for the exporter.
+func (t *tracer) run() {
+    ticker := time.NewTicker(traceFlushInterval)
+    defer ticker.Stop()
+    var batch []*span
+    flush := func() {
+        if len(batch) == 0 {
+            return
+        }
+        if err := t.export(batch); err != nil {
+            log.Printf("tracing: export of %d spans failed: %v", len(batch), err)
+        }
+        batch = nil
+    }
+    for {
+        select {
+        case s := <-t.queue:
+            if batch = append(batch, s); len(batch) >= traceBatchSize { flush() }
+        case <-ticker.C:
+            flush()
+        }
+    }
+}
+
+type spanCtxKey struct{}
+
+func spanFrom(ctx context.Context) *span {
+    s, _ := ctx.Value(spanCtxKey{}).(*span)
+    return s
+}
+
+// start begins a child of the span in ctx. Without one there is no trace to
+// add to, so it returns a nil span.
+func (t *tracer) start(ctx context.Context, name string, kind int) (context.Context, *span) {
+    parent := spanFrom(ctx)
+    if t == nil || parent == nil {
+        return ctx, nil
+    }
+    s := &span{t: t, traceID: parent.traceID, parentID: parent.spanID, sampled: parent.sampled, traceState: parent.traceState, name: name, kind: kind, start: time.Now()}
+    rand.Read(s.spanID[:])
+    return context.WithValue(ctx, spanCtxKey{}, s), s
+}
+
+// startRoot begins a request's server span, continuing the caller's trace
+// when the request carries a valid traceparent.
+func (t *tracer) startRoot(ctx context.Context, name string, remote *span) (context.Context, *span) {
+    if t == nil {
+        if remote != nil { ctx = context.WithValue(ctx, spanCtxKey{}, remote) }
+        return ctx, nil
+    }
+    s := &span{t: t, name: name, kind: spanServer, start: time.Now()}
+    if remote != nil {
+        s.traceID, s.parentID, s.sampled, s.traceState = remote.traceID, remote.spanID, remote.sampled, remote.traceState
+    } else {
+        rand.Read(s.traceID[:])
+        s.sampled = t.ratio >= 1 || randFloat() < t.ratio
+    }
+    rand.Read(s.spanID[:])
+    return context.WithValue(ctx, spanCtxKey{}, s), s
+}
+
+func randFloat() float64 {
+    var b [8]byte
+    rand.Read(b[:])
+    return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// parseTraceparent reads a W3C traceparent header ("00-<trace id>-<parent id>-<flags>").
+func parseTraceparent(h, state string) *span {
+    parts := strings.Split(strings.TrimSpace(h), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+        return nil
+    }
+    // Version 00 has exactly four fields; later versions may add more
+    if parts[0] == "00" && len(parts) != 4 {
+        return nil
+    }
+    s := &span{remote: true, traceState: state}
+    if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+        return nil
+    }
+    if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+        return nil
+    }
+    flags, err := hex.DecodeString(parts[3])
+    if err != nil {
+        return nil
+    }
+    s.sampled = flags[0]&1 == 1
+    return s
+}
+
+func (s *span) traceparent() string {
+    flags := "00"
+    if s.sampled { flags = "01" }
+    return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// injectTrace propagates the trace in ctx to an outgoing request.
+func injectTrace(ctx context.Context, req *http.Request) {
+    s := spanFrom(ctx)
+    if s == nil {
+        return
+    }
+    req.Header.Set("traceparent", s.traceparent())
+    if s.traceState != "" { req.Header.Set("tracestate", s.traceState) }
+}
+
+func (s *span) set(key string, value any) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.attrs {
+        if s.attrs[i].key == key {
+            s.attrs[i].value = value
+            return
+        }
+    }
+    s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+// fail marks the span as failed; msg says why.
+func (s *span) fail(msg string) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.status, s.statusMsg = statusError, msg
+}
+
+// finish ends the span and queues it for export. Only the first call counts.
+func (s *span) finish() {
+    if s == nil || s.remote {
+        return
+    }
+    s.mu.Lock()
+    done := !s.end.IsZero()
+    if !done { s.end = time.Now() }
+    s.mu.Unlock()
+    if done || !s.sampled {
+        return
+    }
+    select {
+    case s.t.queue <- s:
+    default:
+    }
+}
+
+// traceRequests makes each /api/v1 request a server span.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        req := c.Request()
+        remote := parseTraceparent(req.Header.Get("traceparent"), req.Header.Get("tracestate"))
+        ctx, sp := getApp(c).tracer.startRoot(req.Context(), req.Method+" "+c.Path(), remote)
+        c.SetRequest(req.WithContext(ctx))
+        if sp == nil {
+            return next(c)
+        }
+        sp.set("http.request.method", req.Method)
+        sp.set("http.route", c.Path())
+        sp.set("url.path", req.URL.Path)
+        sp.set("client.address", c.RealIP())
+        if ua := req.UserAgent(); ua != "" { sp.set("user_agent.original", ua) }
+        err := next(c)
+        code := c.Response().Status
+        if !c.Response().Committed {
+            code = http.StatusInternalServerError
+            if he, ok := err.(*echo.HTTPError); ok { code = he.Code }
+        }
+        sp.set("http.response.status_code", code)
+        if code >= 500 { sp.fail(strconv.Itoa(code)) }
+        sp.finish()
+        return err
+    }
+}
+
+// tracedBody ends an upstream call's span once its body is drained or closed,
+// so the span covers the whole response, streams included.
+type tracedBody struct {
+    io.ReadCloser
+    sp *span
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    if err != nil { b.sp.finish() }
+    return n, err
+}
+
+func (b *tracedBody) Close() error {
+    err := b.ReadCloser.Close()
+    b.sp.finish()
+    return err
+}
+
+// genAIOperation names the GenAI semantic-convention operation of an endpoint.
+func genAIOperation(endpoint string) string {
+    switch endpoint {
+    case "/chat/completions":
+        return "chat"
+    case "/completions":
+        return "text_completion"
+    case "/embeddings":
+        return "embeddings"
+    }
+    return strings.TrimPrefix(endpoint, "/")
+}
+
+// startGenAI begins the span for one model call, named and labeled per the
+// OpenTelemetry GenAI semantic conventions. logUsage adds the token counts.
+func startGenAI(ctx context.Context, app *App, p Provider, endpoint, model string, payload map[string]any) (context.Context, *span) {
+    op := genAIOperation(endpoint)
+    ctx, sp := app.tracer.start(ctx, op+" "+model, spanInternal)
+    if sp == nil {
+        return ctx, nil
+    }
+    system := p.Type
+    if system == "" { system = "openai" }
+    sp.set("gen_ai.operation.name", op)
+    sp.set("gen_ai.system", system)
+    sp.set("gen_ai.request.model", model)
+    sp.set("llmrouter.provider", p.Name)
+    for key, attr := range map[string]string{"max_tokens": "gen_ai.request.max_tokens", "max_completion_tokens": "gen_ai.request.max_tokens", "temperature": "gen_ai.request.temperature", "top_p": "gen_ai.request.top_p"} {
+        if v, ok := payload[key].(float64); ok {
+            if attr == "gen_ai.request.max_tokens" {
+                sp.set(attr, int64(v))
+            } else {
+                sp.set(attr, v)
+            }
+        }
+    }
+    if s, ok := payload["stream"].(bool); ok && s { sp.set("llmrouter.stream", true) }
+    return ctx, sp
+}
+
+// traceUsage adds what a model call returned to its span.
+func traceUsage(sp *span, status int, usage tokenUsage) {
+    if sp == nil {
+        return
+    }
+    if usage.PromptTokens+usage.CompletionTokens > 0 {
+        sp.set("gen_ai.usage.input_tokens", usage.PromptTokens)
+        sp.set("gen_ai.usage.output_tokens", usage.CompletionTokens)
+    }
+    if len(usage.FinishReasons) > 0 { sp.set("gen_ai.response.finish_reasons", usage.FinishReasons) }
+    switch {
+    case status == 0:
+        sp.fail("no response from provider")
+    case status < 200 || status >= 300:
+        sp.set("error.type", strconv.Itoa(status))
+        sp.fail(http.StatusText(status))
+    }
+}
+
+func dbSystem(app *App) string {
+    if n := app.DB.Dialector.Name(); n != "postgres" {
+        return n
+    }
+    return "postgresql"
+}
+
+// OTLP/JSON encoding: IDs are hex, 64-bit integers are strings.
+type otlpAttr struct {
+    Key   string         `json:"key"`
+    Value map[string]any `json:"value"`
+}
+
+func otlpValue(v any) map[string]any {
+    switch x := v.(type) {
+    case string:
+        return map[string]any{"stringValue": x}
+    case bool:
+        return map[string]any{"boolValue": x}
+    case int:
+        return map[string]any{"intValue": strconv.Itoa(x)}
+    case int64:
+        return map[string]any{"intValue": strconv.FormatInt(x, 10)}
+    case uint:
+        return map[string]any{"intValue": strconv.FormatUint(uint64(x), 10)}
+    case float64:
+        return map[string]any{"doubleValue": x}
+    case []string:
+        vals := make([]map[string]any, len(x))
+        for i, s := range x { vals[i] = map[string]any{"stringValue": s} }
+        return map[string]any{"arrayValue": map[string]any{"values": vals}}
+    }
+    return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+func (s *span) otlp() map[string]any {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    attrs := make([]otlpAttr, len(s.attrs))
+    for i, a := range s.attrs {
+        attrs[i] = otlpAttr{a.key, otlpValue(a.value)}
+    }
+    out := map[string]any{
+        "traceId":           hex.EncodeToString(s.traceID[:]),
+        "spanId":            hex.EncodeToString(s.spanID[:]),
+        "name":              s.name,
+        "kind":              s.kind,
+        "startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+        "endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+        "attributes":        attrs,
+        "status":            map[string]any{"code": s.status, "message": s.statusMsg},
+    }
+    if s.parentID != [8]byte{} { out["parentSpanId"] = hex.EncodeToString(s.parentID[:]) }
+    if s.traceState != "" { out["traceState"] = s.traceState }
+    return out
+}
+
+func (t *tracer) otlpRequest(spans []*span) map[string]any {
+    encoded := make([]map[string]any, len(spans))
+    for i, s := range spans { encoded[i] = s.otlp() }
+    return map[string]any{"resourceSpans": []any{map[string]any{
+        "resource":   map[string]any{"attributes": []otlpAttr{{"service.name", otlpValue(t.service)}}},
+        "scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "llmrouter"}, "spans": encoded}},
+    }}}
+}
+
+func (t *tracer) postOTLP(client *http.Client, url string, headers map[string]string, spans []*span) error {
+    body, _ := json.Marshal(t.otlpRequest(spans))
+    req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    for k, v := range headers { req.Header.Set(k, v) }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("collector status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// printSpans writes one OTLP/JSON request per batch, on a single line.
+func (t *tracer) printSpans(w io.Writer, spans []*span) error {
+    b, err := json.Marshal(t.otlpRequest(spans))
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(w, "%s\n", b)
+    return err
+}
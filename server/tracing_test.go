@@ -0,0 +1,205 @@
+package server
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// otlpExport is what a collector receives, decoded as far as the tests look.
+type otlpExport struct {
+    path    string
+    headers http.Header
+    body    struct {
+        ResourceSpans []struct {
+            Resource struct {
+                Attributes []otlpAttr `json:"attributes"`
+            } `json:"resource"`
+            ScopeSpans []struct {
+                Spans []struct {
+                    TraceID      string     `json:"traceId"`
+                    SpanID       string     `json:"spanId"`
+                    ParentSpanID string     `json:"parentSpanId"`
+                    Name         string     `json:"name"`
+                    Kind         int        `json:"kind"`
+                    Attributes   []otlpAttr `json:"attributes"`
+                    Status       struct {
+                        Code int `json:"code"`
+                    } `json:"status"`
+                } `json:"spans"`
+            } `json:"scopeSpans"`
+        } `json:"resourceSpans"`
+    }
+}
+
+// newCollector starts an OTLP/HTTP collector that answers with status and
+// hands each export to the returned channel.
+func newCollector(t *testing.T, status int) (*httptest.Server, chan otlpExport) {
+    t.Helper()
+    got := make(chan otlpExport, 8)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        exp := otlpExport{path: r.URL.Path, headers: r.Header.Clone()}
+        if err := json.NewDecoder(r.Body).Decode(&exp.body); err != nil {
+            t.Errorf("collector: %v", err)
+        }
+        got <- exp
+        w.WriteHeader(status)
+    }))
+    t.Cleanup(srv.Close)
+    return srv, got
+}
+
+func clearOTELEnv(t *testing.T) {
+    for _, k := range []string{"OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_SERVICE_NAME", "OTEL_EXPORTER_OTLP_HEADERS"} {
+        t.Setenv(k, "")
+    }
+}
+
+func TestNewTracer(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     TracingConfig
+        env     map[string]string
+        wantNil bool
+        wantErr bool
+    }{
+        {name: "none", cfg: TracingConfig{Exporter: "none", SampleRatio: 1}, wantNil: true},
+        {name: "otlp", cfg: TracingConfig{Exporter: "otlp", Endpoint: "http://collector:4318", SampleRatio: 1}},
+        {name: "otlp without endpoint", cfg: TracingConfig{Exporter: "otlp", SampleRatio: 1}, wantErr: true},
+        {name: "otlp endpoint from env", cfg: TracingConfig{Exporter: "otlp", SampleRatio: 1}, env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}},
+        {name: "exporter from env", cfg: TracingConfig{SampleRatio: 1}, env: map[string]string{"OTEL_TRACES_EXPORTER": "console"}},
+        {name: "console", cfg: TracingConfig{Exporter: "console", SampleRatio: 1}},
+        {name: "unknown exporter", cfg: TracingConfig{Exporter: "zipkin", SampleRatio: 1}, wantErr: true},
+        {name: "ratio out of range", cfg: TracingConfig{Exporter: "console", SampleRatio: 1.5}, wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            clearOTELEnv(t)
+            for k, v := range tt.env { t.Setenv(k, v) }
+            tr, err := newTracer(tt.cfg)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+            }
+            if !tt.wantErr && (tr == nil) != tt.wantNil {
+                t.Errorf("tracer = %v, wantNil %v", tr, tt.wantNil)
+            }
+        })
+    }
+}
+
+func TestOTLPExportErrors(t *testing.T) {
+    tests := []struct {
+        name     string
+        status   int
+        endpoint func(string) string
+        down     bool
+        wantErr  string
+    }{
+        {name: "accepted", status: http.StatusOK},
+        {name: "endpoint with path", status: http.StatusOK, endpoint: func(u string) string { return u + "/v1/traces/" }},
+        {name: "collector error", status: http.StatusInternalServerError, wantErr: "collector status 500"},
+        {name: "collector throttles", status: http.StatusTooManyRequests, wantErr: "collector status 429"},
+        {name: "collector down", down: true, wantErr: "refused"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            clearOTELEnv(t)
+            srv, got := newCollector(t, tt.status)
+            endpoint := srv.URL
+            if tt.endpoint != nil { endpoint = tt.endpoint(endpoint) }
+            if tt.down { srv.Close() }
+            tr, err := newTracer(TracingConfig{Exporter: "otlp", Endpoint: endpoint, Headers: map[string]string{"Authorization": "Bearer t0k"}, ServiceName: "router-test", SampleRatio: 1})
+            if err != nil {
+                t.Fatal(err)
+            }
+            _, sp := tr.startRoot(context.Background(), "GET /api/v1/models", nil)
+            sp.end = time.Now()
+            err = tr.export([]*span{sp})
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("export: %v", err)
+            }
+            exp := <-got
+            if exp.path != "/v1/traces" {
+                t.Errorf("path = %q", exp.path)
+            }
+            if exp.headers.Get("Authorization") != "Bearer t0k" || exp.headers.Get("Content-Type") != "application/json" {
+                t.Errorf("headers = %v", exp.headers)
+            }
+        })
+    }
+}
+
+func TestTraceRequestsExport(t *testing.T) {
+    clearOTELEnv(t)
+    srv, got := newCollector(t, http.StatusOK)
+    tr, err := newTracer(TracingConfig{Exporter: "otlp", Endpoint: srv.URL, ServiceName: "router-test", SampleRatio: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    app := &App{tracer: tr}
+    e := echo.New()
+    g := e.Group("/api/v1", withApp(app), traceRequests)
+    g.GET("/models", func(c echo.Context) error {
+        _, sp := app.tracer.start(c.Request().Context(), "lookup", spanClient)
+        sp.set("db.system", "sqlite")
+        sp.finish()
+        return c.JSON(http.StatusOK, echo.Map{})
+    })
+    g.GET("/broken", func(c echo.Context) error {
+        return c.JSON(http.StatusBadGateway, echo.Map{"error": "upstream"})
+    })
+
+    const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+    for _, path := range []string{"/api/v1/models", "/api/v1/broken"} {
+        req := httptest.NewRequest(http.MethodGet, path, nil)
+        if path == "/api/v1/models" { req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01") }
+        e.ServeHTTP(httptest.NewRecorder(), req)
+    }
+
+    spans := map[string]int{} // name to index
+    var exp otlpExport
+    select {
+    case exp = <-got:
+    case <-time.After(3 * traceFlushInterval):
+        t.Fatal("no export reached the collector")
+    }
+    rs := exp.body.ResourceSpans
+    if len(rs) != 1 || len(rs[0].ScopeSpans) != 1 {
+        t.Fatalf("export = %+v", exp.body)
+    }
+    if a := rs[0].Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value["stringValue"] != "router-test" {
+        t.Errorf("resource = %+v", a)
+    }
+    list := rs[0].ScopeSpans[0].Spans
+    for i, s := range list { spans[s.Name] = i }
+    if len(list) != 3 {
+        t.Fatalf("got %d spans: %+v", len(list), list)
+    }
+    server, child, broken := list[spans["GET /api/v1/models"]], list[spans["lookup"]], list[spans["GET /api/v1/broken"]]
+    if server.TraceID != traceID || server.ParentSpanID != parentID || server.Kind != spanServer {
+        t.Errorf("server span = %+v, want trace %s parent %s", server, traceID, parentID)
+    }
+    if child.TraceID != traceID || child.ParentSpanID != server.SpanID || child.Kind != spanClient {
+        t.Errorf("child span = %+v, want parent %s", child, server.SpanID)
+    }
+    if broken.TraceID == traceID || broken.ParentSpanID != "" || broken.Status.Code != statusError {
+        t.Errorf("broken span = %+v, want a new failed trace", broken)
+    }
+    for _, a := range broken.Attributes {
+        if a.Key == "http.response.status_code" && a.Value["intValue"] != "502" {
+            t.Errorf("status code attribute = %v", a.Value)
+        }
+    }
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo/v4"
+)
+
+// Requests wait at most this long for a provider's rate limit window to
+// reset before the router gives up and answers 429 itself.
+const maxThrottleWait = 10 * time.Second
+
+// sendUpstream POSTs a JSON body to a provider endpoint using one of the
+// provider's credentials and records the rate limit headers of the response.
+// A pool key answered with 401 or 429 is benched and the request is retried
+// on another key while one is available. The call holds one of the
+// provider's concurrency slots until the response body is drained or closed.
+// model is the upstream model, for metrics.
+func sendUpstream(ctx context.Context, app *App, p Provider, endpoint, model string, body []byte, estTokens int64) (*http.Response, error) {
+    started := time.Now()
+    release, err := app.gates.acquire(ctx, p)
+    if err != nil {
+        return nil, err
+    }
+    url := strings.TrimSuffix(p.BaseURL, "/") + endpoint
+    for attempt := 0; ; attempt++ {
+        cred, _ := pickCredential(app, p, estTokens)
+        sctx, sp := app.tracer.start(ctx, http.MethodPost, spanClient)
+        req, _ := http.NewRequestWithContext(sctx, http.MethodPost, url, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cred.secret != "" { req.Header.Set("Authorization", "Bearer "+cred.secret) }
+        injectTrace(sctx, req)
+        traceUpstream(sp, req, p, cred, attempt)
+        app.quotas.spend(cred.credential, estTokens)
+        resp, err := upstreamClient.Do(req)
+        app.metrics.upstream(ctx, p, model, endpoint, started, resp, err)
+        if err != nil {
+            sp.set("error.type", fmt.Sprintf("%T", err))
+            sp.fail(err.Error())
+            sp.finish()
+            release()
+            return nil, err
+        }
+        sp.set("http.response.status_code", resp.StatusCode)
+        if resp.StatusCode >= 400 {
+            sp.set("error.type", strconv.Itoa(resp.StatusCode))
+            sp.fail(resp.Status)
+        }
+        resp.Body = &tracedBody{ReadCloser: resp.Body, sp: sp}
+        app.quotas.observe(cred.credential, resp)
+        recordKeyUse(app, cred, resp.StatusCode)
+        rejected := resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusTooManyRequests
+        if rejected && cred.key != nil && attempt < maxKeyAttempts && providerWait(app, p.ID, estTokens) == 0 {
+            resp.Body.Close()
+            continue
+        }
+        resp.Body = &gatedBody{ReadCloser: resp.Body, release: release}
+        return resp, nil
+    }
+}
+
+// traceUpstream describes an upstream HTTP call per the OpenTelemetry HTTP
+// client conventions. The URL carries no secrets; keys go in a header.
+func traceUpstream(sp *span, req *http.Request, p Provider, cred upstreamCred, attempt int) {
+    if sp == nil {
+        return
+    }
+    sp.set("http.request.method", req.Method)
+    sp.set("url.full", req.URL.String())
+    sp.set("server.address", req.URL.Hostname())
+    port := req.URL.Port()
+    if port == "" {
+        port = "80"
+        if req.URL.Scheme == "https" { port = "443" }
+    }
+    if n, err := strconv.Atoi(port); err == nil { sp.set("server.port", n) }
+    sp.set("llmrouter.provider", p.Name)
+    if cred.key != nil { sp.set("llmrouter.provider_key", cred.key.Name) }
+    if attempt > 0 { sp.set("http.request.resend_count", attempt) }
+}
+
+// maxKeyAttempts bounds retries across a provider's key pool for one request.
+const maxKeyAttempts = 4
+
+// credential identifies one upstream API key; KeyID 0 is the provider's own APIKey.
+type credential struct {
+    ProviderID uint
+    KeyID      uint
+}
+
+// upstreamQuota is the last known rate limit state reported by a provider.
+type upstreamQuota struct {
+    hasRequests       bool
+    limitRequests     int64
+    remainingRequests int64
+    resetRequestsAt   time.Time
+    hasTokens         bool
+    limitTokens       int64
+    remainingTokens   int64
+    resetTokensAt     time.Time
+    blockedUntil      time.Time // set after the provider answered 429
+    updatedAt         time.Time
+}
+
+// providerHeadroom is the quota state exposed on /api/providers.
+type providerHeadroom struct {
+    LimitRequests     *int64     `json:"limit_requests,omitempty"`
+    RemainingRequests *int64     `json:"remaining_requests,omitempty"`
+    ResetRequestsAt   *time.Time `json:"reset_requests_at,omitempty"`
+    LimitTokens       *int64     `json:"limit_tokens,omitempty"`
+    RemainingTokens   *int64     `json:"remaining_tokens,omitempty"`
+    ResetTokensAt     *time.Time `json:"reset_tokens_at,omitempty"`
+    BlockedUntil      *time.Time `json:"blocked_until,omitempty"`
+    UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// quotaTracker keeps upstream rate limit state per credential. Remaining
+// counts are decremented optimistically on send so concurrent requests do
+// not all spend the same headroom before the next response arrives.
+type quotaTracker struct {
+    mu     sync.Mutex
+    quotas map[credential]*upstreamQuota
+    // round-robin position per provider for key pools
+    next   map[uint]int
+}
+
+func newQuotaTracker() *quotaTracker {
+    return &quotaTracker{quotas: map[credential]*upstreamQuota{}, next: map[uint]int{}}
+}
+
+func (t *quotaTracker) spend(cred credential, estTokens int64) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    q := t.quotas[cred]
+    if q == nil {
+        return
+    }
+    if q.hasRequests && q.remainingRequests > 0 { q.remainingRequests-- }
+    if q.hasTokens { q.remainingTokens -= estTokens }
+}
+
+// observe updates a credential's state from x-ratelimit-* and Retry-After headers.
+func (t *quotaTracker) observe(cred credential, resp *http.Response) {
+    h := resp.Header
+    now := time.Now()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    q := t.quotas[cred]
+    if q == nil {
+        q = &upstreamQuota{}
+    }
+    seen := false
+    if v, ok := headerInt(h, "x-ratelimit-remaining-requests"); ok {
+        q.hasRequests, q.remainingRequests, seen = true, v, true
+        q.limitRequests, _ = headerInt(h, "x-ratelimit-limit-requests")
+        q.resetRequestsAt = parseReset(h.Get("x-ratelimit-reset-requests"), now)
+    }
+    if v, ok := headerInt(h, "x-ratelimit-remaining-tokens"); ok {
+        q.hasTokens, q.remainingTokens, seen = true, v, true
+        q.limitTokens, _ = headerInt(h, "x-ratelimit-limit-tokens")
+        q.resetTokensAt = parseReset(h.Get("x-ratelimit-reset-tokens"), now)
+    }
+    if resp.StatusCode == http.StatusTooManyRequests {
+        until := parseReset(h.Get("Retry-After"), now)
+        if until.IsZero() {
+            until = now.Add(time.Second)
+        }
+        q.blockedUntil, seen = until, true
+    }
+    if seen {
+        q.updatedAt = now
+        t.quotas[cred] = q
+    }
+}
+
+// bench keeps a credential out of rotation until the given time.
+func (t *quotaTracker) bench(cred credential, until time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    q := t.quotas[cred]
+    if q == nil {
+        q = &upstreamQuota{}
+        t.quotas[cred] = q
+    }
+    if until.After(q.blockedUntil) {
+        q.blockedUntil = until
+    }
+    q.updatedAt = time.Now()
+}
+
+// wait returns how long until the credential is expected to accept a request
+// of estTokens, or 0 if it has headroom now.
+func (t *quotaTracker) wait(cred credential, estTokens int64) time.Duration {
+    now := time.Now()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    q := t.quotas[cred]
+    if q == nil {
+        return 0
+    }
+    var d time.Duration
+    if now.Before(q.blockedUntil) {
+        d = q.blockedUntil.Sub(now)
+    }
+    if q.hasRequests && q.remainingRequests <= 0 && now.Before(q.resetRequestsAt) {
+        if w := q.resetRequestsAt.Sub(now); w > d { d = w }
+    }
+    if q.hasTokens && q.remainingTokens < estTokens && now.Before(q.resetTokensAt) {
+        if w := q.resetTokensAt.Sub(now); w > d { d = w }
+    }
+    return d
+}
+
+// headroom returns a credential's current quota state, treating windows
+// whose reset time has passed as replenished.
+func (t *quotaTracker) headroom(cred credential) *providerHeadroom {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    q := t.quotas[cred]
+    if q == nil {
+        return nil
+    }
+    return q.headroom(time.Now())
+}
+
+// forProvider sums the headroom of all of a provider's credentials.
+// blocked_until is only reported when every credential is blocked.
+func (t *quotaTracker) forProvider(providerID uint) *providerHeadroom {
+    now := time.Now()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    var out *providerHeadroom
+    allBlocked := true
+    for cred, q := range t.quotas {
+        if cred.ProviderID != providerID {
+            continue
+        }
+        h := q.headroom(now)
+        if out == nil {
+            out = h
+            allBlocked = h.BlockedUntil != nil
+            continue
+        }
+        out.LimitRequests = sumInt64(out.LimitRequests, h.LimitRequests)
+        out.RemainingRequests = sumInt64(out.RemainingRequests, h.RemainingRequests)
+        out.LimitTokens = sumInt64(out.LimitTokens, h.LimitTokens)
+        out.RemainingTokens = sumInt64(out.RemainingTokens, h.RemainingTokens)
+        out.ResetRequestsAt = earliest(out.ResetRequestsAt, h.ResetRequestsAt)
+        out.ResetTokensAt = earliest(out.ResetTokensAt, h.ResetTokensAt)
+        if h.BlockedUntil == nil {
+            allBlocked = false
+        } else {
+            out.BlockedUntil = earliest(out.BlockedUntil, h.BlockedUntil)
+        }
+        if h.UpdatedAt.After(out.UpdatedAt) {
+            out.UpdatedAt = h.UpdatedAt
+        }
+    }
+    if out != nil && !allBlocked {
+        out.BlockedUntil = nil
+    }
+    return out
+}
+
+func (q *upstreamQuota) headroom(now time.Time) *providerHeadroom {
+    out := &providerHeadroom{UpdatedAt: q.updatedAt}
+    if q.hasRequests {
+        limit, remaining, reset := q.limitRequests, q.remainingRequests, q.resetRequestsAt
+        if now.Before(reset) {
+            out.ResetRequestsAt = &reset
+        } else if limit > 0 {
+            remaining = limit
+        }
+        out.LimitRequests, out.RemainingRequests = &limit, &remaining
+    }
+    if q.hasTokens {
+        limit, remaining, reset := q.limitTokens, q.remainingTokens, q.resetTokensAt
+        if now.Before(reset) {
+            out.ResetTokensAt = &reset
+        } else if limit > 0 {
+            remaining = limit
+        }
+        out.LimitTokens, out.RemainingTokens = &limit, &remaining
+    }
+    if now.Before(q.blockedUntil) {
+        blocked := q.blockedUntil
+        out.BlockedUntil = &blocked
+    }
+    return out
+}
+
+func sumInt64(a, b *int64) *int64 {
+    if a == nil { return b }
+    if b == nil { return a }
+    v := *a + *b
+    return &v
+}
+
+func earliest(a, b *time.Time) *time.Time {
+    if a == nil { return b }
+    if b == nil || a.Before(*b) { return a }
+    return b
+}
+
+// forget drops all state for a provider's credentials.
+func (t *quotaTracker) forget(providerID uint) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for cred := range t.quotas {
+        if cred.ProviderID == providerID {
+            delete(t.quotas, cred)
+        }
+    }
+    delete(t.next, providerID)
+}
+
+// forgetKey drops the state of a single credential.
+func (t *quotaTracker) forgetKey(cred credential) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.quotas, cred)
+}
+
+// throttleUpstream waits for a provider with no usable key when the wait is short.
+// It returns how long the caller would have to wait when that is too long.
+func throttleUpstream(c echo.Context, app *App, providerID uint, estTokens int64) (time.Duration, error) {
+    d := providerWait(app, providerID, estTokens)
+    if d == 0 {
+        return 0, nil
+    }
+    if d > maxThrottleWait {
+        return d, fmt.Errorf("provider rate limited for %s", formatReset(d))
+    }
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return 0, nil
+    case <-c.Request().Context().Done():
+        return 0, c.Request().Context().Err()
+    }
+}
+
+// upstreamThrottled answers 429 on behalf of a provider that is out of quota.
+func upstreamThrottled(c echo.Context, p Provider, wait time.Duration) error {
+    secs := int(wait.Round(time.Second) / time.Second)
+    if secs < 1 { secs = 1 }
+    c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+    return c.JSON(http.StatusTooManyRequests, echo.Map{"error": echo.Map{
+        "message": fmt.Sprintf("Provider %s has no upstream capacity available; retry after %ds.", p.Name, secs),
+        "type":    "requests",
+        "param":   nil,
+        "code":    "rate_limit_exceeded",
+    }})
+}
+
+// orderByHeadroom moves targets whose provider has no usable key to the end,
+// keeping the configured order otherwise.
+func orderByHeadroom(app *App, targets []FallbackTarget, estTokens int64) []FallbackTarget {
+    ready := make([]FallbackTarget, 0, len(targets))
+    var limited []FallbackTarget
+    for _, t := range targets {
+        if providerWait(app, t.ProviderID, estTokens) > 0 {
+            limited = append(limited, t)
+        } else {
+            ready = append(ready, t)
+        }
+    }
+    return append(ready, limited...)
+}
+
+func headerInt(h http.Header, name string) (int64, bool) {
+    v := strings.TrimSpace(h.Get(name))
+    if v == "" {
+        return 0, false
+    }
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil {
+        return 0, false
+    }
+    return n, true
+}
+
+// parseReset accepts OpenAI-style durations ("1s", "6m0s", "20ms"), plain
+// seconds, RFC 3339 timestamps and HTTP dates, returning an absolute time.
+func parseReset(v string, now time.Time) time.Time {
+    v = strings.TrimSpace(v)
+    if v == "" {
+        return time.Time{}
+    }
+    if d, err := time.ParseDuration(v); err == nil {
+        return now.Add(d)
+    }
+    if f, err := strconv.ParseFloat(v, 64); err == nil {
+        return now.Add(time.Duration(f * float64(time.Second)))
+    }
+    if t, err := time.Parse(time.RFC3339, v); err == nil {
+        return t
+    }
+    if t, err := http.ParseTime(v); err == nil {
+        return t
+    }
+    return time.Time{}
+}
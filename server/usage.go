@@ -0,0 +1,184 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "net/http"
+
+    "github.com/labstack/echo/v4"
+)
+
+// tokenUsage is what a single upstream call consumed, as far as it is known.
+type tokenUsage struct {
+    PromptTokens     int
+    CompletionTokens int
+    CachedTokens     int     // subset of PromptTokens served from the provider's prompt cache
+    Images           int     // image inputs sent in the request
+    AudioSeconds     float64 // billed audio duration, when the provider reports it
+    FinishReasons    []string
+}
+
+// parseUsage extracts the OpenAI-style usage object from a response body or SSE chunk.
+func parseUsage(b []byte) tokenUsage {
+    var v struct {
+        Usage struct {
+            PromptTokens        int `json:"prompt_tokens"`
+            CompletionTokens    int `json:"completion_tokens"`
+            PromptTokensDetails struct {
+                CachedTokens int `json:"cached_tokens"`
+            } `json:"prompt_tokens_details"`
+            // Transcription-style usage: { "type": "duration", "seconds": N }
+            Seconds float64 `json:"seconds"`
+        } `json:"usage"`
+    }
+    if err := json.Unmarshal(b, &v); err != nil {
+        return tokenUsage{}
+    }
+    return tokenUsage{
+        PromptTokens:     v.Usage.PromptTokens,
+        CompletionTokens: v.Usage.CompletionTokens,
+        CachedTokens:     v.Usage.PromptTokensDetails.CachedTokens,
+        AudioSeconds:     v.Usage.Seconds,
+        FinishReasons:    parseFinishReasons(b),
+    }
+}
+
+// parseFinishReasons returns the finish_reason of each choice that has one.
+func parseFinishReasons(b []byte) []string {
+    var v struct {
+        Choices []struct {
+            FinishReason string `json:"finish_reason"`
+        } `json:"choices"`
+    }
+    if err := json.Unmarshal(b, &v); err != nil {
+        return nil
+    }
+    var out []string
+    for _, ch := range v.Choices {
+        if ch.FinishReason != "" { out = append(out, ch.FinishReason) }
+    }
+    return out
+}
+
+// countRequestItems returns the number of chat messages and image parts in a request payload.
+func countRequestItems(payload map[string]any) (int, int) {
+    arr, ok := payload["messages"].([]any)
+    if !ok {
+        return 0, 0
+    }
+    images := 0
+    for _, m := range arr {
+        msg, ok := m.(map[string]any)
+        if !ok {
+            continue
+        }
+        parts, ok := msg["content"].([]any)
+        if !ok {
+            continue
+        }
+        for _, part := range parts {
+            if pm, ok := part.(map[string]any); ok && pm["type"] == "image_url" {
+                images++
+            }
+        }
+    }
+    return len(arr), images
+}
+
+// requestStreamUsage asks the provider to end a stream with a usage chunk,
+// so streamed calls are metered like the rest. It reports whether the client
+// asked for that chunk itself; if not, relayStream keeps it from the client.
+func requestStreamUsage(payload map[string]any) bool {
+    opts, _ := payload["stream_options"].(map[string]any)
+    if opts == nil { opts = map[string]any{} }
+    asked, _ := opts["include_usage"].(bool)
+    opts["include_usage"] = true
+    payload["stream_options"] = opts
+    return asked
+}
+
+// orEstimate stands in the request's estimate when the provider reported no
+// usage, so such calls still count against budgets, spend and rate limits.
+func (u tokenUsage) orEstimate(promptTok, outTok int) tokenUsage {
+    if u.PromptTokens+u.CompletionTokens == 0 {
+        u.PromptTokens, u.CompletionTokens = promptTok, outTok
+    }
+    return u
+}
+
+// usageOnlyChunk reports whether an SSE chunk carries nothing but usage.
+func usageOnlyChunk(data []byte) bool {
+    var v struct {
+        Choices []json.RawMessage `json:"choices"`
+    }
+    return json.Unmarshal(data, &v) == nil && len(v.Choices) == 0
+}
+
+// relayStream copies an upstream SSE body to the client line by line as it
+// arrives and picks up the usage object from the final chunk. Unless
+// clientUsage is set, that chunk was only requested for metering and is not
+// passed on.
+func relayStream(c echo.Context, body io.Reader, clientUsage bool) tokenUsage {
+    c.Response().Header().Set("Content-Type", "text/event-stream")
+    c.Response().WriteHeader(http.StatusOK)
+    var usage tokenUsage
+    var finish []string
+    var pending []byte
+    skipBlank := false
+    buf := make([]byte, 4096)
+    for {
+        n, err := body.Read(buf)
+        if n > 0 {
+            pending = append(pending, buf[:n]...)
+            var out []byte
+            for {
+                i := bytes.IndexByte(pending, '\n')
+                if i < 0 {
+                    break
+                }
+                raw := pending[:i+1]
+                line := bytes.TrimSpace(pending[:i])
+                pending = pending[i+1:]
+                if skipBlank && len(line) == 0 {
+                    // the blank line ending a dropped event
+                    skipBlank = false
+                    continue
+                }
+                skipBlank = false
+                if bytes.HasPrefix(line, []byte("data:")) {
+                    data := bytes.TrimSpace(line[len("data:"):])
+                    if bytes.Contains(data, []byte(`"usage"`)) {
+                        if u := parseUsage(data); u.PromptTokens+u.CompletionTokens > 0 {
+                            usage = u
+                            if !clientUsage && usageOnlyChunk(data) {
+                                skipBlank = true
+                                continue
+                            }
+                        }
+                    }
+                    // Most chunks carry "finish_reason":null; only the last one per choice matters
+                    if bytes.Contains(data, []byte(`"finish_reason"`)) && !bytes.Contains(data, []byte(`"finish_reason":null`)) {
+                        finish = append(finish, parseFinishReasons(data)...)
+                    }
+                }
+                out = append(out, raw...)
+            }
+            if len(out) > 0 {
+                if _, werr := c.Response().Write(out); werr != nil {
+                    break
+                }
+                c.Response().Flush()
+            }
+        }
+        if err != nil {
+            break
+        }
+    }
+    if len(pending) > 0 {
+        c.Response().Write(pending)
+        c.Response().Flush()
+    }
+    usage.FinishReasons = finish
+    return usage
+}
@@ -2,13 +2,14 @@ package server
 
 import (
     "net/http"
+    "strconv"
 
     "github.com/labstack/echo/v4"
 )
 
 type userCreateReq struct {
     Email    string `json:"email"`
-    Password string `json:"password"`
+    Password string `json:"password"` // empty invites the user to choose one
     Role     string `json:"role"`
 }
 
@@ -16,14 +17,22 @@ type userUpdateReq struct {
     Password *string `json:"password"`
     Role     *string `json:"role"`
     Disabled *bool   `json:"disabled"`
+    RPM      *int    `json:"rpm"`
+    TPM      *int    `json:"tpm"`
+    MaxConcurrent *int `json:"max_concurrent"`
+    AllowedModels    *[]string `json:"allowed_models"`
+    AllowedEndpoints *[]string `json:"allowed_endpoints"`
+    TeamID           *uint     `json:"team_id"`
+    TeamRole         *string   `json:"team_role"`
+    TOTPRequired     *bool     `json:"totp_required"`
 }
 
 func registerUserRoutes(g *echo.Group) {
     ag := g.Group("/users")
-    ag.GET("", requireAdmin(blockAdminIfMustChange(adminListUsers)))
-    ag.POST("", requireAdmin(blockAdminIfMustChange(adminCreateUser)))
-    ag.PUT("/:id", requireAdmin(blockAdminIfMustChange(adminUpdateUser)))
-    ag.DELETE("/:id", requireAdmin(blockAdminIfMustChange(adminDeleteUser)))
+    ag.GET("", requirePermission(permUsers, blockAdminIfMustChange(adminListUsers)))
+    ag.POST("", requirePermission(permUsers, blockAdminIfMustChange(adminCreateUser)))
+    ag.PUT("/:id", requirePermission(permUsers, blockAdminIfMustChange(adminUpdateUser)))
+    ag.DELETE("/:id", requirePermission(permUsers, blockAdminIfMustChange(adminDeleteUser)))
 }
 
 func adminListUsers(c echo.Context) error {
@@ -41,18 +50,37 @@ func adminListUsers(c echo.Context) error {
 func adminCreateUser(c echo.Context) error {
     app := getApp(c)
     var req userCreateReq
-    if err := c.Bind(&req); err != nil || req.Email == "" || req.Password == "" || req.Role == "" {
+    if err := c.Bind(&req); err != nil || req.Email == "" || req.Role == "" {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
     }
+    if err := roleAssignable(c, req.Role); err != nil {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+    }
     u := User{Email: req.Email, Role: req.Role}
-    if err := u.SetPassword(req.Password); err != nil {
-        return c.JSON(http.StatusInternalServerError, echo.Map{"error": "hash error"})
+    if req.Password != "" {
+        if err := app.passwords.check(req.Password); err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+        }
+        if err := u.SetPassword(req.Password); err != nil {
+            return c.JSON(http.StatusInternalServerError, echo.Map{"error": "hash error"})
+        }
     }
     if err := app.DB.Create(&u).Error; err != nil {
         return c.JSON(http.StatusConflict, echo.Map{"error": "email exists"})
     }
-    u.PasswordHash = ""
-    return c.JSON(http.StatusCreated, u)
+    if req.Password != "" {
+        audit(c, "user.create", "user", u.ID, nil, u, "password")
+        u.PasswordHash = ""
+        return c.JSON(http.StatusCreated, u)
+    }
+    audit(c, "user.create", "user", u.ID, nil, u)
+    out, err := inviteUser(c, app, &u)
+    if err != nil {
+        // The account stays; the invite can be resent once delivery works
+        return c.JSON(http.StatusBadGateway, echo.Map{"error": "user created but the invite was not sent: " + err.Error(), "user": u})
+    }
+    audit(c, "user.invite", "user", u.ID, nil, nil)
+    return c.JSON(http.StatusCreated, echo.Map{"user": u, "invite": out})
 }
 
 func adminUpdateUser(c echo.Context) error {
@@ -62,22 +90,82 @@ func adminUpdateUser(c echo.Context) error {
     if err := app.DB.First(&u, id).Error; err != nil {
         return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
     }
+    // Acting on an account needs every permission its role has
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
     var req userUpdateReq
     if err := c.Bind(&req); err != nil {
         return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid payload"})
     }
+    before := u
+    prevRole, prevDisabled := u.Role, u.Disabled
     if req.Password != nil {
-        _ = u.SetPassword(*req.Password)
+        if u.ServiceAccount {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "service accounts have no password"})
+        }
+        if u.LDAPDN != "" {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "directory accounts have no local password"})
+        }
+        if err := app.passwords.check(*req.Password); err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+        }
+        if err := u.SetPassword(*req.Password); err != nil {
+            return c.JSON(http.StatusInternalServerError, echo.Map{"error": "hash error"})
+        }
+        // A new password from an admin also lifts a lockout
+        u.FailedLogins, u.LockedUntil = 0, nil
     }
-    if req.Role != nil {
+    if req.Role != nil && *req.Role != u.Role {
+        if err := roleAssignable(c, *req.Role); err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+        }
         u.Role = *req.Role
     }
     if req.Disabled != nil {
         u.Disabled = *req.Disabled
     }
+    if req.TOTPRequired != nil { u.TOTPRequired = *req.TOTPRequired }
+    if req.RPM != nil { u.RPM = *req.RPM }
+    if req.TPM != nil { u.TPM = *req.TPM }
+    if req.MaxConcurrent != nil { u.MaxConcurrent = *req.MaxConcurrent }
+    if u.RPM < 0 || u.TPM < 0 || u.MaxConcurrent < 0 {
+        return c.JSON(http.StatusBadRequest, echo.Map{"error": "negative limit"})
+    }
+    if req.TeamID != nil {
+        if *req.TeamID != 0 && app.DB.First(&Team{}, *req.TeamID).Error != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "unknown team"})
+        }
+        u.TeamID = *req.TeamID
+        if u.TeamID == 0 { u.TeamRole = "" } else if u.TeamRole == "" { u.TeamRole = teamRoleMember }
+    }
+    if req.TeamRole != nil && u.TeamID != 0 {
+        role, ok := parseTeamRole(*req.TeamRole)
+        if !ok {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid team_role"})
+        }
+        u.TeamRole = role
+    }
+    if req.AllowedModels != nil || req.AllowedEndpoints != nil {
+        sr := scopesReq{AllowedModels: u.AllowedModels, AllowedEndpoints: u.AllowedEndpoints}
+        if req.AllowedModels != nil { sr.AllowedModels = *req.AllowedModels }
+        if req.AllowedEndpoints != nil { sr.AllowedEndpoints = *req.AllowedEndpoints }
+        scopes, err := normalizeScopes(sr)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+        }
+        u.Scopes = scopes
+    }
     if err := app.DB.Save(&u).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    app.keyCache.invalidateUser(u.ID)
+    if req.Password != nil || u.Role != prevRole || (u.Disabled && !prevDisabled) {
+        revokeSessions(app, u.ID, "")
+    }
+    var secrets []string
+    if req.Password != nil { secrets = append(secrets, "password") }
+    audit(c, "user.update", "user", u.ID, before, u, secrets...)
     u.PasswordHash = ""
     return c.JSON(http.StatusOK, u)
 }
@@ -85,8 +173,20 @@ func adminUpdateUser(c echo.Context) error {
 func adminDeleteUser(c echo.Context) error {
     app := getApp(c)
     id := c.Param("id")
+    var u User
+    if err := app.DB.First(&u, id).Error; err != nil {
+        return c.NoContent(http.StatusNoContent) // already gone
+    }
+    if err := roleAssignable(c, u.Role); err != nil {
+        return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+    }
     if err := app.DB.Delete(&User{}, id).Error; err != nil {
         return c.JSON(http.StatusInternalServerError, echo.Map{"error": "db error"})
     }
+    audit(c, "user.delete", "user", u.ID, u, nil)
+    if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+        app.keyCache.invalidateUser(uint(n))
+        revokeSessions(app, uint(n), "")
+    }
     return c.NoContent(http.StatusNoContent)
 }
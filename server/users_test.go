@@ -0,0 +1,93 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/labstack/echo/v4"
+)
+
+// callAs runs an admin handler as caller; params are name, value pairs of path parameters.
+func callAs(app *App, caller *User, h echo.HandlerFunc, method, body string, params ...string) *httptest.ResponseRecorder {
+    route, path := "/t", "/t"
+    for i := 0; i+1 < len(params); i += 2 {
+        route += "/:" + params[i]
+        path += "/" + params[i+1]
+    }
+    e := echo.New()
+    e.Add(method, route, h, withApp(app), func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            c.Set("user", caller)
+            return next(c)
+        }
+    })
+    req := httptest.NewRequest(method, path, strings.NewReader(body))
+    req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+    rec := httptest.NewRecorder()
+    e.ServeHTTP(rec, req)
+    return rec
+}
+
+// newTestUser creates a user with a password, creating the role first when it
+// isn't one of the built-in ones.
+func newTestUser(t *testing.T, app *App, email, role string, perms ...string) *User {
+    t.Helper()
+    if len(perms) > 0 {
+        if err := app.DB.Create(&Role{Name: role, Permissions: perms}).Error; err != nil {
+            t.Fatal(err)
+        }
+    }
+    u := &User{Email: email, Role: role}
+    u.SetPassword("Initial-pass-123")
+    if err := app.DB.Create(u).Error; err != nil {
+        t.Fatal(err)
+    }
+    return u
+}
+
+func TestUserAdminActionsNeedTargetRole(t *testing.T) {
+    tests := []struct {
+        name    string
+        handler echo.HandlerFunc
+        method  string
+        body    string
+    }{
+        {name: "reset password", handler: adminUpdateUser, method: http.MethodPut, body: `{"password":"Taken-over-456"}`},
+        {name: "disable", handler: adminUpdateUser, method: http.MethodPut, body: `{"disabled":true}`},
+        {name: "demote", handler: adminUpdateUser, method: http.MethodPut, body: `{"role":"user"}`},
+        {name: "delete", handler: adminDeleteUser, method: http.MethodDelete},
+        {name: "revoke sessions", handler: adminRevokeSessions, method: http.MethodDelete},
+        {name: "unlock", handler: adminUnlockUser, method: http.MethodPost},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApp(t)
+            admin := newTestUser(t, app, "admin@example.org", "admin")
+            helpdesk := newTestUser(t, app, "helpdesk@example.org", "helpdesk", permUsers)
+            user := newTestUser(t, app, "user@example.org", "user")
+
+            rec := callAs(app, helpdesk, tt.handler, tt.method, tt.body, "id", strconv.Itoa(int(admin.ID)))
+            if rec.Code != http.StatusForbidden {
+                t.Fatalf("helpdesk on admin: status %d, want 403: %s", rec.Code, rec.Body)
+            }
+            var after User
+            if err := app.DB.First(&after, admin.ID).Error; err != nil {
+                t.Fatalf("admin is gone: %v", err)
+            }
+            if after.Role != "admin" || after.Disabled || after.PasswordHash != admin.PasswordHash {
+                t.Errorf("admin changed: role %s disabled %v", after.Role, after.Disabled)
+            }
+
+            // The same caller can still manage an account it covers
+            if rec := callAs(app, helpdesk, tt.handler, tt.method, tt.body, "id", strconv.Itoa(int(user.ID))); rec.Code >= 300 {
+                t.Errorf("helpdesk on user: status %d: %s", rec.Code, rec.Body)
+            }
+            if rec := callAs(app, admin, tt.handler, tt.method, tt.body, "id", strconv.Itoa(int(helpdesk.ID))); rec.Code >= 300 {
+                t.Errorf("admin on helpdesk: status %d: %s", rec.Code, rec.Body)
+            }
+        })
+    }
+}